@@ -68,7 +68,9 @@ func main() {
 		// 处理错误，比如日志或退出
 	}
 	providerService := services.NewProviderService()
-	providerRelay := services.NewProviderRelayService(providerService, ":18100")
+	relaySettings := services.NewRelaySettingsService()
+	budgetService := services.NewBudgetService(relaySettings)
+	providerRelay := services.NewProviderRelayService(providerService, relaySettings, budgetService, ":18100")
 	claudeSettings := services.NewClaudeSettingsService(providerRelay.Addr())
 	codexSettings := services.NewCodexSettingsService(providerRelay.Addr())
 	logService := services.NewLogService()
@@ -99,6 +101,8 @@ func main() {
 			application.NewService(appservice),
 			application.NewService(suiService),
 			application.NewService(providerService),
+			application.NewService(relaySettings),
+			application.NewService(budgetService),
 			application.NewService(claudeSettings),
 			application.NewService(codexSettings),
 			application.NewService(logService),
@@ -117,6 +121,12 @@ func main() {
 		},
 	})
 
+	logService.SetWriterStatsSource(providerRelay.LogWriterStats)
+
+	budgetService.SetNotifier(func(alert services.BudgetAlert) {
+		app.Event.Emit("budget:alert", alert)
+	})
+
 	app.OnShutdown(func() {
 		_ = providerRelay.Stop()
 	})
@@ -28,15 +28,38 @@ type Service struct {
 
 // PricingEntry 映射 JSON 内的字段。
 type PricingEntry struct {
-	InputCostPerToken                   float64 `json:"input_cost_per_token"`
-	OutputCostPerToken                  float64 `json:"output_cost_per_token"`
-	CacheCreationInputTokenCost         float64 `json:"cache_creation_input_token_cost"`
-	CacheCreationInputTokenCostAbove1Hr float64 `json:"cache_creation_input_token_cost_above_1hr"`
-	CacheCreationInputTokenCostAbove200 float64 `json:"cache_creation_input_token_cost_above_200k_tokens"`
-	CacheReadInputTokenCost             float64 `json:"cache_read_input_token_cost"`
-	InputCostPerTokenAbove200k          float64 `json:"input_cost_per_token_above_200k_tokens"`
-	InputCostPerTokenAbove128k          float64 `json:"input_cost_per_token_above_128k_tokens"`
-	OutputCostPerTokenAbove200k         float64 `json:"output_cost_per_token_above_200k_tokens"`
+	InputCostPerToken                   float64    `json:"input_cost_per_token"`
+	OutputCostPerToken                  float64    `json:"output_cost_per_token"`
+	CacheCreationInputTokenCost         float64    `json:"cache_creation_input_token_cost"`
+	CacheCreationInputTokenCostAbove1Hr float64    `json:"cache_creation_input_token_cost_above_1hr"`
+	CacheCreationInputTokenCostAbove200 float64    `json:"cache_creation_input_token_cost_above_200k_tokens"`
+	CacheReadInputTokenCost             float64    `json:"cache_read_input_token_cost"`
+	InputCostPerTokenAbove200k          float64    `json:"input_cost_per_token_above_200k_tokens"`
+	InputCostPerTokenAbove128k          float64    `json:"input_cost_per_token_above_128k_tokens"`
+	OutputCostPerTokenAbove200k         float64    `json:"output_cost_per_token_above_200k_tokens"`
+	MaxInputTokens                      TokenLimit `json:"max_input_tokens"`
+	MaxOutputTokens                     TokenLimit `json:"max_output_tokens"`
+	MaxTokens                           TokenLimit `json:"max_tokens"`
+}
+
+// TokenLimit 上下文窗口大小，非数字（如 sample_spec 中的说明文字）按 0 处理。
+type TokenLimit int
+
+// UnmarshalJSON 容忍字符串等非数字取值。
+func (l *TokenLimit) UnmarshalJSON(data []byte) error {
+	var value float64
+	if err := json.Unmarshal(data, &value); err != nil {
+		*l = 0
+		return nil
+	}
+	*l = TokenLimit(value)
+	return nil
+}
+
+// ContextLimits 模型的输入、输出 token 上限，0 表示未知。
+type ContextLimits struct {
+	MaxInputTokens  int `json:"max_input_tokens"`
+	MaxOutputTokens int `json:"max_output_tokens"`
 }
 
 // UsageSnapshot 描述一次请求的 token 用量。
@@ -106,8 +129,18 @@ func NewService() (*Service, error) {
 	}, nil
 }
 
+// LongContextThreshold 单次请求的输入（含缓存读写）超过该值时，1M 上下文模型按长上下文单价计费。
+const LongContextThreshold = 200000
+
 // CalculateCost 根据模型与 token 用量返回费用明细（美元）。
 func (s *Service) CalculateCost(model string, usage UsageSnapshot) CostBreakdown {
+	totalInput := usage.InputTokens + usage.CacheCreateTokens + usage.CacheReadTokens
+	return s.CalculateGroupCost(model, usage, totalInput > LongContextThreshold)
+}
+
+// CalculateGroupCost 计算同一模型多次请求用量之和的费用明细。单价除长上下文外与用量线性相关，
+// 因此调用方需按单次请求是否超过 LongContextThreshold 分组汇总后再计算，longContext 表示该组请求均超过阈值。
+func (s *Service) CalculateGroupCost(model string, usage UsageSnapshot, longContext bool) CostBreakdown {
 	if s == nil || model == "" {
 		return CostBreakdown{}
 	}
@@ -116,7 +149,7 @@ func (s *Service) CalculateCost(model string, usage UsageSnapshot) CostBreakdown
 	if entry == nil && !strings.Contains(strings.ToLower(model), "[1m]") {
 		return breakdown
 	}
-	longTier, useLong := s.longContextTier(model, usage)
+	longTier, useLong := s.longContextTier(model, longContext)
 	if entry == nil {
 		entry = &PricingEntry{}
 	}
@@ -142,6 +175,26 @@ func (s *Service) CalculateCost(model string, usage UsageSnapshot) CostBreakdown
 	return breakdown
 }
 
+// ContextLimits 返回模型的上下文窗口限制，未收录的模型返回 false。
+func (s *Service) ContextLimits(model string) (ContextLimits, bool) {
+	if s == nil {
+		return ContextLimits{}, false
+	}
+	entry, ok := s.getPricing(model)
+	if !ok || entry == nil {
+		return ContextLimits{}, false
+	}
+	limits := ContextLimits{
+		MaxInputTokens:  int(entry.MaxInputTokens),
+		MaxOutputTokens: int(entry.MaxOutputTokens),
+	}
+	// max_tokens 为旧字段，仅在缺少 max_output_tokens 时使用
+	if limits.MaxOutputTokens == 0 {
+		limits.MaxOutputTokens = int(entry.MaxTokens)
+	}
+	return limits, limits.MaxInputTokens > 0 || limits.MaxOutputTokens > 0
+}
+
 func (s *Service) getPricing(model string) (*PricingEntry, bool) {
 	if model == "" {
 		return nil, false
@@ -175,9 +228,8 @@ func (s *Service) getPricing(model string) (*PricingEntry, bool) {
 	return nil, false
 }
 
-func (s *Service) longContextTier(model string, usage UsageSnapshot) (LongContextPricing, bool) {
-	totalInput := usage.InputTokens + usage.CacheCreateTokens + usage.CacheReadTokens
-	if strings.Contains(strings.ToLower(model), "[1m]") && totalInput > 200000 && len(s.longContexts) > 0 {
+func (s *Service) longContextTier(model string, longContext bool) (LongContextPricing, bool) {
+	if strings.Contains(strings.ToLower(model), "[1m]") && longContext && len(s.longContexts) > 0 {
 		if tier, ok := s.longContexts[model]; ok {
 			return tier, true
 		}
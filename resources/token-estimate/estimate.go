@@ -0,0 +1,310 @@
+package tokenestimate
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/tidwall/gjson"
+)
+
+// Format 请求体格式。
+type Format int
+
+const (
+	FormatMessages  Format = iota // Anthropic Messages API（/v1/messages）
+	FormatResponses               // OpenAI Responses API（/responses）
+)
+
+// Family tokenizer 系列，不同系列对英文、中文、符号的切分粒度不同。
+type Family string
+
+const (
+	FamilyClaude  Family = "claude"
+	FamilyO200k   Family = "o200k"  // gpt-4o / gpt-4.1 / gpt-5 / o 系列
+	FamilyCl100k  Family = "cl100k" // gpt-4 / gpt-3.5
+	FamilyGeneric Family = "generic"
+)
+
+// 未知尺寸的图片与文档按经验值估算。
+const (
+	defaultDocumentTokens = 1500
+)
+
+// profile 描述一个 tokenizer 系列的近似参数。
+type profile struct {
+	charsPerToken      float64 // ASCII 字母、数字平均每个 token 的字符数
+	cjkTokens          float64 // 每个中日韩字符的 token 数
+	symbolTokens       float64 // 每个 ASCII 标点、换行的 token 数
+	otherCharsPerToken float64 // 其他非 ASCII 字符平均每个 token 的字符数
+	requestOverhead    int     // 每个请求的固定开销
+	messageOverhead    int     // 每条消息的角色、分隔符开销
+	toolOverhead       int     // 每个工具定义的额外开销
+	toolsPrompt        int     // 启用工具时注入的系统提示
+}
+
+var profiles = map[Family]profile{
+	FamilyClaude: {
+		charsPerToken:      3.5,
+		cjkTokens:          1.2,
+		symbolTokens:       0.8,
+		otherCharsPerToken: 2.0,
+		requestOverhead:    3,
+		messageOverhead:    4,
+		toolOverhead:       10,
+		toolsPrompt:        346,
+	},
+	FamilyO200k: {
+		charsPerToken:      4.0,
+		cjkTokens:          0.8,
+		symbolTokens:       0.6,
+		otherCharsPerToken: 2.5,
+		requestOverhead:    3,
+		messageOverhead:    4,
+		toolOverhead:       8,
+		toolsPrompt:        12,
+	},
+	FamilyCl100k: {
+		charsPerToken:      3.8,
+		cjkTokens:          1.1,
+		symbolTokens:       0.7,
+		otherCharsPerToken: 2.0,
+		requestOverhead:    3,
+		messageOverhead:    4,
+		toolOverhead:       8,
+		toolsPrompt:        12,
+	},
+	FamilyGeneric: {
+		charsPerToken:      3.7,
+		cjkTokens:          1.0,
+		symbolTokens:       0.7,
+		otherCharsPerToken: 2.0,
+		requestOverhead:    3,
+		messageOverhead:    4,
+		toolOverhead:       10,
+		toolsPrompt:        100,
+	},
+}
+
+// Estimate 一次请求的输入 token 估算结果，Images 为 Messages 中图片所占部分。
+type Estimate struct {
+	Family   Family `json:"family"`
+	System   int    `json:"system"`
+	Messages int    `json:"messages"`
+	Tools    int    `json:"tools"`
+	Images   int    `json:"images"`
+	Total    int    `json:"total"`
+}
+
+// FamilyOf 根据模型名推断 tokenizer 系列。
+func FamilyOf(model string) Family {
+	name := strings.ToLower(model)
+	switch {
+	case strings.Contains(name, "claude"):
+		return FamilyClaude
+	case strings.Contains(name, "gpt-4o"), strings.Contains(name, "gpt-4.1"),
+		strings.Contains(name, "gpt-5"), strings.Contains(name, "codex"),
+		strings.HasPrefix(name, "o1"), strings.HasPrefix(name, "o3"), strings.HasPrefix(name, "o4"),
+		strings.Contains(name, "/o1"), strings.Contains(name, "/o3"), strings.Contains(name, "/o4"):
+		return FamilyO200k
+	case strings.Contains(name, "gpt-4"), strings.Contains(name, "gpt-3.5"):
+		return FamilyCl100k
+	default:
+		return FamilyGeneric
+	}
+}
+
+// CountText 估算一段纯文本的 token 数。
+func CountText(family Family, text string) int {
+	return profileOf(family).countText(text)
+}
+
+// EstimateRequest 估算请求体的输入 tokens（包含系统提示、消息、工具定义与图片）。
+func EstimateRequest(format Format, model string, body []byte) Estimate {
+	family := FamilyOf(model)
+	e := &estimator{family: family, profile: profileOf(family)}
+	root := gjson.ParseBytes(body)
+
+	var est Estimate
+	switch format {
+	case FormatResponses:
+		est = e.responses(root)
+	default:
+		est = e.messages(root)
+	}
+	est.Family = family
+	est.Images = e.images
+	est.Total = e.profile.requestOverhead + est.System + est.Messages + est.Tools
+	return est
+}
+
+func profileOf(family Family) profile {
+	if p, ok := profiles[family]; ok {
+		return p
+	}
+	return profiles[FamilyGeneric]
+}
+
+func (p profile) countText(text string) int {
+	if text == "" {
+		return 0
+	}
+	var word, symbol, cjk, other int
+	for _, r := range text {
+		switch {
+		case r == '\n':
+			symbol++
+		case unicode.IsSpace(r):
+			// 空格通常并入相邻的 token
+		case r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			word++
+		case r <= unicode.MaxASCII:
+			symbol++
+		case isCJK(r):
+			cjk++
+		default:
+			other++
+		}
+	}
+	tokens := float64(word)/p.charsPerToken +
+		float64(symbol)*p.symbolTokens +
+		float64(cjk)*p.cjkTokens +
+		float64(other)/p.otherCharsPerToken
+	return int(math.Ceil(tokens))
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// estimator 遍历请求体并累计图片 tokens。
+type estimator struct {
+	family  Family
+	profile profile
+	images  int
+}
+
+// messages 估算 Anthropic Messages 请求。
+func (e *estimator) messages(root gjson.Result) Estimate {
+	est := Estimate{System: e.content(root.Get("system"))}
+	for _, message := range root.Get("messages").Array() {
+		est.Messages += e.profile.messageOverhead + e.content(message.Get("content"))
+	}
+
+	tools := root.Get("tools").Array()
+	if len(tools) > 0 {
+		est.Tools = e.profile.toolsPrompt
+	}
+	for _, tool := range tools {
+		est.Tools += e.profile.toolOverhead + e.tool(tool, "input_schema")
+	}
+	return est
+}
+
+// responses 估算 OpenAI Responses 请求。
+func (e *estimator) responses(root gjson.Result) Estimate {
+	est := Estimate{System: e.profile.countText(root.Get("instructions").String())}
+
+	input := root.Get("input")
+	if input.Type == gjson.String {
+		est.Messages = e.profile.messageOverhead + e.profile.countText(input.String())
+		input = gjson.Result{}
+	}
+	for _, item := range input.Array() {
+		if item.Get("role").Exists() {
+			est.Messages += e.profile.messageOverhead + e.content(item.Get("content"))
+			continue
+		}
+		est.Messages += e.block(item)
+	}
+
+	tools := root.Get("tools").Array()
+	if len(tools) > 0 {
+		est.Tools = e.profile.toolsPrompt
+	}
+	for _, tool := range tools {
+		if tool.Get("type").String() != "function" {
+			// 内置工具（web_search 等）按配置文本估算
+			est.Tools += e.profile.toolOverhead + e.profile.countText(tool.Raw)
+			continue
+		}
+		est.Tools += e.profile.toolOverhead + e.tool(tool, "parameters")
+	}
+	return est
+}
+
+func (e *estimator) tool(tool gjson.Result, schemaField string) int {
+	return e.profile.countText(tool.Get("name").String()) +
+		e.profile.countText(tool.Get("description").String()) +
+		e.profile.countText(tool.Get(schemaField).Raw)
+}
+
+// content 估算 content 字段：可以是字符串、内容块数组或单个内容块。
+func (e *estimator) content(value gjson.Result) int {
+	switch {
+	case value.Type == gjson.String:
+		return e.profile.countText(value.String())
+	case value.IsArray():
+		total := 0
+		for _, block := range value.Array() {
+			total += e.block(block)
+		}
+		return total
+	case value.IsObject():
+		return e.block(value)
+	default:
+		return 0
+	}
+}
+
+// block 估算单个内容块或 Responses 输入项。
+func (e *estimator) block(block gjson.Result) int {
+	if block.Type == gjson.String {
+		return e.profile.countText(block.String())
+	}
+	switch block.Get("type").String() {
+	case "text", "input_text", "output_text", "summary_text":
+		return e.profile.countText(block.Get("text").String())
+	case "thinking":
+		return e.profile.countText(block.Get("thinking").String())
+	case "redacted_thinking":
+		// 加密内容无法估算
+		return 0
+	case "image":
+		return e.image(block.Get("source.data").String(), "")
+	case "input_image":
+		return e.image(block.Get("image_url").String(), block.Get("detail").String())
+	case "document":
+		source := block.Get("source")
+		switch source.Get("type").String() {
+		case "text":
+			return e.profile.countText(source.Get("data").String())
+		case "content":
+			return e.content(source.Get("content"))
+		default:
+			return defaultDocumentTokens
+		}
+	case "input_file":
+		return defaultDocumentTokens
+	case "tool_use":
+		return e.profile.countText(block.Get("name").String()) + e.profile.countText(block.Get("input").Raw)
+	case "tool_result":
+		return e.content(block.Get("content"))
+	case "function_call":
+		return e.profile.countText(block.Get("name").String()) + e.profile.countText(block.Get("arguments").String())
+	case "function_call_output":
+		return e.content(block.Get("output"))
+	case "message":
+		return e.profile.messageOverhead + e.content(block.Get("content"))
+	case "reasoning":
+		return e.content(block.Get("summary"))
+	default:
+		return e.profile.countText(block.Raw)
+	}
+}
+
+func (e *estimator) image(data string, detail string) int {
+	tokens := imageTokens(e.family, data, detail)
+	e.images += tokens
+	return tokens
+}
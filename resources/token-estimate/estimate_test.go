@@ -0,0 +1,154 @@
+package tokenestimate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// ==================== tokenizer 系列测试 ====================
+
+func TestFamilyOf(t *testing.T) {
+	tests := []struct {
+		model    string
+		expected Family
+	}{
+		{"claude-sonnet-4-20250514", FamilyClaude},
+		{"anthropic/claude-opus-4", FamilyClaude},
+		{"gpt-5-codex", FamilyO200k},
+		{"gpt-4o-mini", FamilyO200k},
+		{"o3-mini", FamilyO200k},
+		{"gpt-4-turbo", FamilyCl100k},
+		{"gpt-3.5-turbo", FamilyCl100k},
+		{"deepseek-chat", FamilyGeneric},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := FamilyOf(tt.model); got != tt.expected {
+				t.Errorf("FamilyOf(%q) = %s, 期望 %s", tt.model, got, tt.expected)
+			}
+		})
+	}
+}
+
+// ==================== 文本估算测试 ====================
+
+func TestCountText(t *testing.T) {
+	english := "The quick brown fox jumps over the lazy dog."
+	chinese := "敏捷的棕色狐狸跳过了懒狗。"
+
+	tests := []struct {
+		name   string
+		family Family
+		text   string
+		min    int
+		max    int
+	}{
+		{"空文本", FamilyClaude, "", 0, 0},
+		{"英文 claude", FamilyClaude, english, 9, 14},
+		{"英文 o200k", FamilyO200k, english, 8, 12},
+		{"中文 claude", FamilyClaude, chinese, 12, 18},
+		{"中文 o200k", FamilyO200k, chinese, 8, 14},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CountText(tt.family, tt.text)
+			if got < tt.min || got > tt.max {
+				t.Errorf("CountText(%s) = %d, 期望在 [%d, %d] 之间", tt.family, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+// ==================== 请求估算测试 ====================
+
+func TestEstimateRequestMessages(t *testing.T) {
+	body := []byte(`{
+		"model": "claude-sonnet-4",
+		"system": [{"type": "text", "text": "You are a helpful assistant."}],
+		"messages": [
+			{"role": "user", "content": "Hello, how are you today?"},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "t1", "name": "get_weather", "input": {"city": "Paris"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "t1", "content": "Sunny, 24 degrees"}]}
+		],
+		"tools": [{"name": "get_weather", "description": "Get the weather", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}}}]
+	}`)
+
+	est := EstimateRequest(FormatMessages, "claude-sonnet-4", body)
+	if est.System == 0 || est.Messages == 0 || est.Tools == 0 {
+		t.Fatalf("各部分估算均应大于 0: %+v", est)
+	}
+	if est.Tools < profiles[FamilyClaude].toolsPrompt {
+		t.Errorf("启用工具时应计入工具系统提示: %+v", est)
+	}
+	if est.Total != profiles[FamilyClaude].requestOverhead+est.System+est.Messages+est.Tools {
+		t.Errorf("Total 应为各部分之和: %+v", est)
+	}
+}
+
+func TestEstimateRequestResponses(t *testing.T) {
+	body := []byte(`{
+		"model": "gpt-5-codex",
+		"instructions": "You are a coding agent.",
+		"input": [
+			{"role": "user", "content": [{"type": "input_text", "text": "List the files"}]},
+			{"type": "function_call", "name": "shell", "arguments": "{\"command\":[\"ls\"]}"},
+			{"type": "function_call_output", "output": "main.go\ngo.mod"}
+		],
+		"tools": [{"type": "function", "name": "shell", "parameters": {"type": "object"}}, {"type": "web_search"}]
+	}`)
+
+	est := EstimateRequest(FormatResponses, "gpt-5-codex", body)
+	if est.Family != FamilyO200k {
+		t.Errorf("Family = %s, 期望 %s", est.Family, FamilyO200k)
+	}
+	if est.System == 0 || est.Messages == 0 || est.Tools == 0 {
+		t.Fatalf("各部分估算均应大于 0: %+v", est)
+	}
+
+	plain := EstimateRequest(FormatResponses, "gpt-5", []byte(`{"input":"hello world"}`))
+	if plain.Messages == 0 {
+		t.Errorf("字符串 input 应计入 Messages: %+v", plain)
+	}
+}
+
+// ==================== 图片估算测试 ====================
+
+func TestImageTokens(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatalf("生成测试图片失败: %v", err)
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	tests := []struct {
+		name     string
+		family   Family
+		data     string
+		detail   string
+		expected int
+	}{
+		{"claude 按像素计算", FamilyClaude, data, "", 667},
+		{"openai 按 512 切块", FamilyO200k, "data:image/png;base64," + data, "", 170*2*1 + 85},
+		{"openai low detail", FamilyO200k, data, "low", 85},
+		{"URL 图片使用默认值", FamilyClaude, "https://example.com/a.png", "", defaultClaudeImageTokens},
+		{"无法解析使用默认值", FamilyO200k, "not-base64", "", defaultOpenAIImageTokens},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imageTokens(tt.family, tt.data, tt.detail); got != tt.expected {
+				t.Errorf("imageTokens = %d, 期望 %d", got, tt.expected)
+			}
+		})
+	}
+
+	body := []byte(`{"messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + data + `"}}]}]}`)
+	if est := EstimateRequest(FormatMessages, "claude-sonnet-4", body); est.Images != 667 {
+		t.Errorf("Images = %d, 期望 667", est.Images)
+	}
+}
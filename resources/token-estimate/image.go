@@ -0,0 +1,97 @@
+package tokenestimate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"strings"
+)
+
+const (
+	// 无法读取尺寸时的默认值：Claude 约为 1092x1092，OpenAI 为 1024x1024 high detail
+	defaultClaudeImageTokens = 1600
+	defaultOpenAIImageTokens = 765
+	openAILowDetailTokens    = 85
+
+	// 只解码 base64 的前 64KB 读取图片头
+	imageHeaderBytes = 64 * 1024
+)
+
+// imageTokens 估算一张图片的 tokens，data 为 base64 或 data URL，URL 图片按默认尺寸估算。
+func imageTokens(family Family, data string, detail string) int {
+	openAI := family == FamilyO200k || family == FamilyCl100k
+	if openAI && strings.EqualFold(detail, "low") {
+		return openAILowDetailTokens
+	}
+
+	width, height, ok := imageSize(data)
+	switch {
+	case openAI && ok:
+		return openAIImageTokens(width, height)
+	case openAI:
+		return defaultOpenAIImageTokens
+	case ok:
+		return claudeImageTokens(width, height)
+	default:
+		return defaultClaudeImageTokens
+	}
+}
+
+// claudeImageTokens Claude 会把长边缩到 1568、总像素缩到约 1.15MP，tokens ≈ 宽 × 高 / 750。
+func claudeImageTokens(width int, height int) int {
+	w, h := float64(width), float64(height)
+	if long := math.Max(w, h); long > 1568 {
+		w, h = w*1568/long, h*1568/long
+	}
+	if pixels := w * h; pixels > 1150000 {
+		scale := math.Sqrt(1150000 / pixels)
+		w, h = w*scale, h*scale
+	}
+	return int(math.Ceil(w * h / 750))
+}
+
+// openAIImageTokens 缩放到 2048x2048 以内、短边不超过 768 后，按 512 像素切块：170 × 块数 + 85。
+func openAIImageTokens(width int, height int) int {
+	w, h := float64(width), float64(height)
+	if long := math.Max(w, h); long > 2048 {
+		w, h = w*2048/long, h*2048/long
+	}
+	if short := math.Min(w, h); short > 768 {
+		w, h = w*768/short, h*768/short
+	}
+	tiles := math.Ceil(w/512) * math.Ceil(h/512)
+	return int(170*tiles) + openAILowDetailTokens
+}
+
+// imageSize 从 base64 数据中读取图片尺寸，支持 PNG、JPEG、GIF。
+func imageSize(data string) (int, int, bool) {
+	if strings.HasPrefix(data, "data:") {
+		idx := strings.Index(data, ",")
+		if idx < 0 {
+			return 0, 0, false
+		}
+		data = data[idx+1:]
+	} else if strings.HasPrefix(data, "http://") || strings.HasPrefix(data, "https://") {
+		return 0, 0, false
+	}
+	if data == "" {
+		return 0, 0, false
+	}
+
+	if limit := base64.StdEncoding.EncodedLen(imageHeaderBytes); len(data) > limit {
+		data = data[:limit]
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil && len(raw) == 0 {
+		return 0, 0, false
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return 0, 0, false
+	}
+	return config.Width, config.Height, true
+}
@@ -0,0 +1,576 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+const (
+	defaultCaptureMaxBodyBytes   = 256 << 10
+	defaultCaptureRetentionHours = 72
+
+	// 过期数据的清理间隔，在写入新的捕获时顺带执行
+	capturePruneInterval = 10 * time.Minute
+
+	redactedPlaceholder = "[REDACTED]"
+)
+
+// CaptureSettings 请求/响应体捕获配置。捕获默认关闭，由 provider 的 captureBodies 或下列规则开启
+type CaptureSettings struct {
+	Rules          []CaptureRule `json:"rules,omitempty"`
+	MaxBodyBytes   int           `json:"maxBodyBytes,omitempty"`   // 单个请求体/响应体的保存上限，超出部分截断，默认 256KB
+	RetentionHours int           `json:"retentionHours,omitempty"` // 保存时长，过期后自动删除，默认 72 小时
+	RedactEmails   bool          `json:"redactEmails,omitempty"`   // 脱敏邮箱地址；API Key 与鉴权请求头总是脱敏
+	RedactPatterns []string      `json:"redactPatterns,omitempty"` // 自定义脱敏正则，匹配内容替换为 [REDACTED]
+}
+
+// CaptureRule 捕获规则，按平台、provider、模型（支持通配符）限定范围，空表示全部
+type CaptureRule struct {
+	Platform   string `json:"platform,omitempty"`
+	Provider   string `json:"provider,omitempty"`
+	Model      string `json:"model,omitempty"`
+	OnlyErrors bool   `json:"onlyErrors,omitempty"` // 仅保存失败的尝试
+}
+
+func (r CaptureRule) matches(kind string, provider string, model string) bool {
+	if r.Platform != "" && !strings.EqualFold(r.Platform, kind) {
+		return false
+	}
+	if r.Provider != "" && !matchWildcard(r.Provider, provider) {
+		return false
+	}
+	if r.Model != "" && !matchWildcard(r.Model, model) {
+		return false
+	}
+	return true
+}
+
+// Validate 校验捕获配置
+func (cs CaptureSettings) Validate() []string {
+	errs := make([]string, 0)
+	if cs.MaxBodyBytes < 0 || cs.RetentionHours < 0 {
+		errs = append(errs, "请求体捕获的大小上限与保存时长不能为负数")
+	}
+	for _, pattern := range cs.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Sprintf("脱敏正则 '%s' 无效: %v", pattern, err))
+		}
+	}
+	return errs
+}
+
+// captureMode 判断是否捕获该 provider 的请求，以及是否只保存失败的尝试
+func (cs CaptureSettings) captureMode(kind string, provider Provider, model string) (capture bool, onlyErrors bool) {
+	if provider.CaptureBodies {
+		return true, false
+	}
+	for _, rule := range cs.Rules {
+		if !rule.matches(kind, provider.Name, model) {
+			continue
+		}
+		if !rule.OnlyErrors {
+			return true, false
+		}
+		capture, onlyErrors = true, true
+	}
+	return capture, onlyErrors
+}
+
+func (cs CaptureSettings) maxBodyBytes() int {
+	if cs.MaxBodyBytes <= 0 {
+		return defaultCaptureMaxBodyBytes
+	}
+	return cs.MaxBodyBytes
+}
+
+func (cs CaptureSettings) retention() time.Duration {
+	if cs.RetentionHours <= 0 {
+		return defaultCaptureRetentionHours * time.Hour
+	}
+	return time.Duration(cs.RetentionHours) * time.Hour
+}
+
+type captureSettingsKey struct{}
+
+func withCaptureSettings(ctx context.Context, settings *CaptureSettings) context.Context {
+	return context.WithValue(ctx, captureSettingsKey{}, settings)
+}
+
+// ==================== 脱敏 ====================
+
+type redactRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var (
+	// 常见的 API Key 格式与 JSON 中的密钥字段
+	apiKeyRedactRules = []redactRule{
+		{regexp.MustCompile(`sk-[A-Za-z0-9_\-]{16,}`), redactedPlaceholder},
+		{regexp.MustCompile(`AIza[0-9A-Za-z_\-]{35}`), redactedPlaceholder},
+		{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/\-]{16,}=*`), "${1}" + redactedPlaceholder},
+		{regexp.MustCompile(`(?i)("(?:api[_-]?key|access[_-]?token|secret|password)"\s*:\s*")[^"]*(")`), "${1}" + redactedPlaceholder + "${2}"},
+	}
+	emailRedactRule = redactRule{regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`), redactedPlaceholder}
+
+	// 保存时整体替换值的请求头
+	sensitiveCaptureHeaders = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"X-Api-Key":           true,
+		"Api-Key":             true,
+		"X-Goog-Api-Key":      true,
+		"Cookie":              true,
+		"Set-Cookie":          true,
+	}
+)
+
+// bodyRedactor 在保存前移除请求/响应中的敏感信息
+type bodyRedactor struct {
+	secrets []string
+	rules   []redactRule
+}
+
+func newBodyRedactor(settings CaptureSettings, secrets ...string) *bodyRedactor {
+	redactor := &bodyRedactor{rules: append([]redactRule(nil), apiKeyRedactRules...)}
+	for _, secret := range secrets {
+		if secret != "" {
+			redactor.secrets = append(redactor.secrets, secret)
+		}
+	}
+	if settings.RedactEmails {
+		redactor.rules = append(redactor.rules, emailRedactRule)
+	}
+	for _, pattern := range settings.RedactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Printf("[WARN] 忽略无效的脱敏正则 '%s': %v\n", pattern, err)
+			continue
+		}
+		redactor.rules = append(redactor.rules, redactRule{re, redactedPlaceholder})
+	}
+	return redactor
+}
+
+func (r *bodyRedactor) redact(data []byte) []byte {
+	for _, secret := range r.secrets {
+		data = bytes.ReplaceAll(data, []byte(secret), []byte(redactedPlaceholder))
+	}
+	for _, rule := range r.rules {
+		data = rule.pattern.ReplaceAll(data, []byte(rule.replacement))
+	}
+	return data
+}
+
+func (r *bodyRedactor) redactHeaders(headers map[string]string) map[string]string {
+	redacted := make(map[string]string, len(headers))
+	for key, value := range headers {
+		if sensitiveCaptureHeaders[http.CanonicalHeaderKey(key)] {
+			redacted[key] = redactedPlaceholder
+			continue
+		}
+		redacted[key] = string(r.redact([]byte(value)))
+	}
+	return redacted
+}
+
+// ==================== 捕获 ====================
+
+// CapturedExchange 一次上游尝试捕获的请求与响应，正文已脱敏
+type CapturedExchange struct {
+	RequestID         string            `json:"request_id"`
+	Attempt           int               `json:"attempt"`
+	Platform          string            `json:"platform"`
+	Provider          string            `json:"provider"`
+	Model             string            `json:"model"`
+	HttpCode          int               `json:"http_code"`
+	ErrorClass        string            `json:"error_class"`
+	RequestHeaders    map[string]string `json:"request_headers"`
+	RequestBody       string            `json:"request_body"` // 实际发往上游的请求体
+	ClientBody        string            `json:"client_body"`  // 模型映射与改写规则执行前的请求体，用于重放
+	RequestSize       int64             `json:"request_size"` // 原始大小（字节）
+	RequestTruncated  bool              `json:"request_truncated"`
+	ResponseHeaders   map[string]string `json:"response_headers"`
+	ResponseBody      string            `json:"response_body"`
+	ResponseSize      int64             `json:"response_size"`
+	ResponseTruncated bool              `json:"response_truncated"`
+	CreatedAt         string            `json:"created_at"`
+	ExpiresAt         string            `json:"expires_at"`
+}
+
+// captureBuffer 只保留前 limit 字节，同时统计完整大小
+type captureBuffer struct {
+	limit int
+	buf   bytes.Buffer
+	size  int64
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.buf.Write(p[:room])
+	}
+	return len(p), nil
+}
+
+func (b *captureBuffer) truncated() bool {
+	return b.size > int64(b.buf.Len())
+}
+
+type captureReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyCapture 一次上游尝试的捕获状态，在尝试结束后脱敏、压缩并保存
+type bodyCapture struct {
+	settings   CaptureSettings
+	onlyErrors bool
+	secret     string
+	store      *bodyCaptureStore
+
+	requestHeaders  map[string]string
+	request         *captureBuffer
+	client          []byte
+	responseHeaders map[string]string
+	response        *captureBuffer
+}
+
+// newBodyCapture 按 provider 配置与请求 context 中的捕获规则创建捕获，未开启时返回 nil
+func newBodyCapture(ctx context.Context, kind string, provider Provider, model string, store *bodyCaptureStore) *bodyCapture {
+	var settings CaptureSettings
+	if configured, _ := ctx.Value(captureSettingsKey{}).(*CaptureSettings); configured != nil {
+		settings = *configured
+	}
+	enabled, onlyErrors := settings.captureMode(kind, provider, model)
+	if !enabled {
+		return nil
+	}
+	return &bodyCapture{
+		settings:   settings,
+		onlyErrors: onlyErrors,
+		secret:     provider.APIKey,
+		store:      store,
+		request:    &captureBuffer{limit: settings.maxBodyBytes()},
+		response:   &captureBuffer{limit: settings.maxBodyBytes()},
+	}
+}
+
+func (bc *bodyCapture) captureRequest(headers map[string]string, body []byte, source []byte) {
+	bc.requestHeaders = headers
+	_, _ = bc.request.Write(body)
+	// 与实际请求体相同时不重复保存
+	if len(source) <= bc.settings.maxBodyBytes() && !bytes.Equal(source, body) {
+		bc.client = source
+	}
+}
+
+// tapResponse 在响应体被读取时同步保存一份（已解压的）副本
+func (bc *bodyCapture) tapResponse(resp *http.Response) {
+	bc.responseHeaders = make(map[string]string, len(resp.Header))
+	for key := range resp.Header {
+		bc.responseHeaders[key] = resp.Header.Get(key)
+	}
+	if resp.Body != nil {
+		resp.Body = captureReadCloser{Reader: io.TeeReader(resp.Body, bc.response), Closer: resp.Body}
+	}
+}
+
+// save 在尝试结束后调用；仅捕获失败时跳过成功的尝试，被取消的对冲请求不保存
+func (bc *bodyCapture) save(requestLog *ReqeustLog, succeeded bool) {
+	if requestLog.Outcome == outcomeCancelled {
+		return
+	}
+	if bc.onlyErrors && succeeded && requestLog.ErrorClass == "" {
+		return
+	}
+	now := time.Now().UTC()
+	exchange := &CapturedExchange{
+		RequestID:         requestLog.RequestID,
+		Attempt:           requestLog.Attempt,
+		Platform:          requestLog.Platform,
+		Provider:          requestLog.Provider,
+		Model:             requestLog.Model,
+		HttpCode:          requestLog.HttpCode,
+		ErrorClass:        requestLog.ErrorClass,
+		RequestHeaders:    bc.requestHeaders,
+		RequestBody:       bc.request.buf.String(),
+		ClientBody:        string(bc.client),
+		RequestSize:       bc.request.size,
+		RequestTruncated:  bc.request.truncated(),
+		ResponseHeaders:   bc.responseHeaders,
+		ResponseBody:      bc.response.buf.String(),
+		ResponseSize:      bc.response.size,
+		ResponseTruncated: bc.response.truncated(),
+		CreatedAt:         now.Format(timeLayout),
+		ExpiresAt:         now.Add(bc.settings.retention()).Format(timeLayout),
+	}
+	redactor := newBodyRedactor(bc.settings, bc.secret)
+	bc.store.submit(exchange, redactor)
+}
+
+// ==================== 存储 ====================
+
+// bodyCaptureStore 在后台写入捕获数据并定期清理过期记录；为 nil 时同步写入
+type bodyCaptureStore struct {
+	wg        sync.WaitGroup
+	lastPrune atomic.Int64
+}
+
+func (s *bodyCaptureStore) submit(exchange *CapturedExchange, redactor *bodyRedactor) {
+	if s == nil {
+		if err := insertCapturedExchange(exchange, redactor); err != nil {
+			fmt.Printf("[ERROR] 保存请求体捕获失败: %v\n", err)
+		}
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := insertCapturedExchange(exchange, redactor); err != nil {
+			fmt.Printf("[ERROR] 保存请求体捕获失败: %v\n", err)
+		}
+		s.pruneIfDue()
+	}()
+}
+
+func (s *bodyCaptureStore) pruneIfDue() {
+	now := time.Now()
+	last := s.lastPrune.Load()
+	if now.Sub(time.Unix(0, last)) < capturePruneInterval || !s.lastPrune.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	if removed, err := pruneCapturedExchanges(now); err != nil {
+		fmt.Printf("[WARN] 清理过期的请求体捕获失败: %v\n", err)
+	} else if removed > 0 {
+		fmt.Printf("[INFO] 已清理 %d 条过期的请求体捕获\n", removed)
+	}
+}
+
+// Close 等待正在写入的捕获完成
+func (s *bodyCaptureStore) Close(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("等待请求体捕获写入完成超时")
+	}
+}
+
+func ensureRequestBodyTable() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return err
+	}
+	const createTableSQL = `CREATE TABLE IF NOT EXISTS request_body (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_id TEXT DEFAULT '',
+		attempt INTEGER DEFAULT 0,
+		platform TEXT DEFAULT '',
+		provider TEXT DEFAULT '',
+		model TEXT DEFAULT '',
+		http_code INTEGER DEFAULT 0,
+		error_class TEXT DEFAULT '',
+		request_headers TEXT DEFAULT '',
+		request_body BLOB,
+		client_body BLOB,
+		request_size INTEGER DEFAULT 0,
+		request_truncated INTEGER DEFAULT 0,
+		response_headers TEXT DEFAULT '',
+		response_body BLOB,
+		response_size INTEGER DEFAULT 0,
+		response_truncated INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME
+	)`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return err
+	}
+	if err := ensureTableColumn(db, "request_body", "client_body", "BLOB"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_request_body_request_id ON request_body (request_id)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_request_body_expires_at ON request_body (expires_at)`); err != nil {
+		return err
+	}
+	return nil
+}
+
+// insertCapturedExchange 脱敏后以 gzip 压缩保存请求体与响应体
+func insertCapturedExchange(exchange *CapturedExchange, redactor *bodyRedactor) error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return err
+	}
+	requestHeaders, err := json.Marshal(redactor.redactHeaders(exchange.RequestHeaders))
+	if err != nil {
+		return err
+	}
+	responseHeaders, err := json.Marshal(redactor.redactHeaders(exchange.ResponseHeaders))
+	if err != nil {
+		return err
+	}
+	requestBody, err := gzipBytes(redactor.redact([]byte(exchange.RequestBody)))
+	if err != nil {
+		return err
+	}
+	responseBody, err := gzipBytes(redactor.redact([]byte(exchange.ResponseBody)))
+	if err != nil {
+		return err
+	}
+	var clientBody []byte
+	if exchange.ClientBody != "" {
+		if clientBody, err = gzipBytes(redactor.redact([]byte(exchange.ClientBody))); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`INSERT INTO request_body (
+		request_id, attempt, platform, provider, model, http_code, error_class,
+		request_headers, request_body, client_body, request_size, request_truncated,
+		response_headers, response_body, response_size, response_truncated,
+		created_at, expires_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		exchange.RequestID, exchange.Attempt, exchange.Platform, exchange.Provider, exchange.Model,
+		exchange.HttpCode, exchange.ErrorClass,
+		string(requestHeaders), requestBody, clientBody, exchange.RequestSize, boolToInt(exchange.RequestTruncated),
+		string(responseHeaders), responseBody, exchange.ResponseSize, boolToInt(exchange.ResponseTruncated),
+		exchange.CreatedAt, exchange.ExpiresAt,
+	)
+	return err
+}
+
+// loadCapturedExchanges 按尝试顺序读取某次请求未过期的捕获
+func loadCapturedExchanges(requestID string, now time.Time) ([]CapturedExchange, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT request_id, attempt, platform, provider, model, http_code, error_class,
+		request_headers, request_body, client_body, request_size, request_truncated,
+		response_headers, response_body, response_size, response_truncated,
+		created_at, expires_at
+	FROM request_body WHERE request_id = ? AND expires_at > ? ORDER BY attempt ASC, id ASC`,
+		requestID, now.UTC().Format(timeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exchanges := make([]CapturedExchange, 0)
+	for rows.Next() {
+		var (
+			exchange                            CapturedExchange
+			requestHeaders, responseHeaders     string
+			requestBody, clientBody             []byte
+			responseBody                        []byte
+			requestTruncated, responseTruncated int
+			createdAt, expiresAt                any
+		)
+		if err := rows.Scan(&exchange.RequestID, &exchange.Attempt, &exchange.Platform, &exchange.Provider,
+			&exchange.Model, &exchange.HttpCode, &exchange.ErrorClass,
+			&requestHeaders, &requestBody, &clientBody, &exchange.RequestSize, &requestTruncated,
+			&responseHeaders, &responseBody, &exchange.ResponseSize, &responseTruncated,
+			&createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(requestHeaders), &exchange.RequestHeaders)
+		_ = json.Unmarshal([]byte(responseHeaders), &exchange.ResponseHeaders)
+		if exchange.RequestBody, err = gunzipString(requestBody); err != nil {
+			return nil, err
+		}
+		if exchange.ResponseBody, err = gunzipString(responseBody); err != nil {
+			return nil, err
+		}
+		if exchange.ClientBody, err = gunzipString(clientBody); err != nil {
+			return nil, err
+		}
+		if exchange.ClientBody == "" {
+			// 未映射模型、未执行改写规则时两者相同，只保存了一份
+			exchange.ClientBody = exchange.RequestBody
+		}
+		exchange.RequestTruncated = requestTruncated != 0
+		exchange.ResponseTruncated = responseTruncated != 0
+		exchange.CreatedAt = formatDBTime(createdAt)
+		exchange.ExpiresAt = formatDBTime(expiresAt)
+		exchanges = append(exchanges, exchange)
+	}
+	return exchanges, rows.Err()
+}
+
+// pruneCapturedExchanges 删除已过期的捕获，返回删除条数
+func pruneCapturedExchanges(now time.Time) (int64, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(`DELETE FROM request_body WHERE expires_at <= ?`, now.UTC().Format(timeLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// formatDBTime 将 DATETIME 列的值统一格式化为 timeLayout（驱动可能返回 time.Time 或字符串）
+func formatDBTime(value any) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC().Format(timeLayout)
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipString(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	plain, err := io.ReadAll(reader)
+	return string(plain), err
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ==================== 请求体捕获测试 ====================
+
+func TestCaptureMode(t *testing.T) {
+	settings := CaptureSettings{Rules: []CaptureRule{
+		{Platform: "claude", Model: "claude-opus-*", OnlyErrors: true},
+		{Provider: "debug-*"},
+	}}
+	tests := []struct {
+		name       string
+		kind       string
+		provider   Provider
+		model      string
+		capture    bool
+		onlyErrors bool
+	}{
+		{"provider 开启捕获", "codex", Provider{Name: "p", CaptureBodies: true}, "gpt-5", true, false},
+		{"仅失败规则", "claude", Provider{Name: "p"}, "claude-opus-4", true, true},
+		{"完整捕获规则优先", "claude", Provider{Name: "debug-relay"}, "claude-opus-4", true, false},
+		{"平台不匹配", "codex", Provider{Name: "p"}, "claude-opus-4", false, false},
+		{"未配置", "claude", Provider{Name: "p"}, "claude-sonnet-4", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capture, onlyErrors := settings.captureMode(tt.kind, tt.provider, tt.model)
+			if capture != tt.capture || onlyErrors != tt.onlyErrors {
+				t.Errorf("captureMode = (%v, %v), 期望 (%v, %v)", capture, onlyErrors, tt.capture, tt.onlyErrors)
+			}
+		})
+	}
+}
+
+func TestBodyRedactor(t *testing.T) {
+	redactor := newBodyRedactor(CaptureSettings{
+		RedactEmails:   true,
+		RedactPatterns: []string{`\b\d{4}-\d{4}-\d{4}-\d{4}\b`},
+	}, "my-provider-key")
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"provider 密钥", `key=my-provider-key`, `key=[REDACTED]`},
+		{"sk 格式", `{"text":"use sk-ant-REDACTED"}`, `{"text":"use [REDACTED]"}`},
+		{"Bearer", `Bearer abcdefghijklmnopqrstuvwxyz`, `Bearer [REDACTED]`},
+		{"JSON 密钥字段", `{"api_key": "short", "n": 1}`, `{"api_key": "[REDACTED]", "n": 1}`},
+		{"邮箱", `contact alice@example.com now`, `contact [REDACTED] now`},
+		{"自定义正则", `card 1234-5678-9012-3456`, `card [REDACTED]`},
+		{"普通文本", `hello world`, `hello world`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(redactor.redact([]byte(tt.input))); got != tt.expected {
+				t.Errorf("redact(%q) = %q, 期望 %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+
+	headers := redactor.redactHeaders(map[string]string{"x-api-key": "anything", "Content-Type": "application/json"})
+	if headers["x-api-key"] != redactedPlaceholder || headers["Content-Type"] != "application/json" {
+		t.Errorf("redactHeaders = %v", headers)
+	}
+
+	if emails := newBodyRedactor(CaptureSettings{}).redact([]byte("a@b.com")); string(emails) != "a@b.com" {
+		t.Errorf("未开启邮箱脱敏时不应替换邮箱，实际 %q", emails)
+	}
+}
+
+func TestProxyHandlerBodyCapture(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	initTestRequestLogDB(t)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"message":"bad input from bob@example.com"}}`))
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":"` + strings.Repeat("x", 100) + `","usage":{"input_tokens":1,"output_tokens":2}}`))
+	}))
+	defer healthy.Close()
+
+	providerService := NewProviderService()
+	if err := providerService.SaveProviders("claude", []Provider{
+		{ID: 1, Name: "failing", APIURL: failing.URL, APIKey: "secret-key-1", Enabled: true, Level: 1, CaptureBodies: true},
+		{ID: 2, Name: "healthy", APIURL: healthy.URL, APIKey: "secret-key-2", Enabled: true, Level: 2},
+	}); err != nil {
+		t.Fatalf("保存 provider 失败: %v", err)
+	}
+	settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+	if _, err := settingsService.SaveRelaySettings(RelaySettings{Capture: &CaptureSettings{
+		Rules:        []CaptureRule{{Provider: "healthy"}},
+		MaxBodyBytes: 64,
+		RedactEmails: true,
+	}}); err != nil {
+		t.Fatalf("保存设置失败: %v", err)
+	}
+	prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService}
+
+	c, recorder := newHedgeTestContext()
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`))
+	prs.proxyHandler("claude", "/v1/messages")(c)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("故障转移后应成功，实际状态码 %d", recorder.Code)
+	}
+
+	exchanges, err := NewLogService().GetCapturedExchanges(recorder.Header().Get(requestIDHeader))
+	if err != nil {
+		t.Fatalf("GetCapturedExchanges 失败: %v", err)
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("应捕获 2 次尝试，实际 %d", len(exchanges))
+	}
+
+	failed, succeeded := exchanges[0], exchanges[1]
+	if failed.Provider != "failing" || failed.Attempt != 1 || failed.HttpCode != http.StatusBadRequest {
+		t.Errorf("第 1 次尝试 = %s/%d/%d", failed.Provider, failed.Attempt, failed.HttpCode)
+	}
+	if !strings.Contains(failed.RequestBody, `"model":"claude-sonnet-4"`) {
+		t.Errorf("应捕获发往上游的请求体，实际 %q", failed.RequestBody)
+	}
+	if !strings.Contains(failed.ResponseBody, "bad input from [REDACTED]") {
+		t.Errorf("错误响应体应被捕获并脱敏邮箱，实际 %q", failed.ResponseBody)
+	}
+	for key, value := range failed.RequestHeaders {
+		if strings.Contains(value, "secret-key-1") {
+			t.Errorf("请求头 %s 未脱敏: %q", key, value)
+		}
+	}
+
+	if succeeded.Provider != "healthy" || succeeded.HttpCode != http.StatusOK {
+		t.Errorf("第 2 次尝试 = %s/%d", succeeded.Provider, succeeded.HttpCode)
+	}
+	if !succeeded.ResponseTruncated || len(succeeded.ResponseBody) != 64 || succeeded.ResponseSize <= 64 {
+		t.Errorf("响应体应截断到 64 字节：truncated=%v len=%d size=%d",
+			succeeded.ResponseTruncated, len(succeeded.ResponseBody), succeeded.ResponseSize)
+	}
+	if succeeded.ResponseHeaders["Content-Type"] != "application/json" {
+		t.Errorf("应捕获响应头，实际 %v", succeeded.ResponseHeaders)
+	}
+}
+
+func TestCapturedExchangeExpiry(t *testing.T) {
+	initTestRequestLogDB(t)
+
+	now := time.Now().UTC()
+	redactor := newBodyRedactor(CaptureSettings{})
+	for i, expiresAt := range []time.Time{now.Add(-time.Hour), now.Add(time.Hour)} {
+		if err := insertCapturedExchange(&CapturedExchange{
+			RequestID:   "csr_expiry",
+			Attempt:     i + 1,
+			RequestBody: "{}",
+			ExpiresAt:   expiresAt.Format(timeLayout),
+		}, redactor); err != nil {
+			t.Fatalf("insertCapturedExchange 失败: %v", err)
+		}
+	}
+
+	exchanges, err := NewLogService().GetCapturedExchanges("csr_expiry")
+	if err != nil {
+		t.Fatalf("GetCapturedExchanges 失败: %v", err)
+	}
+	if len(exchanges) != 1 || exchanges[0].Attempt != 2 {
+		t.Fatalf("过期的捕获不应返回，实际 %+v", exchanges)
+	}
+	if expected := now.Add(time.Hour).Format(timeLayout); exchanges[0].ExpiresAt != expected {
+		t.Errorf("expires_at = %q, 期望 %q", exchanges[0].ExpiresAt, expected)
+	}
+
+	removed, err := pruneCapturedExchanges(now)
+	if err != nil || removed != 1 {
+		t.Errorf("pruneCapturedExchanges = (%d, %v), 期望删除 1 条", removed, err)
+	}
+}
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	bodyRuleDelete = "delete" // 删除字段
+	bodyRuleSet    = "set"    // 设置字段值（不存在时创建）
+	bodyRuleRename = "rename" // 重命名字段（同级）
+	bodyRuleClamp  = "clamp"  // 将数值限制在 [min, max] 内
+)
+
+// BodyRule 请求体改写规则，按配置顺序在转发前执行
+// Path 使用 gjson/sjson 路径语法，"#" 表示数组中的每个元素，如 "messages.#.content.#.cache_control"
+type BodyRule struct {
+	Op     string          `json:"op"`               // delete / set / rename / clamp
+	Path   string          `json:"path"`             // 目标字段路径
+	Value  json.RawMessage `json:"value,omitempty"`  // set：写入的 JSON 值
+	To     string          `json:"to,omitempty"`     // rename：新的字段名
+	Min    *float64        `json:"min,omitempty"`    // clamp：下限
+	Max    *float64        `json:"max,omitempty"`    // clamp：上限
+	Models []string        `json:"models,omitempty"` // 仅对匹配的模型生效（支持通配符），空表示全部
+}
+
+// Validate 校验规则配置
+func (r BodyRule) Validate() error {
+	if strings.TrimSpace(r.Path) == "" {
+		return fmt.Errorf("path 不能为空")
+	}
+	switch strings.ToLower(r.Op) {
+	case bodyRuleDelete:
+	case bodyRuleSet:
+		if len(r.Value) == 0 || !json.Valid(r.Value) {
+			return fmt.Errorf("set 规则 '%s' 的 value 不是合法的 JSON", r.Path)
+		}
+	case bodyRuleRename:
+		if r.To == "" || strings.Contains(r.To, ".") {
+			return fmt.Errorf("rename 规则 '%s' 的 to 必须是同级字段名", r.Path)
+		}
+		if lastPathSegment(r.Path) == "#" {
+			return fmt.Errorf("rename 规则 '%s' 不能以数组通配结尾", r.Path)
+		}
+	case bodyRuleClamp:
+		if r.Min == nil && r.Max == nil {
+			return fmt.Errorf("clamp 规则 '%s' 至少需要 min 或 max", r.Path)
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return fmt.Errorf("clamp 规则 '%s' 的 min 不能大于 max", r.Path)
+		}
+	default:
+		return fmt.Errorf("未知的规则类型 '%s'（可选 delete / set / rename / clamp）", r.Op)
+	}
+	return nil
+}
+
+// appliesTo 判断规则是否对指定模型生效
+func (r BodyRule) appliesTo(model string) bool {
+	if len(r.Models) == 0 {
+		return true
+	}
+	for _, pattern := range r.Models {
+		if matchWildcard(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyBodyRules 按顺序对请求体执行 provider 的改写规则，model 为转发给上游的实际模型名
+func (p *Provider) ApplyBodyRules(model string, body []byte) ([]byte, error) {
+	if len(p.BodyRules) == 0 || len(body) == 0 {
+		return body, nil
+	}
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("invalid JSON body")
+	}
+
+	var err error
+	for i, rule := range p.BodyRules {
+		if !rule.appliesTo(model) {
+			continue
+		}
+		if body, err = rule.apply(body); err != nil {
+			return nil, fmt.Errorf("执行第 %d 条改写规则（%s %s）失败: %w", i+1, rule.Op, rule.Path, err)
+		}
+	}
+	return body, nil
+}
+
+func (r BodyRule) apply(body []byte) ([]byte, error) {
+	paths := expandBodyPath(body, r.Path)
+	var err error
+	switch strings.ToLower(r.Op) {
+	case bodyRuleDelete:
+		// 倒序删除，避免数组元素下标前移
+		for i := len(paths) - 1; i >= 0; i-- {
+			if !gjson.GetBytes(body, paths[i]).Exists() {
+				continue
+			}
+			if body, err = sjson.DeleteBytes(body, paths[i]); err != nil {
+				return nil, err
+			}
+		}
+	case bodyRuleSet:
+		for _, path := range paths {
+			if body, err = sjson.SetRawBytes(body, path, r.Value); err != nil {
+				return nil, err
+			}
+		}
+	case bodyRuleRename:
+		for _, path := range paths {
+			value := gjson.GetBytes(body, path)
+			if !value.Exists() {
+				continue
+			}
+			target := replaceLastPathSegment(path, r.To)
+			if body, err = sjson.SetRawBytes(body, target, []byte(value.Raw)); err != nil {
+				return nil, err
+			}
+			if body, err = sjson.DeleteBytes(body, path); err != nil {
+				return nil, err
+			}
+		}
+	case bodyRuleClamp:
+		for _, path := range paths {
+			value := gjson.GetBytes(body, path)
+			if value.Type != gjson.Number {
+				continue
+			}
+			clamped := value.Float()
+			if r.Min != nil {
+				clamped = math.Max(clamped, *r.Min)
+			}
+			if r.Max != nil {
+				clamped = math.Min(clamped, *r.Max)
+			}
+			if clamped == value.Float() {
+				continue
+			}
+			if body, err = sjson.SetBytes(body, path, clamped); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("未知的规则类型 '%s'", r.Op)
+	}
+	return body, nil
+}
+
+// expandBodyPath 将路径中的 "#" 展开为请求体中实际存在的数组下标
+func expandBodyPath(body []byte, path string) []string {
+	paths := []string{""}
+	for _, segment := range splitBodyPath(path) {
+		next := make([]string, 0, len(paths))
+		for _, prefix := range paths {
+			if segment != "#" {
+				next = append(next, joinBodyPath(prefix, segment))
+				continue
+			}
+			array := gjson.ParseBytes(body)
+			if prefix != "" {
+				array = gjson.GetBytes(body, prefix)
+			}
+			if !array.IsArray() {
+				continue
+			}
+			for i := range array.Array() {
+				next = append(next, joinBodyPath(prefix, strconv.Itoa(i)))
+			}
+		}
+		paths = next
+	}
+	return paths
+}
+
+// splitBodyPath 按 "." 切分路径，保留 "\." 转义
+func splitBodyPath(path string) []string {
+	segments := make([]string, 0, 4)
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path):
+			current.WriteByte(path[i])
+			current.WriteByte(path[i+1])
+			i++
+		case path[i] == '.':
+			segments = append(segments, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	return append(segments, current.String())
+}
+
+func joinBodyPath(prefix string, segment string) string {
+	if prefix == "" {
+		return segment
+	}
+	return prefix + "." + segment
+}
+
+func lastPathSegment(path string) string {
+	segments := splitBodyPath(path)
+	return segments[len(segments)-1]
+}
+
+func replaceLastPathSegment(path string, name string) string {
+	segments := splitBodyPath(path)
+	segments[len(segments)-1] = name
+	return strings.Join(segments, ".")
+}
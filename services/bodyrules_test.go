@@ -0,0 +1,168 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// ==================== 请求体改写规则测试 ====================
+
+func TestApplyBodyRules(t *testing.T) {
+	float := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name        string
+		rules       []BodyRule
+		model       string
+		inputJSON   string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:      "无规则保持原样",
+			inputJSON: `{"model":"claude-sonnet-4","max_tokens":1024}`,
+			expected:  `{"model":"claude-sonnet-4","max_tokens":1024}`,
+		},
+		{
+			name:      "删除顶层字段",
+			rules:     []BodyRule{{Op: "delete", Path: "metadata"}, {Op: "delete", Path: "context_management"}},
+			inputJSON: `{"model":"m","metadata":{"user_id":"u"},"context_management":{"edits":[]}}`,
+			expected:  `{"model":"m"}`,
+		},
+		{
+			name:      "删除不存在的字段",
+			rules:     []BodyRule{{Op: "delete", Path: "thinking"}},
+			inputJSON: `{"model":"m"}`,
+			expected:  `{"model":"m"}`,
+		},
+		{
+			name:  "通配删除嵌套 cache_control",
+			rules: []BodyRule{{Op: "delete", Path: "messages.#.content.#.cache_control"}, {Op: "delete", Path: "system.#.cache_control"}},
+			inputJSON: `{"system":[{"type":"text","text":"s","cache_control":{"type":"ephemeral"}}],` +
+				`"messages":[{"role":"user","content":[{"type":"text","text":"a","cache_control":{"type":"ephemeral"}},{"type":"text","text":"b"}]},` +
+				`{"role":"assistant","content":"plain"}]}`,
+			expected: `{"system":[{"type":"text","text":"s"}],` +
+				`"messages":[{"role":"user","content":[{"type":"text","text":"a"},{"type":"text","text":"b"}]},` +
+				`{"role":"assistant","content":"plain"}]}`,
+		},
+		{
+			name:      "通配删除数组元素",
+			rules:     []BodyRule{{Op: "delete", Path: "betas.#"}},
+			inputJSON: `{"betas":["a","b","c"]}`,
+			expected:  `{"betas":[]}`,
+		},
+		{
+			name:      "设置字段值",
+			rules:     []BodyRule{{Op: "set", Path: "temperature", Value: json.RawMessage(`0.2`)}, {Op: "set", Path: "metadata.source", Value: json.RawMessage(`"relay"`)}},
+			inputJSON: `{"model":"m"}`,
+			expected:  `{"model":"m","temperature":0.2,"metadata":{"source":"relay"}}`,
+		},
+		{
+			name:      "重命名字段",
+			rules:     []BodyRule{{Op: "rename", Path: "max_tokens", To: "max_output_tokens"}},
+			inputJSON: `{"model":"m","max_tokens":4096}`,
+			expected:  `{"model":"m","max_output_tokens":4096}`,
+		},
+		{
+			name:      "限制数值上限",
+			rules:     []BodyRule{{Op: "clamp", Path: "max_tokens", Max: float(8192)}},
+			inputJSON: `{"max_tokens":32000}`,
+			expected:  `{"max_tokens":8192}`,
+		},
+		{
+			name:      "限制数值下限",
+			rules:     []BodyRule{{Op: "clamp", Path: "thinking.budget_tokens", Min: float(1024), Max: float(4096)}},
+			inputJSON: `{"thinking":{"type":"enabled","budget_tokens":100}}`,
+			expected:  `{"thinking":{"type":"enabled","budget_tokens":1024}}`,
+		},
+		{
+			name:      "按模型条件生效",
+			rules:     []BodyRule{{Op: "delete", Path: "thinking", Models: []string{"claude-3-5-haiku*"}}},
+			model:     "claude-3-5-haiku",
+			inputJSON: `{"thinking":{"type":"enabled"}}`,
+			expected:  `{}`,
+		},
+		{
+			name:      "模型不匹配时跳过",
+			rules:     []BodyRule{{Op: "delete", Path: "thinking", Models: []string{"claude-3-5-haiku*"}}},
+			model:     "claude-sonnet-4",
+			inputJSON: `{"thinking":{"type":"enabled"}}`,
+			expected:  `{"thinking":{"type":"enabled"}}`,
+		},
+		{
+			name:      "规则按顺序执行",
+			rules:     []BodyRule{{Op: "rename", Path: "max_tokens", To: "limit"}, {Op: "clamp", Path: "limit", Max: float(10)}},
+			inputJSON: `{"max_tokens":100}`,
+			expected:  `{"limit":10}`,
+		},
+		{
+			name:        "非法 JSON",
+			rules:       []BodyRule{{Op: "delete", Path: "metadata"}},
+			inputJSON:   `{invalid`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := Provider{Name: "test", BodyRules: tt.rules}
+			result, err := provider.ApplyBodyRules(tt.model, []byte(tt.inputJSON))
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("期望返回错误，但没有错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("不期望错误，但返回了: %v", err)
+			}
+
+			var got, want interface{}
+			if err := json.Unmarshal(result, &got); err != nil {
+				t.Fatalf("结果不是合法 JSON: %v (%s)", err, result)
+			}
+			if err := json.Unmarshal([]byte(tt.expected), &want); err != nil {
+				t.Fatalf("期望值不是合法 JSON: %v", err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("结果 = %s, 期望 %s", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBodyRuleValidate(t *testing.T) {
+	max := 10.0
+	min := 20.0
+
+	tests := []struct {
+		name      string
+		rule      BodyRule
+		expectErr bool
+	}{
+		{"delete", BodyRule{Op: "delete", Path: "metadata"}, false},
+		{"set", BodyRule{Op: "set", Path: "a", Value: json.RawMessage(`1`)}, false},
+		{"rename", BodyRule{Op: "rename", Path: "a", To: "b"}, false},
+		{"clamp", BodyRule{Op: "clamp", Path: "a", Max: &max}, false},
+		{"空路径", BodyRule{Op: "delete"}, true},
+		{"未知规则", BodyRule{Op: "move", Path: "a"}, true},
+		{"set 缺少 value", BodyRule{Op: "set", Path: "a"}, true},
+		{"rename 目标包含路径", BodyRule{Op: "rename", Path: "a", To: "b.c"}, true},
+		{"clamp 缺少范围", BodyRule{Op: "clamp", Path: "a"}, true},
+		{"clamp min 大于 max", BodyRule{Op: "clamp", Path: "a", Min: &min, Max: &max}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if tt.expectErr && err == nil {
+				t.Errorf("期望返回错误，但没有错误")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("不期望错误，但返回了: %v", err)
+			}
+		})
+	}
+}
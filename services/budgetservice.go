@@ -0,0 +1,359 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	modelpricing "codeswitch/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+const (
+	budgetPeriodDaily   = "daily"
+	budgetPeriodWeekly  = "weekly"
+	budgetPeriodMonthly = "monthly"
+
+	budgetActionNotify  = "notify"  // 软上限：仅通知
+	budgetActionReroute = "reroute" // 软上限：优先使用更便宜的 provider
+
+	// 预算花费缓存时间，避免每个请求都扫描 request_log
+	budgetSpendCacheTTL = 15 * time.Second
+)
+
+// Budget 花费预算，按平台、provider、模型（支持通配符）限定范围，金额单位为美元
+type Budget struct {
+	Name       string  `json:"name"`
+	Enabled    bool    `json:"enabled"`
+	Period     string  `json:"period"`               // daily / weekly / monthly
+	Platform   string  `json:"platform,omitempty"`   // 空表示所有平台
+	Provider   string  `json:"provider,omitempty"`   // 空表示所有 provider
+	Model      string  `json:"model,omitempty"`      // 空表示所有模型，支持 "claude-opus-*"
+	SoftLimit  float64 `json:"softLimit,omitempty"`  // 软上限，0 表示不设置
+	HardLimit  float64 `json:"hardLimit,omitempty"`  // 硬上限，0 表示不设置
+	SoftAction string  `json:"softAction,omitempty"` // notify / reroute，默认 notify
+}
+
+// BudgetStatus 预算当前周期的使用情况
+type BudgetStatus struct {
+	Budget      Budget  `json:"budget"`
+	PeriodStart string  `json:"period_start"`
+	Spent       float64 `json:"spent"`
+	SoftReached bool    `json:"soft_reached"`
+	HardReached bool    `json:"hard_reached"`
+}
+
+// BudgetAlert 预算软上限触发时的通知内容
+type BudgetAlert struct {
+	Budget  string  `json:"budget"`
+	Period  string  `json:"period"`
+	Spent   float64 `json:"spent"`
+	Limit   float64 `json:"limit"`
+	Action  string  `json:"action"`
+	Message string  `json:"message"`
+}
+
+// Validate 校验预算配置
+func (b Budget) Validate() []string {
+	errs := make([]string, 0)
+	switch strings.ToLower(b.Period) {
+	case budgetPeriodDaily, budgetPeriodWeekly, budgetPeriodMonthly:
+	default:
+		errs = append(errs, fmt.Sprintf("预算 '%s' 的周期 '%s' 无效（可选 daily / weekly / monthly）", b.Name, b.Period))
+	}
+	if b.SoftLimit < 0 || b.HardLimit < 0 {
+		errs = append(errs, fmt.Sprintf("预算 '%s' 的上限不能为负数", b.Name))
+	}
+	if b.SoftLimit > 0 && b.HardLimit > 0 && b.SoftLimit > b.HardLimit {
+		errs = append(errs, fmt.Sprintf("预算 '%s' 的软上限不能高于硬上限", b.Name))
+	}
+	switch strings.ToLower(b.SoftAction) {
+	case "", budgetActionNotify, budgetActionReroute:
+	default:
+		errs = append(errs, fmt.Sprintf("预算 '%s' 的软上限动作 '%s' 无效（可选 notify / reroute）", b.Name, b.SoftAction))
+	}
+	return errs
+}
+
+// PeriodStart 返回 now 所在预算周期的起始时间（本地时区，周从周一开始）
+func (b Budget) PeriodStart(now time.Time) time.Time {
+	day := startOfDay(now)
+	switch strings.ToLower(b.Period) {
+	case budgetPeriodWeekly:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case budgetPeriodMonthly:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+	default:
+		return day
+	}
+}
+
+// matches 判断一次请求是否落在预算范围内
+func (b Budget) matches(kind string, provider string, model string) bool {
+	if b.Platform != "" && !strings.EqualFold(b.Platform, kind) {
+		return false
+	}
+	if b.Provider != "" && !matchWildcard(b.Provider, provider) {
+		return false
+	}
+	if b.Model != "" && !matchWildcard(b.Model, model) {
+		return false
+	}
+	return true
+}
+
+func (b Budget) cacheKey(periodStart time.Time) string {
+	return strings.Join([]string{b.Name, b.Period, b.Platform, b.Provider, b.Model, periodStart.Format(timeLayout)}, "|")
+}
+
+type budgetSpend struct {
+	amount    float64
+	updatedAt time.Time
+}
+
+type BudgetService struct {
+	settings *RelaySettingsService
+	pricing  *modelpricing.Service
+
+	mu       sync.Mutex
+	spends   map[string]budgetSpend
+	notified map[string]bool
+	notifier func(BudgetAlert)
+}
+
+func NewBudgetService(settings *RelaySettingsService) *BudgetService {
+	svc, err := modelpricing.DefaultService()
+	if err != nil {
+		log.Printf("pricing service init failed: %v", err)
+	}
+	return &BudgetService{
+		settings: settings,
+		pricing:  svc,
+		spends:   make(map[string]budgetSpend),
+		notified: make(map[string]bool),
+	}
+}
+
+// SetNotifier 设置软上限触发时的通知回调
+func (bs *BudgetService) SetNotifier(notifier func(BudgetAlert)) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.notifier = notifier
+}
+
+// BudgetStatus 返回所有启用预算在当前周期的花费
+func (bs *BudgetService) BudgetStatus() ([]BudgetStatus, error) {
+	settings, err := bs.settings.GetRelaySettings()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	statuses := make([]BudgetStatus, 0, len(settings.Budgets))
+	for _, budget := range settings.Budgets {
+		if !budget.Enabled {
+			continue
+		}
+		periodStart := budget.PeriodStart(now)
+		spent, err := bs.querySpend(budget, periodStart)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, budget.status(periodStart, spent))
+	}
+	return statuses, nil
+}
+
+func (b Budget) status(periodStart time.Time, spent float64) BudgetStatus {
+	return BudgetStatus{
+		Budget:      b,
+		PeriodStart: periodStart.Format(timeLayout),
+		Spent:       spent,
+		SoftReached: b.SoftLimit > 0 && spent >= b.SoftLimit,
+		HardReached: b.HardLimit > 0 && spent >= b.HardLimit,
+	}
+}
+
+// budgetDecision 预算检查结果
+type budgetDecision struct {
+	providers []Provider
+	blockedBy *BudgetStatus // 所有候选都被硬上限拦截时的预算
+}
+
+// apply 按预算过滤候选 provider：命中硬上限的跳过，命中 reroute 软上限的
+// 移到队尾并按模型单价从低到高排列
+func (bs *BudgetService) apply(kind string, requestedModel string, providers []Provider, budgets []Budget) budgetDecision {
+	decision := budgetDecision{providers: providers}
+	if bs == nil || len(budgets) == 0 {
+		return decision
+	}
+
+	now := time.Now()
+	preferred := make([]Provider, 0, len(providers))
+	rerouted := make([]Provider, 0)
+	for _, provider := range providers {
+		model := provider.GetEffectiveModel(requestedModel)
+		blocked, reroute := false, false
+		for _, budget := range budgets {
+			if !budget.Enabled || !budget.matches(kind, provider.Name, model) {
+				continue
+			}
+			periodStart := budget.PeriodStart(now)
+			spent, err := bs.cachedSpend(budget, periodStart)
+			if err != nil {
+				fmt.Printf("[WARN] 计算预算 %s 花费失败: %v\n", budget.Name, err)
+				continue
+			}
+			status := budget.status(periodStart, spent)
+			if status.HardReached {
+				fmt.Printf("[WARN] Provider %s 触发预算 %s 硬上限（$%.4f / $%.2f），已跳过\n",
+					provider.Name, budget.Name, spent, budget.HardLimit)
+				blocked = true
+				decision.blockedBy = &status
+				break
+			}
+			if status.SoftReached {
+				bs.notify(budget, status)
+				if strings.EqualFold(budget.SoftAction, budgetActionReroute) {
+					reroute = true
+				}
+			}
+		}
+		switch {
+		case blocked:
+		case reroute:
+			rerouted = append(rerouted, provider)
+		default:
+			preferred = append(preferred, provider)
+		}
+	}
+
+	sort.SliceStable(rerouted, func(i, j int) bool {
+		return bs.unitPrice(rerouted[i].GetEffectiveModel(requestedModel)) <
+			bs.unitPrice(rerouted[j].GetEffectiveModel(requestedModel))
+	})
+	decision.providers = append(preferred, rerouted...)
+	if len(decision.providers) > 0 {
+		decision.blockedBy = nil
+	}
+	return decision
+}
+
+// unitPrice 模型的输入 + 输出单价，用于 reroute 时比较便宜程度
+func (bs *BudgetService) unitPrice(model string) float64 {
+	if bs.pricing == nil {
+		return 0
+	}
+	cost := bs.pricing.CalculateCost(model, modelpricing.UsageSnapshot{InputTokens: 1, OutputTokens: 1})
+	return cost.TotalCost
+}
+
+func (bs *BudgetService) notify(budget Budget, status BudgetStatus) {
+	key := budget.cacheKey(budget.PeriodStart(time.Now()))
+
+	bs.mu.Lock()
+	if bs.notified[key] {
+		bs.mu.Unlock()
+		return
+	}
+	bs.notified[key] = true
+	notifier := bs.notifier
+	bs.mu.Unlock()
+
+	action := budget.SoftAction
+	if action == "" {
+		action = budgetActionNotify
+	}
+	alert := BudgetAlert{
+		Budget:  budget.Name,
+		Period:  budget.Period,
+		Spent:   status.Spent,
+		Limit:   budget.SoftLimit,
+		Action:  action,
+		Message: fmt.Sprintf("预算 %s 已达到软上限：$%.4f / $%.2f", budget.Name, status.Spent, budget.SoftLimit),
+	}
+	fmt.Printf("[WARN] %s\n", alert.Message)
+	if notifier != nil {
+		notifier(alert)
+	}
+}
+
+func (bs *BudgetService) cachedSpend(budget Budget, periodStart time.Time) (float64, error) {
+	key := budget.cacheKey(periodStart)
+	bs.mu.Lock()
+	cached, ok := bs.spends[key]
+	bs.mu.Unlock()
+	if ok && time.Since(cached.updatedAt) < budgetSpendCacheTTL {
+		return cached.amount, nil
+	}
+
+	amount, err := bs.querySpend(budget, periodStart)
+	if err != nil {
+		return 0, err
+	}
+	bs.mu.Lock()
+	bs.spends[key] = budgetSpend{amount: amount, updatedAt: time.Now()}
+	bs.mu.Unlock()
+	return amount, nil
+}
+
+// querySpend 按模型分组汇总 request_log 的 token 用量并计算费用；
+// 已启用预算当前周期内的原始日志不会被清理（见 pruneRequestLogs）
+func (bs *BudgetService) querySpend(budget Budget, periodStart time.Time) (float64, error) {
+	options := []xdb.Option{
+		// created_at 由 SQLite CURRENT_TIMESTAMP 写入，为 UTC 时间
+		xdb.WhereGte("created_at", periodStart.UTC().Format(timeLayout)),
+		xdb.Field(
+			"provider",
+			"model",
+			"SUM(input_tokens) as input_tokens",
+			"SUM(output_tokens) as output_tokens",
+			"SUM(cache_create_tokens) as cache_create_tokens",
+			"SUM(cache_read_tokens) as cache_read_tokens",
+			"SUM(cache_create_5m_tokens) as cache_create_5m_tokens",
+			"SUM(cache_create_1h_tokens) as cache_create_1h_tokens",
+		),
+		xdb.GroupBy("provider, model"),
+	}
+	if budget.Platform != "" {
+		options = append(options, xdb.WhereEq("platform", strings.ToLower(budget.Platform)))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	total := 0.0
+	for _, record := range records {
+		model := record.GetString("model")
+		if budget.Provider != "" && !matchWildcard(budget.Provider, record.GetString("provider")) {
+			continue
+		}
+		if budget.Model != "" && !matchWildcard(budget.Model, model) {
+			continue
+		}
+		if bs.pricing == nil {
+			continue
+		}
+		cost := bs.pricing.CalculateCost(model, modelpricing.UsageSnapshot{
+			InputTokens:       record.GetInt("input_tokens"),
+			OutputTokens:      record.GetInt("output_tokens"),
+			CacheCreateTokens: record.GetInt("cache_create_tokens"),
+			CacheReadTokens:   record.GetInt("cache_read_tokens"),
+			CacheCreation: cacheCreationDetail(
+				record.GetInt("cache_create_5m_tokens"),
+				record.GetInt("cache_create_1h_tokens"),
+			),
+		})
+		total += cost.TotalCost
+	}
+	return total, nil
+}
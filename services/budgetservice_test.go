@@ -0,0 +1,151 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// ==================== 预算周期测试 ====================
+
+func TestBudgetPeriodStart(t *testing.T) {
+	// 2025-06-18 是周三
+	now := time.Date(2025, 6, 18, 15, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		period   string
+		expected time.Time
+	}{
+		{"daily", time.Date(2025, 6, 18, 0, 0, 0, 0, time.Local)},
+		{"weekly", time.Date(2025, 6, 16, 0, 0, 0, 0, time.Local)},
+		{"monthly", time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			start := Budget{Period: tt.period}.PeriodStart(now)
+			if !start.Equal(tt.expected) {
+				t.Errorf("PeriodStart(%s) = %v, 期望 %v", tt.period, start, tt.expected)
+			}
+		})
+	}
+
+	sunday := time.Date(2025, 6, 22, 23, 0, 0, 0, time.Local)
+	if start := (Budget{Period: "weekly"}).PeriodStart(sunday); start.Day() != 16 {
+		t.Errorf("周日应归属于本周一开始的周期，实际 %v", start)
+	}
+}
+
+// ==================== 预算范围匹配测试 ====================
+
+func TestBudgetMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		budget   Budget
+		kind     string
+		provider string
+		model    string
+		expected bool
+	}{
+		{"全局预算", Budget{}, "claude", "A", "claude-opus-4", true},
+		{"平台匹配", Budget{Platform: "claude"}, "claude", "A", "claude-opus-4", true},
+		{"平台不匹配", Budget{Platform: "codex"}, "claude", "A", "claude-opus-4", false},
+		{"provider 匹配", Budget{Provider: "A"}, "claude", "A", "claude-opus-4", true},
+		{"provider 不匹配", Budget{Provider: "A"}, "claude", "B", "claude-opus-4", false},
+		{"模型通配符匹配", Budget{Model: "claude-opus-*"}, "claude", "A", "claude-opus-4", true},
+		{"模型通配符不匹配", Budget{Model: "claude-opus-*"}, "claude", "A", "claude-sonnet-4", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.budget.matches(tt.kind, tt.provider, tt.model); got != tt.expected {
+				t.Errorf("matches(%q, %q, %q) = %v, 期望 %v", tt.kind, tt.provider, tt.model, got, tt.expected)
+			}
+		})
+	}
+}
+
+// ==================== 预算拦截与改道测试 ====================
+
+func TestBudgetServiceApply(t *testing.T) {
+	newService := func(budgets []Budget, spent map[string]float64) *BudgetService {
+		bs := &BudgetService{spends: map[string]budgetSpend{}, notified: map[string]bool{}}
+		for _, budget := range budgets {
+			key := budget.cacheKey(budget.PeriodStart(time.Now()))
+			bs.spends[key] = budgetSpend{amount: spent[budget.Name], updatedAt: time.Now()}
+		}
+		return bs
+	}
+	providers := []Provider{{Name: "A"}, {Name: "B"}, {Name: "C"}}
+	names := func(list []Provider) []string {
+		result := make([]string, 0, len(list))
+		for _, p := range list {
+			result = append(result, p.Name)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name          string
+		budgets       []Budget
+		spent         map[string]float64
+		expected      []string
+		expectBlocked bool
+	}{
+		{
+			name:     "未超限",
+			budgets:  []Budget{{Name: "all", Enabled: true, Period: "daily", HardLimit: 10}},
+			spent:    map[string]float64{"all": 1},
+			expected: []string{"A", "B", "C"},
+		},
+		{
+			name:     "provider 硬上限跳过",
+			budgets:  []Budget{{Name: "a", Enabled: true, Period: "daily", Provider: "A", HardLimit: 10}},
+			spent:    map[string]float64{"a": 10},
+			expected: []string{"B", "C"},
+		},
+		{
+			name:          "全局硬上限拒绝",
+			budgets:       []Budget{{Name: "all", Enabled: true, Period: "daily", HardLimit: 10}},
+			spent:         map[string]float64{"all": 12},
+			expected:      []string{},
+			expectBlocked: true,
+		},
+		{
+			name:     "软上限 reroute 移到队尾",
+			budgets:  []Budget{{Name: "a", Enabled: true, Period: "daily", Provider: "A", SoftLimit: 5, SoftAction: "reroute"}},
+			spent:    map[string]float64{"a": 6},
+			expected: []string{"B", "C", "A"},
+		},
+		{
+			name:     "软上限 notify 不改变顺序",
+			budgets:  []Budget{{Name: "a", Enabled: true, Period: "daily", Provider: "A", SoftLimit: 5}},
+			spent:    map[string]float64{"a": 6},
+			expected: []string{"A", "B", "C"},
+		},
+		{
+			name:     "未启用的预算不生效",
+			budgets:  []Budget{{Name: "all", Enabled: false, Period: "daily", HardLimit: 10}},
+			spent:    map[string]float64{"all": 12},
+			expected: []string{"A", "B", "C"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := newService(tt.budgets, tt.spent)
+			decision := bs.apply("claude", "claude-sonnet-4", providers, tt.budgets)
+			got := names(decision.providers)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("providers = %v, 期望 %v", got, tt.expected)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Fatalf("providers = %v, 期望 %v", got, tt.expected)
+				}
+			}
+			if (decision.blockedBy != nil) != tt.expectBlocked {
+				t.Errorf("blockedBy = %v, 期望拦截 %v", decision.blockedBy, tt.expectBlocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip     = "gzip"
+	encodingDeflate  = "deflate"
+	encodingBrotli   = "br"
+	encodingZstd     = "zstd"
+	encodingIdentity = "identity"
+
+	// 发往上游的 Accept-Encoding，由中转自行解压，不再透传客户端的值
+	upstreamAcceptEncoding = "gzip, br, zstd"
+)
+
+// 重新压缩返回给客户端时的优先顺序
+var clientEncodingPreference = []string{encodingZstd, encodingBrotli, encodingGzip}
+
+// decodeResponseBody 按 Content-Encoding 解压上游响应体，使用量解析、错误归一化等钩子都能读到明文；
+// 解压后删除 Content-Encoding 与 Content-Length，遇到不支持的编码时保持原样并返回错误
+func decodeResponseBody(resp *http.Response) error {
+	if resp == nil || resp.Body == nil {
+		return nil
+	}
+	encodings := parseContentEncoding(resp.Header.Get("Content-Encoding"))
+	if len(encodings) == 0 {
+		return nil
+	}
+	for _, encoding := range encodings {
+		if !supportedEncoding(encoding) {
+			return fmt.Errorf("不支持的响应编码 '%s'", encoding)
+		}
+	}
+
+	body := &decodedBody{source: resp.Body}
+	var reader io.Reader = resp.Body
+	// 多重编码按应用顺序列出，解压时倒序处理
+	for i := len(encodings) - 1; i >= 0; i-- {
+		reader = &lazyDecoder{source: reader, encoding: encodings[i], body: body}
+	}
+	body.reader = reader
+
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+func parseContentEncoding(value string) []string {
+	encodings := make([]string, 0, 1)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" || item == encodingIdentity {
+			continue
+		}
+		encodings = append(encodings, item)
+	}
+	return encodings
+}
+
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case encodingGzip, "x-gzip", encodingDeflate, encodingBrotli, encodingZstd:
+		return true
+	}
+	return false
+}
+
+// decodedBody 解压后的响应体，关闭时一并释放各层解码器
+type decodedBody struct {
+	source  io.ReadCloser
+	reader  io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		_ = b.closers[i].Close()
+	}
+	return b.source.Close()
+}
+
+// lazyDecoder 在首次读取时才创建解码器：gzip 等解码器创建时就会读取头部，
+// 推迟到读取阶段可以让空响应体或连接错误按普通读取错误处理
+type lazyDecoder struct {
+	source   io.Reader
+	encoding string
+	body     *decodedBody
+	reader   io.Reader
+	err      error
+}
+
+func (d *lazyDecoder) Read(p []byte) (int, error) {
+	if d.reader == nil && d.err == nil {
+		d.reader, d.err = d.open()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.reader.Read(p)
+}
+
+func (d *lazyDecoder) open() (io.Reader, error) {
+	switch d.encoding {
+	case encodingGzip, "x-gzip":
+		reader, err := gzip.NewReader(d.source)
+		if err != nil {
+			return nil, fmt.Errorf("解压 gzip 响应失败: %w", err)
+		}
+		d.body.closers = append(d.body.closers, reader)
+		return reader, nil
+	case encodingDeflate:
+		reader := flate.NewReader(d.source)
+		d.body.closers = append(d.body.closers, reader)
+		return reader, nil
+	case encodingBrotli:
+		return brotli.NewReader(d.source), nil
+	case encodingZstd:
+		decoder, err := zstd.NewReader(d.source, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("解压 zstd 响应失败: %w", err)
+		}
+		reader := decoder.IOReadCloser()
+		d.body.closers = append(d.body.closers, reader)
+		return reader, nil
+	default:
+		return nil, fmt.Errorf("不支持的响应编码 '%s'", d.encoding)
+	}
+}
+
+// negotiateClientEncoding 根据客户端 Accept-Encoding 选择重新压缩的编码，不接受压缩时返回空
+func negotiateClientEncoding(acceptEncoding string) string {
+	accepted := make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = q
+			}
+		}
+		accepted[name] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range clientEncodingPreference {
+		quality, ok := accepted[encoding]
+		if !ok {
+			quality, ok = accepted["*"]
+		}
+		if ok && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressResponseWriter 按协商的编码压缩写回客户端的响应体，仅用于非流式响应
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	encoder  io.WriteCloser
+}
+
+func newCompressResponseWriter(w http.ResponseWriter, encoding string) *compressResponseWriter {
+	return &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+}
+
+func (w *compressResponseWriter) WriteHeader(statusCode int) {
+	if w.encoder != nil {
+		return
+	}
+	switch w.encoding {
+	case encodingZstd:
+		if encoder, err := zstd.NewWriter(w.ResponseWriter, zstd.WithEncoderConcurrency(1)); err == nil {
+			w.encoder = encoder
+		} else {
+			w.encoding, w.encoder = encodingGzip, gzip.NewWriter(w.ResponseWriter)
+		}
+	case encodingBrotli:
+		w.encoder = brotli.NewWriter(w.ResponseWriter)
+	default:
+		w.encoding, w.encoder = encodingGzip, gzip.NewWriter(w.ResponseWriter)
+	}
+
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", w.encoding)
+	header.Add("Vary", "Accept-Encoding")
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if w.encoder == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.encoder.Write(p)
+}
+
+// Close 写出压缩尾部，必须在响应写完后调用
+func (w *compressResponseWriter) Close() error {
+	if w.encoder == nil {
+		return nil
+	}
+	return w.encoder.Close()
+}
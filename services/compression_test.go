@@ -0,0 +1,239 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ==================== 响应压缩测试 ====================
+
+func compressBytes(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case encodingGzip:
+		writer = gzip.NewWriter(&buf)
+	case encodingBrotli:
+		writer = brotli.NewWriter(&buf)
+	case encodingZstd:
+		encoder, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("创建 zstd 编码器失败: %v", err)
+		}
+		writer = encoder
+	default:
+		t.Fatalf("未知编码 %s", encoding)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("压缩失败: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("压缩失败: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decompressBytes(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": []string{encoding}},
+		Body:   io.NopCloser(bytes.NewReader(data)),
+	}
+	if err := decodeResponseBody(resp); err != nil {
+		t.Fatalf("解压失败: %v", err)
+	}
+	plain, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("读取解压后的响应失败: %v", err)
+	}
+	return plain
+}
+
+func TestDecodeResponseBody(t *testing.T) {
+	plain := []byte(`{"usage":{"input_tokens":10,"output_tokens":20}}`)
+
+	for _, encoding := range []string{encodingGzip, encodingBrotli, encodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{
+					"Content-Encoding": []string{encoding},
+					"Content-Length":   []string{"123"},
+				},
+				Body: io.NopCloser(bytes.NewReader(compressBytes(t, encoding, plain))),
+			}
+			if err := decodeResponseBody(resp); err != nil {
+				t.Fatalf("decodeResponseBody 失败: %v", err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("读取失败: %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("解压结果 = %s, 期望 %s", got, plain)
+			}
+			if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" {
+				t.Errorf("解压后应删除 Content-Encoding 与 Content-Length，实际 %v", resp.Header)
+			}
+			_ = resp.Body.Close()
+		})
+	}
+
+	t.Run("多重编码", func(t *testing.T) {
+		data := compressBytes(t, encodingBrotli, compressBytes(t, encodingGzip, plain))
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{"gzip, br"}},
+			Body:   io.NopCloser(bytes.NewReader(data)),
+		}
+		if err := decodeResponseBody(resp); err != nil {
+			t.Fatalf("decodeResponseBody 失败: %v", err)
+		}
+		if got, _ := io.ReadAll(resp.Body); !bytes.Equal(got, plain) {
+			t.Errorf("解压结果 = %s, 期望 %s", got, plain)
+		}
+	})
+
+	t.Run("不支持的编码保持原样", func(t *testing.T) {
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{"compress"}},
+			Body:   io.NopCloser(bytes.NewReader(plain)),
+		}
+		if err := decodeResponseBody(resp); err == nil {
+			t.Errorf("不支持的编码应返回错误")
+		}
+		if resp.Header.Get("Content-Encoding") != "compress" {
+			t.Errorf("不支持的编码不应删除 Content-Encoding")
+		}
+	})
+}
+
+func TestNegotiateClientEncoding(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip, deflate", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, br, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, gzip;q=0.8", "gzip"},
+		{"*", "zstd"},
+	}
+	for _, tt := range tests {
+		if got := negotiateClientEncoding(tt.accept); got != tt.expected {
+			t.Errorf("negotiateClientEncoding(%q) = %q, 期望 %q", tt.accept, got, tt.expected)
+		}
+	}
+}
+
+func TestWriteUpstreamResponseCompressed(t *testing.T) {
+	stream := strings.Join([]string{
+		"event: message_start",
+		`data: {"type":"message_start","message":{"usage":{"input_tokens":100,"output_tokens":1}}}`,
+		"",
+		"event: message_delta",
+		`data: {"type":"message_delta","usage":{"output_tokens":42}}`,
+		"",
+		"",
+	}, "\n")
+	body := `{"type":"message","usage":{"input_tokens":7,"output_tokens":8}}`
+
+	tests := []struct {
+		name           string
+		isStream       bool
+		contentType    string
+		upstream       string
+		clientAccept   string
+		compress       bool
+		expectEncoding string
+		expectInput    int
+		expectOutput   int
+	}{
+		{
+			name:         "gzip 流式响应解压后解析用量",
+			isStream:     true,
+			contentType:  "text/event-stream",
+			upstream:     encodingGzip,
+			clientAccept: "gzip",
+			compress:     true,
+			expectInput:  100,
+			expectOutput: 42,
+		},
+		{
+			name:         "zstd 非流式响应",
+			contentType:  "application/json",
+			upstream:     encodingZstd,
+			expectInput:  7,
+			expectOutput: 8,
+		},
+		{
+			name:           "br 非流式响应按客户端重新压缩",
+			contentType:    "application/json",
+			upstream:       encodingBrotli,
+			clientAccept:   "gzip, br",
+			compress:       true,
+			expectEncoding: encodingBrotli,
+			expectInput:    7,
+			expectOutput:   8,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := body
+			if tt.isStream {
+				plain = stream
+			}
+			var acceptEncoding string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Encoding", tt.upstream)
+				_, _ = w.Write(compressBytes(t, tt.upstream, []byte(plain)))
+			}))
+			defer upstream.Close()
+
+			prs := &ProviderRelayService{}
+			candidate := relayCandidate{provider: Provider{Name: "p", APIURL: upstream.URL, APIKey: "key"}, model: "claude-sonnet-4"}
+			attempt := prs.sendUpstream(context.Background(), "claude", "/v1/messages", nil, map[string]string{"Accept-Encoding": "identity"}, tt.isStream, candidate)
+			defer attempt.finish()
+			if acceptEncoding != upstreamAcceptEncoding {
+				t.Errorf("上游收到的 Accept-Encoding = %q, 期望 %q", acceptEncoding, upstreamAcceptEncoding)
+			}
+
+			c, recorder := newHedgeTestContext()
+			c.Request.Header.Set("Accept-Encoding", tt.clientAccept)
+			c.Set(compressResponsesKey, tt.compress)
+			ok, err := prs.writeUpstreamResponse(c, "claude", attempt)
+			if !ok || err != nil {
+				t.Fatalf("写回响应失败: ok=%v err=%v", ok, err)
+			}
+
+			if attempt.log.InputTokens != tt.expectInput || attempt.log.OutputTokens != tt.expectOutput {
+				t.Errorf("用量 = %d/%d, 期望 %d/%d", attempt.log.InputTokens, attempt.log.OutputTokens, tt.expectInput, tt.expectOutput)
+			}
+
+			got := recorder.Body.Bytes()
+			if encoding := recorder.Header().Get("Content-Encoding"); encoding != tt.expectEncoding {
+				t.Fatalf("返回客户端的 Content-Encoding = %q, 期望 %q", encoding, tt.expectEncoding)
+			}
+			if tt.expectEncoding != "" {
+				got = decompressBytes(t, tt.expectEncoding, got)
+			}
+			if string(got) != plain {
+				t.Errorf("返回客户端的响应体 = %q, 期望 %q", got, plain)
+			}
+		})
+	}
+}
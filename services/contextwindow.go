@@ -0,0 +1,95 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	modelpricing "codeswitch/resources/model-pricing"
+
+	"github.com/tidwall/gjson"
+)
+
+// ProviderContextLimits 覆盖模型的上下文窗口限制，用于上限低于官方的转售渠道
+type ProviderContextLimits struct {
+	MaxInputTokens  int `json:"maxInputTokens,omitempty"`  // 0 表示使用模型价格表中的值
+	MaxOutputTokens int `json:"maxOutputTokens,omitempty"` // 0 表示使用模型价格表中的值
+}
+
+// Validate 校验上下文限制配置
+func (l ProviderContextLimits) Validate() []string {
+	if l.MaxInputTokens < 0 || l.MaxOutputTokens < 0 {
+		return []string{"上下文限制不能为负数"}
+	}
+	return nil
+}
+
+const (
+	// 本地估算与上游 tokenizer 存在偏差，估算值超出输入上限的部分在该比例以内时仍然放行，由上游判断
+	contextEstimateTolerance = 0.1
+
+	// 客户端通过 anthropic-beta 开启 1M 上下文（如 context-1m-2025-08-07）后的输入上限
+	context1mBetaPrefix  = "context-1m-"
+	context1mInputTokens = 1000000
+)
+
+// requestSize 请求的输入规模与客户端要求的输出上限
+type requestSize struct {
+	inputTokens     int
+	maxOutputTokens int
+	context1mBeta   string // 客户端请求的 context-1m beta 标记，未开启时为空
+}
+
+// findContext1mBeta 从逗号分隔的 anthropic-beta 中找出 context-1m 标记
+func findContext1mBeta(betas string) string {
+	for _, flag := range strings.Split(betas, ",") {
+		if flag = strings.TrimSpace(flag); strings.HasPrefix(flag, context1mBetaPrefix) {
+			return flag
+		}
+	}
+	return ""
+}
+
+// measureRequest 按 model 所属的 tokenizer 估算请求的输入 tokens，并读取 max_tokens（codex 为 max_output_tokens）
+func measureRequest(kind string, model string, body []byte) requestSize {
+	field := "max_tokens"
+	if kind == "codex" {
+		field = "max_output_tokens"
+	}
+	return requestSize{
+		inputTokens:     estimateRequestTokens(kind, model, body),
+		maxOutputTokens: int(gjson.GetBytes(body, field).Int()),
+	}
+}
+
+// contextLimits 返回 provider 处理指定模型时的上下文限制：provider 覆盖优先，其次为模型价格表；
+// 客户端开启 context-1m beta 且 provider 会转发该标记时，Claude 模型的输入上限提高到 1M
+func (p *Provider) contextLimits(model string, context1mBeta string, pricing *modelpricing.Service) modelpricing.ContextLimits {
+	effectiveModel := p.GetEffectiveModel(model)
+	limits, _ := pricing.ContextLimits(effectiveModel)
+	if context1mBeta != "" && limits.MaxInputTokens > 0 && limits.MaxInputTokens < context1mInputTokens &&
+		strings.Contains(strings.ToLower(effectiveModel), "claude") &&
+		(p.HeaderRules == nil || p.HeaderRules.filterBetas(context1mBeta) != "") {
+		limits.MaxInputTokens = context1mInputTokens
+	}
+	if p.ContextLimits != nil {
+		if p.ContextLimits.MaxInputTokens > 0 {
+			limits.MaxInputTokens = p.ContextLimits.MaxInputTokens
+		}
+		if p.ContextLimits.MaxOutputTokens > 0 {
+			limits.MaxOutputTokens = p.ContextLimits.MaxOutputTokens
+		}
+	}
+	return limits
+}
+
+// checkContextFit 判断请求能否放进 provider 的上下文窗口，放不下时返回原因
+func (p *Provider) checkContextFit(model string, size requestSize, pricing *modelpricing.Service) error {
+	limits := p.contextLimits(model, size.context1mBeta, pricing)
+	if limits.MaxInputTokens > 0 && float64(size.inputTokens) > float64(limits.MaxInputTokens)*(1+contextEstimateTolerance) {
+		return fmt.Errorf("输入约 %d tokens，超出上限 %d", size.inputTokens, limits.MaxInputTokens)
+	}
+	if limits.MaxOutputTokens > 0 && size.maxOutputTokens > limits.MaxOutputTokens {
+		return fmt.Errorf("max_tokens %d 超出输出上限 %d", size.maxOutputTokens, limits.MaxOutputTokens)
+	}
+	return nil
+}
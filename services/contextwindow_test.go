@@ -0,0 +1,139 @@
+package services
+
+import (
+	"testing"
+
+	modelpricing "codeswitch/resources/model-pricing"
+)
+
+// ==================== 上下文窗口过滤测试 ====================
+
+func TestProviderCheckContextFit(t *testing.T) {
+	pricing, err := modelpricing.NewService()
+	if err != nil {
+		t.Fatalf("加载模型价格表失败: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		provider  Provider
+		model     string
+		size      requestSize
+		expectFit bool
+	}{
+		{
+			name:      "在官方窗口内",
+			provider:  Provider{Name: "A"},
+			model:     "claude-opus-4-20250514",
+			size:      requestSize{inputTokens: 100000, maxOutputTokens: 8000},
+			expectFit: true,
+		},
+		{
+			name:      "输入超出官方窗口",
+			provider:  Provider{Name: "A"},
+			model:     "claude-opus-4-20250514",
+			size:      requestSize{inputTokens: 300000},
+			expectFit: false,
+		},
+		{
+			name:      "估算值略超上限时放行",
+			provider:  Provider{Name: "A"},
+			model:     "claude-opus-4-20250514",
+			size:      requestSize{inputTokens: 210000},
+			expectFit: true,
+		},
+		{
+			name:      "未开启 1M 上下文",
+			provider:  Provider{Name: "A"},
+			model:     "claude-sonnet-4-5-20250929",
+			size:      requestSize{inputTokens: 500000},
+			expectFit: false,
+		},
+		{
+			name:      "context-1m beta 提高输入上限",
+			provider:  Provider{Name: "A"},
+			model:     "claude-sonnet-4-5-20250929",
+			size:      requestSize{inputTokens: 500000, context1mBeta: "context-1m-2025-08-07"},
+			expectFit: true,
+		},
+		{
+			name:      "provider 过滤掉 context-1m beta",
+			provider:  Provider{Name: "A", HeaderRules: &HeaderRules{DenyBetas: []string{"context-1m-*"}}},
+			model:     "claude-sonnet-4-5-20250929",
+			size:      requestSize{inputTokens: 500000, context1mBeta: "context-1m-2025-08-07"},
+			expectFit: false,
+		},
+		{
+			name:      "max_tokens 超出输出上限",
+			provider:  Provider{Name: "A"},
+			model:     "claude-opus-4-20250514",
+			size:      requestSize{inputTokens: 1000, maxOutputTokens: 64000},
+			expectFit: false,
+		},
+		{
+			name:      "provider 覆盖更小的输入上限",
+			provider:  Provider{Name: "A", ContextLimits: &ProviderContextLimits{MaxInputTokens: 32000}},
+			model:     "claude-opus-4-20250514",
+			size:      requestSize{inputTokens: 50000},
+			expectFit: false,
+		},
+		{
+			name: "按映射后的模型计算",
+			provider: Provider{Name: "A", ModelMapping: map[string]string{
+				"claude-opus-4-20250514": "gpt-5",
+			}},
+			model:     "claude-opus-4-20250514",
+			size:      requestSize{inputTokens: 250000},
+			expectFit: true,
+		},
+		{
+			name:      "未知模型不限制",
+			provider:  Provider{Name: "A"},
+			model:     "my-private-model",
+			size:      requestSize{inputTokens: 10000000, maxOutputTokens: 1000000},
+			expectFit: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.provider.checkContextFit(tt.model, tt.size, pricing)
+			if tt.expectFit && err != nil {
+				t.Errorf("期望放得下，但返回了: %v", err)
+			}
+			if !tt.expectFit && err == nil {
+				t.Errorf("期望放不下，但没有返回错误")
+			}
+		})
+	}
+}
+
+func TestFindContext1mBeta(t *testing.T) {
+	tests := []struct {
+		betas    string
+		expected string
+	}{
+		{"", ""},
+		{"interleaved-thinking-2025-05-14", ""},
+		{"interleaved-thinking-2025-05-14, context-1m-2025-08-07", "context-1m-2025-08-07"},
+	}
+	for _, tt := range tests {
+		if got := findContext1mBeta(tt.betas); got != tt.expected {
+			t.Errorf("findContext1mBeta(%q) = %q, 期望 %q", tt.betas, got, tt.expected)
+		}
+	}
+}
+
+func TestMeasureRequest(t *testing.T) {
+	claude := measureRequest("claude", "claude-opus-4-20250514", []byte(`{"model":"claude-opus-4-20250514","max_tokens":4096}`))
+	if claude.maxOutputTokens != 4096 {
+		t.Errorf("claude max_tokens = %d, 期望 4096", claude.maxOutputTokens)
+	}
+	codex := measureRequest("codex", "gpt-5", []byte(`{"model":"gpt-5","max_output_tokens":2048,"max_tokens":1}`))
+	if codex.maxOutputTokens != 2048 {
+		t.Errorf("codex max_output_tokens = %d, 期望 2048", codex.maxOutputTokens)
+	}
+	if claude.inputTokens <= 0 {
+		t.Errorf("输入 tokens 估算应大于 0")
+	}
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicBetaHeader = "Anthropic-Beta"
+
+	// 请求头值中的占位符，转发时替换为 provider 的 API Key
+	headerAPIKeyPlaceholder = "${apiKey}"
+)
+
+// 不应转发给上游的请求头：逐跳头部，由 HTTP 客户端重新计算的 Host / Content-Length，
+// 以及由中转自行协商的 Accept-Encoding
+var droppedRequestHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+	"Accept-Encoding":     true,
+}
+
+// HeaderRules provider 的请求头规则，执行顺序：删除 -> 过滤 anthropic-beta -> 注入/覆盖
+type HeaderRules struct {
+	Set        map[string]string `json:"set,omitempty"`        // 注入或覆盖，值中的 ${apiKey} 会替换为 API Key
+	Remove     []string          `json:"remove,omitempty"`     // 删除的请求头，支持通配符，如 "X-Stainless-*"
+	AllowBetas []string          `json:"allowBetas,omitempty"` // anthropic-beta 白名单（支持通配符），空表示不限制
+	DenyBetas  []string          `json:"denyBetas,omitempty"`  // anthropic-beta 黑名单（支持通配符）
+}
+
+// Validate 校验请求头规则
+func (r HeaderRules) Validate() []string {
+	errs := make([]string, 0)
+	for name := range r.Set {
+		if !validHeaderName(name) {
+			errs = append(errs, fmt.Sprintf("请求头名称 '%s' 无效", name))
+		}
+	}
+	for _, name := range r.Remove {
+		if !validHeaderName(strings.ReplaceAll(name, "*", "")) {
+			errs = append(errs, fmt.Sprintf("删除的请求头名称 '%s' 无效", name))
+		}
+	}
+	return errs
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildUpstreamHeaders 根据客户端请求头与 provider 规则生成发往上游的请求头
+func buildUpstreamHeaders(provider Provider, clientHeaders map[string]string) map[string]string {
+	headers := make(map[string]string, len(clientHeaders)+2)
+	for key, value := range clientHeaders {
+		key = http.CanonicalHeaderKey(key)
+		if droppedRequestHeaders[key] {
+			continue
+		}
+		headers[key] = value
+	}
+	headers["Authorization"] = fmt.Sprintf("Bearer %s", provider.APIKey)
+	headers["Accept-Encoding"] = upstreamAcceptEncoding
+	if _, ok := headers["Accept"]; !ok {
+		headers["Accept"] = "application/json"
+	}
+
+	rules := provider.HeaderRules
+	if rules == nil {
+		return headers
+	}
+
+	for _, pattern := range rules.Remove {
+		pattern = http.CanonicalHeaderKey(pattern)
+		for key := range headers {
+			if matchWildcard(strings.ToLower(pattern), strings.ToLower(key)) {
+				delete(headers, key)
+			}
+		}
+	}
+
+	if betas, ok := headers[anthropicBetaHeader]; ok {
+		if filtered := rules.filterBetas(betas); filtered != "" {
+			headers[anthropicBetaHeader] = filtered
+		} else {
+			delete(headers, anthropicBetaHeader)
+		}
+	}
+
+	for key, value := range rules.Set {
+		headers[http.CanonicalHeaderKey(key)] = strings.ReplaceAll(value, headerAPIKeyPlaceholder, provider.APIKey)
+	}
+	return headers
+}
+
+// filterBetas 按白名单、黑名单过滤逗号分隔的 anthropic-beta 标记
+func (r HeaderRules) filterBetas(value string) string {
+	kept := make([]string, 0)
+	for _, flag := range strings.Split(value, ",") {
+		flag = strings.TrimSpace(flag)
+		if flag == "" {
+			continue
+		}
+		if len(r.AllowBetas) > 0 && !matchAnyWildcard(r.AllowBetas, flag) {
+			continue
+		}
+		if matchAnyWildcard(r.DenyBetas, flag) {
+			continue
+		}
+		kept = append(kept, flag)
+	}
+	return strings.Join(kept, ",")
+}
+
+func matchAnyWildcard(patterns []string, text string) bool {
+	for _, pattern := range patterns {
+		if matchWildcard(pattern, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// 预览时使用的示例请求头，模拟 Claude Code / Codex 的典型请求
+var sampleClientHeaders = map[string]map[string]string{
+	"claude": {
+		"Host":              "127.0.0.1:18100",
+		"Connection":        "keep-alive",
+		"Content-Type":      "application/json",
+		"Content-Length":    "1024",
+		"Accept":            "application/json",
+		"Accept-Encoding":   "gzip, deflate, br",
+		"Authorization":     "Bearer code-switch",
+		"Anthropic-Version": "2023-06-01",
+		"Anthropic-Beta":    "claude-code-20250219,interleaved-thinking-2025-05-14,fine-grained-tool-streaming-2025-05-14,context-management-2025-06-27",
+		"User-Agent":        "claude-cli/2.0.0 (external, cli)",
+		"X-App":             "cli",
+		"X-Stainless-Lang":  "js",
+	},
+	"codex": {
+		"Host":            "127.0.0.1:18100",
+		"Connection":      "keep-alive",
+		"Content-Type":    "application/json",
+		"Content-Length":  "1024",
+		"Accept":          "text/event-stream",
+		"Accept-Encoding": "gzip, deflate, br",
+		"Authorization":   "Bearer code-switch",
+		"User-Agent":      "codex_cli_rs/0.50.0",
+		"Originator":      "codex_cli_rs",
+		"Openai-Beta":     "responses=experimental",
+	},
+}
+
+// PreviewHeaders 展示指定 provider 处理示例请求后最终发往上游的请求头，
+// sample 为空时使用内置的 Claude Code / Codex 示例，API Key 会被打码
+func (ps *ProviderService) PreviewHeaders(kind string, providerName string, sample map[string]string) (map[string]string, error) {
+	providers, err := ps.LoadProviders(kind)
+	if err != nil {
+		return nil, err
+	}
+	for _, provider := range providers {
+		if provider.Name != providerName {
+			continue
+		}
+		if len(sample) == 0 {
+			sample = sampleClientHeaders[strings.ToLower(kind)]
+		}
+		headers := buildUpstreamHeaders(provider, sample)
+		if provider.APIKey != "" {
+			for key, value := range headers {
+				headers[key] = strings.ReplaceAll(value, provider.APIKey, maskAPIKey(provider.APIKey))
+			}
+		}
+		return headers, nil
+	}
+	return nil, fmt.Errorf("未找到 provider '%s'", providerName)
+}
+
+func maskAPIKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "****" + key[len(key)-4:]
+}
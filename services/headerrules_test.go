@@ -0,0 +1,133 @@
+package services
+
+import "testing"
+
+// ==================== 请求头规则测试 ====================
+
+func TestBuildUpstreamHeaders(t *testing.T) {
+	client := map[string]string{
+		"Host":              "127.0.0.1:18100",
+		"Connection":        "keep-alive",
+		"Content-Length":    "42",
+		"Accept-Encoding":   "gzip, br",
+		"Authorization":     "Bearer code-switch",
+		"Content-Type":      "application/json",
+		"Anthropic-Version": "2023-06-01",
+		"Anthropic-Beta":    "claude-code-20250219, interleaved-thinking-2025-05-14,context-management-2025-06-27",
+		"User-Agent":        "claude-cli/2.0.0",
+		"X-Stainless-Lang":  "js",
+		"X-Stainless-Os":    "Linux",
+	}
+
+	tests := []struct {
+		name     string
+		rules    *HeaderRules
+		expected map[string]string // 值为空字符串表示该请求头不应存在
+	}{
+		{
+			name: "默认删除逐跳头并替换鉴权",
+			expected: map[string]string{
+				"Host":            "",
+				"Connection":      "",
+				"Content-Length":  "",
+				"Accept-Encoding": upstreamAcceptEncoding,
+				"Authorization":   "Bearer sk-test-key",
+				"Accept":          "application/json",
+				"Anthropic-Beta":  "claude-code-20250219, interleaved-thinking-2025-05-14,context-management-2025-06-27",
+			},
+		},
+		{
+			name: "注入与覆盖",
+			rules: &HeaderRules{Set: map[string]string{
+				"anthropic-version":   "2024-01-01",
+				"user-agent":          "my-agent/1.0",
+				"OpenAI-Organization": "org-123",
+			}},
+			expected: map[string]string{
+				"Anthropic-Version":   "2024-01-01",
+				"User-Agent":          "my-agent/1.0",
+				"Openai-Organization": "org-123",
+			},
+		},
+		{
+			name:  "API Key 占位符",
+			rules: &HeaderRules{Remove: []string{"Authorization"}, Set: map[string]string{"x-api-key": "${apiKey}"}},
+			expected: map[string]string{
+				"Authorization": "",
+				"X-Api-Key":     "sk-test-key",
+			},
+		},
+		{
+			name:  "通配删除",
+			rules: &HeaderRules{Remove: []string{"x-stainless-*"}},
+			expected: map[string]string{
+				"X-Stainless-Lang": "",
+				"X-Stainless-Os":   "",
+				"User-Agent":       "claude-cli/2.0.0",
+			},
+		},
+		{
+			name:     "beta 白名单",
+			rules:    &HeaderRules{AllowBetas: []string{"claude-code-*", "interleaved-thinking-*"}},
+			expected: map[string]string{"Anthropic-Beta": "claude-code-20250219,interleaved-thinking-2025-05-14"},
+		},
+		{
+			name:     "beta 黑名单",
+			rules:    &HeaderRules{DenyBetas: []string{"context-management-*"}},
+			expected: map[string]string{"Anthropic-Beta": "claude-code-20250219,interleaved-thinking-2025-05-14"},
+		},
+		{
+			name:     "beta 全部过滤后删除请求头",
+			rules:    &HeaderRules{AllowBetas: []string{"unknown-*"}},
+			expected: map[string]string{"Anthropic-Beta": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := Provider{Name: "test", APIKey: "sk-test-key", HeaderRules: tt.rules}
+			headers := buildUpstreamHeaders(provider, client)
+			for key, want := range tt.expected {
+				got, ok := headers[key]
+				if want == "" {
+					if ok {
+						t.Errorf("请求头 %s 不应存在，实际为 %q", key, got)
+					}
+					continue
+				}
+				if got != want {
+					t.Errorf("请求头 %s = %q, 期望 %q", key, got, want)
+				}
+			}
+		})
+	}
+
+	if client["Host"] == "" {
+		t.Errorf("buildUpstreamHeaders 不应修改客户端请求头")
+	}
+}
+
+func TestHeaderRulesValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     HeaderRules
+		expectErr bool
+	}{
+		{"合法规则", HeaderRules{Set: map[string]string{"X-Org": "1"}, Remove: []string{"X-Stainless-*"}}, false},
+		{"名称包含空格", HeaderRules{Set: map[string]string{"X Org": "1"}}, true},
+		{"名称包含冒号", HeaderRules{Remove: []string{"X-Org:"}}, true},
+		{"空名称", HeaderRules{Set: map[string]string{"": "1"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.rules.Validate()
+			if tt.expectErr && len(errs) == 0 {
+				t.Errorf("期望返回错误，但没有错误")
+			}
+			if !tt.expectErr && len(errs) > 0 {
+				t.Errorf("不期望错误，但返回了: %v", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LogExportResult 导出结果
+type LogExportResult struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Rows   int64  `json:"rows"` // 不含表头的数据行数
+}
+
+// UsageExportQuery 用量汇总导出条件
+type UsageExportQuery struct {
+	Platform string `json:"platform"`
+	Provider string `json:"provider"`
+	// 本地时间，格式同 RequestLogQuery；为空表示不限
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	// day（默认，按本地日期汇总）/ hour
+	Granularity string `json:"granularity"`
+}
+
+// requestLogExportColumns 导出的日志列，与 ListRequestLogs 返回的字段一致；花费为按当前价格表计算的结果
+var requestLogExportColumns = []struct {
+	name  string
+	value func(*ReqeustLog) any
+}{
+	{"id", func(l *ReqeustLog) any { return l.ID }},
+	{"created_at", func(l *ReqeustLog) any { return l.CreatedAt }},
+	{"request_id", func(l *ReqeustLog) any { return l.RequestID }},
+	{"attempt", func(l *ReqeustLog) any { return l.Attempt }},
+	{"upstream_request_id", func(l *ReqeustLog) any { return l.UpstreamRequestID }},
+	{"platform", func(l *ReqeustLog) any { return l.Platform }},
+	{"provider", func(l *ReqeustLog) any { return l.Provider }},
+	{"model", func(l *ReqeustLog) any { return l.Model }},
+	{"fallback_from", func(l *ReqeustLog) any { return l.FallbackFrom }},
+	{"http_code", func(l *ReqeustLog) any { return l.HttpCode }},
+	{"error_class", func(l *ReqeustLog) any { return l.ErrorClass }},
+	{"outcome", func(l *ReqeustLog) any { return l.Outcome }},
+	{"is_stream", func(l *ReqeustLog) any { return l.IsStream }},
+	{"is_final", func(l *ReqeustLog) any { return l.IsFinal }},
+	{"is_shadow", func(l *ReqeustLog) any { return l.IsShadow }},
+	{"replay_of", func(l *ReqeustLog) any { return l.ReplayOf }},
+	{"duration_sec", func(l *ReqeustLog) any { return l.DurationSec }},
+	{"estimated_input_tokens", func(l *ReqeustLog) any { return l.EstimatedInputTokens }},
+	{"input_tokens", func(l *ReqeustLog) any { return l.InputTokens }},
+	{"output_tokens", func(l *ReqeustLog) any { return l.OutputTokens }},
+	{"reasoning_tokens", func(l *ReqeustLog) any { return l.ReasoningTokens }},
+	{"cache_create_tokens", func(l *ReqeustLog) any { return l.CacheCreateTokens }},
+	{"cache_create_5m_tokens", func(l *ReqeustLog) any { return l.CacheCreate5mTokens }},
+	{"cache_create_1h_tokens", func(l *ReqeustLog) any { return l.CacheCreate1hTokens }},
+	{"cache_read_tokens", func(l *ReqeustLog) any { return l.CacheReadTokens }},
+	{"input_cost", func(l *ReqeustLog) any { return l.InputCost }},
+	{"output_cost", func(l *ReqeustLog) any { return l.OutputCost }},
+	{"cache_create_cost", func(l *ReqeustLog) any { return l.CacheCreateCost }},
+	{"ephemeral_5m_cost", func(l *ReqeustLog) any { return l.Ephemeral5mCost }},
+	{"ephemeral_1h_cost", func(l *ReqeustLog) any { return l.Ephemeral1hCost }},
+	{"cache_read_cost", func(l *ReqeustLog) any { return l.CacheReadCost }},
+	{"total_cost", func(l *ReqeustLog) any { return l.TotalCost }},
+	{"has_pricing", func(l *ReqeustLog) any { return l.HasPricing }},
+	{"error_message", func(l *ReqeustLog) any { return l.ErrorMessage }},
+}
+
+// usageExportColumns 导出的用量汇总列，第一列为日期或小时
+var usageExportColumns = []string{
+	"platform", "provider", "model",
+	"total_requests", "successful_requests", "failed_requests",
+	"input_tokens", "output_tokens", "reasoning_tokens", "cache_create_tokens", "cache_read_tokens",
+	"input_cost", "output_cost", "cache_create_cost", "cache_read_cost", "total_cost",
+}
+
+// ExportRequestLogs 将满足条件的 request_log 写入 path，format 为 csv / jsonl / xlsx，为空时按扩展名推断。
+// 按游标分批读取，未指定排序方向时按时间正序导出；query 中的 cursor 与 limit 会被忽略
+func (ls *LogService) ExportRequestLogs(query RequestLogQuery, format string, path string) (LogExportResult, error) {
+	columns := make([]string, len(requestLogExportColumns))
+	for i, column := range requestLogExportColumns {
+		columns[i] = column.name
+	}
+	if query.Order == "" {
+		query.Order = "asc"
+	}
+	query.Cursor = ""
+	query.Limit = maxSearchLimit
+
+	return writeExport(format, path, columns, func(write func([]any) error) error {
+		for {
+			page, err := ls.SearchRequestLogs(query)
+			if err != nil {
+				return err
+			}
+			for i := range page.Logs {
+				row := make([]any, len(requestLogExportColumns))
+				for j, column := range requestLogExportColumns {
+					row[j] = column.value(&page.Logs[i])
+				}
+				if err := write(row); err != nil {
+					return err
+				}
+			}
+			if page.NextCursor == "" {
+				return nil
+			}
+			query.Cursor = page.NextCursor
+		}
+	})
+}
+
+// ExportUsage 将按日期（或小时）、platform、provider、model 汇总的用量与花费写入 path，
+// 已汇总的部分读取日汇总表或小时汇总表，尚未汇总的部分从原始日志实时计算，不含影子流量
+func (ls *LogService) ExportUsage(query UsageExportQuery, format string, path string) (LogExportResult, error) {
+	bucketLayout, firstColumn := dateLayout, "date"
+	switch strings.ToLower(query.Granularity) {
+	case "", "day":
+	case "hour":
+		bucketLayout, firstColumn = "2006-01-02 15:00", "hour"
+	default:
+		return LogExportResult{}, fmt.Errorf("不支持的汇总粒度 '%s'，可选 day / hour", query.Granularity)
+	}
+	var since, until time.Time
+	if query.StartTime != "" {
+		start, _, err := parseQueryTime(query.StartTime)
+		if err != nil {
+			return LogExportResult{}, err
+		}
+		since = startOfHour(start)
+	}
+	if query.EndTime != "" {
+		end, dateOnly, err := parseQueryTime(query.EndTime)
+		if err != nil {
+			return LogExportResult{}, err
+		}
+		if dateOnly {
+			end = end.AddDate(0, 0, 1)
+		}
+		// 与开始时间一致按整点汇总，结束时间所在的小时计入结果
+		until = startOfHour(end)
+		if until.Before(end) {
+			until = until.Add(time.Hour)
+		}
+	}
+	// 先校验格式，避免无效请求也去读取汇总数据
+	if _, err := resolveExportFormat(format, path); err != nil {
+		return LogExportResult{}, err
+	}
+
+	var buckets []*usageBucket
+	var err error
+	if firstColumn == "date" {
+		buckets, err = ls.loadDailyUsage(query.Platform, since, until)
+	} else {
+		buckets, err = ls.loadHourlyUsage(query.Platform, since, until)
+	}
+	if err != nil {
+		return LogExportResult{}, err
+	}
+	// 汇总结果的行数只与时间范围和 provider/model 数量有关，可以在内存中合并
+	type exportKey struct {
+		bucket   string
+		platform string
+		provider string
+		model    string
+	}
+	merged := make(map[exportKey]*usageBucket)
+	for _, bucket := range buckets {
+		if query.Provider != "" && bucket.provider != query.Provider {
+			continue
+		}
+		key := exportKey{bucket.hour.Format(bucketLayout), bucket.platform, bucket.provider, bucket.model}
+		total := merged[key]
+		if total == nil {
+			total = &usageBucket{usageKey: bucket.usageKey}
+			merged[key] = total
+		}
+		total.totalRequests += bucket.totalRequests
+		total.successfulRequests += bucket.successfulRequests
+		total.failedRequests += bucket.failedRequests
+		total.inputTokens += bucket.inputTokens
+		total.outputTokens += bucket.outputTokens
+		total.reasoningTokens += bucket.reasoningTokens
+		total.cacheCreateTokens += bucket.cacheCreateTokens
+		total.cacheReadTokens += bucket.cacheReadTokens
+		total.inputCost += bucket.inputCost
+		total.outputCost += bucket.outputCost
+		total.cacheCreateCost += bucket.cacheCreateCost
+		total.cacheReadCost += bucket.cacheReadCost
+		total.totalCost += bucket.totalCost
+	}
+	keys := make([]exportKey, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.bucket != b.bucket {
+			return a.bucket < b.bucket
+		}
+		if a.platform != b.platform {
+			return a.platform < b.platform
+		}
+		if a.provider != b.provider {
+			return a.provider < b.provider
+		}
+		return a.model < b.model
+	})
+
+	columns := append([]string{firstColumn}, usageExportColumns...)
+	return writeExport(format, path, columns, func(write func([]any) error) error {
+		for _, key := range keys {
+			b := merged[key]
+			if err := write([]any{
+				key.bucket, b.platform, b.provider, b.model,
+				b.totalRequests, b.successfulRequests, b.failedRequests,
+				b.inputTokens, b.outputTokens, b.reasoningTokens, b.cacheCreateTokens, b.cacheReadTokens,
+				b.inputCost, b.outputCost, b.cacheCreateCost, b.cacheReadCost, b.totalCost,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeExport 先写入同目录下的临时文件，全部成功后再重命名为 path，失败时不会留下不完整的文件
+func writeExport(format string, path string, columns []string, produce func(write func([]any) error) error) (LogExportResult, error) {
+	result := LogExportResult{Path: path}
+	if strings.TrimSpace(path) == "" {
+		return result, fmt.Errorf("导出路径不能为空")
+	}
+	format, err := resolveExportFormat(format, path)
+	if err != nil {
+		return result, err
+	}
+	result.Format = format
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return result, fmt.Errorf("创建导出目录失败: %w", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return result, fmt.Errorf("创建导出文件失败: %w", err)
+	}
+	tmpPath := file.Name()
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	writer, err := newTableWriter(format, file, columns)
+	if err != nil {
+		return result, err
+	}
+	err = produce(func(row []any) error {
+		if err := writer.writeRow(row); err != nil {
+			return err
+		}
+		result.Rows++
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	if err = writer.close(); err != nil {
+		return result, err
+	}
+	if err = file.Close(); err != nil {
+		return result, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return result, fmt.Errorf("保存导出文件失败: %w", err)
+	}
+	fmt.Printf("[INFO] 已导出 %d 行到 %s\n", result.Rows, path)
+	return result, nil
+}
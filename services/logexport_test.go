@@ -0,0 +1,329 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	modelpricing "codeswitch/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// ==================== 导出测试 ====================
+
+func TestExportRequestLogs(t *testing.T) {
+	initTestRequestLogDB(t)
+	seedSearchLogs(t)
+	ls := NewLogService()
+	dir := t.TempDir()
+
+	yes := true
+	tests := []struct {
+		name   string
+		format string
+		file   string
+		query  RequestLogQuery
+		want   int64
+	}{
+		{"csv 全部", "", "logs.csv", RequestLogQuery{}, 6},
+		{"jsonl 过滤", "jsonl", "logs.out", RequestLogQuery{IsStream: &yes}, 3},
+		{"xlsx", "", "logs.xlsx", RequestLogQuery{Model: "claude-opus-4"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			result, err := ls.ExportRequestLogs(tt.query, tt.format, path)
+			if err != nil {
+				t.Fatalf("ExportRequestLogs 失败: %v", err)
+			}
+			if result.Rows != tt.want {
+				t.Errorf("导出行数 = %d, 期望 %d", result.Rows, tt.want)
+			}
+			if rows := countExportRows(t, result.Format, path); rows != tt.want {
+				t.Errorf("文件中的数据行数 = %d, 期望 %d", rows, tt.want)
+			}
+		})
+	}
+
+	// 分页导出的顺序与跨页连续性
+	f, err := os.Open(filepath.Join(dir, "logs.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	if bom, _, _ := reader.ReadRune(); bom != '\ufeff' {
+		t.Errorf("csv 应以 UTF-8 BOM 开头")
+	}
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		t.Fatalf("解析 csv 失败: %v", err)
+	}
+	if records[0][0] != "id" || records[1][2] != "req-a" || records[6][2] != "req-f" {
+		t.Errorf("csv 应包含表头并按时间正序导出，实际 %v", records)
+	}
+
+	if _, err := ls.ExportRequestLogs(RequestLogQuery{}, "", filepath.Join(dir, "logs.txt")); err == nil {
+		t.Errorf("无法识别的格式应返回错误")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "logs.txt")); !os.IsNotExist(err) {
+		t.Errorf("导出失败时不应留下文件")
+	}
+}
+
+func TestRequestLogExportColumnsMatchLogFields(t *testing.T) {
+	// 每个字段填入不同的值，校验导出列与 JSON 字段一一对应
+	var log ReqeustLog
+	value := reflect.ValueOf(&log).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.Int, reflect.Int64:
+			field.SetInt(int64(i + 1))
+		case reflect.Float64:
+			field.SetFloat(float64(i) + 0.5)
+		case reflect.String:
+			field.SetString(fmt.Sprintf("v%d", i))
+		case reflect.Bool:
+			field.SetBool(i%2 == 0)
+		}
+	}
+	data, err := json.Marshal(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]any)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requestLogExportColumns) != len(fields) {
+		t.Errorf("导出 %d 列，日志共有 %d 个字段", len(requestLogExportColumns), len(fields))
+	}
+	for _, column := range requestLogExportColumns {
+		expected, ok := fields[column.name]
+		if !ok {
+			t.Errorf("导出列 %s 不是日志字段", column.name)
+			continue
+		}
+		if got := fmt.Sprint(column.value(&log)); got != fmt.Sprint(expected) {
+			t.Errorf("导出列 %s = %s, 期望 %v", column.name, got, expected)
+		}
+	}
+}
+
+func TestExportUsage(t *testing.T) {
+	initTestRequestLogDB(t)
+	now := time.Now()
+	for i, age := range []time.Duration{time.Hour, 2 * time.Hour, 26 * time.Hour, 50 * time.Hour} {
+		record := requestLogRecord(&ReqeustLog{
+			Platform: "claude", Provider: []string{"a", "b"}[i%2], Model: "claude-sonnet-4", HttpCode: 200,
+			InputTokens: 1000, OutputTokens: 500,
+		})
+		record["created_at"] = now.Add(-age).UTC().Format(timeLayout)
+		if _, err := xdb.New("request_log").Insert(record); err != nil {
+			t.Fatalf("写入 request_log 失败: %v", err)
+		}
+	}
+	ls := NewLogService()
+	// 部分数据已汇总，导出结果应与全部实时计算一致
+	if _, err := ls.rollupRequestLogs(now.Add(-24 * time.Hour)); err != nil {
+		t.Fatalf("rollupRequestLogs 失败: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	result, err := ls.ExportUsage(UsageExportQuery{Platform: "claude", Granularity: "hour"}, "", path)
+	if err != nil {
+		t.Fatalf("ExportUsage 失败: %v", err)
+	}
+	if result.Rows != 4 {
+		t.Errorf("按小时应导出 4 行，实际 %d", result.Rows)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int64
+	var cost float64
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var row struct {
+			Hour          string  `json:"hour"`
+			TotalRequests int64   `json:"total_requests"`
+			TotalCost     float64 `json:"total_cost"`
+		}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("解析 jsonl 失败: %v", err)
+		}
+		requests += row.TotalRequests
+		cost += row.TotalCost
+	}
+	expected := ls.calculateCost("claude-sonnet-4", modelpricing.UsageSnapshot{InputTokens: 1000, OutputTokens: 500}).TotalCost * 4
+	if requests != 4 || math.Abs(cost-expected) > 1e-9 {
+		t.Errorf("导出合计 %d 次请求、花费 %v，期望 4 次、%v", requests, cost, expected)
+	}
+
+	result, err = ls.ExportUsage(UsageExportQuery{Provider: "a", StartTime: now.Add(-30 * time.Hour).Format(timeLayout)}, "csv",
+		filepath.Join(t.TempDir(), "usage"))
+	if err != nil || result.Rows != 2 {
+		t.Errorf("按 provider 与开始时间过滤后应导出 2 个日期，实际 (%d, %v)", result.Rows, err)
+	}
+	result, err = ls.ExportUsage(UsageExportQuery{Granularity: "hour", EndTime: now.Add(-24 * time.Hour).Format(timeLayout)}, "csv",
+		filepath.Join(t.TempDir(), "usage.csv"))
+	if err != nil || result.Rows != 2 {
+		t.Errorf("按结束时间过滤后应导出 2 个小时，实际 (%d, %v)", result.Rows, err)
+	}
+	if _, err := ls.ExportUsage(UsageExportQuery{Granularity: "week"}, "csv", filepath.Join(t.TempDir(), "usage.csv")); err == nil {
+		t.Errorf("不支持的粒度应返回错误")
+	}
+}
+
+func TestExportUsageReadsDailyRollup(t *testing.T) {
+	initTestRequestLogDB(t)
+	now := time.Now()
+	today := startOfDay(now)
+	for _, createdAt := range []time.Time{
+		today.AddDate(0, 0, -2).Add(10 * time.Hour),
+		today.AddDate(0, 0, -2).Add(20 * time.Hour),
+		today.AddDate(0, 0, -1).Add(time.Hour),
+		today.AddDate(0, 0, -1).Add(23 * time.Hour),
+		now,
+	} {
+		record := requestLogRecord(&ReqeustLog{Platform: "claude", Provider: "a", Model: "claude-sonnet-4", HttpCode: 200})
+		record["created_at"] = createdAt.UTC().Format(timeLayout)
+		if _, err := xdb.New("request_log").Insert(record); err != nil {
+			t.Fatalf("写入 request_log 失败: %v", err)
+		}
+	}
+	ls := NewLogService()
+	// 汇总到今天零点，今天的数据只能来自原始日志
+	if _, err := ls.rollupRequestLogs(today.Add(time.Hour)); err != nil {
+		t.Fatalf("rollupRequestLogs 失败: %v", err)
+	}
+	// 修改日汇总表，用于区分结果来自日汇总表还是小时数据
+	db, err := xdb.DB("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE request_log_daily SET total_requests = total_requests * 10`); err != nil {
+		t.Fatalf("更新日汇总失败: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		startTime string
+		expected  map[string]int64
+	}{
+		{
+			name:      "整天读取日汇总表",
+			startTime: today.AddDate(0, 0, -2).Format(dateLayout),
+			expected: map[string]int64{
+				today.AddDate(0, 0, -2).Format(dateLayout): 20,
+				today.AddDate(0, 0, -1).Format(dateLayout): 20,
+				today.Format(dateLayout):                   1,
+			},
+		},
+		{
+			name:      "不足一天的开头按小时汇总",
+			startTime: today.AddDate(0, 0, -2).Add(15 * time.Hour).Format(timeLayout),
+			expected: map[string]int64{
+				today.AddDate(0, 0, -2).Format(dateLayout): 1,
+				today.AddDate(0, 0, -1).Format(dateLayout): 20,
+				today.Format(dateLayout):                   1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "usage.jsonl")
+			if _, err := ls.ExportUsage(UsageExportQuery{StartTime: tt.startTime}, "", path); err != nil {
+				t.Fatalf("ExportUsage 失败: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int64)
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var row struct {
+					Date          string `json:"date"`
+					TotalRequests int64  `json:"total_requests"`
+				}
+				if err := json.Unmarshal([]byte(line), &row); err != nil {
+					t.Fatalf("解析 jsonl 失败: %v", err)
+				}
+				got[row.Date] += row.TotalRequests
+			}
+			if len(got) != len(tt.expected) {
+				t.Fatalf("按日期导出 %v，期望 %v", got, tt.expected)
+			}
+			for date, requests := range tt.expected {
+				if got[date] != requests {
+					t.Errorf("%s 的请求数 = %d, 期望 %d", date, got[date], requests)
+				}
+			}
+		})
+	}
+}
+
+// countExportRows 统计导出文件中不含表头的数据行数
+func countExportRows(t *testing.T, format string, path string) int64 {
+	t.Helper()
+	switch format {
+	case exportFormatCSV:
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			t.Fatalf("解析 csv 失败: %v", err)
+		}
+		return int64(len(records) - 1)
+	case exportFormatJSONL:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows int64
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var row map[string]any
+			if err := json.Unmarshal([]byte(line), &row); err != nil {
+				t.Fatalf("解析 jsonl 失败: %v", err)
+			}
+			rows++
+		}
+		return rows
+	default:
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatalf("打开 xlsx 失败: %v", err)
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			if file.Name != "xl/worksheets/sheet1.xml" {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			return int64(strings.Count(string(data), "<row>") - 1)
+		}
+		t.Fatalf("xlsx 中缺少工作表")
+		return 0
+	}
+}
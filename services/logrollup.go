@@ -0,0 +1,561 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	modelpricing "codeswitch/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+const (
+	// 整点后等待异步写入的日志落盘，再汇总该小时
+	rollupLag = 5 * time.Minute
+	// 每批汇总的原始日志跨度，限制内存占用与单个事务的大小
+	rollupBatchSpan = 24 * time.Hour
+	// 后台汇总与清理的执行间隔
+	logMaintenanceInterval = time.Hour
+
+	// 小时汇总表已覆盖到的位置（本地整点对应的 UTC 时间，不含），之前的小时不再读取原始日志
+	rollupWatermarkKey = "hourly_watermark"
+)
+
+// 汇总表的指标列，小时表与日表相同
+const usageRollupColumns = `total_requests, successful_requests, failed_requests,
+	input_tokens, output_tokens, reasoning_tokens, cache_create_tokens, cache_read_tokens,
+	input_cost, output_cost, cache_create_cost, cache_read_cost, total_cost`
+
+// usageKey 汇总维度，hour 为本地时间整点
+type usageKey struct {
+	hour     time.Time
+	platform string
+	provider string
+	model    string
+}
+
+// usageBucket 一小时内单个 platform/provider/model 的请求数、token 用量与花费
+type usageBucket struct {
+	usageKey
+	totalRequests      int64
+	successfulRequests int64
+	failedRequests     int64
+	inputTokens        int64
+	outputTokens       int64
+	reasoningTokens    int64
+	cacheCreateTokens  int64
+	cacheReadTokens    int64
+	inputCost          float64
+	outputCost         float64
+	cacheCreateCost    float64
+	cacheReadCost      float64
+	totalCost          float64
+}
+
+func ensureRequestLogRollupTables() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return err
+	}
+	metrics := `total_requests INTEGER DEFAULT 0,
+		successful_requests INTEGER DEFAULT 0,
+		failed_requests INTEGER DEFAULT 0,
+		input_tokens INTEGER DEFAULT 0,
+		output_tokens INTEGER DEFAULT 0,
+		reasoning_tokens INTEGER DEFAULT 0,
+		cache_create_tokens INTEGER DEFAULT 0,
+		cache_read_tokens INTEGER DEFAULT 0,
+		input_cost REAL DEFAULT 0,
+		output_cost REAL DEFAULT 0,
+		cache_create_cost REAL DEFAULT 0,
+		cache_read_cost REAL DEFAULT 0,
+		total_cost REAL DEFAULT 0`
+	// 小时表 bucket 为本地整点对应的 UTC 时间（与 created_at 格式一致），日表 bucket 为本地日期
+	for _, table := range []string{"request_log_hourly", "request_log_daily"} {
+		createTableSQL := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		bucket TEXT NOT NULL,
+		platform TEXT NOT NULL DEFAULT '',
+		provider TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL DEFAULT '',
+		%s,
+		PRIMARY KEY (bucket, platform, provider, model)
+	)`, table, metrics)
+		if _, err := db.Exec(createTableSQL); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS request_log_rollup_state (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`)
+	return err
+}
+
+// 原始日志分组汇总的字段；长上下文按单次请求的输入量计价，因此按是否超过阈值分开汇总。
+// 时区偏移不一定是整小时（如 +05:30），且范围内可能跨越夏令时切换，因此先按 UTC 的 15 分钟分组，
+// 再在 Go 中归入所在的本地整点：所有时区偏移都是 15 分钟的整数倍
+var rawUsageFields = []string{
+	"strftime('%Y-%m-%d %H:', created_at) || printf('%02d', CAST(strftime('%M', created_at) AS INTEGER) / 15 * 15) as slot",
+	"platform",
+	"provider",
+	"model",
+	fmt.Sprintf("CASE WHEN input_tokens + cache_create_tokens + cache_read_tokens > %d THEN 1 ELSE 0 END as long_context",
+		modelpricing.LongContextThreshold),
+	"COUNT(*) as total_requests",
+	"SUM(CASE WHEN http_code >= 200 AND http_code < 300 THEN 1 ELSE 0 END) as successful_requests",
+	"SUM(input_tokens) as input_tokens",
+	"SUM(output_tokens) as output_tokens",
+	"SUM(reasoning_tokens) as reasoning_tokens",
+	"SUM(cache_create_tokens) as cache_create_tokens",
+	"SUM(cache_read_tokens) as cache_read_tokens",
+	"SUM(cache_create_5m_tokens) as cache_create_5m_tokens",
+	"SUM(cache_create_1h_tokens) as cache_create_1h_tokens",
+}
+
+// aggregateRawUsage 在 SQL 中按本地小时、platform、provider、model 汇总 [from, to) 内的原始日志，
+// 再对每组计算一次花费；to 为零值表示不限结束时间。影子流量不计入
+func (ls *LogService) aggregateRawUsage(platform string, from time.Time, to time.Time) (map[usageKey]*usageBucket, error) {
+	buckets := make(map[usageKey]*usageBucket)
+	options := []xdb.Option{
+		// created_at 由 SQLite CURRENT_TIMESTAMP 写入，为 UTC 时间
+		xdb.WhereGte("created_at", from.UTC().Format(timeLayout)),
+		xdb.WhereEq("is_shadow", 0),
+		xdb.Field(rawUsageFields...),
+		xdb.GroupBy("slot, platform, provider, model, long_context"),
+	}
+	if !to.IsZero() {
+		options = append(options, xdb.WhereLt("created_at", to.UTC().Format(timeLayout)))
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return buckets, nil
+		}
+		return nil, err
+	}
+	for _, record := range records {
+		slot, err := time.ParseInLocation("2006-01-02 15:04", record.GetString("slot"), time.UTC)
+		if err != nil {
+			continue
+		}
+		provider := strings.TrimSpace(record.GetString("provider"))
+		if provider == "" {
+			provider = "(unknown)"
+		}
+		key := usageKey{
+			hour:     startOfHour(slot.In(time.Local)),
+			platform: record.GetString("platform"),
+			provider: provider,
+			model:    record.GetString("model"),
+		}
+		bucket := buckets[key]
+		if bucket == nil {
+			bucket = &usageBucket{usageKey: key}
+			buckets[key] = bucket
+		}
+		usage := modelpricing.UsageSnapshot{
+			InputTokens:       record.GetInt("input_tokens"),
+			OutputTokens:      record.GetInt("output_tokens"),
+			CacheCreateTokens: record.GetInt("cache_create_tokens"),
+			CacheReadTokens:   record.GetInt("cache_read_tokens"),
+			CacheCreation: cacheCreationDetail(
+				record.GetInt("cache_create_5m_tokens"),
+				record.GetInt("cache_create_1h_tokens"),
+			),
+		}
+		var cost modelpricing.CostBreakdown
+		if ls != nil && ls.pricing != nil {
+			cost = ls.pricing.CalculateGroupCost(key.model, usage, record.GetBool("long_context"))
+		}
+		total := record.GetInt64("total_requests")
+		successful := record.GetInt64("successful_requests")
+		bucket.totalRequests += total
+		// 只有 HTTP 200-299 才算成功，其他（包括 0）都算失败
+		bucket.successfulRequests += successful
+		bucket.failedRequests += total - successful
+		bucket.inputTokens += int64(usage.InputTokens)
+		bucket.outputTokens += int64(usage.OutputTokens)
+		bucket.reasoningTokens += record.GetInt64("reasoning_tokens")
+		bucket.cacheCreateTokens += int64(usage.CacheCreateTokens)
+		bucket.cacheReadTokens += int64(usage.CacheReadTokens)
+		bucket.inputCost += cost.InputCost
+		bucket.outputCost += cost.OutputCost
+		bucket.cacheCreateCost += cost.CacheCreateCost
+		bucket.cacheReadCost += cost.CacheReadCost
+		bucket.totalCost += cost.TotalCost
+	}
+	return buckets, nil
+}
+
+// loadHourlyUsage 返回 [since, until) 内按小时汇总的用量，since 与 until 应为本地整点，until 为零值表示不限：
+// 水位线之前读取小时汇总表，之后的部分从原始日志实时计算
+func (ls *LogService) loadHourlyUsage(platform string, since time.Time, until time.Time) ([]*usageBucket, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]*usageBucket, 0)
+	rawFrom := since
+	watermark, ok, err := loadRollupWatermark(db)
+	if err != nil {
+		return nil, err
+	}
+	if ok && watermark.After(since) {
+		rollupTo := watermark
+		if !until.IsZero() && until.Before(rollupTo) {
+			rollupTo = until
+		}
+		rolled, err := loadUsageRollup("request_log_hourly", platform,
+			since.UTC().Format(timeLayout), rollupTo.UTC().Format(timeLayout), parseHourlyBucket)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, rolled...)
+		rawFrom = watermark
+	}
+	if !until.IsZero() && !rawFrom.Before(until) {
+		return buckets, nil
+	}
+	raw, err := ls.aggregateRawUsage(platform, rawFrom, until)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range raw {
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// loadDailyUsage 返回 [since, until) 内按本地日期汇总的用量，until 为零值表示不限；bucket 的 hour 为当天零点，
+// 同一日期可能有多个 bucket。水位线所在日期之前的整天读取日汇总表，不足一天的首尾部分按小时汇总
+func (ls *LogService) loadDailyUsage(platform string, since time.Time, until time.Time) ([]*usageBucket, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, err
+	}
+	watermark, ok, err := loadRollupWatermark(db)
+	if err != nil {
+		return nil, err
+	}
+	dayFrom := startOfDay(since.In(time.Local))
+	if dayFrom.Before(since) {
+		dayFrom = dayFrom.AddDate(0, 0, 1)
+	}
+	var dayTo time.Time
+	if ok {
+		// 水位线所在日期的日汇总只覆盖到水位线，不读取
+		dayTo = startOfDay(watermark.In(time.Local))
+	}
+	if !until.IsZero() && until.Before(dayTo) {
+		dayTo = startOfDay(until.In(time.Local))
+	}
+	if !dayFrom.Before(dayTo) {
+		return ls.loadHourlyUsageByDay(platform, since, until)
+	}
+
+	buckets, err := loadUsageRollup("request_log_daily", platform,
+		dayFrom.Format(dateLayout), dayTo.Format(dateLayout), parseDailyBucket)
+	if err != nil {
+		return nil, err
+	}
+	// since 为零值表示不限开始时间，没有不足一天的开头部分
+	if !since.IsZero() && since.Before(dayFrom) {
+		head, err := ls.loadHourlyUsageByDay(platform, since, dayFrom)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, head...)
+	}
+	tail, err := ls.loadHourlyUsageByDay(platform, dayTo, until)
+	if err != nil {
+		return nil, err
+	}
+	return append(buckets, tail...), nil
+}
+
+// loadHourlyUsageByDay 读取 [since, until) 内的小时用量，并将 bucket 归到所在日期的零点
+func (ls *LogService) loadHourlyUsageByDay(platform string, since time.Time, until time.Time) ([]*usageBucket, error) {
+	buckets, err := ls.loadHourlyUsage(platform, since, until)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		bucket.hour = startOfDay(bucket.hour)
+	}
+	return buckets, nil
+}
+
+// 日汇总表 bucket 的格式（本地日期）
+const dateLayout = "2006-01-02"
+
+func parseHourlyBucket(value string) (time.Time, error) {
+	hour, err := time.ParseInLocation(timeLayout, value, time.UTC)
+	return hour.In(time.Local), err
+}
+
+func parseDailyBucket(value string) (time.Time, error) {
+	return time.ParseInLocation(dateLayout, value, time.Local)
+}
+
+// loadUsageRollup 读取汇总表中 bucket 在 [from, to) 内的行，parse 将 bucket 转换为本地时间
+func loadUsageRollup(table string, platform string, from string, to string, parse func(string) (time.Time, error)) ([]*usageBucket, error) {
+	options := []xdb.Option{
+		xdb.WhereGte("bucket", from),
+		xdb.WhereLt("bucket", to),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New(table).Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	buckets := make([]*usageBucket, 0, len(records))
+	for _, record := range records {
+		hour, err := parse(record.GetString("bucket"))
+		if err != nil {
+			continue
+		}
+		buckets = append(buckets, &usageBucket{
+			usageKey: usageKey{
+				hour:     hour,
+				platform: record.GetString("platform"),
+				provider: record.GetString("provider"),
+				model:    record.GetString("model"),
+			},
+			totalRequests:      record.GetInt64("total_requests"),
+			successfulRequests: record.GetInt64("successful_requests"),
+			failedRequests:     record.GetInt64("failed_requests"),
+			inputTokens:        record.GetInt64("input_tokens"),
+			outputTokens:       record.GetInt64("output_tokens"),
+			reasoningTokens:    record.GetInt64("reasoning_tokens"),
+			cacheCreateTokens:  record.GetInt64("cache_create_tokens"),
+			cacheReadTokens:    record.GetInt64("cache_read_tokens"),
+			inputCost:          record.GetFloat64("input_cost"),
+			outputCost:         record.GetFloat64("output_cost"),
+			cacheCreateCost:    record.GetFloat64("cache_create_cost"),
+			cacheReadCost:      record.GetFloat64("cache_read_cost"),
+			totalCost:          record.GetFloat64("total_cost"),
+		})
+	}
+	return buckets, nil
+}
+
+// rollupRequestLogs 将水位线之后、已结束小时内的原始日志写入小时汇总表，
+// 并重算涉及日期的日汇总，返回本次汇总的小时数
+func (ls *LogService) rollupRequestLogs(now time.Time) (int, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return 0, err
+	}
+	end := startOfHour(now.Add(-rollupLag).In(time.Local)).UTC()
+	watermark, ok, err := loadRollupWatermark(db)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if watermark, err = earliestRequestLogHour(db, end); err != nil {
+			return 0, err
+		}
+	}
+
+	hours := 0
+	for watermark.Before(end) {
+		batchEnd := watermark.Add(rollupBatchSpan)
+		if batchEnd.After(end) {
+			batchEnd = end
+		}
+		buckets, err := ls.aggregateRawUsage("", watermark, batchEnd)
+		if err != nil {
+			return hours, err
+		}
+		if err := writeUsageRollup(db, buckets, watermark, batchEnd); err != nil {
+			return hours, err
+		}
+		hours += int(batchEnd.Sub(watermark) / time.Hour)
+		watermark = batchEnd
+	}
+	if !ok && hours == 0 {
+		// 没有历史日志时直接记录水位线，之后从当前小时开始汇总
+		if _, err := db.Exec(upsertRollupStateSQL, rollupWatermarkKey, end.Format(timeLayout)); err != nil {
+			return 0, err
+		}
+	}
+	return hours, nil
+}
+
+const upsertRollupStateSQL = `INSERT INTO request_log_rollup_state (name, value) VALUES (?, ?)
+	ON CONFLICT(name) DO UPDATE SET value = excluded.value`
+
+// writeUsageRollup 在一个事务内替换 [from, to) 的小时汇总、重算涉及日期的日汇总并推进水位线
+func writeUsageRollup(db *sql.DB, buckets map[usageKey]*usageBucket, from time.Time, to time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(`DELETE FROM request_log_hourly WHERE bucket >= ? AND bucket < ?`,
+		from.Format(timeLayout), to.Format(timeLayout)); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO request_log_hourly (bucket, platform, provider, model, ` + usageRollupColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, bucket := range buckets {
+		if _, err = stmt.Exec(
+			bucket.hour.UTC().Format(timeLayout), bucket.platform, bucket.provider, bucket.model,
+			bucket.totalRequests, bucket.successfulRequests, bucket.failedRequests,
+			bucket.inputTokens, bucket.outputTokens, bucket.reasoningTokens, bucket.cacheCreateTokens, bucket.cacheReadTokens,
+			bucket.inputCost, bucket.outputCost, bucket.cacheCreateCost, bucket.cacheReadCost, bucket.totalCost,
+		); err != nil {
+			return err
+		}
+	}
+
+	// 日汇总按本地日期从小时表重算，跨批次的日期会在后续批次中再次更新
+	days := make(map[string]time.Time)
+	for hour := from; hour.Before(to); hour = hour.Add(time.Hour) {
+		day := startOfDay(hour.In(time.Local))
+		days[day.Format(dateLayout)] = day
+	}
+	for key, day := range days {
+		if _, err = tx.Exec(`DELETE FROM request_log_daily WHERE bucket = ?`, key); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`INSERT INTO request_log_daily (bucket, platform, provider, model, `+usageRollupColumns+`)
+			SELECT ?, platform, provider, model,
+				SUM(total_requests), SUM(successful_requests), SUM(failed_requests),
+				SUM(input_tokens), SUM(output_tokens), SUM(reasoning_tokens), SUM(cache_create_tokens), SUM(cache_read_tokens),
+				SUM(input_cost), SUM(output_cost), SUM(cache_create_cost), SUM(cache_read_cost), SUM(total_cost)
+			FROM request_log_hourly WHERE bucket >= ? AND bucket < ?
+			GROUP BY platform, provider, model`,
+			key, day.UTC().Format(timeLayout), day.AddDate(0, 0, 1).UTC().Format(timeLayout)); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec(upsertRollupStateSQL, rollupWatermarkKey, to.Format(timeLayout)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadRollupWatermark 读取小时汇总的水位线（UTC），尚未汇总过时返回 false
+func loadRollupWatermark(db *sql.DB) (time.Time, bool, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM request_log_rollup_state WHERE name = ?`, rollupWatermarkKey).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || isNoSuchTableErr(err) {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+	watermark, err := time.ParseInLocation(timeLayout, value, time.UTC)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("汇总水位线格式错误 %q: %w", value, err)
+	}
+	return watermark, true, nil
+}
+
+// earliestRequestLogHour 返回最早一条原始日志所在本地整点对应的 UTC 时间，没有日志时返回 fallback
+func earliestRequestLogHour(db *sql.DB, fallback time.Time) (time.Time, error) {
+	var earliest any
+	if err := db.QueryRow(`SELECT MIN(created_at) FROM request_log WHERE is_shadow = 0`).Scan(&earliest); err != nil {
+		if isNoSuchTableErr(err) {
+			return fallback, nil
+		}
+		return time.Time{}, err
+	}
+	value := formatDBTime(earliest)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := time.ParseInLocation(timeLayout, value, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("无法解析 created_at %q: %w", value, err)
+	}
+	return startOfHour(parsed.In(time.Local)).UTC(), nil
+}
+
+// pruneRequestLogs 删除超过保留天数的原始日志，尚未汇总的日志以及已启用预算当前周期内的日志不会删除；
+// 返回删除的行数
+func pruneRequestLogs(days int, budgets []Budget, now time.Time) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	db, err := xdb.DB("default")
+	if err != nil {
+		return 0, err
+	}
+	watermark, ok, err := loadRollupWatermark(db)
+	if err != nil || !ok {
+		return 0, err
+	}
+	cutoff := now.UTC().AddDate(0, 0, -days)
+	if watermark.Before(cutoff) {
+		cutoff = watermark
+	}
+	// 预算花费按原始日志计算（含影子流量与单次请求的长上下文计价），需保留最长预算周期内的日志
+	for _, budget := range budgets {
+		if !budget.Enabled {
+			continue
+		}
+		if start := budget.PeriodStart(now); start.Before(cutoff) {
+			cutoff = start
+		}
+	}
+	result, err := db.Exec(`DELETE FROM request_log WHERE created_at < ?`, cutoff.UTC().Format(timeLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// maintainRequestLogs 启动时及之后每小时补算旧日志花费、汇总 request_log，并按保留天数清理原始日志
+func (prs *ProviderRelayService) maintainRequestLogs(stop <-chan struct{}) {
+	ls := &LogService{pricing: prs.pricing}
+	ticker := time.NewTicker(logMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if updated, err := backfillRequestLogCosts(prs.pricing); err != nil {
+			fmt.Printf("[WARN] 补算 request_log 花费失败: %v\n", err)
+		} else if updated > 0 {
+			fmt.Printf("[INFO] 已补算 %d 条 request_log 的花费\n", updated)
+		}
+		if hours, err := ls.rollupRequestLogs(now); err != nil {
+			fmt.Printf("[WARN] 汇总 request_log 失败: %v\n", err)
+		} else if hours > 0 {
+			fmt.Printf("[INFO] 已汇总 %d 小时的 request_log\n", hours)
+		}
+		settings := prs.relaySettings()
+		if removed, err := pruneRequestLogs(settings.LogRetentionDays, settings.Budgets, now); err != nil {
+			fmt.Printf("[WARN] 清理过期的 request_log 失败: %v\n", err)
+		} else if removed > 0 {
+			fmt.Printf("[INFO] 已清理 %d 条过期的 request_log\n", removed)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
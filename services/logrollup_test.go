@@ -0,0 +1,356 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	modelpricing "codeswitch/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// ==================== 日志汇总测试 ====================
+
+func TestRollupRequestLogs(t *testing.T) {
+	initTestRequestLogDB(t)
+
+	now := time.Now()
+	rows := []struct {
+		age      time.Duration
+		httpCode int
+		shadow   bool
+	}{
+		{50 * time.Hour, 200, false},
+		{50 * time.Hour, 500, false},
+		{2 * time.Hour, 200, false},
+		{2 * time.Hour, 200, true},
+		{0, 200, false},
+	}
+	for _, row := range rows {
+		record := requestLogRecord(&ReqeustLog{
+			Platform: "claude", Provider: "p", Model: "claude-sonnet-4", HttpCode: row.httpCode,
+			InputTokens: 1000, OutputTokens: 500, IsShadow: row.shadow,
+		})
+		record["created_at"] = now.Add(-row.age).UTC().Format(timeLayout)
+		if _, err := xdb.New("request_log").Insert(record); err != nil {
+			t.Fatalf("写入 request_log 失败: %v", err)
+		}
+	}
+
+	ls := NewLogService()
+	sumHeatmap := func() (int64, float64) {
+		stats, err := ls.HeatmapStats(3)
+		if err != nil {
+			t.Fatalf("HeatmapStats 失败: %v", err)
+		}
+		var requests int64
+		var cost float64
+		for _, stat := range stats {
+			requests += stat.TotalRequests
+			cost += stat.TotalCost
+		}
+		return requests, cost
+	}
+	rawRequests, rawCost := sumHeatmap()
+	if rawRequests != 4 {
+		t.Fatalf("原始日志统计应为 4 次请求（不含影子流量），实际 %d", rawRequests)
+	}
+	rawToday, err := ls.StatsSince("claude")
+	if err != nil {
+		t.Fatalf("StatsSince 失败: %v", err)
+	}
+
+	hours, err := ls.rollupRequestLogs(now)
+	if err != nil {
+		t.Fatalf("rollupRequestLogs 失败: %v", err)
+	}
+	if hours < 48 {
+		t.Errorf("应从最早的日志开始汇总，实际汇总 %d 小时", hours)
+	}
+	if hours, err := ls.rollupRequestLogs(now); err != nil || hours != 0 {
+		t.Errorf("重复汇总应跳过已汇总的小时，实际 (%d, %v)", hours, err)
+	}
+
+	records, err := xdb.New("request_log_daily").Selects(xdb.Field("SUM(total_requests) as requests", "SUM(failed_requests) as failed"))
+	if err != nil || len(records) != 1 || records[0].GetInt64("requests") != 3 || records[0].GetInt64("failed") != 1 {
+		t.Errorf("日汇总应包含已结束小时的 3 次请求（1 次失败），实际 %v (%v)", records, err)
+	}
+
+	removed, err := pruneRequestLogs(1, nil, now)
+	if err != nil || removed != 2 {
+		t.Errorf("应删除超过 1 天的 2 条原始日志，实际 (%d, %v)", removed, err)
+	}
+
+	requests, cost := sumHeatmap()
+	if requests != rawRequests || math.Abs(cost-rawCost) > 1e-9 {
+		t.Errorf("汇总后统计应保持不变：请求 %d -> %d，花费 %v -> %v", rawRequests, requests, rawCost, cost)
+	}
+	today, err := ls.StatsSince("claude")
+	if err != nil {
+		t.Fatalf("StatsSince 失败: %v", err)
+	}
+	if today.TotalRequests != rawToday.TotalRequests || math.Abs(today.CostTotal-rawToday.CostTotal) > 1e-9 {
+		t.Errorf("今日统计应保持不变：%+v -> %+v", rawToday, today)
+	}
+}
+
+func TestPruneRequestLogsKeepsUnrolledRows(t *testing.T) {
+	initTestRequestLogDB(t)
+
+	record := requestLogRecord(&ReqeustLog{Platform: "claude", Provider: "p", Model: "m", HttpCode: 200})
+	record["created_at"] = time.Now().Add(-10 * 24 * time.Hour).UTC().Format(timeLayout)
+	if _, err := xdb.New("request_log").Insert(record); err != nil {
+		t.Fatalf("写入 request_log 失败: %v", err)
+	}
+	if removed, err := pruneRequestLogs(1, nil, time.Now()); err != nil || removed != 0 {
+		t.Errorf("尚未汇总的日志不应删除，实际 (%d, %v)", removed, err)
+	}
+}
+
+func TestPruneRequestLogsKeepsBudgetPeriod(t *testing.T) {
+	initTestRequestLogDB(t)
+
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	rows := []time.Time{
+		monthStart.AddDate(0, 0, -1), // 上个周期，可以删除
+		monthStart.Add(time.Minute),  // 本月预算周期内，需保留
+	}
+	for _, createdAt := range rows {
+		record := requestLogRecord(&ReqeustLog{Platform: "claude", Provider: "p", Model: "m", HttpCode: 200, InputTokens: 1000})
+		record["created_at"] = createdAt.UTC().Format(timeLayout)
+		if _, err := xdb.New("request_log").Insert(record); err != nil {
+			t.Fatalf("写入 request_log 失败: %v", err)
+		}
+	}
+	if _, err := NewLogService().rollupRequestLogs(now); err != nil {
+		t.Fatalf("rollupRequestLogs 失败: %v", err)
+	}
+
+	budgets := []Budget{
+		{Name: "daily", Enabled: true, Period: "daily", HardLimit: 10},
+		{Name: "monthly", Enabled: true, Period: "monthly", HardLimit: 100},
+		{Name: "disabled", Enabled: false, Period: "monthly", HardLimit: 100},
+	}
+	removed, err := pruneRequestLogs(1, budgets, now)
+	remaining, _ := xdb.New("request_log").Count()
+	if err != nil || removed != 1 || remaining != 1 {
+		t.Errorf("应只删除上个周期的 1 条日志，实际删除 (%d, %v)、剩余 %d", removed, err, remaining)
+	}
+}
+
+func TestRollupRequestLogsHalfHourOffset(t *testing.T) {
+	initTestRequestLogDB(t)
+	local := time.Local
+	time.Local = time.FixedZone("IST", 5*3600+30*60)
+	t.Cleanup(func() { time.Local = local })
+
+	for _, createdAt := range []string{
+		"2025-01-01 04:10:00", // 09:40 +05:30
+		"2025-01-01 04:40:00", // 10:10 +05:30
+		"2025-01-01 05:20:00", // 10:50 +05:30
+		"2025-01-01 18:20:00", // 23:50 +05:30
+		"2025-01-01 18:40:00", // 次日 00:10 +05:30
+	} {
+		record := requestLogRecord(&ReqeustLog{Platform: "claude", Provider: "p", Model: "claude-sonnet-4", HttpCode: 200})
+		record["created_at"] = createdAt
+		if _, err := xdb.New("request_log").Insert(record); err != nil {
+			t.Fatalf("写入 request_log 失败: %v", err)
+		}
+	}
+	expectedHours := map[string]int64{
+		"2025-01-01 09:00": 1,
+		"2025-01-01 10:00": 2,
+		"2025-01-01 23:00": 1,
+		"2025-01-02 00:00": 1,
+	}
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	checkHours := func(name string, buckets []*usageBucket) {
+		t.Helper()
+		got := make(map[string]int64)
+		for _, bucket := range buckets {
+			got[bucket.hour.Format("2006-01-02 15:04")] += bucket.totalRequests
+		}
+		if len(got) != len(expectedHours) {
+			t.Fatalf("%s 按本地小时汇总 %v，期望 %v", name, got, expectedHours)
+		}
+		for hour, requests := range expectedHours {
+			if got[hour] != requests {
+				t.Errorf("%s %s 的请求数 = %d, 期望 %d", name, hour, got[hour], requests)
+			}
+		}
+	}
+
+	ls := NewLogService()
+	raw, err := ls.loadHourlyUsage("", since, time.Time{})
+	if err != nil {
+		t.Fatalf("loadHourlyUsage 失败: %v", err)
+	}
+	checkHours("原始日志", raw)
+
+	if _, err := ls.rollupRequestLogs(time.Date(2025, 1, 2, 6, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("rollupRequestLogs 失败: %v", err)
+	}
+	rolled, err := ls.loadHourlyUsage("", since, time.Time{})
+	if err != nil {
+		t.Fatalf("loadHourlyUsage 失败: %v", err)
+	}
+	checkHours("小时汇总表", rolled)
+
+	records, err := xdb.New("request_log_daily").Selects(xdb.OrderByAsc("bucket"))
+	if err != nil || len(records) != 2 ||
+		records[0].GetString("bucket") != "2025-01-01" || records[0].GetInt64("total_requests") != 4 ||
+		records[1].GetString("bucket") != "2025-01-02" || records[1].GetInt64("total_requests") != 1 {
+		t.Errorf("日汇总应按本地日期切分为 4 + 1 次请求，实际 %v (%v)", records, err)
+	}
+}
+
+// aggregateRawUsageByRow 逐行读取并计价的参考实现，用于校验 SQL 分组汇总的结果并作为基准对照
+func aggregateRawUsageByRow(ls *LogService, from time.Time) (map[usageKey]*usageBucket, error) {
+	records, err := xdb.New("request_log").Selects(
+		xdb.WhereGte("created_at", from.UTC().Format(timeLayout)),
+		xdb.WhereEq("is_shadow", 0),
+	)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[usageKey]*usageBucket)
+	for _, record := range records {
+		createdAt, err := time.ParseInLocation(timeLayout, formatDBTime(record["created_at"]), time.UTC)
+		if err != nil {
+			return nil, err
+		}
+		key := usageKey{
+			hour:     startOfHour(createdAt.In(time.Local)),
+			platform: record.GetString("platform"),
+			provider: record.GetString("provider"),
+			model:    record.GetString("model"),
+		}
+		bucket := buckets[key]
+		if bucket == nil {
+			bucket = &usageBucket{usageKey: key}
+			buckets[key] = bucket
+		}
+		usage := modelpricing.UsageSnapshot{
+			InputTokens:       record.GetInt("input_tokens"),
+			OutputTokens:      record.GetInt("output_tokens"),
+			CacheCreateTokens: record.GetInt("cache_create_tokens"),
+			CacheReadTokens:   record.GetInt("cache_read_tokens"),
+			CacheCreation: cacheCreationDetail(
+				record.GetInt("cache_create_5m_tokens"),
+				record.GetInt("cache_create_1h_tokens"),
+			),
+		}
+		cost := ls.calculateCost(key.model, usage)
+		bucket.totalRequests++
+		bucket.inputTokens += int64(usage.InputTokens)
+		bucket.outputTokens += int64(usage.OutputTokens)
+		bucket.totalCost += cost.TotalCost
+	}
+	return buckets, nil
+}
+
+// seedRequestLogs 写入 n 条分布在最近 24 小时内的合成日志
+func seedRequestLogs(tb testing.TB, n int) {
+	tb.Helper()
+	db, err := xdb.DB("default")
+	if err != nil {
+		tb.Fatalf("获取数据库失败: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatalf("开启事务失败: %v", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO request_log (platform, provider, model, http_code, input_tokens, output_tokens,
+		reasoning_tokens, cache_create_tokens, cache_read_tokens, cache_create_5m_tokens, cache_create_1h_tokens, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?, 0, ?)`)
+	if err != nil {
+		tb.Fatalf("准备语句失败: %v", err)
+	}
+	models := []string{"claude-sonnet-4", "claude-opus-4", "claude-sonnet-4-20250514[1m]", "gpt-5"}
+	now := time.Now().UTC()
+	for i := 0; i < n; i++ {
+		input := 1000 + i%5000
+		if i%97 == 0 {
+			// 少量超过长上下文阈值的请求
+			input = modelpricing.LongContextThreshold + i%1000
+		}
+		httpCode := 200
+		if i%13 == 0 {
+			httpCode = 529
+		}
+		cacheCreate := i % 300
+		if _, err := stmt.Exec(
+			[]string{"claude", "codex"}[i%2], fmt.Sprintf("provider-%d", i%5), models[i%len(models)], httpCode,
+			input, 200+i%700, cacheCreate, i%2000, cacheCreate,
+			now.Add(-time.Duration(i%(24*3600))*time.Second).Format(timeLayout),
+		); err != nil {
+			tb.Fatalf("写入合成日志失败: %v", err)
+		}
+	}
+	_ = stmt.Close()
+	if err := tx.Commit(); err != nil {
+		tb.Fatalf("提交事务失败: %v", err)
+	}
+}
+
+func TestAggregateRawUsageMatchesRowByRow(t *testing.T) {
+	initTestRequestLogDB(t)
+	seedRequestLogs(t, 2000)
+
+	ls := NewLogService()
+	since := time.Now().Add(-25 * time.Hour)
+	grouped, err := ls.aggregateRawUsage("", since, time.Time{})
+	if err != nil {
+		t.Fatalf("aggregateRawUsage 失败: %v", err)
+	}
+	expected, err := aggregateRawUsageByRow(ls, since)
+	if err != nil {
+		t.Fatalf("逐行汇总失败: %v", err)
+	}
+	if len(grouped) != len(expected) {
+		t.Fatalf("分组数量 %d, 期望 %d", len(grouped), len(expected))
+	}
+	for key, want := range expected {
+		got := grouped[key]
+		if got == nil {
+			t.Fatalf("缺少分组 %+v", key)
+		}
+		if got.totalRequests != want.totalRequests || got.inputTokens != want.inputTokens || got.outputTokens != want.outputTokens {
+			t.Errorf("分组 %+v 用量不一致: %+v, 期望 %+v", key, got, want)
+		}
+		if math.Abs(got.totalCost-want.totalCost) > 1e-6*math.Max(1, want.totalCost) {
+			t.Errorf("分组 %+v 花费 %v, 期望 %v", key, got.totalCost, want.totalCost)
+		}
+	}
+}
+
+// BenchmarkRawUsageAggregation 对比 100 万行日志上 SQL 分组汇总与逐行汇总的耗时：
+//
+//	go test ./services -run '^$' -bench RawUsageAggregation -benchtime 1x
+func BenchmarkRawUsageAggregation(b *testing.B) {
+	if testing.Short() {
+		b.Skip("跳过 100 万行基准测试")
+	}
+	initTestRequestLogDB(b)
+	seedRequestLogs(b, 1_000_000)
+	ls := NewLogService()
+	since := time.Now().Add(-25 * time.Hour)
+
+	b.Run("sql-group", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ls.aggregateRawUsage("", since, time.Time{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("row-by-row", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := aggregateRawUsageByRow(ls, since); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	modelpricing "codeswitch/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+
+	// 后台补算花费时每批处理的行数
+	costBackfillBatch = 5000
+)
+
+// requestLogSort 排序字段：expr 用于排序与游标比较，field 为读取游标值的列
+type requestLogSort struct {
+	expr  string
+	field string
+}
+
+// 可排序的字段，created_at 按自增 id 排序（与写入顺序一致）
+var requestLogSortColumns = map[string]requestLogSort{
+	"created_at":    {expr: "id", field: "id"},
+	"duration_sec":  {expr: "duration_sec", field: "duration_sec"},
+	"total_cost":    {expr: "COALESCE(total_cost, 0)", field: "total_cost"},
+	"input_tokens":  {expr: "input_tokens", field: "input_tokens"},
+	"output_tokens": {expr: "output_tokens", field: "output_tokens"},
+}
+
+// RequestLogQuery 日志查询条件，零值字段不参与过滤
+type RequestLogQuery struct {
+	Platform  string `json:"platform"`
+	Provider  string `json:"provider"`
+	Model     string `json:"model"`
+	RequestID string `json:"request_id"`
+
+	// 本地时间，格式 2006-01-02 15:04:05 或 2006-01-02；开始时间包含，结束时间不包含，
+	// 结束时间只写日期时包含当天
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+
+	HttpCode    int    `json:"http_code"`
+	StatusClass string `json:"status_class"` // 2xx / 4xx / 5xx / failed（非 2xx）
+	ErrorClass  string `json:"error_class"`
+	IsStream    *bool  `json:"is_stream"`
+	IsShadow    *bool  `json:"is_shadow"`
+
+	// 按写入（或补算）时的价格保存的 total_cost 过滤；价格表更新后，展示与导出的花费按当前价格重算，
+	// 二者可能不一致，total_cost 排序同理
+	MinCost        *float64 `json:"min_cost"`
+	MaxCost        *float64 `json:"max_cost"`
+	MinDurationSec float64  `json:"min_duration_sec"`
+
+	SortBy string `json:"sort_by"` // created_at（默认）/ duration_sec / total_cost / input_tokens / output_tokens
+	Order  string `json:"order"`   // desc（默认）/ asc
+	Cursor string `json:"cursor"`  // 上一页返回的 next_cursor
+	Limit  int    `json:"limit"`
+}
+
+// RequestLogPage 一页查询结果
+type RequestLogPage struct {
+	Logs       []ReqeustLog `json:"logs"`
+	NextCursor string       `json:"next_cursor"` // 为空表示没有更多数据
+}
+
+// searchCursor 分页游标：上一页最后一行的排序值与 id
+type searchCursor struct {
+	SortBy string  `json:"s"`
+	Value  float64 `json:"v"`
+	ID     int64   `json:"id"`
+}
+
+// SearchRequestLogs 按条件查询 request_log，使用游标分页
+func (ls *LogService) SearchRequestLogs(query RequestLogQuery) (RequestLogPage, error) {
+	page := RequestLogPage{Logs: []ReqeustLog{}}
+	options, err := query.filters()
+	if err != nil {
+		return page, err
+	}
+	sortBy := query.SortBy
+	if sortBy == "" {
+		sortBy = "created_at"
+	}
+	sortKey, ok := requestLogSortColumns[sortBy]
+	if !ok {
+		return page, fmt.Errorf("不支持的排序字段 '%s'", query.SortBy)
+	}
+	desc := true
+	switch strings.ToLower(query.Order) {
+	case "", "desc":
+	case "asc":
+		desc = false
+	default:
+		return page, fmt.Errorf("不支持的排序方向 '%s'", query.Order)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	compare, orderBy := ">", xdb.OrderByAsc
+	if desc {
+		compare, orderBy = "<", xdb.OrderByDesc
+	}
+	if query.Cursor != "" {
+		cursor, err := decodeSearchCursor(query.Cursor)
+		if err != nil || cursor.SortBy != sortBy {
+			return page, fmt.Errorf("无效的分页游标")
+		}
+		if sortKey.expr == "id" {
+			options = append(options, xdb.Where("id", compare, cursor.ID))
+		} else {
+			options = append(options, xdb.WhereGroup(
+				xdb.Where(sortKey.expr, compare, cursor.Value),
+				xdb.WhereOrGroup(
+					xdb.WhereEq(sortKey.expr, cursor.Value),
+					xdb.Where("id", compare, cursor.ID),
+				),
+			))
+		}
+	}
+	if sortKey.expr != "id" {
+		options = append(options, orderBy(sortKey.expr))
+	}
+	// 多取一行判断是否还有下一页
+	options = append(options, orderBy("id"), xdb.Limit(limit+1))
+
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return page, nil
+		}
+		return page, err
+	}
+	hasMore := len(records) > limit
+	if hasMore {
+		records = records[:limit]
+	}
+	page.Logs = ls.requestLogsFromRecords(records)
+	if hasMore {
+		last := records[len(records)-1]
+		cursor := searchCursor{SortBy: sortBy, ID: last.GetInt64("id")}
+		if sortKey.expr != "id" {
+			cursor.Value = last.GetFloat64(sortKey.field)
+		}
+		page.NextCursor = encodeSearchCursor(cursor)
+	}
+	return page, nil
+}
+
+// CountRequestLogs 返回满足条件的日志数量，忽略分页与排序参数
+func (ls *LogService) CountRequestLogs(query RequestLogQuery) (int64, error) {
+	options, err := query.filters()
+	if err != nil {
+		return 0, err
+	}
+	count, err := xdb.New("request_log").Count(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return count, nil
+}
+
+// filters 将查询条件转换为 SQL 过滤条件
+func (q RequestLogQuery) filters() ([]xdb.Option, error) {
+	options := make([]xdb.Option, 0)
+	for _, field := range []struct{ column, value string }{
+		{"platform", q.Platform},
+		{"provider", q.Provider},
+		{"model", q.Model},
+		{"request_id", q.RequestID},
+		{"error_class", q.ErrorClass},
+	} {
+		if value := strings.TrimSpace(field.value); value != "" {
+			options = append(options, xdb.WhereEq(field.column, value))
+		}
+	}
+
+	// created_at 由 SQLite CURRENT_TIMESTAMP 写入，为 UTC 时间
+	if q.StartTime != "" {
+		start, _, err := parseQueryTime(q.StartTime)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, xdb.WhereGte("created_at", start.UTC().Format(timeLayout)))
+	}
+	if q.EndTime != "" {
+		end, dateOnly, err := parseQueryTime(q.EndTime)
+		if err != nil {
+			return nil, err
+		}
+		if dateOnly {
+			end = end.AddDate(0, 0, 1)
+		}
+		options = append(options, xdb.WhereLt("created_at", end.UTC().Format(timeLayout)))
+	}
+
+	if q.HttpCode != 0 {
+		options = append(options, xdb.WhereEq("http_code", q.HttpCode))
+	}
+	switch strings.ToLower(q.StatusClass) {
+	case "":
+	case "2xx", "4xx", "5xx":
+		base := int(q.StatusClass[0]-'0') * 100
+		options = append(options, xdb.WhereGe("http_code", base), xdb.WhereLt("http_code", base+100))
+	case "failed":
+		// 只有 HTTP 200-299 才算成功，其他（包括 0）都算失败
+		options = append(options, xdb.WhereGroup(
+			xdb.WhereLt("http_code", 200),
+			xdb.WhereOrGe("http_code", 300),
+		))
+	default:
+		return nil, fmt.Errorf("不支持的状态分类 '%s'", q.StatusClass)
+	}
+
+	if q.IsStream != nil {
+		options = append(options, xdb.WhereEq("is_stream", boolToInt(*q.IsStream)))
+	}
+	if q.IsShadow != nil {
+		options = append(options, xdb.WhereEq("is_shadow", boolToInt(*q.IsShadow)))
+	}
+	// 使用写入时保存的花费，不随价格表更新
+	if q.MinCost != nil {
+		options = append(options, xdb.WhereGte("total_cost", *q.MinCost))
+	}
+	if q.MaxCost != nil {
+		options = append(options, xdb.WhereLte("total_cost", *q.MaxCost))
+	}
+	if q.MinDurationSec > 0 {
+		options = append(options, xdb.WhereGte("duration_sec", q.MinDurationSec))
+	}
+	return options, nil
+}
+
+// parseQueryTime 解析本地时间，返回是否只包含日期
+func parseQueryTime(value string) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.ParseInLocation(timeLayout, value, time.Local); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("无法解析时间 '%s'，格式应为 2006-01-02 15:04:05 或 2006-01-02", value)
+}
+
+func encodeSearchCursor(cursor searchCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(value string) (searchCursor, error) {
+	var cursor searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
+
+// backfillRequestLogCosts 为添加 total_cost 列之前写入的日志补算花费，返回更新的行数
+func backfillRequestLogCosts(pricing *modelpricing.Service) (int, error) {
+	if pricing == nil {
+		return 0, nil
+	}
+	db, err := xdb.DB("default")
+	if err != nil {
+		return 0, err
+	}
+	ls := &LogService{pricing: pricing}
+	updated := 0
+	for {
+		records, err := xdb.New("request_log").Selects(
+			xdb.WhereIsNil("total_cost"),
+			xdb.Field(
+				"id",
+				"model",
+				"input_tokens",
+				"output_tokens",
+				"cache_create_tokens",
+				"cache_read_tokens",
+				"cache_create_5m_tokens",
+				"cache_create_1h_tokens",
+			),
+			xdb.Limit(costBackfillBatch),
+		)
+		if err != nil {
+			if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+				return updated, nil
+			}
+			return updated, err
+		}
+		if len(records) == 0 {
+			return updated, nil
+		}
+		if err := updateRequestLogCosts(db, ls, records); err != nil {
+			return updated, err
+		}
+		updated += len(records)
+	}
+}
+
+func updateRequestLogCosts(db *sql.DB, ls *LogService, records []xdb.Record) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	stmt, err := tx.Prepare(`UPDATE request_log SET total_cost = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, record := range records {
+		usage := modelpricing.UsageSnapshot{
+			InputTokens:       record.GetInt("input_tokens"),
+			OutputTokens:      record.GetInt("output_tokens"),
+			CacheCreateTokens: record.GetInt("cache_create_tokens"),
+			CacheReadTokens:   record.GetInt("cache_read_tokens"),
+			CacheCreation: cacheCreationDetail(
+				record.GetInt("cache_create_5m_tokens"),
+				record.GetInt("cache_create_1h_tokens"),
+			),
+		}
+		cost := ls.calculateCost(record.GetString("model"), usage)
+		if _, err = stmt.Exec(cost.TotalCost, record.GetInt64("id")); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// ==================== 日志查询测试 ====================
+
+func seedSearchLogs(t *testing.T) {
+	t.Helper()
+	now := time.Now()
+	rows := []struct {
+		model      string
+		httpCode   int
+		errorClass string
+		stream     bool
+		duration   float64
+		cost       any
+		age        time.Duration
+	}{
+		{"claude-sonnet-4", 200, "", true, 1.5, 0.02, time.Hour},
+		{"claude-sonnet-4", 200, "", false, 12, 0.5, 2 * time.Hour},
+		{"claude-opus-4", 529, "overloaded", false, 0.3, 0.0, 3 * time.Hour},
+		{"claude-opus-4", 401, "auth", false, 0.1, 0.0, 4 * time.Hour},
+		{"claude-opus-4", 200, "", true, 30, 1.2, 48 * time.Hour},
+		{"claude-sonnet-4", 0, "timeout", true, 60, nil, 72 * time.Hour},
+	}
+	for i, row := range rows {
+		record := requestLogRecord(&ReqeustLog{
+			Platform: "claude", Provider: "p", Model: row.model, HttpCode: row.httpCode,
+			ErrorClass: row.errorClass, IsStream: row.stream, DurationSec: row.duration,
+			RequestID: "req-" + string(rune('a'+i)),
+		})
+		record["total_cost"] = row.cost
+		record["created_at"] = now.Add(-row.age).UTC().Format(timeLayout)
+		if _, err := xdb.New("request_log").Insert(record); err != nil {
+			t.Fatalf("写入 request_log 失败: %v", err)
+		}
+	}
+}
+
+func TestSearchRequestLogsFilters(t *testing.T) {
+	initTestRequestLogDB(t)
+	seedSearchLogs(t)
+	ls := NewLogService()
+
+	yes, no := true, false
+	minCost, maxCost := 0.1, 1.0
+	tests := []struct {
+		name    string
+		query   RequestLogQuery
+		want    int64
+		wantErr bool
+	}{
+		{"无过滤", RequestLogQuery{}, 6, false},
+		{"按模型", RequestLogQuery{Model: "claude-opus-4"}, 3, false},
+		{"按请求 ID", RequestLogQuery{RequestID: "req-c"}, 1, false},
+		{"按状态码", RequestLogQuery{HttpCode: 529}, 1, false},
+		{"4xx", RequestLogQuery{StatusClass: "4xx"}, 1, false},
+		{"失败请求包含状态码 0", RequestLogQuery{StatusClass: "failed"}, 3, false},
+		{"按错误分类", RequestLogQuery{ErrorClass: "timeout"}, 1, false},
+		{"流式请求", RequestLogQuery{IsStream: &yes}, 3, false},
+		{"非流式请求", RequestLogQuery{IsStream: &no}, 3, false},
+		{"花费区间", RequestLogQuery{MinCost: &minCost, MaxCost: &maxCost}, 1, false},
+		{"最短耗时", RequestLogQuery{MinDurationSec: 10}, 3, false},
+		{"开始时间", RequestLogQuery{StartTime: time.Now().Add(-5 * time.Hour).Format(timeLayout)}, 4, false},
+		{"结束日期包含当天", RequestLogQuery{EndTime: time.Now().AddDate(0, 0, -2).Format("2006-01-02")}, 2, false},
+		{"无效时间", RequestLogQuery{StartTime: "yesterday"}, 0, true},
+		{"无效状态分类", RequestLogQuery{StatusClass: "3xx"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := ls.CountRequestLogs(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CountRequestLogs() 错误 = %v, 期望出错 %v", err, tt.wantErr)
+			}
+			if count != tt.want {
+				t.Errorf("CountRequestLogs() = %d, 期望 %d", count, tt.want)
+			}
+			if tt.wantErr {
+				return
+			}
+			tt.query.Limit = maxSearchLimit
+			page, err := ls.SearchRequestLogs(tt.query)
+			if err != nil || int64(len(page.Logs)) != tt.want || page.NextCursor != "" {
+				t.Errorf("SearchRequestLogs() 返回 %d 条, next_cursor %q (%v), 期望 %d 条", len(page.Logs), page.NextCursor, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchRequestLogsPagination(t *testing.T) {
+	initTestRequestLogDB(t)
+	seedSearchLogs(t)
+	ls := NewLogService()
+
+	tests := []struct {
+		name   string
+		sortBy string
+		order  string
+		want   []string
+	}{
+		// created_at 按写入顺序（id）排序
+		{"默认按时间倒序", "", "", []string{"req-f", "req-e", "req-d", "req-c", "req-b", "req-a"}},
+		{"按时间正序", "created_at", "asc", []string{"req-a", "req-b", "req-c", "req-d", "req-e", "req-f"}},
+		// 花费相同时按 id 排序，NULL 视为 0
+		{"按花费倒序", "total_cost", "desc", []string{"req-e", "req-b", "req-a", "req-f", "req-d", "req-c"}},
+		{"按耗时正序", "duration_sec", "asc", []string{"req-d", "req-c", "req-a", "req-b", "req-e", "req-f"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := RequestLogQuery{SortBy: tt.sortBy, Order: tt.order, Limit: 4}
+			var got []string
+			for pages := 0; pages < 5; pages++ {
+				page, err := ls.SearchRequestLogs(query)
+				if err != nil {
+					t.Fatalf("SearchRequestLogs 失败: %v", err)
+				}
+				for _, log := range page.Logs {
+					got = append(got, log.RequestID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				query.Cursor = page.NextCursor
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("分页结果 %v, 期望 %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("分页结果 %v, 期望 %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	if _, err := ls.SearchRequestLogs(RequestLogQuery{Cursor: "not-a-cursor"}); err == nil {
+		t.Errorf("无效的游标应返回错误")
+	}
+	page, _ := ls.SearchRequestLogs(RequestLogQuery{Limit: 1})
+	if _, err := ls.SearchRequestLogs(RequestLogQuery{SortBy: "duration_sec", Cursor: page.NextCursor}); err == nil {
+		t.Errorf("排序字段与游标不一致时应返回错误")
+	}
+	if _, err := ls.SearchRequestLogs(RequestLogQuery{SortBy: "provider"}); err == nil {
+		t.Errorf("不支持的排序字段应返回错误")
+	}
+}
+
+func TestBackfillRequestLogCosts(t *testing.T) {
+	initTestRequestLogDB(t)
+	record := requestLogRecord(&ReqeustLog{Platform: "claude", Provider: "p", Model: "claude-sonnet-4", HttpCode: 200,
+		InputTokens: 1000, OutputTokens: 500})
+	record["total_cost"] = nil
+	if _, err := xdb.New("request_log").Insert(record); err != nil {
+		t.Fatalf("写入 request_log 失败: %v", err)
+	}
+	ls := NewLogService()
+	updated, err := backfillRequestLogCosts(ls.pricing)
+	if err != nil || updated != 1 {
+		t.Fatalf("应补算 1 条日志，实际 (%d, %v)", updated, err)
+	}
+	minCost := 0.000001
+	if count, err := ls.CountRequestLogs(RequestLogQuery{MinCost: &minCost}); err != nil || count != 1 {
+		t.Errorf("补算后应能按花费过滤，实际 (%d, %v)", count, err)
+	}
+	if updated, err := backfillRequestLogCosts(ls.pricing); err != nil || updated != 0 {
+		t.Errorf("重复补算应跳过已有花费的日志，实际 (%d, %v)", updated, err)
+	}
+}
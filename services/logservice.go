@@ -15,7 +15,8 @@ import (
 const timeLayout = "2006-01-02 15:04:05"
 
 type LogService struct {
-	pricing *modelpricing.Service
+	pricing     *modelpricing.Service
+	writerStats func() []RequestLogWriterStats
 }
 
 func NewLogService() *LogService {
@@ -26,6 +27,19 @@ func NewLogService() *LogService {
 	return &LogService{pricing: svc}
 }
 
+// SetWriterStatsSource 设置 request_log 写入器指标的来源（由中转服务提供）
+func (ls *LogService) SetWriterStatsSource(source func() []RequestLogWriterStats) {
+	ls.writerStats = source
+}
+
+// LogWriterStats 返回每个 request_log 输出的队列长度、丢弃数等指标
+func (ls *LogService) LogWriterStats() []RequestLogWriterStats {
+	if ls == nil || ls.writerStats == nil {
+		return nil
+	}
+	return ls.writerStats()
+}
+
 func (ls *LogService) ListRequestLogs(platform string, provider string, limit int) ([]ReqeustLog, error) {
 	if limit <= 0 {
 		limit = 100
@@ -48,27 +62,109 @@ func (ls *LogService) ListRequestLogs(platform string, provider string, limit in
 	if err != nil {
 		return nil, err
 	}
+	return ls.requestLogsFromRecords(records), nil
+}
+
+// GetRequestAttempts 返回同一客户端请求（X-Code-Switch-Request-Id）的所有上游尝试，按尝试顺序排列
+func (ls *LogService) GetRequestAttempts(requestID string) ([]ReqeustLog, error) {
+	requestID = strings.TrimSpace(requestID)
+	if requestID == "" {
+		return []ReqeustLog{}, nil
+	}
+	records, err := xdb.New("request_log").Selects(
+		xdb.WhereEq("request_id", requestID),
+		xdb.WhereEq("is_shadow", 0),
+		xdb.OrderByAsc("attempt"),
+		xdb.OrderByAsc("id"),
+	)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ReqeustLog{}, nil
+		}
+		return nil, err
+	}
+	return ls.requestLogsFromRecords(records), nil
+}
+
+// GetReplays 返回由指定请求重放产生的 request_log，按时间先后排列
+func (ls *LogService) GetReplays(requestID string) ([]ReqeustLog, error) {
+	requestID = strings.TrimSpace(requestID)
+	if requestID == "" {
+		return []ReqeustLog{}, nil
+	}
+	records, err := xdb.New("request_log").Selects(
+		xdb.WhereEq("replay_of", requestID),
+		xdb.OrderByAsc("id"),
+	)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ReqeustLog{}, nil
+		}
+		return nil, err
+	}
+	return ls.requestLogsFromRecords(records), nil
+}
+
+// ShadowStats 对比最近 hours 小时内影子 provider 与被镜像请求的主请求结果，
+// 影子流量不计入其他统计
+func (ls *LogService) ShadowStats(platform string, hours int) ([]ShadowComparison, error) {
+	if hours <= 0 {
+		hours = 24
+	}
+	return ls.loadShadowComparisons(platform, time.Now().Add(-time.Duration(hours)*time.Hour))
+}
+
+// GetCapturedExchanges 返回某次客户端请求各次上游尝试捕获的请求/响应体（已脱敏），过期的捕获不返回
+func (ls *LogService) GetCapturedExchanges(requestID string) ([]CapturedExchange, error) {
+	requestID = strings.TrimSpace(requestID)
+	if requestID == "" {
+		return []CapturedExchange{}, nil
+	}
+	exchanges, err := loadCapturedExchanges(requestID, time.Now())
+	if err != nil {
+		if isNoSuchTableErr(err) {
+			return []CapturedExchange{}, nil
+		}
+		return nil, err
+	}
+	return exchanges, nil
+}
+
+func (ls *LogService) requestLogsFromRecords(records []xdb.Record) []ReqeustLog {
 	logs := make([]ReqeustLog, 0, len(records))
 	for _, record := range records {
 		logEntry := ReqeustLog{
-			ID:                record.GetInt64("id"),
-			Platform:          record.GetString("platform"),
-			Model:             record.GetString("model"),
-			Provider:          record.GetString("provider"),
-			HttpCode:          record.GetInt("http_code"),
-			InputTokens:       record.GetInt("input_tokens"),
-			OutputTokens:      record.GetInt("output_tokens"),
-			CacheCreateTokens: record.GetInt("cache_create_tokens"),
-			CacheReadTokens:   record.GetInt("cache_read_tokens"),
-			ReasoningTokens:   record.GetInt("reasoning_tokens"),
-			CreatedAt:         record.GetString("created_at"),
-			IsStream:          record.GetBool("is_stream"),
-			DurationSec:       record.GetFloat64("duration_sec"),
+			ID:                   record.GetInt64("id"),
+			Platform:             record.GetString("platform"),
+			Model:                record.GetString("model"),
+			Provider:             record.GetString("provider"),
+			HttpCode:             record.GetInt("http_code"),
+			InputTokens:          record.GetInt("input_tokens"),
+			OutputTokens:         record.GetInt("output_tokens"),
+			CacheCreateTokens:    record.GetInt("cache_create_tokens"),
+			CacheReadTokens:      record.GetInt("cache_read_tokens"),
+			CacheCreate5mTokens:  record.GetInt("cache_create_5m_tokens"),
+			CacheCreate1hTokens:  record.GetInt("cache_create_1h_tokens"),
+			ReasoningTokens:      record.GetInt("reasoning_tokens"),
+			RequestID:            record.GetString("request_id"),
+			Attempt:              record.GetInt("attempt"),
+			UpstreamRequestID:    record.GetString("upstream_request_id"),
+			ErrorClass:           record.GetString("error_class"),
+			ErrorMessage:         record.GetString("error_message"),
+			IsFinal:              record.GetBool("is_final"),
+			ReplayOf:             record.GetString("replay_of"),
+			IsShadow:             record.GetBool("is_shadow"),
+			CreatedAt:            record.GetString("created_at"),
+			IsStream:             record.GetBool("is_stream"),
+			DurationSec:          record.GetFloat64("duration_sec"),
+			Outcome:              record.GetString("outcome"),
+			FallbackFrom:         record.GetString("fallback_from"),
+			EstimatedInputTokens: record.GetInt("estimated_input_tokens"),
 		}
 		ls.decorateCost(&logEntry)
 		logs = append(logs, logEntry)
 	}
-	return logs, nil
+	return logs
 }
 
 func (ls *LogService) ListProviders(platform string) ([]string, error) {
@@ -107,57 +203,24 @@ func (ls *LogService) HeatmapStats(days int) ([]HeatmapStat, error) {
 	if totalHours > 1 {
 		rangeStart = rangeStart.Add(-time.Duration(totalHours-1) * time.Hour)
 	}
-	model := xdb.New("request_log")
-	options := []xdb.Option{
-		xdb.WhereGe("created_at", rangeStart.Format(timeLayout)),
-		xdb.Field(
-			"model",
-			"input_tokens",
-			"output_tokens",
-			"reasoning_tokens",
-			"cache_create_tokens",
-			"cache_read_tokens",
-			"created_at",
-		),
-		xdb.OrderByDesc("created_at"),
-	}
-	records, err := model.Selects(options...)
+	// 已汇总的小时读取小时表，其余从原始日志计算
+	buckets, err := ls.loadHourlyUsage("", rangeStart, time.Time{})
 	if err != nil {
-		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return []HeatmapStat{}, nil
-		}
 		return nil, err
 	}
 	hourBuckets := map[int64]*HeatmapStat{}
-	for _, record := range records {
-		createdAt, _ := parseCreatedAt(record)
-		if createdAt.IsZero() {
-			continue
-		}
-		hourStart := startOfHour(createdAt)
-		hourKey := hourStart.Unix()
+	for _, usage := range buckets {
+		hourKey := usage.hour.Unix()
 		bucket := hourBuckets[hourKey]
 		if bucket == nil {
-			bucket = &HeatmapStat{Day: hourStart.Format("01-02 15")}
+			bucket = &HeatmapStat{Day: usage.hour.Format("01-02 15")}
 			hourBuckets[hourKey] = bucket
 		}
-		bucket.TotalRequests++
-		input := record.GetInt("input_tokens")
-		output := record.GetInt("output_tokens")
-		reasoning := record.GetInt("reasoning_tokens")
-		cacheCreate := record.GetInt("cache_create_tokens")
-		cacheRead := record.GetInt("cache_read_tokens")
-		bucket.InputTokens += int64(input)
-		bucket.OutputTokens += int64(output)
-		bucket.ReasoningTokens += int64(reasoning)
-		usage := modelpricing.UsageSnapshot{
-			InputTokens:       input,
-			OutputTokens:      output,
-			CacheCreateTokens: cacheCreate,
-			CacheReadTokens:   cacheRead,
-		}
-		cost := ls.calculateCost(record.GetString("model"), usage)
-		bucket.TotalCost += cost.TotalCost
+		bucket.TotalRequests += usage.totalRequests
+		bucket.InputTokens += usage.inputTokens
+		bucket.OutputTokens += usage.outputTokens
+		bucket.ReasoningTokens += usage.reasoningTokens
+		bucket.TotalCost += usage.totalCost
 	}
 	if len(hourBuckets) == 0 {
 		return []HeatmapStat{}, nil
@@ -182,33 +245,10 @@ func (ls *LogService) StatsSince(platform string) (LogStats, error) {
 	stats := LogStats{
 		Series: make([]LogStatsSeries, 0, seriesHours),
 	}
-	now := time.Now()
-	model := xdb.New("request_log")
-	seriesStart := startOfDay(now)
+	seriesStart := startOfDay(time.Now())
 	seriesEnd := seriesStart.Add(seriesHours * time.Hour)
-	queryStart := seriesStart.Add(-24 * time.Hour)
-	summaryStart := seriesStart
-	options := []xdb.Option{
-		xdb.WhereGte("created_at", queryStart.Format(timeLayout)),
-		xdb.Field(
-			"model",
-			"input_tokens",
-			"output_tokens",
-			"reasoning_tokens",
-			"cache_create_tokens",
-			"cache_read_tokens",
-			"created_at",
-		),
-		xdb.OrderByAsc("created_at"),
-	}
-	if platform != "" {
-		options = append(options, xdb.WhereEq("platform", platform))
-	}
-	records, err := model.Selects(options...)
+	buckets, err := ls.loadHourlyUsage(platform, seriesStart, seriesEnd)
 	if err != nil {
-		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return stats, nil
-		}
 		return stats, err
 	}
 
@@ -220,79 +260,38 @@ func (ls *LogService) StatsSince(platform string) (LogStats, error) {
 		}
 	}
 
-	for _, record := range records {
-		createdAt, hasTime := parseCreatedAt(record)
-		dayKey := dayFromTimestamp(record.GetString("created_at"))
-		isToday := dayKey == seriesStart.Format("2006-01-02")
-
-		if hasTime {
-			if createdAt.Before(seriesStart) || !createdAt.Before(seriesEnd) {
-				continue
-			}
-		} else {
-			if !isToday {
-				continue
-			}
-			createdAt = seriesStart
+	for _, usage := range buckets {
+		if usage.hour.Before(seriesStart) || !usage.hour.Before(seriesEnd) {
+			continue
 		}
-
-		bucketIndex := 0
-		if hasTime {
-			bucketIndex = int(createdAt.Sub(seriesStart) / time.Hour)
-			if bucketIndex < 0 {
-				bucketIndex = 0
-			}
-			if bucketIndex >= seriesHours {
-				bucketIndex = seriesHours - 1
-			}
+		bucketIndex := int(usage.hour.Sub(seriesStart) / time.Hour)
+		if bucketIndex >= seriesHours {
+			bucketIndex = seriesHours - 1
 		}
 		bucket := seriesBuckets[bucketIndex]
-		input := record.GetInt("input_tokens")
-		output := record.GetInt("output_tokens")
-		reasoning := record.GetInt("reasoning_tokens")
-		cacheCreate := record.GetInt("cache_create_tokens")
-		cacheRead := record.GetInt("cache_read_tokens")
-		usage := modelpricing.UsageSnapshot{
-			InputTokens:       input,
-			OutputTokens:      output,
-			CacheCreateTokens: cacheCreate,
-			CacheReadTokens:   cacheRead,
-		}
-		cost := ls.calculateCost(record.GetString("model"), usage)
-
-		bucket.TotalRequests++
-		bucket.InputTokens += int64(input)
-		bucket.OutputTokens += int64(output)
-		bucket.ReasoningTokens += int64(reasoning)
-		bucket.CacheCreateTokens += int64(cacheCreate)
-		bucket.CacheReadTokens += int64(cacheRead)
-		bucket.TotalCost += cost.TotalCost
-
-		if createdAt.IsZero() || createdAt.Before(summaryStart) {
-			continue
-		}
-		stats.TotalRequests++
-		stats.InputTokens += int64(input)
-		stats.OutputTokens += int64(output)
-		stats.ReasoningTokens += int64(reasoning)
-		stats.CacheCreateTokens += int64(cacheCreate)
-		stats.CacheReadTokens += int64(cacheRead)
-		stats.CostInput += cost.InputCost
-		stats.CostOutput += cost.OutputCost
-		stats.CostCacheCreate += cost.CacheCreateCost
-		stats.CostCacheRead += cost.CacheReadCost
-		stats.CostTotal += cost.TotalCost
+		bucket.TotalRequests += usage.totalRequests
+		bucket.InputTokens += usage.inputTokens
+		bucket.OutputTokens += usage.outputTokens
+		bucket.ReasoningTokens += usage.reasoningTokens
+		bucket.CacheCreateTokens += usage.cacheCreateTokens
+		bucket.CacheReadTokens += usage.cacheReadTokens
+		bucket.TotalCost += usage.totalCost
+
+		stats.TotalRequests += usage.totalRequests
+		stats.InputTokens += usage.inputTokens
+		stats.OutputTokens += usage.outputTokens
+		stats.ReasoningTokens += usage.reasoningTokens
+		stats.CacheCreateTokens += usage.cacheCreateTokens
+		stats.CacheReadTokens += usage.cacheReadTokens
+		stats.CostInput += usage.inputCost
+		stats.CostOutput += usage.outputCost
+		stats.CostCacheCreate += usage.cacheCreateCost
+		stats.CostCacheRead += usage.cacheReadCost
+		stats.CostTotal += usage.totalCost
 	}
 
 	for i := 0; i < seriesHours; i++ {
-		if bucket := seriesBuckets[i]; bucket != nil {
-			stats.Series = append(stats.Series, *bucket)
-		} else {
-			bucketTime := seriesStart.Add(time.Duration(i) * time.Hour)
-			stats.Series = append(stats.Series, LogStatsSeries{
-				Day: bucketTime.Format(timeLayout),
-			})
-		}
+		stats.Series = append(stats.Series, *seriesBuckets[i])
 	}
 
 	return stats, nil
@@ -301,80 +300,29 @@ func (ls *LogService) StatsSince(platform string) (LogStats, error) {
 func (ls *LogService) ProviderDailyStats(platform string) ([]ProviderDailyStat, error) {
 	start := startOfDay(time.Now())
 	end := start.Add(24 * time.Hour)
-	queryStart := start.Add(-24 * time.Hour)
-	model := xdb.New("request_log")
-	options := []xdb.Option{
-		xdb.WhereGte("created_at", queryStart.Format(timeLayout)),
-		xdb.Field(
-			"provider",
-			"model",
-			"http_code",
-			"input_tokens",
-			"output_tokens",
-			"reasoning_tokens",
-			"cache_create_tokens",
-			"cache_read_tokens",
-			"created_at",
-		),
-	}
-	if platform != "" {
-		options = append(options, xdb.WhereEq("platform", platform))
-	}
-	records, err := model.Selects(options...)
+	buckets, err := ls.loadHourlyUsage(platform, start, end)
 	if err != nil {
-		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return []ProviderDailyStat{}, nil
-		}
 		return nil, err
 	}
 	statMap := map[string]*ProviderDailyStat{}
-	for _, record := range records {
-		provider := strings.TrimSpace(record.GetString("provider"))
-		if provider == "" {
-			provider = "(unknown)"
-		}
-		createdAt, hasTime := parseCreatedAt(record)
-		if hasTime {
-			if createdAt.Before(start) || !createdAt.Before(end) {
-				continue
-			}
-		} else {
-			dayKey := dayFromTimestamp(record.GetString("created_at"))
-			if dayKey != start.Format("2006-01-02") {
-				continue
-			}
+	for _, usage := range buckets {
+		if usage.hour.Before(start) || !usage.hour.Before(end) {
+			continue
 		}
-		stat := statMap[provider]
+		stat := statMap[usage.provider]
 		if stat == nil {
-			stat = &ProviderDailyStat{Provider: provider}
-			statMap[provider] = stat
-		}
-		httpCode := record.GetInt("http_code")
-		input := record.GetInt("input_tokens")
-		output := record.GetInt("output_tokens")
-		reasoning := record.GetInt("reasoning_tokens")
-		cacheCreate := record.GetInt("cache_create_tokens")
-		cacheRead := record.GetInt("cache_read_tokens")
-		usage := modelpricing.UsageSnapshot{
-			InputTokens:       input,
-			OutputTokens:      output,
-			CacheCreateTokens: cacheCreate,
-			CacheReadTokens:   cacheRead,
+			stat = &ProviderDailyStat{Provider: usage.provider}
+			statMap[usage.provider] = stat
 		}
-		cost := ls.calculateCost(record.GetString("model"), usage)
-		stat.TotalRequests++
-		// 只有 HTTP 200-299 才算成功，其他（包括 0）都算失败
-		if httpCode >= 200 && httpCode < 300 {
-			stat.SuccessfulRequests++
-		} else {
-			stat.FailedRequests++
-		}
-		stat.InputTokens += int64(input)
-		stat.OutputTokens += int64(output)
-		stat.ReasoningTokens += int64(reasoning)
-		stat.CacheCreateTokens += int64(cacheCreate)
-		stat.CacheReadTokens += int64(cacheRead)
-		stat.CostTotal += cost.TotalCost
+		stat.TotalRequests += usage.totalRequests
+		stat.SuccessfulRequests += usage.successfulRequests
+		stat.FailedRequests += usage.failedRequests
+		stat.InputTokens += usage.inputTokens
+		stat.OutputTokens += usage.outputTokens
+		stat.ReasoningTokens += usage.reasoningTokens
+		stat.CacheCreateTokens += usage.cacheCreateTokens
+		stat.CacheReadTokens += usage.cacheReadTokens
+		stat.CostTotal += usage.totalCost
 	}
 	stats := make([]ProviderDailyStat, 0, len(statMap))
 	for _, stat := range statMap {
@@ -392,6 +340,61 @@ func (ls *LogService) ProviderDailyStats(platform string) ([]ProviderDailyStat,
 	return stats, nil
 }
 
+// ZeroUsageStats 统计最近 hours 小时内各 provider 成功响应中未解析到 token 用量的数量，
+// 比例突然升高通常意味着上游响应格式变化或用量解析出现回归
+func (ls *LogService) ZeroUsageStats(platform string, hours int) ([]ZeroUsageStat, error) {
+	if hours <= 0 {
+		hours = 24
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	options := []xdb.Option{
+		// created_at 由 SQLite CURRENT_TIMESTAMP 写入，为 UTC 时间
+		xdb.WhereGte("created_at", since.UTC().Format(timeLayout)),
+		xdb.WhereGe("http_code", 200),
+		xdb.WhereLt("http_code", 300),
+		// 对冲中被取消的请求不会读取响应体
+		xdb.WhereNotEq("outcome", outcomeCancelled),
+		xdb.WhereEq("is_shadow", 0),
+		xdb.Field(
+			"platform",
+			"provider",
+			"COUNT(*) as successful_requests",
+			"SUM(CASE WHEN input_tokens = 0 AND output_tokens = 0 THEN 1 ELSE 0 END) as zero_usage_requests",
+		),
+		xdb.GroupBy("platform, provider"),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ZeroUsageStat{}, nil
+		}
+		return nil, err
+	}
+	stats := make([]ZeroUsageStat, 0, len(records))
+	for _, record := range records {
+		stat := ZeroUsageStat{
+			Platform:           record.GetString("platform"),
+			Provider:           record.GetString("provider"),
+			SuccessfulRequests: record.GetInt64("successful_requests"),
+			ZeroUsageRequests:  record.GetInt64("zero_usage_requests"),
+		}
+		if stat.SuccessfulRequests > 0 {
+			stat.ZeroUsageRate = float64(stat.ZeroUsageRequests) / float64(stat.SuccessfulRequests)
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ZeroUsageRequests == stats[j].ZeroUsageRequests {
+			return stats[i].Provider < stats[j].Provider
+		}
+		return stats[i].ZeroUsageRequests > stats[j].ZeroUsageRequests
+	})
+	return stats, nil
+}
+
 func (ls *LogService) decorateCost(logEntry *ReqeustLog) {
 	if ls == nil || ls.pricing == nil || logEntry == nil {
 		return
@@ -401,6 +404,7 @@ func (ls *LogService) decorateCost(logEntry *ReqeustLog) {
 		OutputTokens:      logEntry.OutputTokens,
 		CacheCreateTokens: logEntry.CacheCreateTokens,
 		CacheReadTokens:   logEntry.CacheReadTokens,
+		CacheCreation:     cacheCreationDetail(logEntry.CacheCreate5mTokens, logEntry.CacheCreate1hTokens),
 	}
 	cost := ls.pricing.CalculateCost(logEntry.Model, usage)
 	logEntry.HasPricing = cost.HasPricing
@@ -413,63 +417,22 @@ func (ls *LogService) decorateCost(logEntry *ReqeustLog) {
 	logEntry.TotalCost = cost.TotalCost
 }
 
-func (ls *LogService) calculateCost(model string, usage modelpricing.UsageSnapshot) modelpricing.CostBreakdown {
-	if ls == nil || ls.pricing == nil {
-		return modelpricing.CostBreakdown{}
+// cacheCreationDetail 构造缓存写入的 TTL 细分，均为 0 时（旧记录或非 Anthropic 响应）返回 nil，按 5 分钟价格计费
+func cacheCreationDetail(fiveMin int, oneHour int) *modelpricing.CacheCreationDetail {
+	if fiveMin <= 0 && oneHour <= 0 {
+		return nil
 	}
-	return ls.pricing.CalculateCost(model, usage)
-}
-
-func parseCreatedAt(record xdb.Record) (time.Time, bool) {
-	if t := record.GetTime("created_at"); t != nil {
-		return t.In(time.Local), true
-	}
-	raw := strings.TrimSpace(record.GetString("created_at"))
-	if raw == "" {
-		return time.Time{}, false
+	return &modelpricing.CacheCreationDetail{
+		Ephemeral5mTokens: fiveMin,
+		Ephemeral1hTokens: oneHour,
 	}
-
-	layouts := []string{
-		timeLayout,
-		time.RFC3339,
-		"2006-01-02T15:04:05",
-		"2006-01-02 15:04:05 -0700",
-		"2006-01-02 15:04:05 -0700 MST",
-		"2006-01-02 15:04:05 MST",
-		"2006-01-02T15:04:05-0700",
-	}
-	for _, layout := range layouts {
-		if parsed, err := time.Parse(layout, raw); err == nil {
-			return parsed.In(time.Local), true
-		}
-		if parsed, err := time.ParseInLocation(layout, raw, time.Local); err == nil {
-			return parsed.In(time.Local), true
-		}
-	}
-
-	if normalized := strings.Replace(raw, " ", "T", 1); normalized != raw {
-		if parsed, err := time.Parse(time.RFC3339, normalized); err == nil {
-			return parsed.In(time.Local), true
-		}
-	}
-
-	if len(raw) >= len("2006-01-02") {
-		if parsed, err := time.ParseInLocation("2006-01-02", raw[:10], time.Local); err == nil {
-			return parsed, false
-		}
-	}
-
-	return time.Time{}, false
 }
 
-func dayFromTimestamp(value string) string {
-	if len(value) >= len("2006-01-02") {
-		if t, err := time.ParseInLocation(timeLayout, value, time.Local); err == nil {
-			return t.Format("2006-01-02")
-		}
-		return value[:10]
+func (ls *LogService) calculateCost(model string, usage modelpricing.UsageSnapshot) modelpricing.CostBreakdown {
+	if ls == nil || ls.pricing == nil {
+		return modelpricing.CostBreakdown{}
 	}
-	return value
+	return ls.pricing.CalculateCost(model, usage)
 }
 
 func startOfDay(t time.Time) time.Time {
@@ -534,6 +497,14 @@ type ProviderDailyStat struct {
 	CostTotal         float64 `json:"cost_total"`
 }
 
+type ZeroUsageStat struct {
+	Platform           string  `json:"platform"`
+	Provider           string  `json:"provider"`
+	SuccessfulRequests int64   `json:"successful_requests"`
+	ZeroUsageRequests  int64   `json:"zero_usage_requests"`
+	ZeroUsageRate      float64 `json:"zero_usage_rate"`
+}
+
 type LogStatsSeries struct {
 	Day               string  `json:"day"`
 	TotalRequests     int64   `json:"total_requests"`
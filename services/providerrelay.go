@@ -12,6 +12,8 @@ import (
 	"strings"
 	"time"
 
+	modelpricing "codeswitch/resources/model-pricing"
+
 	"github.com/daodao97/xgo/xdb"
 	"github.com/daodao97/xgo/xrequest"
 	"github.com/gin-gonic/gin"
@@ -20,13 +22,38 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// 模型降级后附加在响应上的头部
+const (
+	fallbackFromHeader  = "X-Code-Switch-Fallback-From"
+	fallbackModelHeader = "X-Code-Switch-Fallback-Model"
+)
+
+// SQLite 连接参数：WAL 允许读写并发，busy_timeout 让写入在锁冲突时等待而不是直接返回 database is locked
+const sqliteDSNOptions = "cache=shared&mode=rwc&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+
+// gin.Context 中记录是否重新压缩响应的键
+const compressResponsesKey = "code-switch.compress-responses"
+
 type ProviderRelayService struct {
 	providerService *ProviderService
+	settingsService *RelaySettingsService
+	budgetService   *BudgetService
+	limiters        rateLimiterRegistry
+	pricing         *modelpricing.Service
+	logSinks        *requestLogSinks
+	captures        *bodyCaptureStore
+	shadows         shadowMirror
+	maintenanceStop chan struct{}
 	server          *http.Server
 	addr            string
 }
 
-func NewProviderRelayService(providerService *ProviderService, addr string) *ProviderRelayService {
+func NewProviderRelayService(
+	providerService *ProviderService,
+	settingsService *RelaySettingsService,
+	budgetService *BudgetService,
+	addr string,
+) *ProviderRelayService {
 	if addr == "" {
 		addr = ":18100"
 	}
@@ -37,18 +64,38 @@ func NewProviderRelayService(providerService *ProviderService, addr string) *Pro
 		{
 			Name:   "default",
 			Driver: "sqlite",
-			DSN:    filepath.Join(home, ".code-switch", "app.db?cache=shared&mode=rwc"),
+			DSN:    filepath.Join(home, ".code-switch", "app.db?"+sqliteDSNOptions),
 		},
 	}); err != nil {
 		fmt.Printf("初始化数据库失败: %v\n", err)
-	} else if err := ensureRequestLogTable(); err != nil {
-		fmt.Printf("初始化 request_log 表失败: %v\n", err)
+	} else {
+		if err := ensureRequestLogTable(); err != nil {
+			fmt.Printf("初始化 request_log 表失败: %v\n", err)
+		}
+		if err := ensureRequestBodyTable(); err != nil {
+			fmt.Printf("初始化 request_body 表失败: %v\n", err)
+		}
+		if err := ensureRequestLogRollupTables(); err != nil {
+			fmt.Printf("初始化 request_log 汇总表失败: %v\n", err)
+		}
 	}
 
-	return &ProviderRelayService{
+	pricing, err := modelpricing.DefaultService()
+	if err != nil {
+		fmt.Printf("初始化模型价格表失败: %v\n", err)
+	}
+
+	prs := &ProviderRelayService{
 		providerService: providerService,
+		pricing:         pricing,
+		logSinks:        newRequestLogSinks(pricing),
+		captures:        &bodyCaptureStore{},
+		settingsService: settingsService,
+		budgetService:   budgetService,
 		addr:            addr,
 	}
+	prs.logSinks.configure(prs.relaySettings().LogSinks)
+	return prs
 }
 
 func (prs *ProviderRelayService) Start() error {
@@ -76,6 +123,9 @@ func (prs *ProviderRelayService) Start() error {
 			fmt.Printf("provider relay server error: %v\n", err)
 		}
 	}()
+
+	prs.maintenanceStop = make(chan struct{})
+	go prs.maintainRequestLogs(prs.maintenanceStop)
 	return nil
 }
 
@@ -123,30 +173,78 @@ func (prs *ProviderRelayService) validateConfig() []string {
 }
 
 func (prs *ProviderRelayService) Stop() error {
-	if prs.server == nil {
-		return nil
-	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	return prs.server.Shutdown(ctx)
+
+	var err error
+	if prs.server != nil {
+		err = prs.server.Shutdown(ctx)
+	}
+	if prs.maintenanceStop != nil {
+		close(prs.maintenanceStop)
+		prs.maintenanceStop = nil
+	}
+	if closeErr := prs.shadows.Close(ctx); closeErr != nil {
+		fmt.Printf("[WARN] %v\n", closeErr)
+	}
+	if closeErr := prs.captures.Close(ctx); closeErr != nil {
+		fmt.Printf("[WARN] %v\n", closeErr)
+	}
+	// 服务停止后不再产生新日志，写完各输出队列中剩余的 request_log
+	if prs.logSinks != nil {
+		if closeErr := prs.logSinks.Close(ctx); closeErr != nil {
+			fmt.Printf("[WARN] %v\n", closeErr)
+		}
+	}
+	return err
+}
+
+// LogWriterStats 返回每个 request_log 输出的队列与写入指标
+func (prs *ProviderRelayService) LogWriterStats() []RequestLogWriterStats {
+	if prs.logSinks == nil {
+		return nil
+	}
+	return prs.logSinks.Stats()
 }
 
 func (prs *ProviderRelayService) Addr() string {
 	return prs.addr
 }
 
+// relaySettings 读取中转路由策略，读取失败时回退到默认配置
+func (prs *ProviderRelayService) relaySettings() RelaySettings {
+	settings, err := prs.settingsService.GetRelaySettings()
+	if err != nil {
+		fmt.Printf("[WARN] 读取 relay 配置失败，使用默认配置: %v\n", err)
+		return RelaySettings{}
+	}
+	return settings
+}
+
+// 各平台转发的上游接口
+var relayEndpoints = map[string]string{
+	"claude": "/v1/messages",
+	"codex":  "/responses",
+}
+
 func (prs *ProviderRelayService) registerRoutes(router gin.IRouter) {
-	router.POST("/v1/messages", prs.proxyHandler("claude", "/v1/messages"))
-	router.POST("/responses", prs.proxyHandler("codex", "/responses"))
+	router.POST("/v1/messages", prs.proxyHandler("claude", relayEndpoints["claude"]))
+	router.POST("/responses", prs.proxyHandler("codex", relayEndpoints["codex"]))
+	router.POST(replayRoute, loopbackOnly, prs.replayHandler)
 }
 
 func (prs *ProviderRelayService) proxyHandler(kind string, endpoint string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		trace := &relayTrace{id: newRequestID()}
+		defer trace.finish()
+		c.Request = c.Request.WithContext(withRelayTrace(c.Request.Context(), trace))
+		c.Header(requestIDHeader, trace.id)
+
 		var bodyBytes []byte
 		if c.Request.Body != nil {
 			data, err := io.ReadAll(c.Request.Body)
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+				writeRelayError(c, kind, http.StatusBadRequest, "invalid request body")
 				return
 			}
 			bodyBytes = data
@@ -163,194 +261,569 @@ func (prs *ProviderRelayService) proxyHandler(kind string, endpoint string) gin.
 
 		providers, err := prs.providerService.LoadProviders(kind)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load providers"})
+			writeRelayError(c, kind, http.StatusInternalServerError, "failed to load providers")
 			return
 		}
 
-		active := make([]Provider, 0, len(providers))
-		skippedCount := 0
-		for _, provider := range providers {
-			// 基础过滤：enabled、URL、APIKey
-			if !provider.Enabled || provider.APIURL == "" || provider.APIKey == "" {
+		settings := prs.relaySettings()
+		query := flattenQuery(c.Request.URL.Query())
+		clientHeaders := cloneHeaders(c.Request.Header)
+		hedge := settings.Platform(kind).Hedge
+		c.Set(compressResponsesKey, settings.CompressResponses)
+		c.Request = c.Request.WithContext(withCaptureSettings(c.Request.Context(), settings.Capture))
+		if prs.logSinks != nil {
+			prs.logSinks.configure(settings.LogSinks)
+		}
+
+		// 降级链：请求模型的所有 provider 均失败后，依次尝试链上的下一个模型
+		models := append([]string{requestedModel}, settings.Platform(kind).FallbackModels(requestedModel)...)
+
+		now := time.Now()
+		var lastErr error
+		var blockedBy *BudgetStatus
+		mirrored := false
+		attemptCount, candidateCount, skippedCount := 0, 0, 0
+		// 因上下文窗口不足跳过的 provider，全部 provider 都因此被跳过时按请求过长处理
+		contextSkipped := 0
+		var contextErr error
+		for index, model := range models {
+			tier := relayTier{model: model, body: bodyBytes}
+			if index > 0 {
+				modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, model)
+				if err != nil {
+					fmt.Printf("[ERROR] 降级替换模型名失败: %v\n", err)
+					continue
+				}
+				tier.body = modifiedBody
+				tier.fallbackFrom = requestedModel
+				fmt.Printf("[WARN] 模型 %s 的 provider 均失败或不可用，降级到 %s\n", models[index-1], model)
+			}
+			// 每级只估算一次输入 tokens，上下文过滤、限流与日志共用
+			tier.size = measureRequest(kind, model, tier.body)
+			tier.size.context1mBeta = findContext1mBeta(clientHeaders[anthropicBetaHeader])
+
+			selection := selectProviders(providers, model, now, tier.size, prs.pricing)
+			skippedCount += selection.skipped
+			contextSkipped += selection.contextSkipped
+			if selection.contextErr != nil {
+				contextErr = selection.contextErr
+			}
+			active := selection.active
+			if len(active) == 0 {
 				continue
 			}
+			// 有 provider 配置了 weight 或调度窗口调整了 level / weight 时才重新排序，否则保持配置顺序
+			if selection.adjusted || selection.weighted {
+				active = orderProviders(active)
+			}
 
-			// 配置验证：失败则自动跳过
-			if errs := provider.ValidateConfiguration(); len(errs) > 0 {
-				fmt.Printf("[WARN] Provider %s 配置验证失败，已自动跳过: %v\n", provider.Name, errs)
-				skippedCount++
+			// 预算检查：硬上限跳过 provider，全部被拦截时尝试降级或拒绝
+			decision := prs.budgetService.apply(kind, model, active, settings.Budgets)
+			if len(decision.providers) == 0 {
+				if decision.blockedBy != nil {
+					blockedBy = decision.blockedBy
+				}
+				skippedCount += len(active)
 				continue
 			}
+			skippedCount += len(active) - len(decision.providers)
+			tier.providers = decision.providers
+			candidateCount += len(tier.providers)
+
+			// 影子流量：第一个通过预算检查的层级按采样率异步镜像到待评估的 provider，不影响本次请求
+			if !mirrored {
+				mirrored = true
+				prs.mirrorShadow(kind, endpoint, query, clientHeaders, isStream, tier, trace.id, settings.Platform(kind).Shadow, settings.Budgets)
+			}
 
-			// 核心过滤：只保留支持请求模型的 provider
-			if requestedModel != "" && !provider.IsModelSupported(requestedModel) {
-				fmt.Printf("[INFO] Provider %s 不支持模型 %s，已跳过\n", provider.Name, requestedModel)
-				skippedCount++
-				continue
+			fmt.Printf("[INFO] 找到 %d 个可用的 provider（已过滤 %d 个）：", len(tier.providers), skippedCount)
+			for _, p := range tier.providers {
+				fmt.Printf("%s ", p.Name)
 			}
+			fmt.Println()
 
-			active = append(active, provider)
+			ok, attempts, err := prs.relayProviders(c, kind, endpoint, query, clientHeaders, isStream, tier, hedge)
+			attemptCount += attempts
+			if ok {
+				return
+			}
+			if err != nil {
+				lastErr = err
+				if index+1 < len(models) && !canFallback(err) {
+					fmt.Printf("[WARN] 模型 %s 的请求失败（%v），不属于可降级的错误，停止降级\n", model, err)
+					break
+				}
+			}
 		}
 
-		if len(active) == 0 {
-			if requestedModel != "" {
-				c.JSON(http.StatusNotFound, gin.H{
-					"error": fmt.Sprintf("没有可用的 provider 支持模型 '%s'（已跳过 %d 个不兼容的 provider）", requestedModel, skippedCount),
-				})
+		if candidateCount == 0 {
+			if blockedBy != nil {
+				writeBudgetExceededError(c, kind, blockedBy)
+			} else if contextSkipped > 0 && contextSkipped == skippedCount {
+				// 保留 "prompt is too long" 字样，客户端据此触发上下文压缩
+				writeRelayError(c, kind, http.StatusBadRequest,
+					fmt.Sprintf("prompt is too long: 请求超出全部 %d 个 provider 的上下文窗口（%v）", contextSkipped, contextErr))
+			} else if requestedModel != "" {
+				writeRelayError(c, kind, http.StatusNotFound,
+					fmt.Sprintf("没有可用的 provider 支持模型 '%s'（已跳过 %d 个不兼容的 provider）", requestedModel, skippedCount))
 			} else {
-				c.JSON(http.StatusNotFound, gin.H{"error": "no providers available"})
+				writeRelayError(c, kind, http.StatusNotFound, "no providers available")
 			}
 			return
 		}
 
-		fmt.Printf("[INFO] 找到 %d 个可用的 provider（已过滤 %d 个）：", len(active), skippedCount)
-		for _, p := range active {
-			fmt.Printf("%s ", p.Name)
+		summary := fmt.Sprintf("所有 %d 个 provider 均失败（共尝试 %d 次）", candidateCount, attemptCount)
+		writeRelayFailure(c, kind, summary, lastErr)
+	}
+}
+
+// providerSelection 一级降级链的 provider 过滤结果
+type providerSelection struct {
+	active         []Provider
+	skipped        int   // 被跳过的 provider 数量（不含未启用的）
+	contextSkipped int   // 其中因上下文窗口不足被跳过的数量
+	contextErr     error // 最后一个上下文窗口不足的原因
+	adjusted       bool  // 是否有 provider 当前处于调整 level / weight 的调度窗口内
+	weighted       bool  // 是否有 provider 当前 weight 不为 0
+}
+
+// selectProviders 过滤出可处理指定模型的 provider
+func selectProviders(
+	providers []Provider,
+	model string,
+	now time.Time,
+	size requestSize,
+	pricing *modelpricing.Service,
+) providerSelection {
+	selection := providerSelection{active: make([]Provider, 0, len(providers))}
+	for _, provider := range providers {
+		// 基础过滤：enabled、URL、APIKey
+		if !provider.Enabled || provider.APIURL == "" || provider.APIKey == "" {
+			continue
+		}
+
+		// 配置验证：失败则自动跳过
+		if errs := provider.ValidateConfiguration(); len(errs) > 0 {
+			fmt.Printf("[WARN] Provider %s 配置验证失败，已自动跳过: %v\n", provider.Name, errs)
+			selection.skipped++
+			continue
 		}
-		fmt.Println()
 
-		query := flattenQuery(c.Request.URL.Query())
-		clientHeaders := cloneHeaders(c.Request.Header)
+		// 核心过滤：只保留支持请求模型的 provider
+		if model != "" && !provider.IsModelSupported(model) {
+			fmt.Printf("[INFO] Provider %s 不支持模型 %s，已跳过\n", provider.Name, model)
+			selection.skipped++
+			continue
+		}
 
-		var lastErr error
-		attemptCount := 0
-		for i, provider := range active {
-			attemptCount++
+		// 上下文窗口：放不下请求的 provider 直接跳过，避免上游返回 context_length 错误
+		if err := provider.checkContextFit(model, size, pricing); err != nil {
+			fmt.Printf("[INFO] Provider %s 上下文窗口不足（%v），已跳过\n", provider.Name, err)
+			selection.skipped++
+			selection.contextSkipped++
+			selection.contextErr = err
+			continue
+		}
 
-			effectiveModel := provider.GetEffectiveModel(requestedModel)
+		// 时间窗口调度：不在可用时段内跳过，并应用窗口内的 level / weight
+		state := provider.ScheduleState(now)
+		if !state.Active {
+			fmt.Printf("[INFO] Provider %s 当前不在调度时段内，已跳过\n", provider.Name)
+			selection.skipped++
+			continue
+		}
+		if state.Level != provider.Level || state.Weight != provider.Weight {
+			selection.adjusted = true
+		}
+		provider.Level = state.Level
+		provider.Weight = state.Weight
+		if provider.Weight > 0 {
+			selection.weighted = true
+		}
 
-			currentBodyBytes := bodyBytes
-			if effectiveModel != requestedModel && requestedModel != "" {
-				fmt.Printf("[INFO]   Provider %s 映射模型: %s -> %s\n", provider.Name, requestedModel, effectiveModel)
+		selection.active = append(selection.active, provider)
+	}
+	return selection
+}
 
-				modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
-				if err != nil {
-					fmt.Printf("[ERROR]   替换模型名失败: %v\n", err)
-					lastErr = err
-					continue
-				}
-				currentBodyBytes = modifiedBody
-			}
+// relayTier 降级链中的一级：同一模型的全部候选 provider
+type relayTier struct {
+	model        string
+	body         []byte
+	fallbackFrom string // 降级前客户端请求的模型，未降级时为空
+	size         requestSize
+	providers    []Provider
+}
 
-			fmt.Printf("[INFO]   [%d/%d] Provider: %s | Model: %s\n",
-				i+1, len(active), provider.Name, effectiveModel)
+func (t relayTier) prepare(provider Provider) (relayCandidate, error) {
+	candidate, err := prepareCandidate(provider, t.model, t.body)
+	candidate.fallbackFrom = t.fallbackFrom
+	candidate.estimatedTokens = t.size.inputTokens
+	return candidate, err
+}
 
-			startTime := time.Now()
-			ok, err := prs.forwardRequest(c, kind, provider, endpoint, query, clientHeaders, currentBodyBytes, isStream, effectiveModel)
-			duration := time.Since(startTime)
+// relayProviders 依次尝试同一级的候选 provider，返回是否成功、尝试次数和最后一次错误
+func (prs *ProviderRelayService) relayProviders(
+	c *gin.Context,
+	kind string,
+	endpoint string,
+	query map[string]string,
+	clientHeaders map[string]string,
+	isStream bool,
+	tier relayTier,
+	hedge HedgeSettings,
+) (bool, int, error) {
+	active := tier.providers
+	var lastErr error
+	attemptCount := 0
+	for i := 0; i < len(active); i++ {
+		attemptCount++
+
+		primary, err := tier.prepare(active[i])
+		if err != nil {
+			fmt.Printf("[ERROR]   准备请求体失败: %v\n", err)
+			lastErr = err
+			continue
+		}
 
-			if ok {
-				fmt.Printf("[INFO]   ✓ 成功: %s | 耗时: %.2fs\n", provider.Name, duration.Seconds())
-				return
-			}
+		lease, err := prs.limiters.acquire(c.Request.Context(), kind, primary)
+		if err != nil {
+			fmt.Printf("[WARN]   Provider %s 触发限流，已跳过: %v\n", primary.provider.Name, err)
+			lastErr = &rateLimitRefusal{provider: primary.provider.Name, err: err}
+			continue
+		}
+		primary.lease = lease
 
-			errorMsg := "未知错误"
-			if err != nil {
-				errorMsg = err.Error()
+		fmt.Printf("[INFO]   [%d/%d] Provider: %s | Model: %s\n",
+			i+1, len(active), primary.provider.Name, primary.model)
+
+		// 对冲候选：仅在开启对冲且存在下一个 provider 时准备
+		var backup *relayCandidate
+		if hedge.Enabled && i+1 < len(active) {
+			if candidate, err := tier.prepare(active[i+1]); err == nil {
+				backup = &candidate
 			}
-			fmt.Printf("[WARN]   ✗ 失败: %s | 错误: %s | 耗时: %.2fs\n",
-				provider.Name, errorMsg, duration.Seconds())
-			lastErr = err
 		}
 
-		message := fmt.Sprintf("所有 %d 个 provider 均失败（共尝试 %d 次）", len(active), attemptCount)
-		if lastErr != nil {
-			message = fmt.Sprintf("%s: %s", message, lastErr.Error())
+		startTime := time.Now()
+		result := prs.forwardWithHedge(c, kind, endpoint, query, clientHeaders, isStream, primary, backup, hedge.Delay())
+		duration := time.Since(startTime)
+
+		if result.hedged {
+			// 对冲候选已经参与过本轮请求，不再单独尝试
+			attemptCount++
+			i++
 		}
-		c.JSON(http.StatusBadGateway, gin.H{"error": message})
+
+		if result.ok {
+			fmt.Printf("[INFO]   ✓ 成功: %s | 耗时: %.2fs\n", result.provider, duration.Seconds())
+			return true, attemptCount, nil
+		}
+
+		errorMsg := "未知错误"
+		if result.err != nil {
+			errorMsg = result.err.Error()
+		}
+		fmt.Printf("[WARN]   ✗ 失败: %s | 错误: %s | 耗时: %.2fs\n",
+			result.provider, errorMsg, duration.Seconds())
+		lastErr = result.err
+	}
+	return false, attemptCount, lastErr
+}
+
+// relayCandidate 一个已完成模型映射、可直接转发的 provider
+type relayCandidate struct {
+	provider Provider
+	alias    string // 映射前的模型名（客户端请求或降级后的模型）
+	model    string
+	body     []byte
+	source   []byte     // 模型映射与改写规则执行前的请求体
+	lease    *rateLease // 限流配额，未配置限流时为 nil
+
+	fallbackFrom    string // 降级前客户端请求的模型，未降级时为空
+	estimatedTokens int    // 按映射前的请求体估算的输入 tokens，限流与日志共用
+}
+
+// prepareCandidate 计算 provider 的实际模型名，替换请求体中的模型并执行改写规则
+func prepareCandidate(provider Provider, requestedModel string, bodyBytes []byte) (relayCandidate, error) {
+	effectiveModel := provider.GetEffectiveModel(requestedModel)
+	candidate := relayCandidate{provider: provider, alias: requestedModel, model: effectiveModel, body: bodyBytes, source: bodyBytes}
+	if effectiveModel != requestedModel && requestedModel != "" {
+		fmt.Printf("[INFO]   Provider %s 映射模型: %s -> %s\n", provider.Name, requestedModel, effectiveModel)
+
+		modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
+		if err != nil {
+			return candidate, err
+		}
+		candidate.body = modifiedBody
+	}
+
+	transformed, err := provider.ApplyBodyRules(effectiveModel, candidate.body)
+	if err != nil {
+		return candidate, err
+	}
+	candidate.body = transformed
+	return candidate, nil
+}
+
+// relayAttempt 一次发往上游的请求，记录响应与 request_log
+type relayAttempt struct {
+	candidate relayCandidate
+	log       *ReqeustLog
+	start     time.Time
+	resp      *xrequest.Response
+	err       error
+	cancel    context.CancelFunc
+	trace     *relayTrace
+	logs      *requestLogSinks
+	capture   *bodyCapture
+	pricing   *modelpricing.Service
+}
+
+// succeeded 上游是否返回了 2xx 响应头
+func (a *relayAttempt) succeeded() bool {
+	return a.err == nil && a.resp != nil &&
+		a.resp.StatusCode() >= http.StatusOK && a.resp.StatusCode() < http.StatusMultipleChoices
+}
+
+// failure 返回本次尝试失败的原因
+func (a *relayAttempt) failure() error {
+	if a.err != nil {
+		return a.err
+	}
+	if a.resp == nil {
+		return fmt.Errorf("empty response")
+	}
+	return fmt.Errorf("upstream status %d", a.resp.StatusCode())
+}
+
+// finish 结束本次尝试：关闭未读取的响应体、取消请求并归还限流配额
+func (a *relayAttempt) finish() {
+	if a.resp != nil && a.resp.RawResponse != nil && a.resp.RawResponse.Body != nil {
+		_ = a.resp.RawResponse.Body.Close()
+	}
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.candidate.lease.release(promptTokens(a.log))
+}
+
+// save 结束计时并记录失败原因；属于某次客户端请求时交由 relayTrace 判断是否为最终结果后写入
+func (a *relayAttempt) save() {
+	a.log.DurationSec = time.Since(a.start).Seconds()
+	if a.err != nil {
+		a.log.ErrorClass, a.log.ErrorMessage = classifyRelayError(a.err)
+	}
+	(&LogService{pricing: a.pricing}).decorateCost(a.log)
+	if a.capture != nil {
+		a.capture.save(a.log, a.succeeded())
+	}
+	if a.trace != nil {
+		a.trace.record(a)
+		return
+	}
+	a.log.IsFinal = a.succeeded()
+	a.insert()
+}
+
+// insert 写入 request_log
+func (a *relayAttempt) insert() {
+	if a.logs != nil {
+		a.logs.Enqueue(a.log)
+		return
+	}
+	if _, err := xdb.New("request_log").Insert(requestLogRecord(a.log)); err != nil {
+		fmt.Printf("写入 request_log 失败: %v\n", err)
+	}
+}
+
+func requestLogRecord(requestLog *ReqeustLog) xdb.Record {
+	return xdb.Record{
+		"platform":               requestLog.Platform,
+		"model":                  requestLog.Model,
+		"provider":               requestLog.Provider,
+		"http_code":              requestLog.HttpCode,
+		"input_tokens":           requestLog.InputTokens,
+		"output_tokens":          requestLog.OutputTokens,
+		"cache_create_tokens":    requestLog.CacheCreateTokens,
+		"cache_read_tokens":      requestLog.CacheReadTokens,
+		"cache_create_5m_tokens": requestLog.CacheCreate5mTokens,
+		"cache_create_1h_tokens": requestLog.CacheCreate1hTokens,
+		"reasoning_tokens":       requestLog.ReasoningTokens,
+		"is_stream":              boolToInt(requestLog.IsStream),
+		"duration_sec":           requestLog.DurationSec,
+		"outcome":                requestLog.Outcome,
+		"fallback_from":          requestLog.FallbackFrom,
+		"estimated_input_tokens": requestLog.EstimatedInputTokens,
+		"request_id":             requestLog.RequestID,
+		"attempt":                requestLog.Attempt,
+		"upstream_request_id":    requestLog.UpstreamRequestID,
+		"error_class":            requestLog.ErrorClass,
+		"error_message":          requestLog.ErrorMessage,
+		"is_final":               boolToInt(requestLog.IsFinal),
+		"replay_of":              requestLog.ReplayOf,
+		"is_shadow":              boolToInt(requestLog.IsShadow),
+		"total_cost":             requestLog.TotalCost,
 	}
 }
 
 func (prs *ProviderRelayService) forwardRequest(
 	c *gin.Context,
 	kind string,
-	provider Provider,
 	endpoint string,
 	query map[string]string,
 	clientHeaders map[string]string,
-	bodyBytes []byte,
 	isStream bool,
-	model string,
+	candidate relayCandidate,
 ) (bool, error) {
+	attempt := prs.sendUpstream(c.Request.Context(), kind, endpoint, query, clientHeaders, isStream, candidate)
+	defer attempt.save()
+	defer attempt.finish()
+	return prs.writeUpstreamResponse(c, kind, attempt)
+}
+
+// sendUpstream 向上游发送请求，在收到响应头后返回
+func (prs *ProviderRelayService) sendUpstream(
+	ctx context.Context,
+	kind string,
+	endpoint string,
+	query map[string]string,
+	clientHeaders map[string]string,
+	isStream bool,
+	candidate relayCandidate,
+) *relayAttempt {
+	provider := candidate.provider
 	targetURL := joinURL(provider.APIURL, endpoint)
-	headers := cloneMap(clientHeaders)
-	headers["Authorization"] = fmt.Sprintf("Bearer %s", provider.APIKey)
-	if _, ok := headers["Accept"]; !ok {
-		headers["Accept"] = "application/json"
-	}
-
-	requestLog := &ReqeustLog{
-		Platform: kind,
-		Provider: provider.Name,
-		Model:    model,
-		IsStream: isStream,
-	}
-	start := time.Now()
-	defer func() {
-		requestLog.DurationSec = time.Since(start).Seconds()
-		if _, err := xdb.New("request_log").Insert(xdb.Record{
-			"platform":            requestLog.Platform,
-			"model":               requestLog.Model,
-			"provider":            requestLog.Provider,
-			"http_code":           requestLog.HttpCode,
-			"input_tokens":        requestLog.InputTokens,
-			"output_tokens":       requestLog.OutputTokens,
-			"cache_create_tokens": requestLog.CacheCreateTokens,
-			"cache_read_tokens":   requestLog.CacheReadTokens,
-			"reasoning_tokens":    requestLog.ReasoningTokens,
-			"is_stream":           boolToInt(requestLog.IsStream),
-			"duration_sec":        requestLog.DurationSec,
-		}); err != nil {
-			fmt.Printf("写入 request_log 失败: %v\n", err)
-		}
-	}()
+	headers := buildUpstreamHeaders(provider, clientHeaders)
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	attempt := &relayAttempt{
+		candidate: candidate,
+		log: &ReqeustLog{
+			Platform: kind,
+			Provider: provider.Name,
+			Model:    candidate.model,
+			IsStream: isStream,
+
+			FallbackFrom:         candidate.fallbackFrom,
+			EstimatedInputTokens: candidate.estimatedTokens,
+		},
+		start:  time.Now(),
+		cancel: cancel,
+	}
+	attempt.logs = prs.logSinks
+	attempt.pricing = prs.pricing
+	if trace := relayTraceFrom(ctx); trace != nil {
+		attempt.trace = trace
+		attempt.log.RequestID = trace.id
+		attempt.log.Attempt = trace.nextAttempt()
+		attempt.log.ReplayOf = trace.replayOf
+		attempt.log.IsShadow = trace.shadow
+	}
+	// 镜像请求与客户端请求共用 request_id，不捕获请求体以免与原请求的捕获混淆
+	if capture := newBodyCapture(ctx, kind, provider, candidate.model, prs.captures); capture != nil && !attempt.log.IsShadow {
+		capture.captureRequest(headers, candidate.body, candidate.source)
+		attempt.capture = capture
+	}
 
+	// 关闭 xrequest 的调试输出：开发模式下它会提前读取响应体，绕过中转的解压与用量解析
 	req := xrequest.New().
+		SetDebug(false).
+		WithContext(attemptCtx).
 		SetHeaders(headers).
 		SetQueryParams(query).
 		SetRetry(1, 500*time.Millisecond)
 
-	reqBody := bytes.NewReader(bodyBytes)
+	reqBody := bytes.NewReader(candidate.body)
 	req = req.SetBody(reqBody)
 
+	// 5xx 重试耗尽时 xrequest 会同时返回响应与错误，此时以响应为准，保留上游的错误信息与请求 ID
 	resp, err := req.Post(targetURL)
-	if err != nil {
-		return false, err
+	if resp == nil || resp.RawResponse == nil {
+		if err == nil {
+			err = fmt.Errorf("empty response")
+		}
+		attempt.err = err
+		return attempt
 	}
 
-	if resp == nil {
-		return false, fmt.Errorf("empty response")
+	attempt.resp = resp
+	attempt.log.HttpCode = resp.StatusCode()
+	attempt.log.UpstreamRequestID = upstreamRequestID(resp.RawResponse.Header)
+	if err := decodeResponseBody(resp.RawResponse); err != nil {
+		fmt.Printf("[WARN] Provider %s 响应解压失败，按原样转发: %v\n", provider.Name, err)
+	}
+	if attempt.capture != nil {
+		attempt.capture.tapResponse(resp.RawResponse)
+	}
+	if resp.StatusCode() >= http.StatusBadRequest {
+		// 读取错误响应体，保留上游原始错误信息
+		attempt.err = newUpstreamError(provider.Name, resp.RawResponse)
+		return attempt
 	}
-
 	if resp.Error() != nil {
-		return false, resp.Error()
+		attempt.err = resp.Error()
+		return attempt
 	}
 
-	status := resp.StatusCode()
-	requestLog.HttpCode = status
+	return attempt
+}
 
-	if status >= http.StatusOK && status < http.StatusMultipleChoices {
-		_, copyErr := resp.ToHttpResponseWriter(c.Writer, ReqeustLogHook(c, kind, requestLog))
-		return copyErr == nil, copyErr
+// writeUpstreamResponse 将成功的上游响应写回客户端
+func (prs *ProviderRelayService) writeUpstreamResponse(c *gin.Context, kind string, attempt *relayAttempt) (bool, error) {
+	if !attempt.succeeded() {
+		return false, attempt.failure()
+	}
+	candidate := attempt.candidate
+	if candidate.fallbackFrom != "" {
+		c.Header(fallbackFromHeader, candidate.fallbackFrom)
+		c.Header(fallbackModelHeader, candidate.alias)
+	}
+
+	// 在响应体写回客户端的同时解析 token 用量
+	raw := attempt.resp.RawResponse
+	stream := isEventStream(raw.Header, attempt.log.IsStream)
+	raw.Body = newUsageTap(raw.Body, kind, stream, attempt.log)
+
+	hooks := []xrequest.ResponseHook{ErrorEventNormalizeHook(kind, candidate.provider.Name)}
+	if candidate.provider.RewriteResponseModel && candidate.alias != "" && candidate.alias != candidate.model {
+		// 改写后响应体长度会变化，不能沿用上游的 Content-Length
+		raw.Header.Del("Content-Length")
+		hooks = append(hooks, ResponseModelRewriteHook(candidate.alias))
 	}
 
-	return false, fmt.Errorf("upstream status %d", status)
+	// 流式响应保持明文逐行刷新；非流式响应按客户端 Accept-Encoding 重新压缩
+	var writer http.ResponseWriter = c.Writer
+	if encoding := negotiateClientEncoding(c.GetHeader("Accept-Encoding")); encoding != "" &&
+		!stream && c.GetBool(compressResponsesKey) && raw.Header.Get("Content-Encoding") == "" {
+		compressWriter := newCompressResponseWriter(c.Writer, encoding)
+		defer compressWriter.Close()
+		writer = compressWriter
+	}
+
+	_, copyErr := attempt.resp.ToHttpResponseWriter(writer, hooks...)
+	if copyErr != nil {
+		attempt.log.ErrorClass, attempt.log.ErrorMessage = errorClassStream, truncateErrorMessage(copyErr.Error())
+	}
+	if copyErr == nil && attempt.log.InputTokens == 0 && attempt.log.OutputTokens == 0 {
+		fmt.Printf("[WARN] Provider %s 的成功响应未解析到 token 用量（model=%s, stream=%v），请检查用量解析\n",
+			candidate.provider.Name, candidate.model, stream)
+	}
+	return copyErr == nil, copyErr
 }
 
 func cloneHeaders(header http.Header) map[string]string {
 	cloned := make(map[string]string, len(header))
 	for key, values := range header {
-		if len(values) > 0 {
-			cloned[key] = values[len(values)-1]
+		if len(values) == 0 {
+			continue
 		}
-	}
-	return cloned
-}
-
-func cloneMap(m map[string]string) map[string]string {
-	cloned := make(map[string]string, len(m))
-	for k, v := range m {
-		cloned[k] = v
+		// anthropic-beta 可能分多行发送，合并后统一过滤
+		if http.CanonicalHeaderKey(key) == anthropicBetaHeader {
+			cloned[key] = strings.Join(values, ",")
+			continue
+		}
+		cloned[key] = values[len(values)-1]
 	}
 	return cloned
 }
@@ -379,13 +852,18 @@ func boolToInt(b bool) int {
 }
 
 func ensureRequestLogColumn(db *sql.DB, column string, definition string) error {
-	query := fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('request_log') WHERE name = '%s'", column)
+	return ensureTableColumn(db, "request_log", column, definition)
+}
+
+// ensureTableColumn 为已存在的表补充新增的列
+func ensureTableColumn(db *sql.DB, table string, column string, definition string) error {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name = '%s'", table, column)
 	var count int
 	if err := db.QueryRow(query).Scan(&count); err != nil {
 		return err
 	}
 	if count == 0 {
-		alter := fmt.Sprintf("ALTER TABLE request_log ADD COLUMN %s %s", column, definition)
+		alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
 		if _, err := db.Exec(alter); err != nil {
 			return err
 		}
@@ -412,9 +890,23 @@ func ensureRequestLogTableWithDB(db *sql.DB) error {
 		output_tokens INTEGER,
 		cache_create_tokens INTEGER,
 		cache_read_tokens INTEGER,
+		cache_create_5m_tokens INTEGER DEFAULT 0,
+		cache_create_1h_tokens INTEGER DEFAULT 0,
 		reasoning_tokens INTEGER,
 		is_stream INTEGER DEFAULT 0,
 		duration_sec REAL DEFAULT 0,
+		outcome TEXT DEFAULT '',
+		fallback_from TEXT DEFAULT '',
+		estimated_input_tokens INTEGER DEFAULT 0,
+		request_id TEXT DEFAULT '',
+		attempt INTEGER DEFAULT 0,
+		upstream_request_id TEXT DEFAULT '',
+		error_class TEXT DEFAULT '',
+		error_message TEXT DEFAULT '',
+		is_final INTEGER DEFAULT 0,
+		replay_of TEXT DEFAULT '',
+		is_shadow INTEGER DEFAULT 0,
+		total_cost REAL,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	)`
 
@@ -431,76 +923,170 @@ func ensureRequestLogTableWithDB(db *sql.DB) error {
 	if err := ensureRequestLogColumn(db, "duration_sec", "REAL DEFAULT 0"); err != nil {
 		return err
 	}
+	if err := ensureRequestLogColumn(db, "outcome", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "fallback_from", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "estimated_input_tokens", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "cache_create_5m_tokens", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "cache_create_1h_tokens", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "request_id", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "attempt", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "upstream_request_id", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "error_class", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "error_message", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "is_final", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "replay_of", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "is_shadow", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	// 写入时计算的花费，用于按花费过滤与排序；旧记录为 NULL，由后台任务补算
+	if err := ensureRequestLogColumn(db, "total_cost", "REAL"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_request_log_request_id ON request_log (request_id)`); err != nil {
+		return err
+	}
+	// 统计按时间范围查询，并常按平台或 provider 过滤
+	for _, index := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_request_log_created_at ON request_log (created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_request_log_platform_created_at ON request_log (platform, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_request_log_provider_created_at ON request_log (provider, created_at)`,
+	} {
+		if _, err := db.Exec(index); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func ReqeustLogHook(c *gin.Context, kind string, usage *ReqeustLog) func(data []byte) (bool, []byte) { // SSE 钩子：累计字节和解析 token 用量
-	return func(data []byte) (bool, []byte) {
-		payload := strings.TrimSpace(string(data))
+type ReqeustLog struct {
+	ID                   int64   `json:"id"`
+	Platform             string  `json:"platform"` // claude code or codex
+	Model                string  `json:"model"`
+	Provider             string  `json:"provider"` // provider name
+	HttpCode             int     `json:"http_code"`
+	InputTokens          int     `json:"input_tokens"`
+	OutputTokens         int     `json:"output_tokens"`
+	CacheCreateTokens    int     `json:"cache_create_tokens"`
+	CacheReadTokens      int     `json:"cache_read_tokens"`
+	CacheCreate5mTokens  int     `json:"cache_create_5m_tokens"` // 缓存写入中 5 分钟 TTL 的部分
+	CacheCreate1hTokens  int     `json:"cache_create_1h_tokens"` // 缓存写入中 1 小时 TTL 的部分
+	ReasoningTokens      int     `json:"reasoning_tokens"`
+	RequestID            string  `json:"request_id"`          // 客户端请求 ID，同一请求的多次上游尝试相同
+	Attempt              int     `json:"attempt"`             // 本次上游尝试在该请求中的序号，从 1 开始
+	UpstreamRequestID    string  `json:"upstream_request_id"` // 上游返回的请求 ID
+	ErrorClass           string  `json:"error_class"`         // 失败类型，成功为空
+	ErrorMessage         string  `json:"error_message"`       // 截断后的失败原因或上游错误信息
+	IsFinal              bool    `json:"is_final"`            // 是否为返回给客户端的最终结果，失败后发生重试或降级时为 false
+	ReplayOf             string  `json:"replay_of"`           // 重放请求对应的原始请求 ID，普通请求为空
+	IsShadow             bool    `json:"is_shadow"`           // 是否为影子流量的镜像请求，request_id 与被镜像的客户端请求相同
+	IsStream             bool    `json:"is_stream"`
+	DurationSec          float64 `json:"duration_sec"`
+	Outcome              string  `json:"outcome"`                // hedged / cancelled，普通请求为空
+	FallbackFrom         string  `json:"fallback_from"`          // 降级前请求的模型，未降级为空
+	EstimatedInputTokens int     `json:"estimated_input_tokens"` // 本地估算的输入 tokens，用于跟踪估算准确度
+	CreatedAt            string  `json:"created_at"`
+	InputCost            float64 `json:"input_cost"`
+	OutputCost           float64 `json:"output_cost"`
+	CacheCreateCost      float64 `json:"cache_create_cost"`
+	CacheReadCost        float64 `json:"cache_read_cost"`
+	Ephemeral5mCost      float64 `json:"ephemeral_5m_cost"`
+	Ephemeral1hCost      float64 `json:"ephemeral_1h_cost"`
+	TotalCost            float64 `json:"total_cost"`
+	HasPricing           bool    `json:"has_pricing"`
+}
 
-		parserFn := ClaudeCodeParseTokenUsageFromResponse
-		if kind == "codex" {
-			parserFn = CodexParseTokenUsageFromResponse
-		}
-		parseEventPayload(payload, parserFn, usage)
+// claude code usage parser
+func ClaudeCodeParseTokenUsageFromResponse(data string, usage *ReqeustLog) {
+	// message_start：message.usage 携带输入与缓存用量
+	if messageUsage := gjson.Get(data, "message.usage"); messageUsage.Exists() {
+		parseClaudeUsage(messageUsage, usage)
+		return
+	}
 
-		return true, data
+	// message_delta：usage 为累计值，输出 tokens 直接覆盖；部分上游也会在此给出输入用量
+	deltaUsage := gjson.Get(data, "usage")
+	if !deltaUsage.Exists() {
+		return
+	}
+	usage.OutputTokens = int(deltaUsage.Get("output_tokens").Int())
+	if v := deltaUsage.Get("input_tokens").Int(); v > 0 {
+		usage.InputTokens = int(v)
+	}
+	if v := deltaUsage.Get("cache_creation_input_tokens").Int(); v > 0 {
+		usage.CacheCreateTokens = int(v)
+	}
+	if v := deltaUsage.Get("cache_read_input_tokens").Int(); v > 0 {
+		usage.CacheReadTokens = int(v)
+	}
+	if v := deltaUsage.Get("cache_creation.ephemeral_5m_input_tokens").Int(); v > 0 {
+		usage.CacheCreate5mTokens = int(v)
+	}
+	if v := deltaUsage.Get("cache_creation.ephemeral_1h_input_tokens").Int(); v > 0 {
+		usage.CacheCreate1hTokens = int(v)
 	}
 }
 
-func parseEventPayload(payload string, parser func(string, *ReqeustLog), usage *ReqeustLog) {
-	lines := strings.Split(payload, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "data:") {
-			parser(strings.TrimPrefix(line, "data: "), usage)
-		}
+// codex usage parser
+func CodexParseTokenUsageFromResponse(data string, usage *ReqeustLog) {
+	if responseUsage := gjson.Get(data, "response.usage"); responseUsage.Exists() {
+		parseCodexUsage(responseUsage, usage)
 	}
 }
 
-type ReqeustLog struct {
-	ID                int64   `json:"id"`
-	Platform          string  `json:"platform"` // claude code or codex
-	Model             string  `json:"model"`
-	Provider          string  `json:"provider"` // provider name
-	HttpCode          int     `json:"http_code"`
-	InputTokens       int     `json:"input_tokens"`
-	OutputTokens      int     `json:"output_tokens"`
-	CacheCreateTokens int     `json:"cache_create_tokens"`
-	CacheReadTokens   int     `json:"cache_read_tokens"`
-	ReasoningTokens   int     `json:"reasoning_tokens"`
-	IsStream          bool    `json:"is_stream"`
-	DurationSec       float64 `json:"duration_sec"`
-	CreatedAt         string  `json:"created_at"`
-	InputCost         float64 `json:"input_cost"`
-	OutputCost        float64 `json:"output_cost"`
-	CacheCreateCost   float64 `json:"cache_create_cost"`
-	CacheReadCost     float64 `json:"cache_read_cost"`
-	Ephemeral5mCost   float64 `json:"ephemeral_5m_cost"`
-	Ephemeral1hCost   float64 `json:"ephemeral_1h_cost"`
-	TotalCost         float64 `json:"total_cost"`
-	HasPricing        bool    `json:"has_pricing"`
+// ParseTokenUsageFromBody 解析非流式响应体中的 token 用量
+func ParseTokenUsageFromBody(kind string, body []byte, usage *ReqeustLog) {
+	bodyUsage := gjson.GetBytes(body, "usage")
+	if !bodyUsage.IsObject() {
+		return
+	}
+	if kind == "codex" {
+		parseCodexUsage(bodyUsage, usage)
+		return
+	}
+	parseClaudeUsage(bodyUsage, usage)
 }
 
-// claude code usage parser
-func ClaudeCodeParseTokenUsageFromResponse(data string, usage *ReqeustLog) {
-	usage.InputTokens += int(gjson.Get(data, "message.usage.input_tokens").Int())
-	usage.OutputTokens += int(gjson.Get(data, "message.usage.output_tokens").Int())
-	usage.CacheCreateTokens += int(gjson.Get(data, "message.usage.cache_creation_input_tokens").Int())
-	usage.CacheReadTokens += int(gjson.Get(data, "message.usage.cache_read_input_tokens").Int())
-
-	usage.InputTokens += int(gjson.Get(data, "usage.input_tokens").Int())
-	usage.OutputTokens += int(gjson.Get(data, "usage.output_tokens").Int())
+// parseClaudeUsage 解析 Anthropic usage 对象，cache_creation 中细分了 5 分钟与 1 小时缓存写入
+func parseClaudeUsage(value gjson.Result, usage *ReqeustLog) {
+	usage.InputTokens = int(value.Get("input_tokens").Int())
+	usage.OutputTokens = int(value.Get("output_tokens").Int())
+	usage.CacheCreateTokens = int(value.Get("cache_creation_input_tokens").Int())
+	usage.CacheReadTokens = int(value.Get("cache_read_input_tokens").Int())
+	usage.CacheCreate5mTokens = int(value.Get("cache_creation.ephemeral_5m_input_tokens").Int())
+	usage.CacheCreate1hTokens = int(value.Get("cache_creation.ephemeral_1h_input_tokens").Int())
 }
 
-// codex usage parser
-func CodexParseTokenUsageFromResponse(data string, usage *ReqeustLog) {
-	usage.InputTokens += int(gjson.Get(data, "response.usage.input_tokens").Int())
-	usage.OutputTokens += int(gjson.Get(data, "response.usage.output_tokens").Int())
-	usage.CacheReadTokens += int(gjson.Get(data, "response.usage.input_tokens_details.cached_tokens").Int())
-	usage.ReasoningTokens += int(gjson.Get(data, "response.usage.output_tokens_details.reasoning_tokens").Int())
-	fmt.Println("data ---->", data, fmt.Sprintf("%v", usage))
+// parseCodexUsage 解析 OpenAI Responses usage 对象
+func parseCodexUsage(value gjson.Result, usage *ReqeustLog) {
+	usage.InputTokens = int(value.Get("input_tokens").Int())
+	usage.OutputTokens = int(value.Get("output_tokens").Int())
+	usage.CacheReadTokens = int(value.Get("input_tokens_details.cached_tokens").Int())
+	usage.ReasoningTokens = int(value.Get("output_tokens_details.reasoning_tokens").Int())
 }
 
 // ReplaceModelInRequestBody 替换请求体中的模型名
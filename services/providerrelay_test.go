@@ -2,6 +2,11 @@ package services
 
 import (
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/tidwall/gjson"
@@ -302,3 +307,186 @@ func BenchmarkReplaceModelInRequestBody(b *testing.B) {
 		_, _ = ReplaceModelInRequestBody(bodyBytes, "anthropic/claude-sonnet-4")
 	}
 }
+
+// ==================== 模型降级链端到端测试 ====================
+
+func TestProxyHandlerModelFallback(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	var receivedModel string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receivedModel = gjson.GetBytes(body, "model").String()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer healthy.Close()
+
+	providerService := NewProviderService()
+	if err := providerService.SaveProviders("claude", []Provider{
+		{ID: 1, Name: "opus-only", APIURL: failing.URL, APIKey: "key", Enabled: true,
+			SupportedModels: map[string]bool{"claude-opus-4": true}},
+		{ID: 2, Name: "sonnet-only", APIURL: healthy.URL, APIKey: "key", Enabled: true,
+			SupportedModels: map[string]bool{"claude-sonnet-4": true}},
+	}); err != nil {
+		t.Fatalf("保存 provider 失败: %v", err)
+	}
+
+	settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+	if _, err := settingsService.SaveRelaySettings(RelaySettings{
+		Platforms: map[string]PlatformRelaySettings{
+			"claude": {FallbackChains: [][]string{{"claude-opus-4", "claude-sonnet-4", "claude-haiku-4"}}},
+		},
+	}); err != nil {
+		t.Fatalf("保存 relay 配置失败: %v", err)
+	}
+
+	prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService}
+	handler := prs.proxyHandler("claude", "/v1/messages")
+
+	c, recorder := newHedgeTestContext()
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"claude-opus-4","messages":[]}`))
+	handler(c)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("降级后应成功，实际状态码 %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if receivedModel != "claude-sonnet-4" {
+		t.Errorf("上游收到的模型 = %s, 期望 claude-sonnet-4", receivedModel)
+	}
+	if got := recorder.Header().Get(fallbackFromHeader); got != "claude-opus-4" {
+		t.Errorf("%s = %q, 期望 claude-opus-4", fallbackFromHeader, got)
+	}
+	if got := recorder.Header().Get(fallbackModelHeader); got != "claude-sonnet-4" {
+		t.Errorf("%s = %q, 期望 claude-sonnet-4", fallbackModelHeader, got)
+	}
+}
+
+func TestProxyHandlerFallbackOnlyOnRetryableErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		expectFallback bool
+	}{
+		{"上游 503 降级", http.StatusServiceUnavailable, true},
+		{"上游 429 降级", http.StatusTooManyRequests, true},
+		{"请求无效不降级", http.StatusBadRequest, false},
+		{"请求过大不降级", http.StatusRequestEntityTooLarge, false},
+		{"鉴权失败不降级", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			t.Setenv("USERPROFILE", t.TempDir())
+
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"unsupported parameter"}}`))
+			}))
+			defer failing.Close()
+			fallbackCalled := false
+			healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fallbackCalled = true
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"ok":true}`))
+			}))
+			defer healthy.Close()
+
+			providerService := NewProviderService()
+			if err := providerService.SaveProviders("claude", []Provider{
+				{ID: 1, Name: "opus-only", APIURL: failing.URL, APIKey: "key", Enabled: true,
+					SupportedModels: map[string]bool{"claude-opus-4": true}},
+				{ID: 2, Name: "haiku-only", APIURL: healthy.URL, APIKey: "key", Enabled: true,
+					SupportedModels: map[string]bool{"claude-haiku-4": true}},
+			}); err != nil {
+				t.Fatalf("保存 provider 失败: %v", err)
+			}
+			settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+			if _, err := settingsService.SaveRelaySettings(RelaySettings{
+				Platforms: map[string]PlatformRelaySettings{
+					"claude": {FallbackChains: [][]string{{"claude-opus-4", "claude-haiku-4"}}},
+				},
+			}); err != nil {
+				t.Fatalf("保存 relay 配置失败: %v", err)
+			}
+
+			prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService}
+			c, recorder := newHedgeTestContext()
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+				strings.NewReader(`{"model":"claude-opus-4","messages":[]}`))
+			prs.proxyHandler("claude", "/v1/messages")(c)
+
+			if fallbackCalled != tt.expectFallback {
+				t.Fatalf("是否降级 = %v, 期望 %v（状态码 %d）", fallbackCalled, tt.expectFallback, recorder.Code)
+			}
+			if tt.expectFallback && recorder.Code != http.StatusOK {
+				t.Errorf("降级后应成功，实际状态码 %d", recorder.Code)
+			}
+			if !tt.expectFallback && recorder.Code == http.StatusOK {
+				t.Errorf("不降级时应返回错误，实际状态码 %d", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestProxyHandlerPromptTooLong(t *testing.T) {
+	small := &ProviderContextLimits{MaxInputTokens: 10}
+	tests := []struct {
+		name       string
+		providers  []Provider
+		expectCode int
+		expectText string
+	}{
+		{
+			name: "全部因上下文窗口跳过",
+			providers: []Provider{
+				{ID: 1, Name: "A", APIURL: "http://127.0.0.1:1", APIKey: "key", Enabled: true, ContextLimits: small},
+				{ID: 2, Name: "B", APIURL: "http://127.0.0.1:1", APIKey: "key", Enabled: true, ContextLimits: small},
+			},
+			expectCode: http.StatusBadRequest,
+			expectText: "prompt is too long",
+		},
+		{
+			name: "同时存在不支持模型的 provider",
+			providers: []Provider{
+				{ID: 1, Name: "A", APIURL: "http://127.0.0.1:1", APIKey: "key", Enabled: true, ContextLimits: small},
+				{ID: 2, Name: "B", APIURL: "http://127.0.0.1:1", APIKey: "key", Enabled: true,
+					SupportedModels: map[string]bool{"claude-haiku-4": true}},
+			},
+			expectCode: http.StatusNotFound,
+			expectText: "没有可用的 provider 支持模型",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			t.Setenv("USERPROFILE", t.TempDir())
+			providerService := NewProviderService()
+			if err := providerService.SaveProviders("claude", tt.providers); err != nil {
+				t.Fatalf("保存 provider 失败: %v", err)
+			}
+			settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+			prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService}
+
+			c, recorder := newHedgeTestContext()
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(
+				`{"model":"claude-opus-4","messages":[{"role":"user","content":"`+strings.Repeat("hello world ", 200)+`"}]}`))
+			prs.proxyHandler("claude", "/v1/messages")(c)
+
+			if recorder.Code != tt.expectCode || !strings.Contains(recorder.Body.String(), tt.expectText) {
+				t.Errorf("响应 = %d %s, 期望 %d 且包含 %q", recorder.Code, recorder.Body.String(), tt.expectCode, tt.expectText)
+			}
+			if tt.expectCode == http.StatusBadRequest && !strings.Contains(recorder.Body.String(), "invalid_request_error") {
+				t.Errorf("请求过长应返回 invalid_request_error，实际 %s", recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // Windows 等系统可能缺少时区数据库
+)
+
+const (
+	scheduleActionEnable  = "enable"  // 仅在窗口内可用（默认）
+	scheduleActionDisable = "disable" // 窗口内不可用
+	scheduleActionAdjust  = "adjust"  // 仅调整窗口内的 level / weight
+
+	// 计算下一次状态变化时向后扫描的最长时间
+	scheduleLookahead = 8 * 24 * time.Hour
+
+	// 编译结果缓存的最大条目数，超出后清空重建
+	maxScheduleCacheEntries = 256
+)
+
+// ProviderSchedule 时间窗口：控制 provider 何时可用，或在窗口内调整 level / weight
+// 窗口可用 cron 表达式（"分 时 日 月 周"，按分钟匹配）或 星期 + 时段 描述，二选一
+type ProviderSchedule struct {
+	Name     string `json:"name,omitempty"`
+	Timezone string `json:"timezone,omitempty"` // IANA 时区，如 "Asia/Shanghai"，默认本地时区
+	Cron     string `json:"cron,omitempty"`     // 如 "* 9-17 * * 1-5" 表示工作日 9:00-17:59
+	Weekdays []int  `json:"weekdays,omitempty"` // 0=周日 ... 6=周六，空表示每天
+	Start    string `json:"start,omitempty"`    // "HH:MM"，空表示 00:00
+	End      string `json:"end,omitempty"`      // "HH:MM"（不含），早于 Start 表示跨午夜
+	Action   string `json:"action,omitempty"`   // enable / disable / adjust，默认 enable
+	Level    int    `json:"level,omitempty"`    // 窗口内覆盖的 level，0 表示不调整
+	Weight   int    `json:"weight,omitempty"`   // 窗口内覆盖的 weight，0 表示不调整
+}
+
+// ScheduleState provider 在某一时刻的调度状态
+type ScheduleState struct {
+	Active bool `json:"active"`
+	Level  int  `json:"level"`
+	Weight int  `json:"weight"`
+}
+
+// ProviderScheduleStatus 当前调度状态及下一次变化，供前端展示
+type ProviderScheduleStatus struct {
+	Name       string        `json:"name"`
+	Enabled    bool          `json:"enabled"`
+	Current    ScheduleState `json:"current"`
+	NextChange string        `json:"next_change,omitempty"` // 为空表示 8 天内无变化
+	Next       ScheduleState `json:"next"`
+}
+
+type compiledSchedule struct {
+	location *time.Location
+	cron     *cronSpec
+	weekdays uint8
+	start    int // 分钟
+	end      int // 分钟
+	action   string
+	level    int
+	weight   int
+}
+
+func (s ProviderSchedule) compile() (*compiledSchedule, error) {
+	compiled := &compiledSchedule{
+		location: time.Local,
+		action:   strings.ToLower(strings.TrimSpace(s.Action)),
+		level:    s.Level,
+		weight:   s.Weight,
+	}
+	if compiled.action == "" {
+		compiled.action = scheduleActionEnable
+	}
+	switch compiled.action {
+	case scheduleActionEnable, scheduleActionDisable, scheduleActionAdjust:
+	default:
+		return nil, fmt.Errorf("未知的 action '%s'（可选 enable / disable / adjust）", s.Action)
+	}
+	if s.Level < 0 || s.Weight < 0 {
+		return nil, fmt.Errorf("level、weight 不能为负数")
+	}
+
+	if s.Timezone != "" {
+		location, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("时区 '%s' 无效: %v", s.Timezone, err)
+		}
+		compiled.location = location
+	}
+
+	if strings.TrimSpace(s.Cron) != "" {
+		if len(s.Weekdays) > 0 || s.Start != "" || s.End != "" {
+			return nil, fmt.Errorf("cron 与 weekdays/start/end 不能同时配置")
+		}
+		spec, err := parseCron(s.Cron)
+		if err != nil {
+			return nil, err
+		}
+		compiled.cron = spec
+		return compiled, nil
+	}
+
+	for _, day := range s.Weekdays {
+		if day < 0 || day > 6 {
+			return nil, fmt.Errorf("weekday %d 无效（0=周日 ... 6=周六）", day)
+		}
+		compiled.weekdays |= 1 << uint(day)
+	}
+	if len(s.Weekdays) == 0 {
+		compiled.weekdays = 0x7f
+	}
+
+	var err error
+	if compiled.start, err = parseClock(s.Start, 0); err != nil {
+		return nil, err
+	}
+	if compiled.end, err = parseClock(s.End, 24*60); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// parseClock 解析 "HH:MM"，空字符串返回默认值
+func parseClock(value string, fallback int) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("时间 '%s' 格式无效，应为 HH:MM", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (cs *compiledSchedule) weekdayAllowed(day time.Weekday) bool {
+	return cs.weekdays&(1<<uint(day)) != 0
+}
+
+// contains 判断时刻 t 是否落在窗口内
+func (cs *compiledSchedule) contains(t time.Time) bool {
+	local := t.In(cs.location)
+	if cs.cron != nil {
+		return cs.cron.matches(local)
+	}
+
+	minute := local.Hour()*60 + local.Minute()
+	switch {
+	case cs.start == cs.end || (cs.start == 0 && cs.end == 24*60):
+		return cs.weekdayAllowed(local.Weekday())
+	case cs.start < cs.end:
+		return minute >= cs.start && minute < cs.end && cs.weekdayAllowed(local.Weekday())
+	default:
+		// 跨午夜窗口，星期以窗口开始的那天为准
+		if minute >= cs.start {
+			return cs.weekdayAllowed(local.Weekday())
+		}
+		if minute < cs.end {
+			return cs.weekdayAllowed(local.AddDate(0, 0, -1).Weekday())
+		}
+		return false
+	}
+}
+
+func compileSchedules(schedules []ProviderSchedule) ([]*compiledSchedule, error) {
+	compiled := make([]*compiledSchedule, 0, len(schedules))
+	for i, schedule := range schedules {
+		item, err := schedule.compile()
+		if err != nil {
+			name := schedule.Name
+			if name == "" {
+				name = strconv.Itoa(i + 1)
+			}
+			return nil, fmt.Errorf("调度 '%s' 无效: %v", name, err)
+		}
+		compiled = append(compiled, item)
+	}
+	return compiled, nil
+}
+
+// scheduleCacheEntry 一组调度配置的编译结果
+type scheduleCacheEntry struct {
+	schedules []*compiledSchedule
+	err       error
+}
+
+// scheduleCache 按调度配置内容缓存编译结果：provider 配置每次请求都会重新加载，
+// 避免每次都解析 cron 与加载时区
+var scheduleCache struct {
+	mu      sync.Mutex
+	entries map[string]scheduleCacheEntry
+}
+
+// cachedSchedules 返回调度配置的编译结果，配置内容不变时复用
+func cachedSchedules(schedules []ProviderSchedule) ([]*compiledSchedule, error) {
+	data, err := json.Marshal(schedules)
+	if err != nil {
+		return compileSchedules(schedules)
+	}
+	key := string(data)
+
+	scheduleCache.mu.Lock()
+	defer scheduleCache.mu.Unlock()
+	if entry, ok := scheduleCache.entries[key]; ok {
+		return entry.schedules, entry.err
+	}
+	if scheduleCache.entries == nil || len(scheduleCache.entries) >= maxScheduleCacheEntries {
+		scheduleCache.entries = make(map[string]scheduleCacheEntry)
+	}
+	compiled, err := compileSchedules(schedules)
+	scheduleCache.entries[key] = scheduleCacheEntry{schedules: compiled, err: err}
+	return compiled, err
+}
+
+func scheduleStateAt(base ScheduleState, schedules []*compiledSchedule, t time.Time) ScheduleState {
+	state := base
+	hasEnable, inEnable := false, false
+	for _, schedule := range schedules {
+		if schedule.action == scheduleActionEnable {
+			hasEnable = true
+		}
+		if !schedule.contains(t) {
+			continue
+		}
+		switch schedule.action {
+		case scheduleActionEnable:
+			inEnable = true
+		case scheduleActionDisable:
+			state.Active = false
+		}
+		if schedule.level > 0 {
+			state.Level = schedule.level
+		}
+		if schedule.weight > 0 {
+			state.Weight = schedule.weight
+		}
+	}
+	if hasEnable && !inEnable {
+		state.Active = false
+	}
+	return state
+}
+
+// ScheduleState 返回 provider 在 t 时刻的调度状态；调度配置无效时视为不可用
+func (p *Provider) ScheduleState(t time.Time) ScheduleState {
+	base := ScheduleState{Active: true, Level: p.Level, Weight: p.Weight}
+	if len(p.Schedules) == 0 {
+		return base
+	}
+	schedules, err := cachedSchedules(p.Schedules)
+	if err != nil {
+		return ScheduleState{Active: false, Level: p.Level, Weight: p.Weight}
+	}
+	return scheduleStateAt(base, schedules, t)
+}
+
+// NextScheduleChange 返回 now 之后调度状态第一次发生变化的时间与新状态
+func (p *Provider) NextScheduleChange(now time.Time) (time.Time, ScheduleState, bool) {
+	base := ScheduleState{Active: true, Level: p.Level, Weight: p.Weight}
+	schedules, err := cachedSchedules(p.Schedules)
+	if err != nil || len(schedules) == 0 {
+		return time.Time{}, base, false
+	}
+	current := scheduleStateAt(base, schedules, now)
+	cursor := now.Truncate(time.Minute)
+	deadline := now.Add(scheduleLookahead)
+	for cursor = cursor.Add(time.Minute); cursor.Before(deadline); cursor = cursor.Add(time.Minute) {
+		if next := scheduleStateAt(base, schedules, cursor); next != current {
+			return cursor, next, true
+		}
+	}
+	return time.Time{}, current, false
+}
+
+// ScheduleStatus 返回指定平台所有 provider 的当前调度状态及下一次变化时间
+func (ps *ProviderService) ScheduleStatus(kind string) ([]ProviderScheduleStatus, error) {
+	providers, err := ps.LoadProviders(kind)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	statuses := make([]ProviderScheduleStatus, 0, len(providers))
+	for _, provider := range providers {
+		status := ProviderScheduleStatus{
+			Name:    provider.Name,
+			Enabled: provider.Enabled,
+			Current: provider.ScheduleState(now),
+		}
+		status.Next = status.Current
+		if at, next, ok := provider.NextScheduleChange(now); ok {
+			status.NextChange = at.Format(timeLayout)
+			status.Next = next
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// orderProviders 按 level 升序排列（默认 1），同一 level 内配置了 weight 时按权重随机排序；
+// 仅在有 provider 配置了 weight 或调度窗口调整了 level / weight 时使用，其余情况保持配置顺序
+func orderProviders(providers []Provider) []Provider {
+	ordered := make([]Provider, len(providers))
+	copy(ordered, providers)
+
+	effectiveLevel := func(p Provider) int {
+		if p.Level <= 0 {
+			return 1
+		}
+		return p.Level
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return effectiveLevel(ordered[i]) < effectiveLevel(ordered[j])
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && effectiveLevel(ordered[end]) == effectiveLevel(ordered[start]) {
+			end++
+		}
+		weightedShuffle(ordered[start:end])
+		start = end
+	}
+	return ordered
+}
+
+// weightedShuffle 按 weight 做加权随机排序（Efraimidis-Spirakis），未配置 weight 时保持原顺序
+func weightedShuffle(group []Provider) {
+	weighted := false
+	for _, p := range group {
+		if p.Weight > 0 {
+			weighted = true
+			break
+		}
+	}
+	if !weighted || len(group) < 2 {
+		return
+	}
+	keys := make(map[string]float64, len(group))
+	for _, p := range group {
+		weight := float64(p.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		keys[p.Name] = math.Pow(rand.Float64(), 1/weight)
+	}
+	sort.SliceStable(group, func(i, j int) bool {
+		return keys[group[i].Name] > keys[group[j].Name]
+	})
+}
+
+// cronSpec 五段式 cron 表达式（分 时 日 月 周），按分钟匹配
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron 表达式 '%s' 应包含 5 段（分 时 日 月 周）", expr)
+	}
+	spec := &cronSpec{}
+	var err error
+	if spec.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if spec.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if spec.dom, spec.domAny, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if spec.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if spec.dow, spec.dowAny, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 7 与 0 均表示周日
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	return spec, nil
+}
+
+// parseCronField 解析单段 cron：支持 *、n、a-b、a,b、*/n、a-b/n
+func parseCronField(field string, min int, max int) (uint64, bool, error) {
+	var bits uint64
+	any := field == "*"
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			rangePart = part[:idx]
+			n, err := strconv.Atoi(part[idx+1:])
+			if err != nil || n <= 0 {
+				return 0, false, fmt.Errorf("cron 步长 '%s' 无效", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			a, errA := strconv.Atoi(bounds[0])
+			b, errB := strconv.Atoi(bounds[1])
+			if errA != nil || errB != nil || a > b {
+				return 0, false, fmt.Errorf("cron 范围 '%s' 无效", rangePart)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, false, fmt.Errorf("cron 字段 '%s' 无效", rangePart)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max {
+			return 0, false, fmt.Errorf("cron 字段 '%s' 超出范围 %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, any, nil
+}
+
+func (c *cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 ||
+		c.hour&(1<<uint(t.Hour())) == 0 ||
+		c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	// 与标准 cron 一致：日、周都有限定时满足其一即可
+	if !c.domAny && !c.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// ==================== cron 表达式测试 ====================
+
+func TestCronSpecMatches(t *testing.T) {
+	// 2025-06-18 是周三
+	wednesday := time.Date(2025, 6, 18, 10, 30, 0, 0, time.UTC)
+	saturday := time.Date(2025, 6, 21, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		expr     string
+		at       time.Time
+		expected bool
+	}{
+		{"任意时间", "* * * * *", wednesday, true},
+		{"工作日白天", "* 9-17 * * 1-5", wednesday, true},
+		{"工作日白天-周末不匹配", "* 9-17 * * 1-5", saturday, false},
+		{"整点", "0 * * * *", wednesday, false},
+		{"步长", "*/15 * * * *", wednesday, true},
+		{"列表", "* 8,10,12 * * *", wednesday, true},
+		{"周日用 7 表示", "* * * * 7", time.Date(2025, 6, 22, 0, 0, 0, 0, time.UTC), true},
+		{"日与周同时限定时满足其一", "* * 1 * 3", wednesday, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q) 返回错误: %v", tt.expr, err)
+			}
+			if got := spec.matches(tt.at); got != tt.expected {
+				t.Errorf("matches(%q, %v) = %v, 期望 %v", tt.expr, tt.at, got, tt.expected)
+			}
+		})
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 5-3 * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) 期望返回错误", expr)
+		}
+	}
+}
+
+// ==================== 时间窗口测试 ====================
+
+func TestProviderScheduleState(t *testing.T) {
+	// 2025-06-18 是周三
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, 6, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		schedules []ProviderSchedule
+		at        time.Time
+		expected  ScheduleState
+	}{
+		{
+			name:     "无调度始终可用",
+			at:       at(18, 3, 0),
+			expected: ScheduleState{Active: true, Level: 1},
+		},
+		{
+			name:      "enable 窗口内可用",
+			schedules: []ProviderSchedule{{Timezone: "UTC", Weekdays: []int{1, 2, 3, 4, 5}, Start: "09:00", End: "18:00"}},
+			at:        at(18, 9, 0),
+			expected:  ScheduleState{Active: true, Level: 1},
+		},
+		{
+			name:      "enable 窗口外不可用",
+			schedules: []ProviderSchedule{{Timezone: "UTC", Weekdays: []int{1, 2, 3, 4, 5}, Start: "09:00", End: "18:00"}},
+			at:        at(18, 18, 0),
+			expected:  ScheduleState{Active: false, Level: 1},
+		},
+		{
+			name:      "跨午夜窗口按开始日计算星期",
+			schedules: []ProviderSchedule{{Timezone: "UTC", Weekdays: []int{3}, Start: "22:00", End: "06:00"}},
+			at:        at(19, 2, 0),
+			expected:  ScheduleState{Active: true, Level: 1},
+		},
+		{
+			name:      "disable 窗口",
+			schedules: []ProviderSchedule{{Timezone: "UTC", Cron: "* 0-5 * * *", Action: "disable"}},
+			at:        at(18, 3, 0),
+			expected:  ScheduleState{Active: false, Level: 1},
+		},
+		{
+			name:      "adjust 调整 level 与 weight",
+			schedules: []ProviderSchedule{{Timezone: "UTC", Start: "09:00", End: "18:00", Action: "adjust", Level: 3, Weight: 5}},
+			at:        at(18, 12, 0),
+			expected:  ScheduleState{Active: true, Level: 3, Weight: 5},
+		},
+		{
+			name:      "时区换算",
+			schedules: []ProviderSchedule{{Timezone: "Asia/Shanghai", Start: "09:00", End: "18:00"}},
+			at:        at(18, 2, 0), // 北京时间 10:00
+			expected:  ScheduleState{Active: true, Level: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := Provider{Name: "A", Level: 1, Schedules: tt.schedules}
+			if got := provider.ScheduleState(tt.at); got != tt.expected {
+				t.Errorf("ScheduleState(%v) = %+v, 期望 %+v", tt.at, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProviderNextScheduleChange(t *testing.T) {
+	provider := Provider{
+		Name:      "A",
+		Schedules: []ProviderSchedule{{Timezone: "UTC", Start: "09:00", End: "18:00"}},
+	}
+	now := time.Date(2025, 6, 18, 17, 30, 20, 0, time.UTC)
+
+	at, next, ok := provider.NextScheduleChange(now)
+	if !ok {
+		t.Fatalf("期望找到下一次变化")
+	}
+	if expected := time.Date(2025, 6, 18, 18, 0, 0, 0, time.UTC); !at.Equal(expected) {
+		t.Errorf("下一次变化时间 = %v, 期望 %v", at, expected)
+	}
+	if next.Active {
+		t.Errorf("18:00 之后应不可用")
+	}
+
+	if _, _, ok := (&Provider{Name: "B"}).NextScheduleChange(now); ok {
+		t.Errorf("无调度的 provider 不应有状态变化")
+	}
+}
+
+func TestProviderScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		schedule  ProviderSchedule
+		expectErr bool
+	}{
+		{"星期 + 时段", ProviderSchedule{Weekdays: []int{1, 5}, Start: "09:00", End: "18:00"}, false},
+		{"cron", ProviderSchedule{Cron: "* 9-17 * * 1-5", Timezone: "Asia/Shanghai"}, false},
+		{"无效时区", ProviderSchedule{Timezone: "Mars/Olympus"}, true},
+		{"无效星期", ProviderSchedule{Weekdays: []int{7}}, true},
+		{"无效时间", ProviderSchedule{Start: "25:00"}, true},
+		{"cron 与时段同时配置", ProviderSchedule{Cron: "* * * * *", Start: "09:00"}, true},
+		{"未知 action", ProviderSchedule{Action: "pause"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileSchedules([]ProviderSchedule{tt.schedule})
+			if tt.expectErr && err == nil {
+				t.Errorf("期望返回错误，但没有错误")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("不期望错误，但返回了: %v", err)
+			}
+		})
+	}
+}
+
+// ==================== 优先级排序测试 ====================
+
+func TestOrderProviders(t *testing.T) {
+	providers := []Provider{
+		{Name: "A", Level: 2},
+		{Name: "B"},
+		{Name: "C", Level: 1},
+		{Name: "D", Level: 3},
+	}
+	ordered := orderProviders(providers)
+	expected := []string{"B", "C", "A", "D"}
+	for i, p := range ordered {
+		if p.Name != expected[i] {
+			t.Fatalf("排序结果 %v, 期望 %v", ordered, expected)
+		}
+	}
+	if providers[0].Name != "A" {
+		t.Errorf("orderProviders 不应修改原切片")
+	}
+
+	// 加权：权重悬殊时高权重 provider 绝大多数情况下排在前面
+	weighted := []Provider{{Name: "low", Weight: 1}, {Name: "high", Weight: 1000}}
+	first := 0
+	for i := 0; i < 100; i++ {
+		if orderProviders(weighted)[0].Name == "high" {
+			first++
+		}
+	}
+	if first < 90 {
+		t.Errorf("高权重 provider 排在首位 %d/100 次，期望绝大多数", first)
+	}
+}
+
+func TestSelectProvidersKeepsOrderWithoutScheduleOverrides(t *testing.T) {
+	now := time.Date(2025, 6, 18, 10, 30, 0, 0, time.UTC)
+	provider := func(name string, level int, schedules ...ProviderSchedule) Provider {
+		return Provider{Name: name, APIURL: "https://example.com", APIKey: "key", Enabled: true, Level: level, Schedules: schedules}
+	}
+	weighted := provider("B", 1)
+	weighted.Weight = 5
+	tests := []struct {
+		name           string
+		providers      []Provider
+		expectAdjusted bool
+		expectWeighted bool
+	}{
+		{"未配置调度", []Provider{provider("A", 3), provider("B", 1)}, false, false},
+		{"调度窗口只控制可用时段", []Provider{provider("A", 3, ProviderSchedule{Timezone: "UTC", Start: "09:00", End: "18:00"}), provider("B", 1)}, false, false},
+		{"调度窗口调整 level", []Provider{provider("A", 3, ProviderSchedule{Timezone: "UTC", Action: "adjust", Level: 1}), provider("B", 2)}, true, false},
+		{"窗口外不调整", []Provider{provider("A", 3, ProviderSchedule{Timezone: "UTC", Action: "adjust", Start: "20:00", End: "22:00", Level: 1}), provider("B", 1)}, false, false},
+		{"配置了 weight", []Provider{provider("A", 1), weighted}, false, true},
+		{"调度窗口设置 weight", []Provider{provider("A", 1, ProviderSchedule{Timezone: "UTC", Action: "adjust", Weight: 3}), provider("B", 1)}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection := selectProviders(tt.providers, "", now, requestSize{}, nil)
+			active := selection.active
+			if selection.adjusted != tt.expectAdjusted {
+				t.Errorf("adjusted = %v, 期望 %v", selection.adjusted, tt.expectAdjusted)
+			}
+			if selection.weighted != tt.expectWeighted {
+				t.Errorf("weighted = %v, 期望 %v", selection.weighted, tt.expectWeighted)
+			}
+			if len(active) != len(tt.providers) || active[0].Name != "A" {
+				t.Errorf("selectProviders 应保持配置顺序，实际 %v", active)
+			}
+		})
+	}
+}
+
+func TestCachedSchedules(t *testing.T) {
+	schedules := []ProviderSchedule{{Timezone: "Asia/Shanghai", Cron: "* 9-17 * * 1-5"}}
+	first, err := cachedSchedules(schedules)
+	if err != nil {
+		t.Fatalf("cachedSchedules 返回错误: %v", err)
+	}
+	second, _ := cachedSchedules([]ProviderSchedule{{Timezone: "Asia/Shanghai", Cron: "* 9-17 * * 1-5"}})
+	if len(first) != 1 || len(second) != 1 || first[0] != second[0] {
+		t.Errorf("相同配置应复用编译结果")
+	}
+	if _, err := cachedSchedules([]ProviderSchedule{{Timezone: "Mars/Base"}}); err == nil {
+		t.Errorf("无效配置的错误也应返回")
+	}
+}
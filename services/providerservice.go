@@ -32,6 +32,30 @@ type Provider struct {
 	// 使用 omitempty 确保零值不序列化，向后兼容
 	Level int `json:"level,omitempty"`
 
+	// 客户端侧限流 - RPM / TPM / 最大并发，未配置则不限制
+	RateLimit *ProviderRateLimit `json:"rateLimit,omitempty"`
+
+	// 同一 level 内的权重，配置后按权重随机排序；0 表示不参与加权
+	Weight int `json:"weight,omitempty"`
+
+	// 时间窗口调度 - 控制可用时段，或在窗口内调整 level / weight
+	Schedules []ProviderSchedule `json:"schedules,omitempty"`
+
+	// 上下文窗口覆盖 - 未配置时使用模型价格表中的 max_input_tokens / max_output_tokens
+	ContextLimits *ProviderContextLimits `json:"contextLimits,omitempty"`
+
+	// 请求体改写规则 - 按顺序执行，用于删除上游不支持的字段等
+	BodyRules []BodyRule `json:"bodyRules,omitempty"`
+
+	// 请求头规则 - 注入/覆盖、删除请求头，过滤 anthropic-beta
+	HeaderRules *HeaderRules `json:"headerRules,omitempty"`
+
+	// 将响应中的模型名改写回映射前的模型名，避免客户端看到 provider 内部模型名
+	RewriteResponseModel bool `json:"rewriteResponseModel,omitempty"`
+
+	// 捕获发往该 provider 的请求体与响应体（脱敏后压缩保存），用于排查异常响应
+	CaptureBodies bool `json:"captureBodies,omitempty"`
+
 	// 内部字段：配置验证错误（不持久化）
 	configErrors []string `json:"-"`
 }
@@ -270,6 +294,33 @@ func (p *Provider) ValidateConfiguration() []string {
 		}
 	}
 
+	// 规则 4：限流配置合法
+	if p.RateLimit != nil {
+		errors = append(errors, p.RateLimit.Validate()...)
+	}
+
+	// 规则 5：调度配置合法
+	if _, err := compileSchedules(p.Schedules); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	// 规则 6：上下文限制合法
+	if p.ContextLimits != nil {
+		errors = append(errors, p.ContextLimits.Validate()...)
+	}
+
+	// 规则 7：请求体改写规则合法
+	for i, rule := range p.BodyRules {
+		if err := rule.Validate(); err != nil {
+			errors = append(errors, fmt.Sprintf("第 %d 条请求体改写规则无效: %v", i+1, err))
+		}
+	}
+
+	// 规则 8：请求头规则合法
+	if p.HeaderRules != nil {
+		errors = append(errors, p.HeaderRules.Validate()...)
+	}
+
 	p.configErrors = errors
 	return errors
 }
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/daodao97/xgo/xrequest"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// writePlatformError 按入站平台返回 Anthropic（claude）或 OpenAI（codex）格式的错误
+func writePlatformError(c *gin.Context, kind string, status int, errType string, message string) {
+	if kind == "codex" {
+		c.JSON(status, gin.H{
+			"error": gin.H{
+				"message": message,
+				"type":    errType,
+				"code":    errType,
+			},
+		})
+		return
+	}
+	c.JSON(status, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
+// writeBudgetExceededError 预算硬上限拦截时返回的错误，使用不会触发客户端自动重试的错误类型
+func writeBudgetExceededError(c *gin.Context, kind string, status *BudgetStatus) {
+	message := fmt.Sprintf("code-switch: 预算 %s 已达到硬上限（%s 周期已花费 $%.4f，上限 $%.2f）",
+		status.Budget.Name, status.Budget.Period, status.Spent, status.Budget.HardLimit)
+	if kind == "codex" {
+		writePlatformError(c, kind, http.StatusTooManyRequests, "insufficient_quota", message)
+		return
+	}
+	writePlatformError(c, kind, http.StatusPaymentRequired, "billing_error", message)
+}
+
+// 读取上游错误响应体的上限
+const maxUpstreamErrorBody = 64 * 1024
+
+// upstreamError 上游返回的非 2xx 响应，message 为从响应体中提取的原始错误信息
+type upstreamError struct {
+	provider string
+	status   int
+	message  string
+}
+
+func (e *upstreamError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("provider %s 返回状态码 %d", e.provider, e.status)
+	}
+	return fmt.Sprintf("provider %s 返回状态码 %d: %s", e.provider, e.status, e.message)
+}
+
+// newUpstreamError 读取上游错误响应体并提取错误信息
+func newUpstreamError(provider string, resp *http.Response) *upstreamError {
+	uerr := &upstreamError{provider: provider, status: resp.StatusCode}
+	if resp.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBody))
+		uerr.message = extractUpstreamErrorMessage(body)
+	}
+	return uerr
+}
+
+var (
+	htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	htmlTagPattern   = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// 各家上游错误响应中常见的错误信息字段
+var upstreamErrorMessagePaths = []string{"error.message", "message", "msg", "error_msg", "errorMessage", "detail", "error", "errors.0.message"}
+
+// extractUpstreamErrorMessage 从 JSON、HTML 或纯文本错误响应中提取可读的错误信息
+func extractUpstreamErrorMessage(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return ""
+	}
+	if gjson.ValidBytes(body) {
+		for _, path := range upstreamErrorMessagePaths {
+			if value := gjson.GetBytes(body, path); value.Type == gjson.String && value.String() != "" {
+				return truncateErrorMessage(value.String())
+			}
+		}
+		return truncateErrorMessage(string(body))
+	}
+
+	text := string(body)
+	lower := strings.ToLower(text)
+	if strings.Contains(lower, "<html") || strings.Contains(lower, "<!doctype") {
+		if match := htmlTitlePattern.FindStringSubmatch(text); len(match) > 1 && strings.TrimSpace(match[1]) != "" {
+			text = match[1]
+		} else {
+			text = htmlTagPattern.ReplaceAllString(text, " ")
+		}
+		text = html.UnescapeString(text)
+	}
+	return truncateErrorMessage(strings.Join(strings.Fields(text), " "))
+}
+
+func truncateErrorMessage(message string) string {
+	const maxRunes = 300
+	runes := []rune(strings.TrimSpace(message))
+	if len(runes) <= maxRunes {
+		return string(runes)
+	}
+	return string(runes[:maxRunes]) + "..."
+}
+
+// request_log 中记录的失败类型
+const (
+	errorClassNetwork        = "network"         // 连接失败、DNS 错误等
+	errorClassTimeout        = "timeout"         // 请求超时
+	errorClassCancelled      = "cancelled"       // 客户端断开或对冲落败被取消
+	errorClassAuth           = "auth"            // 上游返回 401 / 403
+	errorClassRateLimit      = "rate_limit"      // 上游返回 429
+	errorClassInvalidRequest = "invalid_request" // 上游返回 400 / 404 / 413 / 422
+	errorClassServer         = "server_error"    // 上游返回 5xx
+	errorClassHTTP           = "http_error"      // 其他非 2xx 状态码
+	errorClassStream         = "stream"          // 响应写回客户端途中中断
+	errorClassOther          = "other"
+)
+
+// canFallback 判断一级模型的全部 provider 失败后是否可以降级到下一个模型：
+// 只有限流、上游 5xx / 过载、超时与网络错误才降级；请求无效、鉴权失败等换模型也无法解决，
+// 降级反而会让客户端的请求被其他模型静默应答
+func canFallback(err error) bool {
+	if err == nil {
+		return true
+	}
+	var refusal *rateLimitRefusal
+	if errors.As(err, &refusal) && !errors.Is(err, context.Canceled) {
+		return true
+	}
+	switch class, _ := classifyRelayError(err); class {
+	case errorClassRateLimit, errorClassServer, errorClassTimeout, errorClassNetwork:
+		return true
+	default:
+		return false
+	}
+}
+
+// classifyRelayError 将上游尝试的失败原因归类，并返回用于记录的错误信息
+func classifyRelayError(err error) (string, string) {
+	if err == nil {
+		return "", ""
+	}
+	message := truncateErrorMessage(err.Error())
+
+	var uerr *upstreamError
+	if errors.As(err, &uerr) {
+		if uerr.message != "" {
+			message = uerr.message
+		}
+		switch {
+		case uerr.status == http.StatusUnauthorized, uerr.status == http.StatusForbidden:
+			return errorClassAuth, message
+		case uerr.status == http.StatusTooManyRequests:
+			return errorClassRateLimit, message
+		case uerr.status == http.StatusBadRequest, uerr.status == http.StatusNotFound,
+			uerr.status == http.StatusRequestEntityTooLarge, uerr.status == http.StatusUnprocessableEntity:
+			return errorClassInvalidRequest, message
+		case uerr.status >= http.StatusInternalServerError:
+			return errorClassServer, message
+		default:
+			return errorClassHTTP, message
+		}
+	}
+
+	// xrequest 的 RequestError 未实现 Unwrap，需要手动取出底层错误
+	var reqErr *xrequest.RequestError
+	if errors.As(err, &reqErr) && reqErr.Err != nil {
+		err = reqErr.Err
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errorClassCancelled, message
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorClassTimeout, message
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTimeout, message
+	case errors.As(err, &netErr):
+		return errorClassNetwork, message
+	default:
+		return errorClassOther, message
+	}
+}
+
+// clientErrorStatus 将上游状态码映射为返回给客户端的状态码：
+// provider 自身的鉴权、路由问题不应让客户端误以为是自己的凭证错误
+func clientErrorStatus(status int) int {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests
+	case status == http.StatusBadRequest, status == http.StatusRequestEntityTooLarge, status == http.StatusUnprocessableEntity:
+		return status
+	case status == http.StatusServiceUnavailable, status == 529:
+		return status
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// canonicalErrorType 返回状态码对应的平台错误类型
+func canonicalErrorType(kind string, status int) string {
+	if kind == "codex" {
+		switch status {
+		case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			return "invalid_request_error"
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return "authentication_error"
+		case http.StatusTooManyRequests:
+			return "rate_limit_exceeded"
+		default:
+			return "server_error"
+		}
+	}
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// writeRelayError 返回中转服务自身产生的错误
+func writeRelayError(c *gin.Context, kind string, status int, message string) {
+	writePlatformError(c, kind, status, canonicalErrorType(kind, status), message)
+}
+
+// writeRelayFailure 所有 provider 均失败时返回规范化错误，保留最后一个上游的原始错误信息与 provider 名称
+func writeRelayFailure(c *gin.Context, kind string, summary string, lastErr error) {
+	var uerr *upstreamError
+	if errors.As(lastErr, &uerr) {
+		writeRelayError(c, kind, clientErrorStatus(uerr.status), fmt.Sprintf("%s: %s", summary, uerr.Error()))
+		return
+	}
+	if lastErr != nil {
+		summary = fmt.Sprintf("%s: %s", summary, lastErr.Error())
+	}
+	writeRelayError(c, kind, http.StatusBadGateway, summary)
+}
+
+// ErrorEventNormalizeHook 将流式响应中不规范的错误事件改写为入站平台的标准格式，
+// 作为 ToHttpResponseWriter 的钩子按 SSE 行调用
+func ErrorEventNormalizeHook(kind string, provider string) func(data []byte) (bool, []byte) {
+	lastEvent := ""
+	return func(data []byte) (bool, []byte) {
+		line := bytes.TrimSpace(data)
+		if bytes.HasPrefix(line, []byte("event:")) {
+			lastEvent = strings.TrimSpace(string(line[len("event:"):]))
+			return true, data
+		}
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			return true, data
+		}
+		payload := bytes.TrimSpace(line[len("data:"):])
+		if !gjson.ValidBytes(payload) || !isErrorPayload(payload) || isCanonicalErrorPayload(kind, payload) {
+			return true, data
+		}
+
+		message := fmt.Sprintf("provider %s: %s", provider, extractUpstreamErrorMessage(payload))
+		var normalized []byte
+		if kind == "codex" {
+			normalized, _ = json.Marshal(gin.H{"type": "error", "code": "server_error", "message": message, "param": nil})
+		} else {
+			normalized, _ = json.Marshal(gin.H{"type": "error", "error": gin.H{"type": "api_error", "message": message}})
+		}
+
+		fmt.Printf("[WARN] Provider %s 返回了不规范的流式错误，已改写: %s\n", provider, payload)
+		output := append([]byte("data: "), normalized...)
+		if lastEvent != "error" {
+			// 客户端按 event 名称识别错误事件
+			output = append([]byte("event: error\n"), output...)
+		}
+		lastEvent = ""
+		return true, output
+	}
+}
+
+// isErrorPayload 判断 SSE 负载是否为错误事件：type 为 error，或缺少 type 但带有错误字段
+func isErrorPayload(payload []byte) bool {
+	eventType := gjson.GetBytes(payload, "type")
+	if eventType.Exists() {
+		return eventType.String() == "error"
+	}
+	for _, field := range []string{"error", "msg", "message", "detail"} {
+		if gjson.GetBytes(payload, field).Exists() {
+			return true
+		}
+	}
+	return false
+}
+
+// isCanonicalErrorPayload 判断错误事件是否已符合平台格式
+func isCanonicalErrorPayload(kind string, payload []byte) bool {
+	if gjson.GetBytes(payload, "type").String() != "error" {
+		return false
+	}
+	if kind == "codex" {
+		return gjson.GetBytes(payload, "message").Type == gjson.String
+	}
+	return gjson.GetBytes(payload, "error.type").Type == gjson.String &&
+		gjson.GetBytes(payload, "error.message").Type == gjson.String
+}
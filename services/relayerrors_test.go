@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/daodao97/xgo/xrequest"
+	"github.com/tidwall/gjson"
+)
+
+// ==================== 上游错误信息提取测试 ====================
+
+func TestExtractUpstreamErrorMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"空响应", "", ""},
+		{"Anthropic 格式", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, "Overloaded"},
+		{"OpenAI 格式", `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`, "Rate limit reached"},
+		{"msg 字段", `{"code":500,"msg":"余额不足"}`, "余额不足"},
+		{"error 字符串", `{"error":"upstream timeout"}`, "upstream timeout"},
+		{"未知 JSON 原样返回", `{"code":42}`, `{"code":42}`},
+		{"HTML 标题", `<!DOCTYPE html><html><head><title>502 Bad Gateway</title></head><body><h1>nginx</h1></body></html>`, "502 Bad Gateway"},
+		{"HTML 无标题", `<html><body><h1>Service   Unavailable</h1><p>try later</p></body></html>`, "Service Unavailable try later"},
+		{"纯文本", "  upstream connect error\n", "upstream connect error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractUpstreamErrorMessage([]byte(tt.body)); got != tt.expected {
+				t.Errorf("extractUpstreamErrorMessage() = %q, 期望 %q", got, tt.expected)
+			}
+		})
+	}
+
+	long := strings.Repeat("错", 500)
+	if got := extractUpstreamErrorMessage([]byte(long)); len([]rune(got)) != 303 {
+		t.Errorf("超长错误信息应截断到 300 字符，实际 %d", len([]rune(got)))
+	}
+}
+
+// ==================== 流式错误事件规范化测试 ====================
+
+func TestErrorEventNormalizeHook(t *testing.T) {
+	tests := []struct {
+		name      string
+		kind      string
+		lines     []string
+		expectOut string // 最后一行的期望输出，空表示原样返回
+		checkPath string
+		checkVal  string
+	}{
+		{
+			name:  "普通事件保持原样",
+			kind:  "claude",
+			lines: []string{`data: {"type":"content_block_delta","delta":{"text":"hi"}}`},
+		},
+		{
+			name:  "规范的 Claude 错误保持原样",
+			kind:  "claude",
+			lines: []string{"event: error", `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`},
+		},
+		{
+			name:      "msg 错误改写为 Claude 格式",
+			kind:      "claude",
+			lines:     []string{"event: error", `data: {"code":500,"msg":"余额不足"}`},
+			checkPath: "error.message",
+			checkVal:  "provider P1: 余额不足",
+		},
+		{
+			name:      "OpenAI 格式错误改写为 Codex 格式",
+			kind:      "codex",
+			lines:     []string{`data: {"error":{"message":"quota exceeded"}}`},
+			checkPath: "message",
+			checkVal:  "provider P1: quota exceeded",
+		},
+		{
+			name:  "规范的 Codex 错误保持原样",
+			kind:  "codex",
+			lines: []string{`data: {"type":"error","code":"server_error","message":"boom","param":null}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := ErrorEventNormalizeHook(tt.kind, "P1")
+			var output []byte
+			for _, line := range tt.lines {
+				_, output = hook([]byte(line))
+			}
+			last := tt.lines[len(tt.lines)-1]
+			if tt.checkPath == "" {
+				if string(output) != last {
+					t.Errorf("输出 = %s, 期望原样返回", output)
+				}
+				return
+			}
+
+			outLines := strings.Split(string(output), "\n")
+			data := strings.TrimPrefix(outLines[len(outLines)-1], "data: ")
+			if got := gjson.Get(data, "type").String(); got != "error" {
+				t.Errorf("type = %q, 期望 error（输出 %s）", got, output)
+			}
+			if got := gjson.Get(data, tt.checkPath).String(); got != tt.checkVal {
+				t.Errorf("%s = %q, 期望 %q", tt.checkPath, got, tt.checkVal)
+			}
+			hasEventLine := len(outLines) == 2 && outLines[0] == "event: error"
+			if precededByEvent := len(tt.lines) > 1; hasEventLine == precededByEvent {
+				t.Errorf("缺少 event 行时应补充 event: error（输出 %s）", output)
+			}
+		})
+	}
+}
+
+// ==================== 最终错误响应测试 ====================
+
+func TestWriteRelayFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		kind         string
+		err          error
+		expectStatus int
+		typePath     string
+		expectType   string
+	}{
+		{
+			name:         "上游 429 透传为限流错误",
+			kind:         "claude",
+			err:          &upstreamError{provider: "P1", status: http.StatusTooManyRequests, message: "slow down"},
+			expectStatus: http.StatusTooManyRequests,
+			typePath:     "error.type",
+			expectType:   "rate_limit_error",
+		},
+		{
+			name:         "上游 401 不透传鉴权错误",
+			kind:         "claude",
+			err:          &upstreamError{provider: "P1", status: http.StatusUnauthorized, message: "invalid key"},
+			expectStatus: http.StatusBadGateway,
+			typePath:     "error.type",
+			expectType:   "api_error",
+		},
+		{
+			name:         "Codex 格式",
+			kind:         "codex",
+			err:          &upstreamError{provider: "P1", status: 529, message: "overloaded"},
+			expectStatus: 529,
+			typePath:     "error.type",
+			expectType:   "server_error",
+		},
+		{
+			name:         "网络错误",
+			kind:         "claude",
+			err:          errors.New("connection refused"),
+			expectStatus: http.StatusBadGateway,
+			typePath:     "error.type",
+			expectType:   "api_error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, recorder := newHedgeTestContext()
+			writeRelayFailure(c, tt.kind, "所有 1 个 provider 均失败", tt.err)
+			if recorder.Code != tt.expectStatus {
+				t.Errorf("状态码 = %d, 期望 %d", recorder.Code, tt.expectStatus)
+			}
+			body := recorder.Body.String()
+			if got := gjson.Get(body, tt.typePath).String(); got != tt.expectType {
+				t.Errorf("%s = %q, 期望 %q（响应 %s）", tt.typePath, got, tt.expectType, body)
+			}
+			if !strings.Contains(body, tt.err.Error()) {
+				t.Errorf("错误信息应包含原始错误 %q（响应 %s）", tt.err.Error(), body)
+			}
+		})
+	}
+}
+
+func TestClassifyRelayError(t *testing.T) {
+	tests := []struct {
+		name            string
+		err             error
+		expectedClass   string
+		expectedMessage string
+	}{
+		{"成功", nil, "", ""},
+		{"鉴权失败", &upstreamError{provider: "p", status: http.StatusUnauthorized, message: "invalid api key"}, errorClassAuth, "invalid api key"},
+		{"限流", &upstreamError{provider: "p", status: http.StatusTooManyRequests}, errorClassRateLimit, "provider p 返回状态码 429"},
+		{"请求无效", &upstreamError{provider: "p", status: http.StatusBadRequest, message: "bad"}, errorClassInvalidRequest, "bad"},
+		{"上游 5xx", &upstreamError{provider: "p", status: 529, message: "overloaded"}, errorClassServer, "overloaded"},
+		{"其他状态码", &upstreamError{provider: "p", status: http.StatusConflict, message: "conflict"}, errorClassHTTP, "conflict"},
+		{"取消", xrequest.NewRequestError("请求失败", context.Canceled), errorClassCancelled, "请求失败: context canceled"},
+		{"超时", xrequest.NewRequestError("请求失败", context.DeadlineExceeded), errorClassTimeout, "请求失败: context deadline exceeded"},
+		{"网络错误", xrequest.NewRequestError("请求失败", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), errorClassNetwork, "请求失败: dial tcp: connection refused"},
+		{"其他", errors.New("empty response"), errorClassOther, "empty response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, message := classifyRelayError(tt.err)
+			if class != tt.expectedClass || message != tt.expectedMessage {
+				t.Errorf("classifyRelayError = (%q, %q), 期望 (%q, %q)", class, message, tt.expectedClass, tt.expectedMessage)
+			}
+		})
+	}
+}
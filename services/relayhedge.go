@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// request_log.outcome 取值
+const (
+	outcomeHedged    = "hedged"    // 参与对冲竞速的请求
+	outcomeCancelled = "cancelled" // 对冲竞速中落败并被取消的请求
+)
+
+// hedgeResult 一轮转发（可能触发对冲）的结果
+type hedgeResult struct {
+	ok       bool
+	hedged   bool   // 是否触发了对冲请求
+	provider string // 最终响应或最后失败的 provider
+	err      error
+}
+
+// forwardWithHedge 转发请求；当 backup 不为空且主 provider 在 delay 内未返回响应头时，
+// 并发请求 backup，采用先返回成功响应头的一方，取消另一方
+func (prs *ProviderRelayService) forwardWithHedge(
+	c *gin.Context,
+	kind string,
+	endpoint string,
+	query map[string]string,
+	clientHeaders map[string]string,
+	isStream bool,
+	primary relayCandidate,
+	backup *relayCandidate,
+	delay time.Duration,
+) hedgeResult {
+	if backup == nil {
+		ok, err := prs.forwardRequest(c, kind, endpoint, query, clientHeaders, isStream, primary)
+		return hedgeResult{ok: ok, provider: primary.provider.Name, err: err}
+	}
+
+	ctx := c.Request.Context()
+	// 按发起顺序记录取消函数，两个候选可能同名（同一 provider 出现在不同层级）
+	type raceResult struct {
+		index   int
+		attempt *relayAttempt
+	}
+	results := make(chan raceResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+	launch := func(candidate relayCandidate) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			results <- raceResult{index: index, attempt: prs.sendUpstream(attemptCtx, kind, endpoint, query, clientHeaders, isStream, candidate)}
+		}()
+	}
+
+	launch(primary)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		// 主 provider 在延迟内返回，按普通请求处理
+		attempt := res.attempt
+		defer attempt.save()
+		defer attempt.finish()
+		ok, err := prs.writeUpstreamResponse(c, kind, attempt)
+		return hedgeResult{ok: ok, provider: primary.provider.Name, err: err}
+	case <-timer.C:
+	}
+
+	// 对冲请求不排队：对冲候选已达限流上限时，继续等待主 provider
+	lease, err := prs.limiters.tryAcquire(ctx, kind, *backup)
+	if err != nil {
+		fmt.Printf("[INFO]   Provider %s 触发限流，放弃对冲: %v\n", backup.provider.Name, err)
+		attempt := (<-results).attempt
+		defer attempt.save()
+		defer attempt.finish()
+		ok, err := prs.writeUpstreamResponse(c, kind, attempt)
+		return hedgeResult{ok: ok, provider: primary.provider.Name, err: err}
+	}
+	hedgeCandidate := *backup
+	hedgeCandidate.lease = lease
+
+	fmt.Printf("[INFO]   Provider %s 在 %v 内未返回响应头，对冲请求 %s\n",
+		primary.provider.Name, delay, backup.provider.Name)
+	launch(hedgeCandidate)
+
+	result := hedgeResult{hedged: true}
+	pending := 2
+	var winner *relayAttempt
+	winnerIndex := -1
+	for pending > 0 && winner == nil {
+		res := <-results
+		attempt := res.attempt
+		pending--
+		attempt.log.Outcome = outcomeHedged
+		if attempt.succeeded() {
+			winner, winnerIndex = attempt, res.index
+			continue
+		}
+		result.provider = attempt.candidate.provider.Name
+		result.err = attempt.failure()
+		attempt.finish()
+		attempt.save()
+	}
+
+	if winner == nil {
+		return result
+	}
+
+	// 取消仍在进行中的落败请求，并在其返回后记录日志
+	for index, cancel := range cancels {
+		if index != winnerIndex {
+			cancel()
+		}
+	}
+	if pending > 0 {
+		go func() {
+			loser := (<-results).attempt
+			loser.log.Outcome = outcomeCancelled
+			loser.finish()
+			loser.save()
+			fmt.Printf("[INFO]   对冲请求 %s 已取消\n", loser.candidate.provider.Name)
+		}()
+	}
+
+	defer winner.save()
+	defer winner.finish()
+	result.provider = winner.candidate.provider.Name
+	result.ok, result.err = prs.writeUpstreamResponse(c, kind, winner)
+	return result
+}
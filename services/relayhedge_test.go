@@ -0,0 +1,150 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/gin-gonic/gin"
+)
+
+func newHedgeTestUpstream(t *testing.T, delay time.Duration, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newHedgeTestContext() (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	return c, recorder
+}
+
+func TestForwardWithHedge(t *testing.T) {
+	slow := newHedgeTestUpstream(t, 500*time.Millisecond, `{"from":"slow"}`)
+	fast := newHedgeTestUpstream(t, 0, `{"from":"fast"}`)
+
+	candidate := func(name, url string) relayCandidate {
+		return relayCandidate{
+			provider: Provider{Name: name, APIURL: url, APIKey: "key"},
+			model:    "claude-sonnet-4",
+			body:     []byte(`{"model":"claude-sonnet-4"}`),
+		}
+	}
+
+	tests := []struct {
+		name         string
+		primary      relayCandidate
+		backup       *relayCandidate
+		delay        time.Duration
+		expectHedged bool
+		expectBody   string
+		expectWinner string
+		// 期望记录一条被取消的落败请求
+		expectCancelled bool
+	}{
+		{
+			name:         "未配置对冲候选",
+			primary:      candidate("slow", slow.URL),
+			delay:        10 * time.Millisecond,
+			expectHedged: false,
+			expectBody:   `{"from":"slow"}`,
+			expectWinner: "slow",
+		},
+		{
+			name:         "主 provider 在延迟内返回",
+			primary:      candidate("fast", fast.URL),
+			backup:       &relayCandidate{provider: Provider{Name: "slow", APIURL: slow.URL, APIKey: "key"}},
+			delay:        time.Second,
+			expectHedged: false,
+			expectBody:   `{"from":"fast"}`,
+			expectWinner: "fast",
+		},
+		{
+			name:            "主 provider 超时触发对冲",
+			primary:         candidate("slow", slow.URL),
+			backup:          func() *relayCandidate { c := candidate("fast", fast.URL); return &c }(),
+			delay:           20 * time.Millisecond,
+			expectHedged:    true,
+			expectBody:      `{"from":"fast"}`,
+			expectWinner:    "fast",
+			expectCancelled: true,
+		},
+		{
+			name:            "同名候选仍能取消落败请求",
+			primary:         candidate("same", slow.URL),
+			backup:          func() *relayCandidate { c := candidate("same", fast.URL); return &c }(),
+			delay:           20 * time.Millisecond,
+			expectHedged:    true,
+			expectBody:      `{"from":"fast"}`,
+			expectWinner:    "same",
+			expectCancelled: true,
+		},
+	}
+
+	prs := &ProviderRelayService{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initTestRequestLogDB(t)
+			c, recorder := newHedgeTestContext()
+			result := prs.forwardWithHedge(c, "claude", "/v1/messages", nil, map[string]string{}, false, tt.primary, tt.backup, tt.delay)
+
+			if !result.ok {
+				t.Fatalf("期望转发成功，但失败: %v", result.err)
+			}
+			if result.hedged != tt.expectHedged {
+				t.Errorf("hedged = %v, 期望 %v", result.hedged, tt.expectHedged)
+			}
+			if result.provider != tt.expectWinner {
+				t.Errorf("provider = %q, 期望 %q", result.provider, tt.expectWinner)
+			}
+			if recorder.Body.String() != tt.expectBody {
+				t.Errorf("响应体 = %q, 期望 %q", recorder.Body.String(), tt.expectBody)
+			}
+
+			// 落败请求在后台返回后才写入日志
+			expectRows := 1
+			if tt.expectCancelled {
+				expectRows = 2
+			}
+			var records []xdb.Record
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				records, _ = xdb.New("request_log").Selects(xdb.OrderByAsc("id"))
+				if len(records) >= expectRows {
+					break
+				}
+			}
+			if len(records) != expectRows {
+				t.Fatalf("应记录 %d 次尝试，实际 %d", expectRows, len(records))
+			}
+			finals, cancelled := 0, 0
+			for _, record := range records {
+				if record.GetBool("is_final") {
+					finals++
+				}
+				if record.GetString("outcome") == outcomeCancelled && record.GetString("error_class") == errorClassCancelled {
+					cancelled++
+				}
+			}
+			if finals != 1 {
+				t.Errorf("应有 1 条 is_final 的胜出记录，实际 %d", finals)
+			}
+			if tt.expectCancelled && cancelled != 1 {
+				t.Errorf("应有 1 条被取消的落败记录（outcome=cancelled, error_class=cancelled），实际 %v", records)
+			}
+		})
+	}
+}
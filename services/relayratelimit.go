@@ -0,0 +1,368 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	tokenestimate "codeswitch/resources/token-estimate"
+)
+
+const (
+	rateLimitModeQueue     = "queue"     // 超限时排队等待，直到超时
+	rateLimitModeSpillover = "spillover" // 超限时立即切换到下一个 provider
+
+	defaultRateLimitQueueTimeoutMs = 30000
+)
+
+// ProviderRateLimit 客户端侧的 provider 限流配置，零值表示不限制
+type ProviderRateLimit struct {
+	RPM            int    `json:"rpm,omitempty"`            // 每分钟请求数
+	TPM            int    `json:"tpm,omitempty"`            // 每分钟输入 tokens
+	MaxConcurrency int    `json:"maxConcurrency,omitempty"` // 最大并发请求数
+	OnLimit        string `json:"onLimit,omitempty"`        // queue / spillover，默认 spillover
+	QueueTimeoutMs int    `json:"queueTimeoutMs,omitempty"` // queue 模式下的最长等待时间
+}
+
+// IsEmpty 是否未配置任何限制
+func (r ProviderRateLimit) IsEmpty() bool {
+	return r.RPM <= 0 && r.TPM <= 0 && r.MaxConcurrency <= 0
+}
+
+// QueueTimeout 返回超限时的最长等待时间，spillover 模式为 0
+func (r ProviderRateLimit) QueueTimeout() time.Duration {
+	if !strings.EqualFold(r.OnLimit, rateLimitModeQueue) {
+		return 0
+	}
+	if r.QueueTimeoutMs <= 0 {
+		return defaultRateLimitQueueTimeoutMs * time.Millisecond
+	}
+	return time.Duration(r.QueueTimeoutMs) * time.Millisecond
+}
+
+// Validate 校验限流配置
+func (r ProviderRateLimit) Validate() []string {
+	errs := make([]string, 0)
+	if r.RPM < 0 || r.TPM < 0 || r.MaxConcurrency < 0 || r.QueueTimeoutMs < 0 {
+		errs = append(errs, "限流配置无效：rpm、tpm、maxConcurrency、queueTimeoutMs 不能为负数")
+	}
+	switch strings.ToLower(r.OnLimit) {
+	case "", rateLimitModeQueue, rateLimitModeSpillover:
+	default:
+		errs = append(errs, fmt.Sprintf("限流配置无效：未知的 onLimit '%s'（可选 queue / spillover）", r.OnLimit))
+	}
+	return errs
+}
+
+// tokenBucket 令牌桶，容量为每分钟配额，按秒匀速补充
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // 每秒补充的令牌数
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	capacity := float64(perMinute)
+	return &tokenBucket{
+		capacity: capacity,
+		tokens:   capacity,
+		rate:     capacity / 60,
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// clamp 单次请求的消耗不超过桶容量，避免永远无法放行
+func (b *tokenBucket) clamp(n float64) float64 {
+	return math.Min(n, b.capacity)
+}
+
+// waitTime 返回获得 n 个令牌还需等待的时间，nil 桶不限制
+func (b *tokenBucket) waitTime(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	n = b.clamp(n)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take 扣除令牌，允许透支（用于按实际用量修正）
+func (b *tokenBucket) take(n float64, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.refill(now)
+	b.tokens = math.Min(b.capacity, b.tokens-n)
+}
+
+// concurrencySlots 并发名额计数；配置变更重建限流器时沿用同一实例，进行中的请求仍计入新的上限
+type concurrencySlots struct {
+	mu       sync.Mutex
+	max      int
+	inflight int
+	freed    chan struct{} // 名额归还或上限变化时关闭并替换，唤醒等待者
+}
+
+func newConcurrencySlots(max int) *concurrencySlots {
+	return &concurrencySlots{max: max, freed: make(chan struct{})}
+}
+
+// wake 唤醒所有等待者，调用方需持有 mu
+func (s *concurrencySlots) wake() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+func (s *concurrencySlots) setMax(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.max = max
+	s.wake()
+}
+
+func (s *concurrencySlots) acquire(ctx context.Context, deadline time.Time) error {
+	var timer *time.Timer
+	for {
+		s.mu.Lock()
+		if s.inflight < s.max {
+			s.inflight++
+			s.mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil
+		}
+		freed, max := s.freed, s.max
+		s.mu.Unlock()
+
+		if timer == nil {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return fmt.Errorf("超出并发限制 %d", max)
+			}
+			timer = time.NewTimer(wait)
+		}
+		select {
+		case <-freed:
+		case <-timer.C:
+			return fmt.Errorf("超出并发限制 %d", max)
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *concurrencySlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight > 0 {
+		s.inflight--
+	}
+	s.wake()
+}
+
+// providerLimiter 单个 provider 的限流器
+type providerLimiter struct {
+	config   ProviderRateLimit
+	mu       sync.Mutex
+	requests *tokenBucket
+	tokens   *tokenBucket
+	slots    *concurrencySlots
+}
+
+func newProviderLimiter(config ProviderRateLimit) *providerLimiter {
+	now := time.Now()
+	limiter := &providerLimiter{
+		config:   config,
+		requests: newTokenBucket(config.RPM, now),
+		tokens:   newTokenBucket(config.TPM, now),
+	}
+	if config.MaxConcurrency > 0 {
+		limiter.slots = newConcurrencySlots(config.MaxConcurrency)
+	}
+	return limiter
+}
+
+// rateLease 一次放行的凭证，请求结束后归还
+type rateLease struct {
+	limiter     *providerLimiter
+	takenTokens float64 // 放行时实际从 TPM 令牌桶扣除的数量（已按容量截断）
+	once        sync.Once
+}
+
+// release 归还并发名额，并按实际输入 tokens（含缓存写入与读取）修正 TPM 令牌桶
+func (l *rateLease) release(actualTokens int) {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		limiter := l.limiter
+		limiter.releaseSlot()
+		if limiter.tokens != nil && actualTokens > 0 {
+			limiter.mu.Lock()
+			limiter.tokens.take(float64(actualTokens)-l.takenTokens, time.Now())
+			limiter.mu.Unlock()
+		}
+	})
+}
+
+// acquire 申请一次请求配额，超限时最多等待 wait
+func (pl *providerLimiter) acquire(ctx context.Context, estimatedTokens int, wait time.Duration) (*rateLease, error) {
+	deadline := time.Now().Add(wait)
+
+	if pl.slots != nil {
+		if err := pl.slots.acquire(ctx, deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		pl.mu.Lock()
+		now := time.Now()
+		delay := pl.requests.waitTime(1, now)
+		reason := fmt.Sprintf("超出 RPM 限制 %d", pl.config.RPM)
+		if tokenDelay := pl.tokens.waitTime(float64(estimatedTokens), now); tokenDelay > delay {
+			delay = tokenDelay
+			reason = fmt.Sprintf("超出 TPM 限制 %d", pl.config.TPM)
+		}
+		if delay == 0 {
+			pl.requests.take(1, now)
+			lease := &rateLease{limiter: pl}
+			if pl.tokens != nil {
+				lease.takenTokens = pl.tokens.clamp(float64(estimatedTokens))
+				pl.tokens.take(lease.takenTokens, now)
+			}
+			pl.mu.Unlock()
+			return lease, nil
+		}
+		pl.mu.Unlock()
+
+		if now.Add(delay).After(deadline) {
+			pl.releaseSlot()
+			return nil, errors.New(reason)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			pl.releaseSlot()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (pl *providerLimiter) releaseSlot() {
+	if pl.slots != nil {
+		pl.slots.release()
+	}
+}
+
+// rateLimitRefusal 本地限流拒绝放行，按上游限流处理
+type rateLimitRefusal struct {
+	provider string
+	err      error
+}
+
+func (e *rateLimitRefusal) Error() string {
+	return fmt.Sprintf("provider %s 限流: %v", e.provider, e.err)
+}
+
+func (e *rateLimitRefusal) Unwrap() error {
+	return e.err
+}
+
+// rateLimiterRegistry 按 平台/provider 维护限流器，配置变更时重建；
+// 并发名额跨重建共享，避免旧请求尚未结束时新限流器从零计数
+type rateLimiterRegistry struct {
+	mu       sync.Mutex
+	limiters map[string]*providerLimiter
+	slots    map[string]*concurrencySlots
+}
+
+func (r *rateLimiterRegistry) limiter(kind string, provider Provider) *providerLimiter {
+	if provider.RateLimit == nil || provider.RateLimit.IsEmpty() {
+		return nil
+	}
+	key := kind + "/" + provider.Name
+	config := *provider.RateLimit
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limiters == nil {
+		r.limiters = make(map[string]*providerLimiter)
+	}
+	if existing, ok := r.limiters[key]; ok && existing.config == config {
+		return existing
+	}
+	limiter := newProviderLimiter(config)
+	if limiter.slots != nil {
+		if r.slots == nil {
+			r.slots = make(map[string]*concurrencySlots)
+		}
+		if shared, ok := r.slots[key]; ok {
+			shared.setMax(config.MaxConcurrency)
+			limiter.slots = shared
+		} else {
+			r.slots[key] = limiter.slots
+		}
+	}
+	r.limiters[key] = limiter
+	return limiter
+}
+
+// acquire 按 provider 的 onLimit 策略申请配额；未配置限流时返回 nil 凭证
+func (r *rateLimiterRegistry) acquire(ctx context.Context, kind string, candidate relayCandidate) (*rateLease, error) {
+	limiter := r.limiter(kind, candidate.provider)
+	if limiter == nil {
+		return nil, nil
+	}
+	return limiter.acquire(ctx, candidate.estimatedTokens, limiter.config.QueueTimeout())
+}
+
+// tryAcquire 不等待地申请配额，用于对冲请求
+func (r *rateLimiterRegistry) tryAcquire(ctx context.Context, kind string, candidate relayCandidate) (*rateLease, error) {
+	limiter := r.limiter(kind, candidate.provider)
+	if limiter == nil {
+		return nil, nil
+	}
+	return limiter.acquire(ctx, candidate.estimatedTokens, 0)
+}
+
+// estimateRequestTokens 按模型所属的 tokenizer 系列估算请求的输入 tokens
+func estimateRequestTokens(kind string, model string, body []byte) int {
+	format := tokenestimate.FormatMessages
+	if kind == "codex" {
+		format = tokenestimate.FormatResponses
+	}
+	return tokenestimate.EstimateRequest(format, model, body).Total
+}
+
+// promptTokens 返回请求实际处理的输入 tokens，与估算口径一致地包含缓存部分：
+// Anthropic 的 input_tokens 不含缓存写入与读取，OpenAI 的 input_tokens 已包含 cached_tokens
+func promptTokens(log *ReqeustLog) int {
+	if log.Platform == "codex" {
+		return log.InputTokens
+	}
+	return log.InputTokens + log.CacheCreateTokens + log.CacheReadTokens
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// ==================== 令牌桶测试 ====================
+
+func TestTokenBucketWaitTime(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		perMinute int
+		take      float64
+		elapsed   time.Duration
+		request   float64
+		expected  time.Duration
+	}{
+		{
+			name:      "桶满时立即放行",
+			perMinute: 60,
+			request:   1,
+			expected:  0,
+		},
+		{
+			name:      "耗尽后需等待补充",
+			perMinute: 60,
+			take:      60,
+			request:   1,
+			expected:  time.Second,
+		},
+		{
+			name:      "经过一段时间后自动补充",
+			perMinute: 60,
+			take:      60,
+			elapsed:   2 * time.Second,
+			request:   2,
+			expected:  0,
+		},
+		{
+			name:      "透支后等待更久",
+			perMinute: 60,
+			take:      70,
+			request:   1,
+			expected:  11 * time.Second,
+		},
+		{
+			name:      "单次请求超过容量时按容量计算",
+			perMinute: 60,
+			request:   1000,
+			expected:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newTokenBucket(tt.perMinute, start)
+			bucket.take(tt.take, start)
+			wait := bucket.waitTime(tt.request, start.Add(tt.elapsed))
+			if wait != tt.expected {
+				t.Errorf("waitTime(%v) = %v, 期望 %v", tt.request, wait, tt.expected)
+			}
+		})
+	}
+
+	var unlimited *tokenBucket
+	if wait := unlimited.waitTime(1, start); wait != 0 {
+		t.Errorf("未配置的令牌桶不应限流，实际等待 %v", wait)
+	}
+}
+
+// ==================== 限流器测试 ====================
+
+func TestProviderLimiterConcurrency(t *testing.T) {
+	limiter := newProviderLimiter(ProviderRateLimit{MaxConcurrency: 1})
+	ctx := context.Background()
+
+	lease, err := limiter.acquire(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("首个请求应放行: %v", err)
+	}
+
+	// spillover：并发已满时立即失败
+	if _, err := limiter.acquire(ctx, 0, 0); err == nil {
+		t.Errorf("并发已满时 spillover 应立即失败")
+	}
+
+	// queue：等待期间释放名额后放行
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		lease.release(0)
+	}()
+	queued, err := limiter.acquire(ctx, 0, time.Second)
+	if err != nil {
+		t.Fatalf("排队等待后应放行: %v", err)
+	}
+	queued.release(0)
+	queued.release(0) // 重复释放不应阻塞
+}
+
+func TestProviderLimiterRPM(t *testing.T) {
+	limiter := newProviderLimiter(ProviderRateLimit{RPM: 2})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.acquire(ctx, 0, 0); err != nil {
+			t.Fatalf("第 %d 个请求应放行: %v", i+1, err)
+		}
+	}
+	if _, err := limiter.acquire(ctx, 0, 0); err == nil {
+		t.Errorf("超过 RPM 后应被限流")
+	}
+}
+
+func TestRateLeaseReleaseCorrectsTakenTokens(t *testing.T) {
+	limiter := newProviderLimiter(ProviderRateLimit{TPM: 1000})
+	ctx := context.Background()
+
+	// 估算值超过桶容量时只扣除容量，按实际用量修正时不应退还未扣除的部分
+	lease, err := limiter.acquire(ctx, 5000, 0)
+	if err != nil {
+		t.Fatalf("超过容量的请求应按容量放行: %v", err)
+	}
+	lease.release(1500)
+	if wait := limiter.tokens.waitTime(1, time.Now()); wait <= 0 {
+		t.Errorf("实际用量 1500 超过容量 1000，修正后令牌桶应透支，实际无需等待")
+	}
+}
+
+func TestPromptTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		log    ReqeustLog
+		expect int
+	}{
+		{"claude 计入缓存写入与读取", ReqeustLog{Platform: "claude", InputTokens: 10, CacheCreateTokens: 200, CacheReadTokens: 3000}, 3210},
+		{"codex input_tokens 已含缓存", ReqeustLog{Platform: "codex", InputTokens: 3010, CacheReadTokens: 3000}, 3010},
+	}
+	for _, tt := range tests {
+		if got := promptTokens(&tt.log); got != tt.expect {
+			t.Errorf("%s: promptTokens = %d, 期望 %d", tt.name, got, tt.expect)
+		}
+	}
+}
+
+func TestRateLimiterRegistryKeepsConcurrencyAcrossReload(t *testing.T) {
+	var registry rateLimiterRegistry
+	ctx := context.Background()
+	provider := Provider{Name: "p", RateLimit: &ProviderRateLimit{MaxConcurrency: 1}}
+
+	lease, err := registry.limiter("claude", provider).acquire(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("首个请求应放行: %v", err)
+	}
+
+	// 配置变更后重建限流器，进行中的请求仍占用并发名额
+	provider.RateLimit = &ProviderRateLimit{MaxConcurrency: 1, RPM: 100}
+	reloaded := registry.limiter("claude", provider)
+	if _, err := reloaded.acquire(ctx, 0, 0); err == nil {
+		t.Fatalf("配置变更后并发不应超过上限")
+	}
+	lease.release(0)
+	next, err := reloaded.acquire(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("旧请求释放名额后应放行: %v", err)
+	}
+	next.release(0)
+
+	// 调大上限后立即生效
+	provider.RateLimit = &ProviderRateLimit{MaxConcurrency: 2}
+	raised := registry.limiter("claude", provider)
+	for i := 0; i < 2; i++ {
+		if _, err := raised.acquire(ctx, 0, 0); err != nil {
+			t.Fatalf("上限调整为 2 后第 %d 个请求应放行: %v", i+1, err)
+		}
+	}
+}
+
+func TestProviderRateLimitValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    ProviderRateLimit
+		expectErr bool
+	}{
+		{"空配置", ProviderRateLimit{}, false},
+		{"queue 模式", ProviderRateLimit{RPM: 10, OnLimit: "queue", QueueTimeoutMs: 5000}, false},
+		{"spillover 模式", ProviderRateLimit{MaxConcurrency: 3, OnLimit: "spillover"}, false},
+		{"负数配置", ProviderRateLimit{RPM: -1}, true},
+		{"未知策略", ProviderRateLimit{RPM: 10, OnLimit: "drop"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.config.Validate()
+			if tt.expectErr && len(errs) == 0 {
+				t.Errorf("期望返回错误，但没有错误")
+			}
+			if !tt.expectErr && len(errs) > 0 {
+				t.Errorf("不期望错误，但返回了: %v", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 重放接口，与转发接口共用中转端口，但只接受本机请求
+const replayRoute = "/code-switch/replay"
+
+// 单次重放的最长耗时，包含限流排队与读取完整响应
+const replayTimeout = 10 * time.Minute
+
+// 对比结果中保留的原始响应长度（无法提取回复文本时使用）
+const maxReplayRawOutput = 4 << 10
+
+// ReplayOptions 重放参数
+type ReplayOptions struct {
+	RequestID string `json:"request_id"`      // 原始请求 ID（X-Code-Switch-Request-Id）
+	Provider  string `json:"provider"`        // 目标 provider 名称
+	Model     string `json:"model,omitempty"` // 目标模型，空表示沿用原请求的模型
+}
+
+// ReplayRun 一次请求的结果摘要
+type ReplayRun struct {
+	RequestID         string  `json:"request_id"`
+	Attempt           int     `json:"attempt"`
+	Provider          string  `json:"provider"`
+	Model             string  `json:"model"`
+	HttpCode          int     `json:"http_code"`
+	ErrorClass        string  `json:"error_class"`
+	ErrorMessage      string  `json:"error_message"`
+	DurationSec       float64 `json:"duration_sec"`
+	InputTokens       int     `json:"input_tokens"`
+	OutputTokens      int     `json:"output_tokens"`
+	CacheCreateTokens int     `json:"cache_create_tokens"`
+	CacheReadTokens   int     `json:"cache_read_tokens"`
+	ReasoningTokens   int     `json:"reasoning_tokens"`
+	TotalCost         float64 `json:"total_cost"`
+	HasPricing        bool    `json:"has_pricing"`
+	Output            string  `json:"output"` // 回复文本，无法提取时为截断的原始响应
+}
+
+// ReplayComparison 原始请求与重放请求的对比，重放请求的 request_log 通过 replay_of 关联原始请求
+type ReplayComparison struct {
+	OriginalRequestID string    `json:"original_request_id"`
+	ReplayRequestID   string    `json:"replay_request_id"`
+	Original          ReplayRun `json:"original"`
+	Replay            ReplayRun `json:"replay"`
+	DurationDeltaSec  float64   `json:"duration_delta_sec"` // 重放耗时 - 原始耗时
+	CostDelta         float64   `json:"cost_delta"`         // 重放花费 - 原始花费
+}
+
+// ReplayRequest 将已捕获的请求按正常转发流程（模型映射、改写规则、鉴权、限流）发送到指定 provider，
+// 返回与原始请求在输出、耗时与花费上的对比。请求体使用捕获时的脱敏版本
+func (prs *ProviderRelayService) ReplayRequest(opts ReplayOptions) (*ReplayComparison, error) {
+	opts.RequestID = strings.TrimSpace(opts.RequestID)
+	opts.Provider = strings.TrimSpace(opts.Provider)
+	if opts.RequestID == "" || opts.Provider == "" {
+		return nil, fmt.Errorf("request_id 与 provider 不能为空")
+	}
+
+	exchanges, err := loadCapturedExchanges(opts.RequestID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(exchanges) == 0 {
+		return nil, fmt.Errorf("请求 %s 没有可用的请求体捕获（未开启捕获或已过期）", opts.RequestID)
+	}
+	// 原始结果取 request_log 中的最终尝试（即返回给客户端的那次）；仅捕获失败尝试时最终尝试可能没有捕获，
+	// 此时请求体取最后一次捕获的尝试，对比指标仍以最终尝试的日志为准
+	ls := &LogService{pricing: prs.pricing}
+	attempts, err := ls.GetRequestAttempts(opts.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	var final *ReqeustLog
+	for i := range attempts {
+		if attempts[i].IsFinal {
+			final = &attempts[i]
+		}
+	}
+	original := exchanges[len(exchanges)-1]
+	if final != nil {
+		for _, exchange := range exchanges {
+			if exchange.Attempt == final.Attempt {
+				original = exchange
+			}
+		}
+	}
+	if original.RequestTruncated && original.ClientBody == original.RequestBody {
+		return nil, fmt.Errorf("请求 %s 的请求体超过捕获上限已被截断，无法重放", opts.RequestID)
+	}
+
+	kind := original.Platform
+	endpoint, ok := relayEndpoints[kind]
+	if !ok {
+		return nil, fmt.Errorf("未知的平台 '%s'", kind)
+	}
+	provider, err := prs.findProvider(kind, opts.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []byte(original.ClientBody)
+	requestedModel := gjson.GetBytes(body, "model").String()
+	if opts.Model != "" && opts.Model != requestedModel {
+		if body, err = ReplaceModelInRequestBody(body, opts.Model); err != nil {
+			return nil, err
+		}
+		requestedModel = opts.Model
+	}
+	settings := prs.relaySettings()
+	// 重放同样计入预算，目标 provider 已触发硬上限时不发送
+	if decision := prs.budgetService.apply(kind, requestedModel, []Provider{provider}, settings.Budgets); len(decision.providers) == 0 {
+		return nil, fmt.Errorf("provider %s 已达到预算 %s 的硬上限（$%.4f / $%.2f），无法重放",
+			provider.Name, decision.blockedBy.Budget.Name, decision.blockedBy.Spent, decision.blockedBy.Budget.HardLimit)
+	}
+	candidate, err := prepareCandidate(provider, requestedModel, body)
+	if err != nil {
+		return nil, fmt.Errorf("准备请求体失败: %w", err)
+	}
+	candidate.estimatedTokens = estimateRequestTokens(kind, requestedModel, body)
+	isStream := gjson.GetBytes(body, "stream").Bool()
+
+	trace := &relayTrace{id: newRequestID(), replayOf: opts.RequestID}
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+	ctx = withRelayTrace(ctx, trace)
+	ctx = withCaptureSettings(ctx, settings.Capture)
+
+	lease, err := prs.limiters.acquire(ctx, kind, candidate)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s 限流: %w", provider.Name, err)
+	}
+	candidate.lease = lease
+
+	fmt.Printf("[INFO] 重放请求 %s -> Provider: %s | Model: %s\n", opts.RequestID, provider.Name, candidate.model)
+	attempt := prs.sendUpstream(ctx, kind, endpoint, nil, replayHeaders(original.RequestHeaders), isStream, candidate)
+	output := readReplayResponse(kind, attempt)
+	attempt.finish()
+	attempt.save()
+	trace.finish()
+
+	replayLog := *attempt.log
+	ls.decorateCost(&replayLog)
+	replay := replayRunFromLog(replayLog)
+	replay.Output = output
+
+	originalRun := ReplayRun{
+		RequestID:  original.RequestID,
+		Attempt:    original.Attempt,
+		Provider:   original.Provider,
+		Model:      original.Model,
+		HttpCode:   original.HttpCode,
+		ErrorClass: original.ErrorClass,
+	}
+	if final != nil {
+		originalRun = replayRunFromLog(*final)
+	}
+	// 最终尝试未被捕获时没有原始回复可供对比
+	if final == nil || final.Attempt == original.Attempt {
+		originalStream := isEventStream(http.Header{"Content-Type": {original.ResponseHeaders["Content-Type"]}}, isStream)
+		originalRun.Output = extractResponseText(kind, originalStream, []byte(original.ResponseBody))
+	}
+
+	return &ReplayComparison{
+		OriginalRequestID: opts.RequestID,
+		ReplayRequestID:   trace.id,
+		Original:          originalRun,
+		Replay:            replay,
+		DurationDeltaSec:  replay.DurationSec - originalRun.DurationSec,
+		CostDelta:         replay.TotalCost - originalRun.TotalCost,
+	}, nil
+}
+
+// replayHandler POST /code-switch/replay，请求体为 ReplayOptions
+func (prs *ProviderRelayService) replayHandler(c *gin.Context) {
+	var opts ReplayOptions
+	if err := c.ShouldBindJSON(&opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	comparison, err := prs.ReplayRequest(opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, comparison)
+}
+
+// loopbackOnly 拒绝非本机的请求：中转端口监听所有网卡，而重放会用本机保存的密钥向任意 provider 发送已捕获的请求
+func loopbackOnly(c *gin.Context) {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "replay is only available from localhost"})
+		return
+	}
+	c.Next()
+}
+
+// findProvider 按名称查找 provider，未启用的 provider 也可用于重放对比
+func (prs *ProviderRelayService) findProvider(kind string, name string) (Provider, error) {
+	providers, err := prs.providerService.LoadProviders(kind)
+	if err != nil {
+		return Provider{}, err
+	}
+	for _, provider := range providers {
+		if !strings.EqualFold(provider.Name, name) {
+			continue
+		}
+		if provider.APIURL == "" || provider.APIKey == "" {
+			return Provider{}, fmt.Errorf("provider %s 未配置 API 地址或 API Key", provider.Name)
+		}
+		return provider, nil
+	}
+	return Provider{}, fmt.Errorf("平台 %s 下不存在 provider '%s'", kind, name)
+}
+
+// replayHeaders 以捕获的请求头作为客户端请求头，去掉已脱敏的鉴权头，由目标 provider 重新注入
+func replayHeaders(captured map[string]string) map[string]string {
+	headers := make(map[string]string, len(captured))
+	for key, value := range captured {
+		if sensitiveCaptureHeaders[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		headers[key] = value
+	}
+	return headers
+}
+
+// readReplayResponse 读取重放响应并解析用量，返回回复文本
+func readReplayResponse(kind string, attempt *relayAttempt) string {
+	if !attempt.succeeded() {
+		return ""
+	}
+	raw := attempt.resp.RawResponse
+	stream := isEventStream(raw.Header, attempt.log.IsStream)
+	tap := newUsageTap(raw.Body, kind, stream, attempt.log)
+	body, err := io.ReadAll(io.LimitReader(tap, maxUsageBodyBytes))
+	_ = tap.Close()
+	raw.Body = http.NoBody
+	if err != nil {
+		attempt.log.ErrorClass, attempt.log.ErrorMessage = errorClassStream, truncateErrorMessage(err.Error())
+	}
+	return extractResponseText(kind, stream, body)
+}
+
+// extractResponseText 从流式或非流式响应中提取回复文本
+func extractResponseText(kind string, stream bool, body []byte) string {
+	var text strings.Builder
+	if stream {
+		decoder := &sseDecoder{}
+		for _, event := range append(decoder.Feed(body), decoder.Flush()...) {
+			switch {
+			case kind == "codex" && event.eventType() == "response.output_text.delta":
+				text.WriteString(gjson.Get(event.data, "delta").String())
+			case kind != "codex" && event.eventType() == "content_block_delta":
+				text.WriteString(gjson.Get(event.data, "delta.text").String())
+			}
+		}
+	} else if kind == "codex" {
+		for _, item := range gjson.GetBytes(body, "output").Array() {
+			for _, content := range item.Get("content").Array() {
+				text.WriteString(content.Get("text").String())
+			}
+		}
+	} else {
+		for _, content := range gjson.GetBytes(body, "content").Array() {
+			if content.Get("type").String() == "text" {
+				text.WriteString(content.Get("text").String())
+			}
+		}
+	}
+	if text.Len() == 0 && len(body) > 0 {
+		if len(body) > maxReplayRawOutput {
+			body = body[:maxReplayRawOutput]
+		}
+		return string(body)
+	}
+	return text.String()
+}
+
+func replayRunFromLog(log ReqeustLog) ReplayRun {
+	return ReplayRun{
+		RequestID:         log.RequestID,
+		Attempt:           log.Attempt,
+		Provider:          log.Provider,
+		Model:             log.Model,
+		HttpCode:          log.HttpCode,
+		ErrorClass:        log.ErrorClass,
+		ErrorMessage:      log.ErrorMessage,
+		DurationSec:       log.DurationSec,
+		InputTokens:       log.InputTokens,
+		OutputTokens:      log.OutputTokens,
+		CacheCreateTokens: log.CacheCreateTokens,
+		CacheReadTokens:   log.CacheReadTokens,
+		ReasoningTokens:   log.ReasoningTokens,
+		TotalCost:         log.TotalCost,
+		HasPricing:        log.HasPricing,
+	}
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// ==================== 请求重放测试 ====================
+
+func TestExtractResponseText(t *testing.T) {
+	claudeStream := strings.Join([]string{
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"Hel"}}`,
+		``,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"lo"}}`,
+		``,
+	}, "\n")
+	codexStream := strings.Join([]string{
+		`data: {"type":"response.output_text.delta","delta":"Hi"}`,
+		``,
+		`data: {"type":"response.output_text.delta","delta":" there"}`,
+		``,
+	}, "\n")
+
+	tests := []struct {
+		name     string
+		kind     string
+		stream   bool
+		body     string
+		expected string
+	}{
+		{"claude 非流式", "claude", false, `{"content":[{"type":"thinking","thinking":"x"},{"type":"text","text":"Hello"}]}`, "Hello"},
+		{"claude 流式", "claude", true, claudeStream, "Hello"},
+		{"codex 非流式", "codex", false, `{"output":[{"type":"message","content":[{"type":"output_text","text":"Hi there"}]}]}`, "Hi there"},
+		{"codex 流式", "codex", true, codexStream, "Hi there"},
+		{"无法提取时返回原始响应", "claude", false, `{"error":{"message":"boom"}}`, `{"error":{"message":"boom"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractResponseText(tt.kind, tt.stream, []byte(tt.body)); got != tt.expected {
+				t.Errorf("extractResponseText = %q, 期望 %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReplayRequest(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	initTestRequestLogDB(t)
+
+	original := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"original answer"}],"usage":{"input_tokens":10,"output_tokens":5}}`))
+	}))
+	defer original.Close()
+
+	var (
+		mu       sync.Mutex
+		received []byte
+		headers  http.Header
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received, _ = io.ReadAll(r.Body)
+		headers = r.Header.Clone()
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"replayed answer"}],"usage":{"input_tokens":12,"output_tokens":7}}`))
+	}))
+	defer target.Close()
+
+	providerService := NewProviderService()
+	if err := providerService.SaveProviders("claude", []Provider{
+		{ID: 1, Name: "original", APIURL: original.URL, APIKey: "original-key", Enabled: true, Level: 1, CaptureBodies: true},
+		{
+			ID: 2, Name: "target", APIURL: target.URL, APIKey: "target-key", Enabled: false, Level: 2,
+			SupportedModels: map[string]bool{"target-haiku": true},
+			ModelMapping:    map[string]string{"claude-haiku-4": "target-haiku"},
+			BodyRules:       []BodyRule{{Op: bodyRuleDelete, Path: "metadata"}},
+		},
+	}); err != nil {
+		t.Fatalf("保存 provider 失败: %v", err)
+	}
+	settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+	prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService}
+
+	c, recorder := newHedgeTestContext()
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4","metadata":{"user_id":"u"},"messages":[{"role":"user","content":"hi"}]}`))
+	c.Request.Header.Set("Anthropic-Version", "2023-06-01")
+	prs.proxyHandler("claude", "/v1/messages")(c)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("原始请求应成功，实际状态码 %d", recorder.Code)
+	}
+	requestID := recorder.Header().Get(requestIDHeader)
+
+	comparison, err := prs.ReplayRequest(ReplayOptions{RequestID: requestID, Provider: "target", Model: "claude-haiku-4"})
+	if err != nil {
+		t.Fatalf("ReplayRequest 失败: %v", err)
+	}
+
+	mu.Lock()
+	if model := gjson.GetBytes(received, "model").String(); model != "target-haiku" {
+		t.Errorf("重放请求应按目标 provider 映射模型，实际 %q", model)
+	}
+	if gjson.GetBytes(received, "metadata").Exists() {
+		t.Errorf("重放请求应执行目标 provider 的改写规则: %s", received)
+	}
+	if auth := headers.Get("Authorization"); auth != "Bearer target-key" {
+		t.Errorf("重放请求应使用目标 provider 的 API Key，实际 %q", auth)
+	}
+	if version := headers.Get("Anthropic-Version"); version != "2023-06-01" {
+		t.Errorf("重放请求应保留客户端请求头，实际 anthropic-version=%q", version)
+	}
+	mu.Unlock()
+
+	if comparison.OriginalRequestID != requestID || comparison.ReplayRequestID == "" || comparison.ReplayRequestID == requestID {
+		t.Errorf("请求 ID 关联错误: %+v", comparison)
+	}
+	if comparison.Original.Provider != "original" || comparison.Original.Output != "original answer" || comparison.Original.InputTokens != 10 {
+		t.Errorf("原始结果 = %+v", comparison.Original)
+	}
+	if comparison.Replay.Provider != "target" || comparison.Replay.Model != "target-haiku" ||
+		comparison.Replay.Output != "replayed answer" || comparison.Replay.OutputTokens != 7 || comparison.Replay.HttpCode != http.StatusOK {
+		t.Errorf("重放结果 = %+v", comparison.Replay)
+	}
+
+	replays, err := NewLogService().GetReplays(requestID)
+	if err != nil {
+		t.Fatalf("GetReplays 失败: %v", err)
+	}
+	if len(replays) != 1 || replays[0].RequestID != comparison.ReplayRequestID || replays[0].ReplayOf != requestID || !replays[0].IsFinal {
+		t.Errorf("重放 request_log = %+v", replays)
+	}
+
+	t.Run("HTTP 接口", func(t *testing.T) {
+		c, recorder := newHedgeTestContext()
+		payload, _ := json.Marshal(ReplayOptions{RequestID: "csr_missing", Provider: "target"})
+		c.Request = httptest.NewRequest(http.MethodPost, replayRoute, bytes.NewReader(payload))
+		prs.replayHandler(c)
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "没有可用的请求体捕获") {
+			t.Errorf("未捕获的请求应返回 400，实际 %d: %s", recorder.Code, recorder.Body.String())
+		}
+	})
+
+	t.Run("仅允许本机访问", func(t *testing.T) {
+		router := gin.New()
+		prs.registerRoutes(router)
+		tests := []struct {
+			name       string
+			remoteAddr string
+			expectCode int
+		}{
+			{"IPv4 本机", "127.0.0.1:50000", http.StatusBadRequest},
+			{"IPv6 本机", "[::1]:50000", http.StatusBadRequest},
+			{"局域网地址", "192.168.1.20:50000", http.StatusForbidden},
+		}
+		for _, tt := range tests {
+			payload, _ := json.Marshal(ReplayOptions{RequestID: "csr_missing", Provider: "target"})
+			req := httptest.NewRequest(http.MethodPost, replayRoute, bytes.NewReader(payload))
+			req.RemoteAddr = tt.remoteAddr
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			if recorder.Code != tt.expectCode {
+				t.Errorf("%s: 状态码 = %d, 期望 %d", tt.name, recorder.Code, tt.expectCode)
+			}
+		}
+	})
+
+	t.Run("未知 provider", func(t *testing.T) {
+		if _, err := prs.ReplayRequest(ReplayOptions{RequestID: requestID, Provider: "missing"}); err == nil {
+			t.Errorf("不存在的 provider 应返回错误")
+		}
+	})
+}
+
+func TestReplayRequestOnlyErrorsCapture(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	initTestRequestLogDB(t)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":{"message":"boom"}}`))
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"answer"}],"usage":{"input_tokens":10,"output_tokens":5}}`))
+	}))
+	defer healthy.Close()
+
+	providerService := NewProviderService()
+	if err := providerService.SaveProviders("claude", []Provider{
+		{ID: 1, Name: "failing", APIURL: failing.URL, APIKey: "failing-key", Enabled: true, Level: 1},
+		{ID: 2, Name: "healthy", APIURL: healthy.URL, APIKey: "healthy-key", Enabled: true, Level: 2},
+	}); err != nil {
+		t.Fatalf("保存 provider 失败: %v", err)
+	}
+	limited := Budget{Name: "healthy", Enabled: true, Period: "daily", Provider: "healthy", HardLimit: 10}
+	settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+	if _, err := settingsService.SaveRelaySettings(RelaySettings{
+		Capture: &CaptureSettings{Rules: []CaptureRule{{OnlyErrors: true}}},
+		Budgets: []Budget{limited},
+	}); err != nil {
+		t.Fatalf("保存设置失败: %v", err)
+	}
+	budgetService := &BudgetService{spends: map[string]budgetSpend{}, notified: map[string]bool{}}
+	prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService, budgetService: budgetService}
+
+	c, recorder := newHedgeTestContext()
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`))
+	prs.proxyHandler("claude", "/v1/messages")(c)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("原始请求应切换到 healthy 成功，实际状态码 %d", recorder.Code)
+	}
+	requestID := recorder.Header().Get(requestIDHeader)
+
+	comparison, err := prs.ReplayRequest(ReplayOptions{RequestID: requestID, Provider: "healthy"})
+	if err != nil {
+		t.Fatalf("ReplayRequest 失败: %v", err)
+	}
+	if comparison.Original.Provider != "healthy" || comparison.Original.HttpCode != http.StatusOK || comparison.Original.Attempt != 2 {
+		t.Errorf("原始结果应取最终尝试，实际 %+v", comparison.Original)
+	}
+	if comparison.Original.Output != "" {
+		t.Errorf("最终尝试未被捕获时不应使用失败尝试的响应作为原始回复，实际 %q", comparison.Original.Output)
+	}
+
+	budgetService.spends[limited.cacheKey(limited.PeriodStart(time.Now()))] = budgetSpend{amount: 12, updatedAt: time.Now()}
+	if _, err := prs.ReplayRequest(ReplayOptions{RequestID: requestID, Provider: "healthy"}); err == nil || !strings.Contains(err.Error(), "硬上限") {
+		t.Errorf("目标 provider 触发预算硬上限时应拒绝重放，实际 %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	relaySettingsDir  = ".code-switch"
+	relaySettingsFile = "relay.json"
+
+	defaultHedgeDelayMs = 2000
+
+	defaultShadowConcurrency = 2
+)
+
+// RelaySettings 中转服务的路由策略配置，按平台（claude / codex）分组
+type RelaySettings struct {
+	Platforms map[string]PlatformRelaySettings `json:"platforms,omitempty"`
+
+	// 花费预算，转发前按 request_log 汇总检查
+	Budgets []Budget `json:"budgets,omitempty"`
+
+	// 按客户端 Accept-Encoding 重新压缩非流式响应；上游响应总是先由中转解压
+	CompressResponses bool `json:"compressResponses,omitempty"`
+
+	// 除本地 SQLite 外的 request_log 输出（JSONL 文件、webhook、OTLP）
+	LogSinks []LogSinkConfig `json:"logSinks,omitempty"`
+
+	// 请求/响应体捕获：按规则开启、大小上限、保存时长与脱敏
+	Capture *CaptureSettings `json:"capture,omitempty"`
+
+	// 原始 request_log 保留天数，超过的行在汇总进小时/日汇总表后删除，已启用预算当前周期内的行除外；0 表示永久保留
+	LogRetentionDays int `json:"logRetentionDays,omitempty"`
+}
+
+// PlatformRelaySettings 单个平台的路由策略
+type PlatformRelaySettings struct {
+	// 对冲请求：首个 provider 在 DelayMs 内未返回响应头时，并发请求下一个候选
+	Hedge HedgeSettings `json:"hedge"`
+
+	// 模型降级链：如 ["claude-opus-4", "claude-sonnet-4", "claude-haiku-4"]，
+	// 请求模型的 provider 全部失败后依次尝试后续模型
+	FallbackChains [][]string `json:"fallbackChains,omitempty"`
+
+	// 影子流量：按采样率将请求异步镜像到待评估的 provider，响应丢弃，仅记录 request_log
+	Shadow ShadowSettings `json:"shadow"`
+}
+
+// HedgeSettings 对冲请求配置
+type HedgeSettings struct {
+	Enabled bool `json:"enabled"`
+	DelayMs int  `json:"delayMs,omitempty"`
+}
+
+// Delay 返回对冲触发延迟，未配置时使用默认值
+func (h HedgeSettings) Delay() time.Duration {
+	if h.DelayMs <= 0 {
+		return defaultHedgeDelayMs * time.Millisecond
+	}
+	return time.Duration(h.DelayMs) * time.Millisecond
+}
+
+// ShadowSettings 影子流量配置
+type ShadowSettings struct {
+	Enabled        bool    `json:"enabled"`
+	Provider       string  `json:"provider,omitempty"`       // 镜像目标 provider 名称，可以是未启用的 provider
+	SampleRate     float64 `json:"sampleRate,omitempty"`     // 采样率，取值 (0, 1]
+	MaxConcurrency int     `json:"maxConcurrency,omitempty"` // 同时进行的镜像请求上限，超出时跳过
+}
+
+// Concurrency 返回镜像请求并发上限，未配置时使用默认值
+func (s ShadowSettings) Concurrency() int {
+	if s.MaxConcurrency <= 0 {
+		return defaultShadowConcurrency
+	}
+	return s.MaxConcurrency
+}
+
+// Validate 校验影子流量配置，未开启时不校验
+func (s ShadowSettings) Validate(kind string) []string {
+	errs := make([]string, 0)
+	if !s.Enabled {
+		return errs
+	}
+	if strings.TrimSpace(s.Provider) == "" {
+		errs = append(errs, fmt.Sprintf("平台 %s 的影子流量未指定目标 provider", kind))
+	}
+	if s.SampleRate <= 0 || s.SampleRate > 1 {
+		errs = append(errs, fmt.Sprintf("平台 %s 的影子流量采样率 %v 需在 (0, 1] 之间", kind, s.SampleRate))
+	}
+	if s.MaxConcurrency < 0 {
+		errs = append(errs, fmt.Sprintf("平台 %s 的影子流量并发上限不能为负数", kind))
+	}
+	return errs
+}
+
+// FallbackModels 返回 model 所在降级链中排在它之后的模型，未配置时返回 nil
+func (ps PlatformRelaySettings) FallbackModels(model string) []string {
+	if model == "" {
+		return nil
+	}
+	for _, chain := range ps.FallbackChains {
+		for i, item := range chain {
+			if strings.EqualFold(item, model) {
+				return chain[i+1:]
+			}
+		}
+	}
+	return nil
+}
+
+// Validate 校验单个平台的路由策略
+func (ps PlatformRelaySettings) Validate(kind string) []string {
+	errs := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, chain := range ps.FallbackChains {
+		if len(chain) < 2 {
+			errs = append(errs, fmt.Sprintf("平台 %s 的降级链 %v 至少需要 2 个模型", kind, chain))
+		}
+		for _, model := range chain {
+			key := strings.ToLower(strings.TrimSpace(model))
+			if key == "" {
+				errs = append(errs, fmt.Sprintf("平台 %s 的降级链 %v 包含空模型名", kind, chain))
+				continue
+			}
+			if seen[key] {
+				errs = append(errs, fmt.Sprintf("平台 %s 的模型 '%s' 出现在多个降级链位置", kind, model))
+			}
+			seen[key] = true
+		}
+	}
+	errs = append(errs, ps.Shadow.Validate(kind)...)
+	return errs
+}
+
+// Validate 校验路由策略配置
+func (rs RelaySettings) Validate() []string {
+	errs := make([]string, 0)
+	for kind, platform := range rs.Platforms {
+		errs = append(errs, platform.Validate(kind)...)
+	}
+	for _, budget := range rs.Budgets {
+		errs = append(errs, budget.Validate()...)
+	}
+	if rs.Capture != nil {
+		errs = append(errs, rs.Capture.Validate()...)
+	}
+	if rs.LogRetentionDays < 0 {
+		errs = append(errs, "request_log 保留天数不能为负数")
+	}
+	sinkNames := make(map[string]bool)
+	for _, sink := range rs.LogSinks {
+		errs = append(errs, sink.Validate()...)
+		key := strings.ToLower(strings.TrimSpace(sink.Name))
+		if key != "" && sinkNames[key] {
+			errs = append(errs, fmt.Sprintf("日志输出名称 '%s' 重复", sink.Name))
+		}
+		sinkNames[key] = true
+	}
+	return errs
+}
+
+// Platform 返回指定平台的配置，未配置时返回零值
+func (rs RelaySettings) Platform(kind string) PlatformRelaySettings {
+	if rs.Platforms == nil {
+		return PlatformRelaySettings{}
+	}
+	return rs.Platforms[strings.ToLower(kind)]
+}
+
+type RelaySettingsService struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewRelaySettingsService() *RelaySettingsService {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return &RelaySettingsService{
+		path: filepath.Join(home, relaySettingsDir, relaySettingsFile),
+	}
+}
+
+// GetRelaySettings returns the persisted relay settings or defaults if the file does not exist.
+func (rss *RelaySettingsService) GetRelaySettings() (RelaySettings, error) {
+	if rss == nil {
+		return RelaySettings{}, nil
+	}
+	rss.mu.Lock()
+	defer rss.mu.Unlock()
+	return rss.loadLocked()
+}
+
+// SaveRelaySettings persists the provided relay settings to disk.
+func (rss *RelaySettingsService) SaveRelaySettings(settings RelaySettings) (RelaySettings, error) {
+	rss.mu.Lock()
+	defer rss.mu.Unlock()
+
+	if errs := settings.Validate(); len(errs) > 0 {
+		return settings, fmt.Errorf("配置验证失败：\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	if err := rss.saveLocked(settings); err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+func (rss *RelaySettingsService) loadLocked() (RelaySettings, error) {
+	settings := RelaySettings{}
+	data, err := os.ReadFile(rss.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return settings, nil
+		}
+		return settings, err
+	}
+	if len(data) == 0 {
+		return settings, nil
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+func (rss *RelaySettingsService) saveLocked(settings RelaySettings) error {
+	dir := filepath.Dir(rss.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := rss.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rss.path)
+}
@@ -0,0 +1,63 @@
+package services
+
+import "testing"
+
+// ==================== 模型降级链测试 ====================
+
+func TestPlatformFallbackModels(t *testing.T) {
+	platform := PlatformRelaySettings{
+		FallbackChains: [][]string{
+			{"claude-opus-4", "claude-sonnet-4", "claude-haiku-4"},
+		},
+	}
+
+	tests := []struct {
+		model    string
+		expected []string
+	}{
+		{"claude-opus-4", []string{"claude-sonnet-4", "claude-haiku-4"}},
+		{"Claude-Sonnet-4", []string{"claude-haiku-4"}},
+		{"claude-haiku-4", []string{}},
+		{"gpt-5", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			got := platform.FallbackModels(tt.model)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("FallbackModels(%q) = %v, 期望 %v", tt.model, got, tt.expected)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Fatalf("FallbackModels(%q) = %v, 期望 %v", tt.model, got, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestPlatformRelaySettingsValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		chains    [][]string
+		expectErr bool
+	}{
+		{"合法降级链", [][]string{{"claude-opus-4", "claude-sonnet-4"}}, false},
+		{"只有一个模型", [][]string{{"claude-opus-4"}}, true},
+		{"空模型名", [][]string{{"claude-opus-4", " "}}, true},
+		{"模型重复出现", [][]string{{"a", "b"}, {"b", "c"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := PlatformRelaySettings{FallbackChains: tt.chains}.Validate("claude")
+			if tt.expectErr && len(errs) == 0 {
+				t.Errorf("期望返回错误，但没有错误")
+			}
+			if !tt.expectErr && len(errs) > 0 {
+				t.Errorf("不期望错误，但返回了: %v", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 按 request_id 查询主请求结果时每批的 ID 数量，避免超出 SQLite 参数上限
+const shadowLookupBatch = 500
+
+// 单次镜像请求的最长耗时，超时后取消，避免挂起的上游长期占用镜像名额
+const shadowTimeout = 10 * time.Minute
+
+// shadowMirror 按平台限制同时进行的镜像请求数
+type shadowMirror struct {
+	mu       sync.Mutex
+	inflight map[string]int
+	wg       sync.WaitGroup
+}
+
+// acquire 占用一个镜像名额，已达上限时返回 false
+func (m *shadowMirror) acquire(kind string, limit int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inflight == nil {
+		m.inflight = make(map[string]int)
+	}
+	if m.inflight[kind] >= limit {
+		return false
+	}
+	m.inflight[kind]++
+	m.wg.Add(1)
+	return true
+}
+
+func (m *shadowMirror) release(kind string) {
+	m.mu.Lock()
+	m.inflight[kind]--
+	m.mu.Unlock()
+	m.wg.Done()
+}
+
+// Close 等待进行中的镜像请求结束
+func (m *shadowMirror) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("等待影子流量请求结束超时")
+	}
+}
+
+// mirrorShadow 按采样率将通过预算检查的一级请求异步发送到影子 provider，响应丢弃，
+// 仅以 is_shadow 标记写入 request_log；并发已满或影子 provider 触发预算硬上限时跳过本次镜像
+func (prs *ProviderRelayService) mirrorShadow(
+	kind string,
+	endpoint string,
+	query map[string]string,
+	clientHeaders map[string]string,
+	isStream bool,
+	tier relayTier,
+	requestID string,
+	shadow ShadowSettings,
+	budgets []Budget,
+) {
+	if !shadow.Enabled || shadow.Provider == "" || rand.Float64() >= shadow.SampleRate {
+		return
+	}
+	if !prs.shadows.acquire(kind, shadow.Concurrency()) {
+		return
+	}
+	go func() {
+		defer prs.shadows.release(kind)
+		if err := prs.sendShadow(kind, endpoint, query, clientHeaders, isStream, tier, requestID, shadow.Provider, budgets); err != nil {
+			fmt.Printf("[WARN] 影子流量镜像到 %s 失败: %v\n", shadow.Provider, err)
+		}
+	}()
+}
+
+func (prs *ProviderRelayService) sendShadow(
+	kind string,
+	endpoint string,
+	query map[string]string,
+	clientHeaders map[string]string,
+	isStream bool,
+	tier relayTier,
+	requestID string,
+	providerName string,
+	budgets []Budget,
+) error {
+	provider, err := prs.findProvider(kind, providerName)
+	if err != nil {
+		return err
+	}
+	if !provider.IsModelSupported(tier.model) {
+		// 目标 provider 不支持的模型不镜像，也不视为失败
+		return nil
+	}
+	// 影子 provider 同样计入预算，已触发硬上限时不再镜像
+	if decision := prs.budgetService.apply(kind, tier.model, []Provider{provider}, budgets); len(decision.providers) == 0 {
+		fmt.Printf("[INFO] 影子 provider %s 触发预算硬上限，跳过本次镜像\n", provider.Name)
+		return nil
+	}
+	candidate, err := tier.prepare(provider)
+	if err != nil {
+		return fmt.Errorf("准备请求体失败: %w", err)
+	}
+
+	// 镜像请求不随客户端请求取消，但有超时；同样受影子 provider 的限流约束，超限时不排队，直接放弃本次镜像
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+	lease, err := prs.limiters.tryAcquire(ctx, kind, candidate)
+	if err != nil {
+		fmt.Printf("[INFO] 影子 provider %s 触发限流，跳过本次镜像: %v\n", provider.Name, err)
+		return nil
+	}
+	candidate.lease = lease
+
+	trace := &relayTrace{id: requestID, shadow: true}
+	ctx = withRelayTrace(ctx, trace)
+	attempt := prs.sendUpstream(ctx, kind, endpoint, query, clientHeaders, isStream, candidate)
+	readReplayResponse(kind, attempt)
+	attempt.finish()
+	attempt.save()
+	trace.finish()
+	return nil
+}
+
+// ShadowSideStats 一侧（主请求或镜像请求）的汇总指标
+type ShadowSideStats struct {
+	TotalRequests      int64   `json:"total_requests"`
+	SuccessfulRequests int64   `json:"successful_requests"`
+	FailedRequests     int64   `json:"failed_requests"`
+	SuccessRate        float64 `json:"success_rate"`
+	AvgDurationSec     float64 `json:"avg_duration_sec"`
+	InputTokens        int64   `json:"input_tokens"`
+	OutputTokens       int64   `json:"output_tokens"`
+	CostTotal          float64 `json:"cost_total"`
+}
+
+func (s *ShadowSideStats) add(log ReqeustLog) {
+	s.TotalRequests++
+	if log.HttpCode >= 200 && log.HttpCode < 300 && log.ErrorClass == "" {
+		s.SuccessfulRequests++
+	} else {
+		s.FailedRequests++
+	}
+	// 先累计总耗时，汇总结束后再换算为平均值
+	s.AvgDurationSec += log.DurationSec
+	s.InputTokens += int64(log.InputTokens)
+	s.OutputTokens += int64(log.OutputTokens)
+	s.CostTotal += log.TotalCost
+}
+
+func (s *ShadowSideStats) finalize() {
+	if s.TotalRequests == 0 {
+		return
+	}
+	s.SuccessRate = float64(s.SuccessfulRequests) / float64(s.TotalRequests)
+	s.AvgDurationSec /= float64(s.TotalRequests)
+}
+
+// ShadowComparison 同一批被镜像请求上，主请求最终结果与影子 provider 结果的对比
+type ShadowComparison struct {
+	Platform       string          `json:"platform"`
+	ShadowProvider string          `json:"shadow_provider"`
+	Primary        ShadowSideStats `json:"primary"` // 对应客户端请求返回给客户端的最终结果
+	Shadow         ShadowSideStats `json:"shadow"`
+}
+
+// loadShadowComparisons 汇总 since 之后的镜像请求，并按 request_id 关联主请求的最终结果
+func (ls *LogService) loadShadowComparisons(platform string, since time.Time) ([]ShadowComparison, error) {
+	options := []xdb.Option{
+		xdb.WhereEq("is_shadow", 1),
+		// created_at 由 SQLite CURRENT_TIMESTAMP 写入，为 UTC 时间
+		xdb.WhereGte("created_at", since.UTC().Format(timeLayout)),
+		xdb.OrderByAsc("id"),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ShadowComparison{}, nil
+		}
+		return nil, err
+	}
+	shadows := ls.requestLogsFromRecords(records)
+
+	ids := make([]any, 0, len(shadows))
+	for _, log := range shadows {
+		ids = append(ids, log.RequestID)
+	}
+	primaries := make(map[string]ReqeustLog, len(ids))
+	for start := 0; start < len(ids); start += shadowLookupBatch {
+		end := min(start+shadowLookupBatch, len(ids))
+		records, err := xdb.New("request_log").Selects(
+			xdb.WhereIn("request_id", ids[start:end]),
+			xdb.WhereEq("is_shadow", 0),
+			xdb.WhereEq("is_final", 1),
+		)
+		if err != nil && !errors.Is(err, xdb.ErrNotFound) {
+			return nil, err
+		}
+		for _, log := range ls.requestLogsFromRecords(records) {
+			primaries[log.RequestID] = log
+		}
+	}
+
+	groups := make(map[string]*ShadowComparison)
+	for _, log := range shadows {
+		key := log.Platform + "\x00" + log.Provider
+		group := groups[key]
+		if group == nil {
+			group = &ShadowComparison{Platform: log.Platform, ShadowProvider: log.Provider}
+			groups[key] = group
+		}
+		group.Shadow.add(log)
+		if primary, ok := primaries[log.RequestID]; ok {
+			group.Primary.add(primary)
+		}
+	}
+
+	comparisons := make([]ShadowComparison, 0, len(groups))
+	for _, group := range groups {
+		group.Primary.finalize()
+		group.Shadow.finalize()
+		comparisons = append(comparisons, *group)
+	}
+	sort.Slice(comparisons, func(i, j int) bool {
+		if comparisons[i].Platform == comparisons[j].Platform {
+			return comparisons[i].ShadowProvider < comparisons[j].ShadowProvider
+		}
+		return comparisons[i].Platform < comparisons[j].Platform
+	})
+	return comparisons, nil
+}
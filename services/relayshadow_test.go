@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ==================== 影子流量测试 ====================
+
+func TestShadowSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings ShadowSettings
+		wantErr  bool
+	}{
+		{"未开启不校验", ShadowSettings{SampleRate: 5}, false},
+		{"正常配置", ShadowSettings{Enabled: true, Provider: "new", SampleRate: 0.1}, false},
+		{"缺少 provider", ShadowSettings{Enabled: true, SampleRate: 0.1}, true},
+		{"采样率为 0", ShadowSettings{Enabled: true, Provider: "new"}, true},
+		{"采样率大于 1", ShadowSettings{Enabled: true, Provider: "new", SampleRate: 1.5}, true},
+		{"并发为负数", ShadowSettings{Enabled: true, Provider: "new", SampleRate: 1, MaxConcurrency: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := tt.settings.Validate("claude"); (len(errs) > 0) != tt.wantErr {
+				t.Errorf("Validate() = %v, 期望出错 %v", errs, tt.wantErr)
+			}
+		})
+	}
+
+	var mirror shadowMirror
+	if !mirror.acquire("claude", 1) || mirror.acquire("claude", 1) {
+		t.Errorf("并发上限为 1 时第二个镜像请求应被跳过")
+	}
+	if !mirror.acquire("codex", 1) {
+		t.Errorf("并发上限应按平台独立计算")
+	}
+	mirror.release("claude")
+	mirror.release("codex")
+	if err := mirror.Close(context.Background()); err != nil {
+		t.Errorf("Close 失败: %v", err)
+	}
+}
+
+func TestProxyHandlerShadowMirror(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	initTestRequestLogDB(t)
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":10,"output_tokens":5}}`))
+	}))
+	defer primary.Close()
+	var mirrored atomic.Int32
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"shadow"}],"usage":{"input_tokens":11,"output_tokens":9}}`))
+	}))
+	defer shadow.Close()
+
+	providerService := NewProviderService()
+	if err := providerService.SaveProviders("claude", []Provider{
+		{ID: 1, Name: "primary", APIURL: primary.URL, APIKey: "primary-key", Enabled: true, Level: 1},
+		{ID: 2, Name: "candidate", APIURL: shadow.URL, APIKey: "candidate-key", Enabled: false, Level: 2},
+	}); err != nil {
+		t.Fatalf("保存 provider 失败: %v", err)
+	}
+	settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+	if _, err := settingsService.SaveRelaySettings(RelaySettings{Platforms: map[string]PlatformRelaySettings{
+		"claude": {Shadow: ShadowSettings{Enabled: true, Provider: "candidate", SampleRate: 1}},
+	}}); err != nil {
+		t.Fatalf("保存设置失败: %v", err)
+	}
+	prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService}
+
+	c, recorder := newHedgeTestContext()
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`))
+	prs.proxyHandler("claude", "/v1/messages")(c)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"text":"ok"`) {
+		t.Fatalf("客户端应收到主 provider 的响应，实际 %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if err := prs.shadows.Close(context.Background()); err != nil {
+		t.Fatalf("等待镜像请求失败: %v", err)
+	}
+	if mirrored.Load() != 1 {
+		t.Fatalf("应镜像 1 次请求，实际 %d", mirrored.Load())
+	}
+
+	ls := NewLogService()
+	requestID := recorder.Header().Get(requestIDHeader)
+	attempts, err := ls.GetRequestAttempts(requestID)
+	if err != nil || len(attempts) != 1 || attempts[0].Provider != "primary" {
+		t.Errorf("请求尝试不应包含镜像请求，实际 %+v (%v)", attempts, err)
+	}
+	if stats, err := ls.ZeroUsageStats("claude", 1); err != nil || len(stats) != 1 || stats[0].SuccessfulRequests != 1 {
+		t.Errorf("影子流量不应计入其他统计，实际 %+v (%v)", stats, err)
+	}
+
+	comparisons, err := ls.ShadowStats("claude", 1)
+	if err != nil {
+		t.Fatalf("ShadowStats 失败: %v", err)
+	}
+	if len(comparisons) != 1 {
+		t.Fatalf("应有 1 组对比，实际 %+v", comparisons)
+	}
+	got := comparisons[0]
+	if got.ShadowProvider != "candidate" || got.Shadow.TotalRequests != 1 || got.Shadow.SuccessRate != 1 ||
+		got.Shadow.InputTokens != 11 || got.Shadow.OutputTokens != 9 {
+		t.Errorf("影子结果 = %+v", got.Shadow)
+	}
+	if got.Primary.TotalRequests != 1 || got.Primary.InputTokens != 10 || got.Primary.OutputTokens != 5 {
+		t.Errorf("主请求结果 = %+v", got.Primary)
+	}
+}
+
+func TestProxyHandlerShadowMirrorSkipped(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	initTestRequestLogDB(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"ok"}],"usage":{"input_tokens":10,"output_tokens":5}}`))
+	}))
+	defer upstream.Close()
+	var mirrored atomic.Int32
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"shadow"}]}`))
+	}))
+	defer shadow.Close()
+
+	candidate := Provider{ID: 2, Name: "candidate", APIURL: shadow.URL, APIKey: "candidate-key", Level: 2,
+		RateLimit: &ProviderRateLimit{MaxConcurrency: 1}}
+	providerService := NewProviderService()
+	if err := providerService.SaveProviders("claude", []Provider{
+		{ID: 1, Name: "primary", APIURL: upstream.URL, APIKey: "primary-key", Enabled: true, Level: 1},
+		candidate,
+	}); err != nil {
+		t.Fatalf("保存 provider 失败: %v", err)
+	}
+	exhausted := Budget{Name: "all", Enabled: true, Period: "daily", HardLimit: 10}
+	shadowExhausted := Budget{Name: "shadow", Enabled: true, Period: "daily", Provider: "candidate", HardLimit: 10}
+
+	tests := []struct {
+		name    string
+		budgets []Budget
+		// 镜像前占满影子 provider 的并发名额
+		occupyShadow bool
+		expectCode   int
+	}{
+		{name: "预算硬上限拦截时不镜像", budgets: []Budget{exhausted}, expectCode: http.StatusPaymentRequired},
+		{name: "影子 provider 限流时跳过镜像", occupyShadow: true, expectCode: http.StatusOK},
+		{name: "影子 provider 预算硬上限时跳过镜像", budgets: []Budget{shadowExhausted}, expectCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirrored.Store(0)
+			settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+			if _, err := settingsService.SaveRelaySettings(RelaySettings{
+				Platforms: map[string]PlatformRelaySettings{
+					"claude": {Shadow: ShadowSettings{Enabled: true, Provider: "candidate", SampleRate: 1}},
+				},
+				Budgets: tt.budgets,
+			}); err != nil {
+				t.Fatalf("保存设置失败: %v", err)
+			}
+			budgetService := &BudgetService{spends: map[string]budgetSpend{}, notified: map[string]bool{}}
+			for _, budget := range tt.budgets {
+				budgetService.spends[budget.cacheKey(budget.PeriodStart(time.Now()))] = budgetSpend{amount: 12, updatedAt: time.Now()}
+			}
+			prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService, budgetService: budgetService}
+			if tt.occupyShadow {
+				lease, err := prs.limiters.limiter("claude", candidate).acquire(context.Background(), 0, 0)
+				if err != nil {
+					t.Fatalf("占用并发名额失败: %v", err)
+				}
+				defer lease.release(0)
+			}
+
+			c, recorder := newHedgeTestContext()
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+				strings.NewReader(`{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`))
+			prs.proxyHandler("claude", "/v1/messages")(c)
+			if recorder.Code != tt.expectCode {
+				t.Errorf("状态码 = %d, 期望 %d: %s", recorder.Code, tt.expectCode, recorder.Body.String())
+			}
+			if err := prs.shadows.Close(context.Background()); err != nil {
+				t.Fatalf("等待镜像请求失败: %v", err)
+			}
+			if mirrored.Load() != 0 {
+				t.Errorf("不应镜像请求，实际镜像 %d 次", mirrored.Load())
+			}
+		})
+	}
+}
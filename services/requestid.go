@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 返回给客户端的请求 ID 头部，同一次客户端请求的所有上游尝试共用该 ID
+const requestIDHeader = "X-Code-Switch-Request-Id"
+
+// 上游在响应中返回自身请求 ID 的常见头部（Anthropic 为 request-id，OpenAI 及多数中转为 x-request-id）
+var upstreamRequestIDHeaders = []string{"Request-Id", "X-Request-Id", "X-Oneapi-Request-Id"}
+
+type relayTraceKey struct{}
+
+// relayTrace 一次客户端请求的追踪信息，随请求 context 传递给每次上游尝试。
+// 最近一次失败的尝试会暂缓写入，直到确定其后是否还有重试或降级，以便标记 is_final
+type relayTrace struct {
+	id       string
+	replayOf string // 重放时为原始请求 ID
+	shadow   bool   // 影子流量的镜像请求
+	attempts atomic.Int32
+
+	mu       sync.Mutex
+	pending  *relayAttempt
+	finished bool
+}
+
+// nextAttempt 返回下一次上游尝试的序号，从 1 开始
+func (t *relayTrace) nextAttempt() int {
+	return int(t.attempts.Add(1))
+}
+
+// record 保存一次已结束的尝试
+func (t *relayTrace) record(attempt *relayAttempt) {
+	t.mu.Lock()
+	var ready []*relayAttempt
+	switch {
+	case t.finished || attempt.log.Outcome == outcomeCancelled:
+		// 请求已结束或被取消的对冲尝试，不是最终结果
+		ready = append(ready, attempt)
+	default:
+		if t.pending != nil {
+			ready = append(ready, t.pending)
+		}
+		t.pending = nil
+		if attempt.succeeded() {
+			attempt.log.IsFinal = true
+			ready = append(ready, attempt)
+		} else {
+			t.pending = attempt
+		}
+	}
+	t.mu.Unlock()
+
+	for _, item := range ready {
+		item.insert()
+	}
+}
+
+// finish 在客户端请求结束时调用，暂缓的失败尝试即为最终结果
+func (t *relayTrace) finish() {
+	t.mu.Lock()
+	t.finished = true
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	if pending != nil {
+		pending.log.IsFinal = true
+		pending.insert()
+	}
+}
+
+func withRelayTrace(ctx context.Context, trace *relayTrace) context.Context {
+	return context.WithValue(ctx, relayTraceKey{}, trace)
+}
+
+func relayTraceFrom(ctx context.Context) *relayTrace {
+	trace, _ := ctx.Value(relayTraceKey{}).(*relayTrace)
+	return trace
+}
+
+// newRequestID 生成请求 ID：时间戳前缀便于按时间排序，随机后缀避免冲突
+func newRequestID() string {
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return fmt.Sprintf("csr_%x", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("csr_%x%s", time.Now().UnixMilli(), hex.EncodeToString(random[:]))
+}
+
+// upstreamRequestID 读取上游响应中的请求 ID，用于向服务商反馈问题
+func upstreamRequestID(header http.Header) string {
+	for _, key := range upstreamRequestIDHeaders {
+		if value := header.Get(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
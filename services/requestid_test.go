@@ -0,0 +1,142 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// initTestRequestLogDB 使用临时 SQLite 文件初始化 request_log 表
+func initTestRequestLogDB(t testing.TB) {
+	t.Helper()
+	if err := xdb.Inits([]xdb.Config{{
+		Name:   "default",
+		Driver: "sqlite",
+		DSN:    filepath.Join(t.TempDir(), "app.db?"+sqliteDSNOptions),
+	}}); err != nil {
+		t.Fatalf("初始化数据库失败: %v", err)
+	}
+	if err := ensureRequestLogTable(); err != nil {
+		t.Fatalf("初始化 request_log 表失败: %v", err)
+	}
+	if err := ensureRequestBodyTable(); err != nil {
+		t.Fatalf("初始化 request_body 表失败: %v", err)
+	}
+	if err := ensureRequestLogRollupTables(); err != nil {
+		t.Fatalf("初始化 request_log 汇总表失败: %v", err)
+	}
+}
+
+// ==================== 请求 ID 测试 ====================
+
+func TestNewRequestID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newRequestID()
+		if !strings.HasPrefix(id, "csr_") {
+			t.Fatalf("请求 ID %q 缺少 csr_ 前缀", id)
+		}
+		if seen[id] {
+			t.Fatalf("请求 ID %q 重复", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestUpstreamRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected string
+	}{
+		{"Anthropic", http.Header{"Request-Id": {"req_011"}}, "req_011"},
+		{"OpenAI", http.Header{"X-Request-Id": {"abc-123"}}, "abc-123"},
+		{"优先 request-id", http.Header{"Request-Id": {"req_1"}, "X-Request-Id": {"x_1"}}, "req_1"},
+		{"缺失", http.Header{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamRequestID(tt.header); got != tt.expected {
+				t.Errorf("upstreamRequestID = %q, 期望 %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProxyHandlerRequestID(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	initTestRequestLogDB(t)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Request-Id", "req_failed")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", "req_ok")
+		_, _ = w.Write([]byte(`{"usage":{"input_tokens":1,"output_tokens":2}}`))
+	}))
+	defer healthy.Close()
+
+	providerService := NewProviderService()
+	if err := providerService.SaveProviders("claude", []Provider{
+		{ID: 1, Name: "failing", APIURL: failing.URL, APIKey: "key", Enabled: true, Level: 1},
+		{ID: 2, Name: "healthy", APIURL: healthy.URL, APIKey: "key", Enabled: true, Level: 2},
+	}); err != nil {
+		t.Fatalf("保存 provider 失败: %v", err)
+	}
+	settingsService := &RelaySettingsService{path: filepath.Join(t.TempDir(), "relay.json")}
+	prs := &ProviderRelayService{providerService: providerService, settingsService: settingsService}
+
+	c, recorder := newHedgeTestContext()
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages",
+		strings.NewReader(`{"model":"claude-sonnet-4","messages":[]}`))
+	prs.proxyHandler("claude", "/v1/messages")(c)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("故障转移后应成功，实际状态码 %d: %s", recorder.Code, recorder.Body.String())
+	}
+	requestID := recorder.Header().Get(requestIDHeader)
+	if requestID == "" {
+		t.Fatalf("响应缺少 %s", requestIDHeader)
+	}
+
+	attempts, err := NewLogService().GetRequestAttempts(requestID)
+	if err != nil {
+		t.Fatalf("GetRequestAttempts 失败: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("应记录 2 次尝试，实际 %d", len(attempts))
+	}
+	expected := []struct {
+		provider   string
+		upstream   string
+		attempt    int
+		httpCode   int
+		errorClass string
+		final      bool
+	}{
+		{"failing", "req_failed", 1, http.StatusServiceUnavailable, errorClassServer, false},
+		{"healthy", "req_ok", 2, http.StatusOK, "", true},
+	}
+	for i, want := range expected {
+		got := attempts[i]
+		if got.Provider != want.provider || got.Attempt != want.attempt || got.UpstreamRequestID != want.upstream {
+			t.Errorf("第 %d 次尝试 = {%s %d %s}, 期望 {%s %d %s}", i+1,
+				got.Provider, got.Attempt, got.UpstreamRequestID, want.provider, want.attempt, want.upstream)
+		}
+		if got.HttpCode != want.httpCode || got.ErrorClass != want.errorClass || got.IsFinal != want.final {
+			t.Errorf("第 %d 次尝试 http_code=%d error_class=%q is_final=%v, 期望 %d %q %v", i+1,
+				got.HttpCode, got.ErrorClass, got.IsFinal, want.httpCode, want.errorClass, want.final)
+		}
+		if got.RequestID != requestID {
+			t.Errorf("第 %d 次尝试的 request_id = %q, 期望 %q", i+1, got.RequestID, requestID)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	modelpricing "codeswitch/resources/model-pricing"
+)
+
+const (
+	logSinkSQLite  = "sqlite"
+	logSinkJSONL   = "jsonl"
+	logSinkWebhook = "webhook"
+	logSinkOTLP    = "otlp"
+
+	defaultJSONLMaxSizeMB = 100
+	defaultJSONLMaxFiles  = 5
+	defaultSinkTimeoutMs  = 5000
+)
+
+// RequestLogSink request_log 的输出目标。Write 由各自的后台写入协程按批次调用，
+// 不会被并发调用；返回错误只影响该 sink 自身的指标
+type RequestLogSink interface {
+	Name() string
+	Write(logs []*ReqeustLog) error
+	Close() error
+}
+
+// LogSinkConfig 额外的 request_log 输出配置，SQLite 始终启用无需配置
+type LogSinkConfig struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"` // jsonl / webhook / otlp
+	Enabled   bool              `json:"enabled"`
+	Path      string            `json:"path,omitempty"`      // jsonl 文件路径，默认 ~/.code-switch/logs/request_log.jsonl
+	MaxSizeMB int               `json:"maxSizeMB,omitempty"` // jsonl 单个文件上限，超过后轮转，默认 100
+	MaxFiles  int               `json:"maxFiles,omitempty"`  // jsonl 保留的历史文件数，默认 5
+	URL       string            `json:"url,omitempty"`       // webhook 地址或 OTLP/HTTP logs 地址（如 http://localhost:4318/v1/logs）
+	Headers   map[string]string `json:"headers,omitempty"`   // 附加请求头，如鉴权信息
+	TimeoutMs int               `json:"timeoutMs,omitempty"` // HTTP 请求超时，默认 5000
+}
+
+// Validate 校验输出配置
+func (cfg LogSinkConfig) Validate() []string {
+	errs := make([]string, 0)
+	name := strings.TrimSpace(cfg.Name)
+	if name == "" {
+		errs = append(errs, "日志输出的名称不能为空")
+	} else if strings.EqualFold(name, logSinkSQLite) {
+		errs = append(errs, fmt.Sprintf("日志输出名称 '%s' 为内置 SQLite 输出保留", cfg.Name))
+	}
+	switch strings.ToLower(cfg.Type) {
+	case logSinkJSONL:
+	case logSinkWebhook, logSinkOTLP:
+		parsed, err := url.Parse(cfg.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Sprintf("日志输出 '%s' 的地址 '%s' 无效（需要 http/https URL）", cfg.Name, cfg.URL))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("日志输出 '%s' 的类型 '%s' 无效（可选 jsonl / webhook / otlp）", cfg.Name, cfg.Type))
+	}
+	if cfg.MaxSizeMB < 0 || cfg.MaxFiles < 0 || cfg.TimeoutMs < 0 {
+		errs = append(errs, fmt.Sprintf("日志输出 '%s' 的数值配置不能为负数", cfg.Name))
+	}
+	return errs
+}
+
+// newLogSink 根据配置创建输出
+func newLogSink(cfg LogSinkConfig) (RequestLogSink, error) {
+	switch strings.ToLower(cfg.Type) {
+	case logSinkJSONL:
+		path := cfg.Path
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				home = "."
+			}
+			path = filepath.Join(home, relaySettingsDir, "logs", "request_log.jsonl")
+		}
+		maxSizeMB := cfg.MaxSizeMB
+		if maxSizeMB <= 0 {
+			maxSizeMB = defaultJSONLMaxSizeMB
+		}
+		maxFiles := cfg.MaxFiles
+		if maxFiles <= 0 {
+			maxFiles = defaultJSONLMaxFiles
+		}
+		return newJSONLLogSink(cfg.Name, path, int64(maxSizeMB)<<20, maxFiles), nil
+	case logSinkWebhook, logSinkOTLP:
+		timeoutMs := cfg.TimeoutMs
+		if timeoutMs <= 0 {
+			timeoutMs = defaultSinkTimeoutMs
+		}
+		return &httpLogSink{
+			name:    cfg.Name,
+			format:  strings.ToLower(cfg.Type),
+			url:     cfg.URL,
+			headers: cfg.Headers,
+			client:  &http.Client{Timeout: time.Duration(timeoutMs) * time.Millisecond},
+		}, nil
+	default:
+		return nil, fmt.Errorf("未知的日志输出类型 '%s'", cfg.Type)
+	}
+}
+
+// ==================== SQLite ====================
+
+// sqliteLogSink 写入本地 app.db，供界面的日志与统计使用
+type sqliteLogSink struct{}
+
+func (sqliteLogSink) Name() string                   { return logSinkSQLite }
+func (sqliteLogSink) Write(logs []*ReqeustLog) error { return insertRequestLogs(logs) }
+func (sqliteLogSink) Close() error                   { return nil }
+
+// ==================== JSONL ====================
+
+// jsonlLogSink 每条日志一行 JSON，文件超过 maxSize 后重命名为带时间戳的历史文件，
+// 只保留最近 maxFiles 个历史文件
+type jsonlLogSink struct {
+	name     string
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newJSONLLogSink(name string, path string, maxSize int64, maxFiles int) *jsonlLogSink {
+	return &jsonlLogSink{name: name, path: path, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+func (s *jsonlLogSink) Name() string { return s.name }
+
+func (s *jsonlLogSink) Write(logs []*ReqeustLog) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, requestLog := range logs {
+		if err := encoder.Encode(requestLog); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		if err := s.openLocked(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(buf.Len()) > s.maxSize {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(buf.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+func (s *jsonlLogSink) openLocked() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *jsonlLogSink) rotateLocked() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	rotated := fmt.Sprintf("%s-%s%s", base, time.Now().Format("20060102-150405.000"), ext)
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+
+	// 时间戳格式按字典序即按时间排序，删除最旧的历史文件
+	history, err := filepath.Glob(base + "-*" + ext)
+	if err == nil && len(history) > s.maxFiles {
+		sort.Strings(history)
+		for _, old := range history[:len(history)-s.maxFiles] {
+			if err := os.Remove(old); err != nil {
+				fmt.Printf("[WARN] 删除历史日志文件 %s 失败: %v\n", old, err)
+			}
+		}
+	}
+	return s.openLocked()
+}
+
+func (s *jsonlLogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// ==================== Webhook / OTLP ====================
+
+// httpLogSink 将每批日志 POST 到外部地址：webhook 发送 {"source","logs"} JSON，
+// otlp 按 OTLP/HTTP JSON 编码发送 logs，可直接对接 OpenTelemetry Collector
+type httpLogSink struct {
+	name    string
+	format  string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (s *httpLogSink) Name() string { return s.name }
+
+func (s *httpLogSink) Write(logs []*ReqeustLog) error {
+	var payload any
+	if s.format == logSinkOTLP {
+		payload = otlpLogsPayload(logs)
+	} else {
+		payload = map[string]any{"source": "code-switch", "logs": logs}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s 返回状态码 %d: %s", s.url, resp.StatusCode, strings.TrimSpace(string(snippet)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (s *httpLogSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// otlpLogsPayload 将日志编码为 OTLP ExportLogsServiceRequest 的 JSON 形式，
+// request_log 的每个字段成为一条属性
+func otlpLogsPayload(logs []*ReqeustLog) map[string]any {
+	records := make([]map[string]any, 0, len(logs))
+	for _, requestLog := range logs {
+		severityNumber, severityText := 9, "INFO"
+		if requestLog.ErrorClass != "" {
+			severityNumber, severityText = 17, "ERROR"
+		}
+		timestamp := time.Now()
+		if parsed, err := time.ParseInLocation(timeLayout, requestLog.CreatedAt, time.UTC); err == nil {
+			timestamp = parsed
+		}
+		records = append(records, map[string]any{
+			"timeUnixNano":   fmt.Sprintf("%d", timestamp.UnixNano()),
+			"severityNumber": severityNumber,
+			"severityText":   severityText,
+			"body": map[string]any{"stringValue": fmt.Sprintf("%s %s %s %d",
+				requestLog.Platform, requestLog.Provider, requestLog.Model, requestLog.HttpCode)},
+			"attributes": otlpAttributes(requestLog),
+		})
+	}
+	return map[string]any{
+		"resourceLogs": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": []map[string]any{
+					{"key": "service.name", "value": map[string]any{"stringValue": "code-switch"}},
+				},
+			},
+			"scopeLogs": []map[string]any{{
+				"scope":      map[string]any{"name": "code-switch.relay"},
+				"logRecords": records,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(requestLog *ReqeustLog) []map[string]any {
+	data, err := json.Marshal(requestLog)
+	if err != nil {
+		return nil
+	}
+	fields := make(map[string]any)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]map[string]any, 0, len(keys))
+	for _, key := range keys {
+		if key == "id" {
+			continue
+		}
+		var value map[string]any
+		switch v := fields[key].(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				value = map[string]any{"intValue": v.String()}
+			} else if f, err := v.Float64(); err == nil {
+				value = map[string]any{"doubleValue": f}
+			}
+		}
+		if value == nil {
+			continue
+		}
+		attributes = append(attributes, map[string]any{"key": key, "value": value})
+	}
+	return attributes
+}
+
+// ==================== 多输出分发 ====================
+
+// requestLogSinks 将每条日志分发给所有输出。每个输出拥有独立的队列与写入协程，
+// 某个输出变慢或失败只会导致它自己的日志积压或丢弃，不影响请求与其他输出
+type requestLogSinks struct {
+	primary *logSinkWriter // 内置 SQLite 输出
+	pricing *modelpricing.Service
+
+	mu       sync.RWMutex
+	configs  []LogSinkConfig
+	external []*logSinkWriter
+}
+
+type logSinkWriter struct {
+	sink   RequestLogSink
+	writer *requestLogWriter
+}
+
+func newLogSinkWriter(sink RequestLogSink) *logSinkWriter {
+	return &logSinkWriter{
+		sink:   sink,
+		writer: newRequestLogWriter(defaultLogQueueSize, defaultLogBatchSize, defaultLogFlushInterval, sink.Write),
+	}
+}
+
+func newRequestLogSinks(pricing *modelpricing.Service) *requestLogSinks {
+	return &requestLogSinks{
+		primary: newLogSinkWriter(sqliteLogSink{}),
+		pricing: pricing,
+	}
+}
+
+// configure 按配置重建额外的输出，配置未变化时不做任何操作
+func (s *requestLogSinks) configure(configs []LogSinkConfig) {
+	s.mu.RLock()
+	unchanged := reflect.DeepEqual(s.configs, configs)
+	s.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	external := make([]*logSinkWriter, 0, len(configs))
+	for _, cfg := range configs {
+		if !cfg.Enabled {
+			continue
+		}
+		sink, err := newLogSink(cfg)
+		if err != nil {
+			fmt.Printf("[WARN] 日志输出 '%s' 配置无效: %v\n", cfg.Name, err)
+			continue
+		}
+		item := newLogSinkWriter(sink)
+		// 额外输出队列已满时立即丢弃，不让外部系统的故障拖慢请求
+		item.writer.timeout = 0
+		external = append(external, item)
+	}
+
+	s.mu.Lock()
+	previous := s.external
+	s.external = external
+	s.configs = configs
+	s.mu.Unlock()
+
+	if len(previous) > 0 {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			closeLogSinkWriters(ctx, previous)
+		}()
+	}
+}
+
+// Enqueue 将日志提交给所有输出
+func (s *requestLogSinks) Enqueue(requestLog *ReqeustLog) {
+	s.primary.writer.Enqueue(requestLog)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.external) == 0 {
+		return
+	}
+	record := s.exportRecord(requestLog)
+	for _, item := range s.external {
+		item.writer.Enqueue(record)
+	}
+}
+
+// exportRecord 为外部输出补全写入 SQLite 时由数据库生成的时间与按价格表计算的费用
+func (s *requestLogSinks) exportRecord(requestLog *ReqeustLog) *ReqeustLog {
+	record := *requestLog
+	if record.CreatedAt == "" {
+		record.CreatedAt = time.Now().UTC().Format(timeLayout)
+	}
+	(&LogService{pricing: s.pricing}).decorateCost(&record)
+	return &record
+}
+
+// Close 写完所有输出中剩余的日志并释放资源；之后提交的日志由各输出同步写入
+func (s *requestLogSinks) Close(ctx context.Context) error {
+	s.mu.RLock()
+	items := append([]*logSinkWriter{s.primary}, s.external...)
+	s.mu.RUnlock()
+	return closeLogSinkWriters(ctx, items)
+}
+
+func closeLogSinkWriters(ctx context.Context, items []*logSinkWriter) error {
+	var errs []string
+	for _, item := range items {
+		if err := item.writer.Close(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", item.sink.Name(), err))
+		}
+		if err := item.sink.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", item.sink.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("关闭日志输出失败: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Stats 返回每个输出的写入指标，SQLite 排在首位
+func (s *requestLogSinks) Stats() []RequestLogWriterStats {
+	s.mu.RLock()
+	items := append([]*logSinkWriter{s.primary}, s.external...)
+	s.mu.RUnlock()
+
+	stats := make([]RequestLogWriterStats, 0, len(items))
+	for _, item := range items {
+		itemStats := item.writer.Stats()
+		itemStats.Sink = item.sink.Name()
+		stats = append(stats, itemStats)
+	}
+	return stats
+}
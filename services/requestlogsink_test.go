@@ -0,0 +1,226 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ==================== 日志输出测试 ====================
+
+func TestLogSinkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  LogSinkConfig
+		wantErr bool
+	}{
+		{"jsonl", LogSinkConfig{Name: "file", Type: "jsonl"}, false},
+		{"webhook", LogSinkConfig{Name: "hook", Type: "webhook", URL: "https://example.com/logs"}, false},
+		{"otlp 缺少地址", LogSinkConfig{Name: "otel", Type: "otlp"}, true},
+		{"非 http 地址", LogSinkConfig{Name: "hook", Type: "webhook", URL: "ftp://example.com"}, true},
+		{"名称为空", LogSinkConfig{Type: "jsonl"}, true},
+		{"保留名称", LogSinkConfig{Name: "SQLite", Type: "jsonl"}, true},
+		{"未知类型", LogSinkConfig{Name: "x", Type: "kafka"}, true},
+		{"负数配置", LogSinkConfig{Name: "file", Type: "jsonl", MaxFiles: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := tt.config.Validate(); (len(errs) > 0) != tt.wantErr {
+				t.Errorf("Validate() = %v, 期望出错 %v", errs, tt.wantErr)
+			}
+		})
+	}
+
+	settings := RelaySettings{LogSinks: []LogSinkConfig{
+		{Name: "file", Type: "jsonl"},
+		{Name: "File", Type: "jsonl"},
+	}}
+	if errs := settings.Validate(); len(errs) != 1 || !strings.Contains(errs[0], "重复") {
+		t.Errorf("重复的输出名称应报错，实际 %v", errs)
+	}
+}
+
+func TestJSONLLogSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "request_log.jsonl")
+	sink := newJSONLLogSink("file", path, 1500, 2)
+	defer sink.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := sink.Write([]*ReqeustLog{{Provider: "p", Model: "claude-sonnet-4", Attempt: i + 1}}); err != nil {
+			t.Fatalf("第 %d 次写入失败: %v", i+1, err)
+		}
+		// 轮转文件名精确到毫秒，避免同一毫秒内重名
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	history, _ := filepath.Glob(filepath.Join(dir, "request_log-*.jsonl"))
+	if len(history) != 2 {
+		t.Errorf("应保留 2 个历史文件，实际 %d: %v", len(history), history)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("当前日志文件不存在: %v", err)
+	}
+	if info.Size() > 1500 {
+		t.Errorf("当前日志文件大小 %d 超过上限 1500", info.Size())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("打开日志文件失败: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var last ReqeustLog
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			t.Fatalf("日志行不是合法 JSON: %s", scanner.Text())
+		}
+	}
+	if last.Attempt != 10 {
+		t.Errorf("当前文件最后一行 attempt = %d, 期望 10", last.Attempt)
+	}
+}
+
+func TestHTTPLogSinkPayload(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		bodies   = make(map[string]string)
+		authSeen string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = string(data)
+		authSeen = r.Header.Get("Authorization")
+		mu.Unlock()
+		if r.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	logs := []*ReqeustLog{{
+		Platform: "claude", Provider: "p", Model: "claude-sonnet-4", HttpCode: 503,
+		InputTokens: 12, DurationSec: 1.5, ErrorClass: errorClassServer, IsFinal: true,
+		CreatedAt: "2026-01-02 03:04:05",
+	}}
+
+	t.Run("webhook", func(t *testing.T) {
+		sink, _ := newLogSink(LogSinkConfig{Name: "hook", Type: "webhook", URL: server.URL + "/hook",
+			Headers: map[string]string{"Authorization": "Bearer token"}})
+		if err := sink.Write(logs); err != nil {
+			t.Fatalf("Write 失败: %v", err)
+		}
+		body := bodies["/hook"]
+		if gjson.Get(body, "logs.0.provider").String() != "p" || gjson.Get(body, "logs.0.input_tokens").Int() != 12 {
+			t.Errorf("webhook 请求体 = %s", body)
+		}
+		if authSeen != "Bearer token" {
+			t.Errorf("附加请求头 Authorization = %q", authSeen)
+		}
+	})
+
+	t.Run("otlp", func(t *testing.T) {
+		sink, _ := newLogSink(LogSinkConfig{Name: "otel", Type: "otlp", URL: server.URL + "/v1/logs"})
+		if err := sink.Write(logs); err != nil {
+			t.Fatalf("Write 失败: %v", err)
+		}
+		record := gjson.Get(bodies["/v1/logs"], "resourceLogs.0.scopeLogs.0.logRecords.0")
+		if record.Get("severityText").String() != "ERROR" {
+			t.Errorf("失败请求的 severityText = %s, 期望 ERROR", record.Get("severityText"))
+		}
+		if record.Get("timeUnixNano").String() != "1767323045000000000" {
+			t.Errorf("timeUnixNano = %s", record.Get("timeUnixNano"))
+		}
+		attributes := make(map[string]gjson.Result)
+		for _, attr := range record.Get("attributes").Array() {
+			attributes[attr.Get("key").String()] = attr.Get("value")
+		}
+		if attributes["input_tokens"].Get("intValue").String() != "12" ||
+			attributes["duration_sec"].Get("doubleValue").Float() != 1.5 ||
+			!attributes["is_final"].Get("boolValue").Bool() ||
+			attributes["provider"].Get("stringValue").String() != "p" {
+			t.Errorf("OTLP 属性 = %s", record.Get("attributes"))
+		}
+		if _, ok := attributes["upstream_request_id"]; ok {
+			t.Errorf("空字符串字段不应作为属性输出")
+		}
+	})
+
+	t.Run("非 2xx 返回错误", func(t *testing.T) {
+		sink, _ := newLogSink(LogSinkConfig{Name: "fail", Type: "webhook", URL: server.URL + "/fail"})
+		if err := sink.Write(logs); err == nil || !strings.Contains(err.Error(), "502") {
+			t.Errorf("Write 应返回状态码错误，实际 %v", err)
+		}
+	})
+}
+
+type panicLogSink struct{}
+
+func (panicLogSink) Name() string                   { return "panic" }
+func (panicLogSink) Write(logs []*ReqeustLog) error { panic("sink crashed") }
+func (panicLogSink) Close() error                   { return nil }
+
+func TestRequestLogSinksIsolation(t *testing.T) {
+	initTestRequestLogDB(t)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	path := filepath.Join(t.TempDir(), "request_log.jsonl")
+	sinks := newRequestLogSinks(nil)
+	sinks.configure([]LogSinkConfig{
+		{Name: "file", Type: "jsonl", Enabled: true, Path: path},
+		{Name: "hook", Type: "webhook", Enabled: true, URL: unavailable.URL},
+		{Name: "disabled", Type: "jsonl", Enabled: false, Path: filepath.Join(t.TempDir(), "x.jsonl")},
+	})
+	sinks.mu.Lock()
+	sinks.external = append(sinks.external, newLogSinkWriter(panicLogSink{}))
+	sinks.mu.Unlock()
+
+	sinks.Enqueue(&ReqeustLog{Platform: "claude", Provider: "p", RequestID: "csr_sink", Attempt: 1})
+	if err := sinks.Close(context.Background()); err != nil {
+		t.Fatalf("Close 失败: %v", err)
+	}
+
+	stats := make(map[string]RequestLogWriterStats)
+	for _, item := range sinks.Stats() {
+		stats[item.Sink] = item
+	}
+	if len(stats) != 4 {
+		t.Fatalf("应有 4 个输出（禁用的不创建），实际 %v", stats)
+	}
+	if stats["sqlite"].Written != 1 || stats["file"].Written != 1 {
+		t.Errorf("正常输出应写入 1 条，sqlite=%d file=%d", stats["sqlite"].Written, stats["file"].Written)
+	}
+	if stats["hook"].Failed != 1 || stats["panic"].Failed != 1 || !strings.Contains(stats["panic"].LastError, "sink crashed") {
+		t.Errorf("故障输出应记录失败，hook=%+v panic=%+v", stats["hook"], stats["panic"])
+	}
+
+	attempts, err := NewLogService().GetRequestAttempts("csr_sink")
+	if err != nil || len(attempts) != 1 {
+		t.Fatalf("SQLite 应写入 1 条日志，实际 %d (%v)", len(attempts), err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("读取 JSONL 失败: %v", err)
+	}
+	if gjson.GetBytes(data, "created_at").String() == "" {
+		t.Errorf("外部输出的日志应补全 created_at: %s", data)
+	}
+}
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+const (
+	defaultLogQueueSize     = 4096
+	defaultLogBatchSize     = 200
+	defaultLogFlushInterval = 500 * time.Millisecond
+
+	// 队列已满时最多等待的时间，超时后丢弃该条日志，避免日志写入拖慢请求
+	logEnqueueTimeout = time.Second
+)
+
+// RequestLogWriterStats 异步日志写入器的运行指标
+type RequestLogWriterStats struct {
+	Sink          string  `json:"sink"`            // 输出名称
+	Enqueued      int64   `json:"enqueued"`        // 进入队列的日志数
+	Written       int64   `json:"written"`         // 成功写入的日志数
+	Failed        int64   `json:"failed"`          // 写入失败的日志数
+	Dropped       int64   `json:"dropped"`         // 队列持续已满而丢弃的日志数
+	Blocked       int64   `json:"blocked"`         // 入队时因队列已满而等待的次数
+	QueueDepth    int     `json:"queue_depth"`     // 当前队列长度
+	QueueCapacity int     `json:"queue_capacity"`  // 队列容量
+	MaxQueueDepth int64   `json:"max_queue_depth"` // 历史最大队列长度
+	Batches       int64   `json:"batches"`         // 已提交的批次数
+	LastFlushMs   float64 `json:"last_flush_ms"`   // 最近一批的写入耗时
+	LastError     string  `json:"last_error,omitempty"`
+}
+
+// requestLogWriter 将 request_log 写入移出请求路径：日志进入缓冲队列，
+// 由后台协程按批次在单个事务中写入，Close 时写完队列中剩余的日志
+type requestLogWriter struct {
+	queue         chan *ReqeustLog
+	batchSize     int
+	flushInterval time.Duration
+	timeout       time.Duration // 队列已满时的最长等待时间
+	write         func([]*ReqeustLog) error
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+
+	enqueued      atomic.Int64
+	written       atomic.Int64
+	failed        atomic.Int64
+	dropped       atomic.Int64
+	blocked       atomic.Int64
+	maxQueueDepth atomic.Int64
+	batches       atomic.Int64
+	lastFlushNs   atomic.Int64
+	lastError     atomic.Value
+}
+
+func newRequestLogWriter(queueSize int, batchSize int, flushInterval time.Duration, write func([]*ReqeustLog) error) *requestLogWriter {
+	w := &requestLogWriter{
+		queue:         make(chan *ReqeustLog, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		timeout:       logEnqueueTimeout,
+		write:         write,
+		done:          make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Enqueue 提交一条日志；写入器已关闭时直接同步写入
+func (w *requestLogWriter) Enqueue(requestLog *ReqeustLog) {
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		w.flush([]*ReqeustLog{requestLog})
+		return
+	}
+	defer w.mu.RUnlock()
+
+	select {
+	case w.queue <- requestLog:
+	default:
+		// 队列已满：短暂等待写入器消化，仍然满则丢弃
+		w.blocked.Add(1)
+		if w.timeout <= 0 {
+			w.drop(requestLog)
+			return
+		}
+		timer := time.NewTimer(w.timeout)
+		defer timer.Stop()
+		select {
+		case w.queue <- requestLog:
+		case <-timer.C:
+			w.drop(requestLog)
+			return
+		}
+	}
+	w.enqueued.Add(1)
+	if depth := int64(len(w.queue)); depth > w.maxQueueDepth.Load() {
+		w.maxQueueDepth.Store(depth)
+	}
+}
+
+func (w *requestLogWriter) drop(requestLog *ReqeustLog) {
+	w.dropped.Add(1)
+	fmt.Printf("[WARN] request_log 写入队列已满，丢弃日志（provider=%s, model=%s）\n",
+		requestLog.Provider, requestLog.Model)
+}
+
+func (w *requestLogWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*ReqeustLog, 0, w.batchSize)
+	for {
+		select {
+		case requestLog, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, requestLog)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = make([]*ReqeustLog, 0, w.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = make([]*ReqeustLog, 0, w.batchSize)
+			}
+		}
+	}
+}
+
+func (w *requestLogWriter) flush(batch []*ReqeustLog) {
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	err := w.safeWrite(batch)
+	w.lastFlushNs.Store(int64(time.Since(start)))
+	w.batches.Add(1)
+	if err != nil {
+		w.failed.Add(int64(len(batch)))
+		w.lastError.Store(err.Error())
+		fmt.Printf("[ERROR] 批量写入 request_log 失败（%d 条）: %v\n", len(batch), err)
+		return
+	}
+	w.written.Add(int64(len(batch)))
+}
+
+// safeWrite 调用写入函数，将 panic 转为错误，避免单个输出的故障终止写入协程
+func (w *requestLogWriter) safeWrite(batch []*ReqeustLog) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return w.write(batch)
+}
+
+// Close 停止接收新日志并等待队列写完，ctx 超时后放弃等待
+func (w *requestLogWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("等待 request_log 写入完成超时，剩余 %d 条", len(w.queue))
+	}
+}
+
+// Stats 返回写入器的运行指标
+func (w *requestLogWriter) Stats() RequestLogWriterStats {
+	stats := RequestLogWriterStats{
+		Enqueued:      w.enqueued.Load(),
+		Written:       w.written.Load(),
+		Failed:        w.failed.Load(),
+		Dropped:       w.dropped.Load(),
+		Blocked:       w.blocked.Load(),
+		QueueDepth:    len(w.queue),
+		QueueCapacity: cap(w.queue),
+		MaxQueueDepth: w.maxQueueDepth.Load(),
+		Batches:       w.batches.Load(),
+		LastFlushMs:   float64(w.lastFlushNs.Load()) / float64(time.Millisecond),
+	}
+	if lastError, ok := w.lastError.Load().(string); ok {
+		stats.LastError = lastError
+	}
+	return stats
+}
+
+// insertRequestLogs 在单个事务中批量写入 request_log
+func insertRequestLogs(logs []*ReqeustLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	db, err := xdb.DB("default")
+	if err != nil {
+		return err
+	}
+
+	columns := make([]string, 0, 32)
+	for column := range requestLogRecord(logs[0]) {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := fmt.Sprintf("INSERT INTO request_log (%s) VALUES (%s)", strings.Join(columns, ", "), placeholders)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := insertRequestLogsTx(tx, query, columns, logs); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertRequestLogsTx(tx *sql.Tx, query string, columns []string, logs []*ReqeustLog) error {
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	args := make([]any, len(columns))
+	for _, requestLog := range logs {
+		record := requestLogRecord(requestLog)
+		for i, column := range columns {
+			args[i] = record[column]
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
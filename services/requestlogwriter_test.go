@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ==================== 异步日志写入测试 ====================
+
+type recordingLogSink struct {
+	mu      sync.Mutex
+	batches [][]*ReqeustLog
+}
+
+func (s *recordingLogSink) write(logs []*ReqeustLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]*ReqeustLog(nil), logs...))
+	return nil
+}
+
+func (s *recordingLogSink) total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, batch := range s.batches {
+		total += len(batch)
+	}
+	return total
+}
+
+func TestRequestLogWriterBatching(t *testing.T) {
+	t.Run("按批次大小写入", func(t *testing.T) {
+		sink := &recordingLogSink{}
+		writer := newRequestLogWriter(16, 2, time.Hour, sink.write)
+		for i := 0; i < 5; i++ {
+			writer.Enqueue(&ReqeustLog{Provider: "p"})
+		}
+		if err := writer.Close(context.Background()); err != nil {
+			t.Fatalf("Close 失败: %v", err)
+		}
+		if sink.total() != 5 {
+			t.Fatalf("应写入 5 条日志，实际 %d", sink.total())
+		}
+		for i, batch := range sink.batches {
+			if len(batch) > 2 {
+				t.Errorf("第 %d 批包含 %d 条，超过批次大小 2", i+1, len(batch))
+			}
+		}
+		stats := writer.Stats()
+		if stats.Enqueued != 5 || stats.Written != 5 || stats.Batches != 3 {
+			t.Errorf("指标 enqueued=%d written=%d batches=%d, 期望 5 5 3", stats.Enqueued, stats.Written, stats.Batches)
+		}
+	})
+
+	t.Run("按时间间隔写入", func(t *testing.T) {
+		sink := &recordingLogSink{}
+		writer := newRequestLogWriter(16, 100, 10*time.Millisecond, sink.write)
+		defer writer.Close(context.Background())
+		writer.Enqueue(&ReqeustLog{Provider: "p"})
+
+		deadline := time.Now().Add(time.Second)
+		for sink.total() == 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if sink.total() != 1 {
+			t.Errorf("未满批次应在定时器触发后写入，实际写入 %d 条", sink.total())
+		}
+	})
+
+	t.Run("关闭后同步写入", func(t *testing.T) {
+		sink := &recordingLogSink{}
+		writer := newRequestLogWriter(16, 100, time.Hour, sink.write)
+		_ = writer.Close(context.Background())
+		writer.Enqueue(&ReqeustLog{Provider: "late"})
+		if sink.total() != 1 {
+			t.Errorf("关闭后提交的日志应同步写入，实际写入 %d 条", sink.total())
+		}
+	})
+}
+
+func TestRequestLogWriterBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	writer := newRequestLogWriter(1, 1, time.Hour, func(logs []*ReqeustLog) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return errors.New("disk full")
+	})
+	writer.timeout = 10 * time.Millisecond
+
+	// 第一条被写入协程取走并阻塞，第二条占满队列，第三条等待超时后丢弃
+	writer.Enqueue(&ReqeustLog{})
+	<-started
+	writer.Enqueue(&ReqeustLog{})
+	writer.Enqueue(&ReqeustLog{})
+
+	stats := writer.Stats()
+	if stats.Blocked != 1 || stats.Dropped != 1 || stats.Enqueued != 2 {
+		t.Errorf("指标 blocked=%d dropped=%d enqueued=%d, 期望 1 1 2", stats.Blocked, stats.Dropped, stats.Enqueued)
+	}
+	if stats.QueueDepth != 1 || stats.QueueCapacity != 1 {
+		t.Errorf("队列长度 %d/%d, 期望 1/1", stats.QueueDepth, stats.QueueCapacity)
+	}
+
+	close(release)
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatalf("Close 失败: %v", err)
+	}
+	stats = writer.Stats()
+	if stats.Failed != 2 || stats.LastError != "disk full" {
+		t.Errorf("写入失败指标 failed=%d last_error=%q, 期望 2 \"disk full\"", stats.Failed, stats.LastError)
+	}
+}
+
+func TestInsertRequestLogs(t *testing.T) {
+	initTestRequestLogDB(t)
+
+	logs := []*ReqeustLog{
+		{Platform: "claude", Provider: "a", RequestID: "csr_batch", Attempt: 1, HttpCode: 503, ErrorClass: errorClassServer},
+		{Platform: "claude", Provider: "b", RequestID: "csr_batch", Attempt: 2, HttpCode: 200, InputTokens: 10, IsFinal: true},
+	}
+	if err := insertRequestLogs(logs); err != nil {
+		t.Fatalf("insertRequestLogs 失败: %v", err)
+	}
+
+	attempts, err := NewLogService().GetRequestAttempts("csr_batch")
+	if err != nil {
+		t.Fatalf("GetRequestAttempts 失败: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("应读取到 2 条日志，实际 %d", len(attempts))
+	}
+	if attempts[0].Provider != "a" || attempts[0].ErrorClass != errorClassServer || attempts[0].IsFinal {
+		t.Errorf("第 1 条日志 = %+v", attempts[0])
+	}
+	if attempts[1].Provider != "b" || attempts[1].InputTokens != 10 || !attempts[1].IsFinal {
+		t.Errorf("第 2 条日志 = %+v", attempts[1])
+	}
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"bytes"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// 响应中可能携带模型名的字段：
+// 非流式响应的 model、Claude message_start 的 message.model、Codex response.* 事件的 response.model
+var responseModelPaths = []string{"model", "message.model", "response.model"}
+
+// ResponseModelRewriteHook 将上游响应中的模型名改写为客户端请求的模型名，
+// 作为 ToHttpResponseWriter 的钩子，按 SSE 行（流式）或整个响应体（非流式）调用
+func ResponseModelRewriteHook(model string) func(data []byte) (bool, []byte) {
+	return func(data []byte) (bool, []byte) {
+		if model == "" || !bytes.Contains(data, []byte(`"model"`)) {
+			return true, data
+		}
+		if gjson.ValidBytes(data) {
+			return true, rewriteResponseModel(data, model)
+		}
+
+		// SSE：逐行改写 data: 负载
+		lines := bytes.Split(data, []byte("\n"))
+		for i, line := range lines {
+			trimmed := bytes.TrimSpace(line)
+			if !bytes.HasPrefix(trimmed, []byte("data:")) {
+				continue
+			}
+			payload := bytes.TrimSpace(bytes.TrimPrefix(trimmed, []byte("data:")))
+			if !gjson.ValidBytes(payload) {
+				continue
+			}
+			rewritten := rewriteResponseModel(payload, model)
+			lines[i] = append([]byte("data: "), rewritten...)
+		}
+		return true, bytes.Join(lines, []byte("\n"))
+	}
+}
+
+func rewriteResponseModel(payload []byte, model string) []byte {
+	for _, path := range responseModelPaths {
+		value := gjson.GetBytes(payload, path)
+		if value.Type != gjson.String || value.String() == model {
+			continue
+		}
+		if rewritten, err := sjson.SetBytes(payload, path, model); err == nil {
+			payload = rewritten
+		}
+	}
+	return payload
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// ==================== 响应模型名改写测试 ====================
+
+func TestResponseModelRewriteHook(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		path     string // 期望被改写的字段，空表示原样返回
+		expected string
+	}{
+		{
+			name:     "非流式 Claude 响应",
+			input:    `{"id":"msg_1","type":"message","model":"anthropic/claude-sonnet-4-20250514","content":[]}`,
+			path:     "model",
+			expected: "claude-sonnet-4",
+		},
+		{
+			name:     "Claude message_start 事件",
+			input:    `data: {"type":"message_start","message":{"id":"msg_1","model":"anthropic/claude-sonnet-4-20250514"}}`,
+			path:     "message.model",
+			expected: "claude-sonnet-4",
+		},
+		{
+			name:     "data: 后无空格",
+			input:    `data:{"type":"message_start","message":{"model":"internal"}}`,
+			path:     "message.model",
+			expected: "claude-sonnet-4",
+		},
+		{
+			name:     "Codex response.created 事件",
+			input:    `data: {"type":"response.created","response":{"id":"resp_1","model":"gpt-5-internal"}}`,
+			path:     "response.model",
+			expected: "claude-sonnet-4",
+		},
+		{
+			name:  "不含模型名的事件保持原样",
+			input: `data: {"type":"content_block_delta","delta":{"text":"hi"}}`,
+		},
+		{
+			name:  "event 行保持原样",
+			input: `event: message_start`,
+		},
+	}
+
+	hook := ResponseModelRewriteHook("claude-sonnet-4")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flush, output := hook([]byte(tt.input))
+			if !flush {
+				t.Fatalf("hook 不应拦截数据")
+			}
+			if tt.path == "" {
+				if string(output) != tt.input {
+					t.Errorf("输出 = %s, 期望原样返回 %s", output, tt.input)
+				}
+				return
+			}
+			payload := string(output)
+			if len(payload) > 5 && payload[:5] == "data:" {
+				payload = payload[5:]
+			}
+			if got := gjson.Get(payload, tt.path).String(); got != tt.expected {
+				t.Errorf("%s = %q, 期望 %q（输出 %s）", tt.path, got, tt.expected, output)
+			}
+		})
+	}
+}
+
+func TestWriteUpstreamResponseRewritesModel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `{"type":"message","model":"anthropic/claude-sonnet-4-20250514","usage":{"input_tokens":1,"output_tokens":1}}`
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	provider := Provider{
+		Name:                 "reseller",
+		APIURL:               upstream.URL,
+		APIKey:               "key",
+		ModelMapping:         map[string]string{"claude-sonnet-4": "anthropic/claude-sonnet-4-20250514"},
+		RewriteResponseModel: true,
+	}
+	candidate, err := prepareCandidate(provider, "claude-sonnet-4", []byte(`{"model":"claude-sonnet-4"}`))
+	if err != nil {
+		t.Fatalf("prepareCandidate 失败: %v", err)
+	}
+
+	prs := &ProviderRelayService{}
+	c, recorder := newHedgeTestContext()
+	ok, err := prs.forwardRequest(c, "claude", "/v1/messages", nil, map[string]string{}, false, candidate)
+	if !ok || err != nil {
+		t.Fatalf("转发失败: ok=%v err=%v", ok, err)
+	}
+	if got := gjson.Get(recorder.Body.String(), "model").String(); got != "claude-sonnet-4" {
+		t.Errorf("响应 model = %q, 期望 claude-sonnet-4（响应 %s）", got, recorder.Body.String())
+	}
+	if got := recorder.Header().Get("Content-Length"); got != "" {
+		t.Errorf("改写后不应保留上游 Content-Length，实际为 %s", got)
+	}
+}
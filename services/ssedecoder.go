@@ -0,0 +1,206 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// sseEvent 一个完整的 SSE 事件
+type sseEvent struct {
+	name string // event 字段，未设置时为空
+	data string // 多行 data 以 "\n" 连接
+	id   string
+}
+
+// eventType 返回事件类型：优先使用 event 名称，其次为 data 中的 type 字段
+func (e sseEvent) eventType() string {
+	if e.name != "" {
+		return e.name
+	}
+	return gjson.Get(e.data, "type").String()
+}
+
+// sseDecoder 流式 SSE 解析器：缓存不完整的行，按空行切分事件，
+// 支持多行 data、event 名称、注释行以及 "data:" 后无空格的写法
+type sseDecoder struct {
+	buf     []byte
+	name    string
+	id      string
+	data    []string
+	hasData bool
+}
+
+// Feed 写入一段数据，返回其中已完整的事件
+func (d *sseDecoder) Feed(chunk []byte) []sseEvent {
+	d.buf = append(d.buf, chunk...)
+	var events []sseEvent
+	for {
+		idx := bytes.IndexAny(d.buf, "\r\n")
+		if idx < 0 {
+			break
+		}
+		// "\r" 位于缓冲区末尾时可能是被拆开的 "\r\n"，等待下一段数据
+		if d.buf[idx] == '\r' && idx == len(d.buf)-1 {
+			break
+		}
+		line := string(d.buf[:idx])
+		next := idx + 1
+		if d.buf[idx] == '\r' && d.buf[next] == '\n' {
+			next++
+		}
+		d.buf = d.buf[next:]
+		if event, ok := d.processLine(line); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Flush 在流结束时派发最后一个未以空行结尾的事件
+func (d *sseDecoder) Flush() []sseEvent {
+	var events []sseEvent
+	if len(d.buf) > 0 {
+		line := strings.TrimRight(string(d.buf), "\r")
+		d.buf = nil
+		if event, ok := d.processLine(line); ok {
+			events = append(events, event)
+		}
+	}
+	if event, ok := d.dispatch(); ok {
+		events = append(events, event)
+	}
+	return events
+}
+
+func (d *sseDecoder) processLine(line string) (sseEvent, bool) {
+	if line == "" {
+		return d.dispatch()
+	}
+	if strings.HasPrefix(line, ":") {
+		// 注释行（常用作心跳）
+		return sseEvent{}, false
+	}
+
+	field, value := line, ""
+	if idx := strings.IndexByte(line, ':'); idx >= 0 {
+		field, value = line[:idx], line[idx+1:]
+		value = strings.TrimPrefix(value, " ")
+	}
+	switch field {
+	case "data":
+		d.data = append(d.data, value)
+		d.hasData = true
+	case "event":
+		d.name = value
+	case "id":
+		d.id = value
+	}
+	return sseEvent{}, false
+}
+
+func (d *sseDecoder) dispatch() (sseEvent, bool) {
+	defer func() {
+		d.name, d.data, d.hasData = "", nil, false
+	}()
+	if !d.hasData {
+		return sseEvent{}, false
+	}
+	return sseEvent{name: d.name, data: strings.Join(d.data, "\n"), id: d.id}, true
+}
+
+// 非流式响应体用于解析用量的最大缓存字节数，超出后放弃解析
+const maxUsageBodyBytes = 8 << 20
+
+// usageTap 包装上游响应体，在数据写回客户端的同时记录 token 用量：
+// 流式响应按 SSE 事件解析，非流式响应缓存完整的 JSON 后解析 usage 字段
+type usageTap struct {
+	body     io.ReadCloser
+	kind     string
+	stream   bool
+	usage    *ReqeustLog
+	decoder  sseDecoder
+	buf      []byte
+	overflow bool
+	once     sync.Once
+}
+
+func newUsageTap(body io.ReadCloser, kind string, stream bool, usage *ReqeustLog) io.ReadCloser {
+	return &usageTap{body: body, kind: kind, stream: stream, usage: usage}
+}
+
+func (t *usageTap) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if n > 0 {
+		t.observe(p[:n])
+	}
+	if err == io.EOF {
+		t.flush()
+	}
+	return n, err
+}
+
+func (t *usageTap) Close() error {
+	t.flush()
+	return t.body.Close()
+}
+
+func (t *usageTap) observe(chunk []byte) {
+	if t.stream {
+		for _, event := range t.decoder.Feed(chunk) {
+			recordUsageEvent(t.kind, event, t.usage)
+		}
+		return
+	}
+	if t.overflow {
+		return
+	}
+	if len(t.buf)+len(chunk) > maxUsageBodyBytes {
+		t.overflow, t.buf = true, nil
+		return
+	}
+	t.buf = append(t.buf, chunk...)
+}
+
+func (t *usageTap) flush() {
+	t.once.Do(func() {
+		if !t.stream {
+			if !t.overflow {
+				ParseTokenUsageFromBody(t.kind, t.buf, t.usage)
+			}
+			t.buf = nil
+			return
+		}
+		for _, event := range t.decoder.Flush() {
+			recordUsageEvent(t.kind, event, t.usage)
+		}
+	})
+}
+
+// isEventStream 根据响应的 Content-Type 判断是否为 SSE，缺少明确类型时以客户端是否请求流式为准
+func isEventStream(header http.Header, requested bool) bool {
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	switch {
+	case strings.Contains(contentType, "text/event-stream"):
+		return true
+	case strings.Contains(contentType, "json"):
+		return false
+	default:
+		return requested
+	}
+}
+
+// recordUsageEvent 将事件路由到对应平台的解析器：
+// Claude 只解析 message_start / message_delta，Codex 只解析 response.completed
+func recordUsageEvent(kind string, event sseEvent, usage *ReqeustLog) {
+	switch eventType := event.eventType(); {
+	case kind == "codex" && eventType == "response.completed":
+		CodexParseTokenUsageFromResponse(event.data, usage)
+	case kind != "codex" && (eventType == "message_start" || eventType == "message_delta"):
+		ClaudeCodeParseTokenUsageFromResponse(event.data, usage)
+	}
+}
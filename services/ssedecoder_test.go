@@ -0,0 +1,219 @@
+package services
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// ==================== SSE 解析器测试 ====================
+
+func TestSSEDecoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   string
+		expected []sseEvent
+	}{
+		{
+			name:     "标准事件",
+			stream:   "event: message_start\ndata: {\"a\":1}\n\n",
+			expected: []sseEvent{{name: "message_start", data: `{"a":1}`}},
+		},
+		{
+			name:     "data: 后无空格",
+			stream:   "data:{\"a\":1}\n\n",
+			expected: []sseEvent{{data: `{"a":1}`}},
+		},
+		{
+			name:     "多行 data",
+			stream:   "data: line1\ndata: line2\n\n",
+			expected: []sseEvent{{data: "line1\nline2"}},
+		},
+		{
+			name:     "注释与心跳",
+			stream:   ": ping\n\n:keep-alive\ndata: x\n\n",
+			expected: []sseEvent{{data: "x"}},
+		},
+		{
+			name:     "CRLF 换行",
+			stream:   "event: a\r\ndata: 1\r\n\r\nevent: b\r\ndata: 2\r\n\r\n",
+			expected: []sseEvent{{name: "a", data: "1"}, {name: "b", data: "2"}},
+		},
+		{
+			name:     "末尾缺少空行时在 Flush 中派发",
+			stream:   "data: 1\n\ndata: 2",
+			expected: []sseEvent{{data: "1"}, {data: "2"}},
+		},
+		{
+			name:     "事件名不跨事件保留",
+			stream:   "event: a\ndata: 1\n\ndata: 2\n\n",
+			expected: []sseEvent{{name: "a", data: "1"}, {data: "2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 逐字节写入，模拟事件被拆分到多个 TCP 包
+			var decoder sseDecoder
+			var events []sseEvent
+			for i := 0; i < len(tt.stream); i++ {
+				events = append(events, decoder.Feed([]byte{tt.stream[i]})...)
+			}
+			events = append(events, decoder.Flush()...)
+
+			if len(events) != len(tt.expected) {
+				t.Fatalf("解析出 %d 个事件 %+v, 期望 %d 个", len(events), events, len(tt.expected))
+			}
+			for i, event := range events {
+				if event.name != tt.expected[i].name || event.data != tt.expected[i].data {
+					t.Errorf("事件 %d = %+v, 期望 %+v", i, event, tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+// ==================== 用量解析测试 ====================
+
+func TestUsageTap(t *testing.T) {
+	claudeStream := strings.Join([]string{
+		"event: message_start",
+		`data: {"type":"message_start","message":{"model":"claude-sonnet-4","usage":{"input_tokens":100,"output_tokens":1,"cache_creation_input_tokens":20,"cache_read_input_tokens":30}}}`,
+		"",
+		": ping",
+		"",
+		"event: content_block_delta",
+		`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"usage"},"usage":{"output_tokens":999}}`,
+		"",
+		"event: message_delta",
+		`data:{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":42}}`,
+		"",
+		"event: message_delta",
+		`data: {"type":"message_delta","usage":{"output_tokens":50}}`,
+		"",
+	}, "\n")
+
+	codexStream := strings.Join([]string{
+		"event: response.created",
+		`data: {"type":"response.created","response":{"usage":{"input_tokens":999}}}`,
+		"",
+		"event: response.completed",
+		`data: {"type":"response.completed","response":{"usage":{"input_tokens":200,"input_tokens_details":{"cached_tokens":50},"output_tokens":80,"output_tokens_details":{"reasoning_tokens":30}}}}`,
+		"",
+	}, "\n")
+
+	tests := []struct {
+		name     string
+		kind     string
+		stream   string
+		isSSE    bool
+		expected ReqeustLog
+	}{
+		{
+			name:     "Claude 只解析 message_start / message_delta",
+			kind:     "claude",
+			stream:   claudeStream,
+			isSSE:    true,
+			expected: ReqeustLog{InputTokens: 100, OutputTokens: 50, CacheCreateTokens: 20, CacheReadTokens: 30},
+		},
+		{
+			name:     "Codex 只解析 response.completed",
+			kind:     "codex",
+			stream:   codexStream,
+			isSSE:    true,
+			expected: ReqeustLog{InputTokens: 200, OutputTokens: 80, CacheReadTokens: 50, ReasoningTokens: 30},
+		},
+		{
+			name:   "Claude 路由不解析 Codex 事件",
+			kind:   "claude",
+			stream: codexStream,
+			isSSE:  true,
+		},
+		{
+			name:   "Claude 非流式响应与缓存细分",
+			kind:   "claude",
+			stream: `{"id":"msg_1","type":"message","model":"claude-sonnet-4","usage":{"input_tokens":10,"output_tokens":20,"cache_creation_input_tokens":300,"cache_read_input_tokens":40,"cache_creation":{"ephemeral_5m_input_tokens":100,"ephemeral_1h_input_tokens":200}}}`,
+			expected: ReqeustLog{
+				InputTokens: 10, OutputTokens: 20, CacheCreateTokens: 300, CacheReadTokens: 40,
+				CacheCreate5mTokens: 100, CacheCreate1hTokens: 200,
+			},
+		},
+		{
+			name:     "Codex 非流式响应",
+			kind:     "codex",
+			stream:   `{"id":"resp_1","object":"response","usage":{"input_tokens":200,"input_tokens_details":{"cached_tokens":50},"output_tokens":80,"output_tokens_details":{"reasoning_tokens":30}}}`,
+			expected: ReqeustLog{InputTokens: 200, OutputTokens: 80, CacheReadTokens: 50, ReasoningTokens: 30},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := &ReqeustLog{}
+			body := io.NopCloser(iotest.OneByteReader(strings.NewReader(tt.stream)))
+			tap := newUsageTap(body, tt.kind, tt.isSSE, usage)
+			data, err := io.ReadAll(tap)
+			if err != nil {
+				t.Fatalf("读取失败: %v", err)
+			}
+			if string(data) != tt.stream {
+				t.Errorf("usageTap 不应修改响应内容")
+			}
+			_ = tap.Close()
+
+			if usage.InputTokens != tt.expected.InputTokens ||
+				usage.OutputTokens != tt.expected.OutputTokens ||
+				usage.CacheCreateTokens != tt.expected.CacheCreateTokens ||
+				usage.CacheReadTokens != tt.expected.CacheReadTokens ||
+				usage.ReasoningTokens != tt.expected.ReasoningTokens ||
+				usage.CacheCreate5mTokens != tt.expected.CacheCreate5mTokens ||
+				usage.CacheCreate1hTokens != tt.expected.CacheCreate1hTokens {
+				t.Errorf("用量 = %+v, 期望 %+v", *usage, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIsEventStream(t *testing.T) {
+	tests := []struct {
+		contentType string
+		requested   bool
+		expected    bool
+	}{
+		{"text/event-stream; charset=utf-8", false, true},
+		{"application/json", true, false},
+		{"", true, true},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.contentType != "" {
+			header.Set("Content-Type", tt.contentType)
+		}
+		if got := isEventStream(header, tt.requested); got != tt.expected {
+			t.Errorf("isEventStream(%q, %v) = %v, 期望 %v", tt.contentType, tt.requested, got, tt.expected)
+		}
+	}
+}
+
+func TestDecorateCostCacheCreationDetail(t *testing.T) {
+	ls := NewLogService()
+	if ls.pricing == nil {
+		t.Skip("价格表不可用")
+	}
+	base := ReqeustLog{Model: "claude-sonnet-4-20250514", CacheCreateTokens: 1000}
+	fiveMin := base
+	ls.decorateCost(&fiveMin)
+
+	oneHour := base
+	oneHour.CacheCreate1hTokens = 1000
+	ls.decorateCost(&oneHour)
+
+	if oneHour.Ephemeral1hCost <= 0 || oneHour.Ephemeral5mCost != 0 {
+		t.Errorf("1 小时缓存写入应按 1h 价格计费，得到 5m=%v 1h=%v", oneHour.Ephemeral5mCost, oneHour.Ephemeral1hCost)
+	}
+	if oneHour.CacheCreateCost <= fiveMin.CacheCreateCost {
+		t.Errorf("1 小时缓存写入费用 %v 应高于 5 分钟 %v", oneHour.CacheCreateCost, fiveMin.CacheCreateCost)
+	}
+}
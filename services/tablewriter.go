@@ -0,0 +1,246 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+	exportFormatXLSX  = "xlsx"
+
+	// XLSX 单个工作表的行数上限（含表头）
+	xlsxMaxRows = 1048576
+)
+
+// tableWriter 逐行写出导出数据，不在内存中保留已写出的行
+type tableWriter interface {
+	writeRow(values []any) error
+	close() error
+}
+
+// resolveExportFormat 返回导出格式，未指定时按文件扩展名推断
+func resolveExportFormat(format string, path string) (string, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch format {
+	case exportFormatCSV, exportFormatJSONL, exportFormatXLSX:
+		return format, nil
+	case "ndjson":
+		return exportFormatJSONL, nil
+	default:
+		return "", fmt.Errorf("不支持的导出格式 '%s'，可选 csv / jsonl / xlsx", format)
+	}
+}
+
+func newTableWriter(format string, w io.Writer, columns []string) (tableWriter, error) {
+	switch format {
+	case exportFormatCSV:
+		return newCSVTableWriter(w, columns)
+	case exportFormatJSONL:
+		return &jsonlTableWriter{w: bufio.NewWriter(w), columns: columns}, nil
+	case exportFormatXLSX:
+		return newXLSXTableWriter(w, columns)
+	default:
+		return nil, fmt.Errorf("不支持的导出格式 '%s'", format)
+	}
+}
+
+// formatCell 将单元格的值转换为文本
+func formatCell(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ==================== CSV ====================
+
+type csvTableWriter struct {
+	w *csv.Writer
+}
+
+func newCSVTableWriter(w io.Writer, columns []string) (*csvTableWriter, error) {
+	// 写入 UTF-8 BOM，Excel 直接打开时才能正确识别中文
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return nil, err
+	}
+	writer := &csvTableWriter{w: csv.NewWriter(w)}
+	if err := writer.w.Write(columns); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (cw *csvTableWriter) writeRow(values []any) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		text := formatCell(value)
+		if _, ok := value.(string); ok && text != "" && strings.IndexByte("=+-@", text[0]) >= 0 {
+			// 避免上游错误信息等文本在表格软件中被当作公式执行
+			text = "'" + text
+		}
+		record[i] = text
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvTableWriter) close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// ==================== JSONL ====================
+
+// jsonlTableWriter 每行输出一个 JSON 对象，字段顺序与列顺序一致
+type jsonlTableWriter struct {
+	w       *bufio.Writer
+	columns []string
+}
+
+func (jw *jsonlTableWriter) writeRow(values []any) error {
+	jw.w.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			jw.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(jw.columns[i])
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		jw.w.Write(key)
+		jw.w.WriteByte(':')
+		jw.w.Write(data)
+	}
+	jw.w.WriteString("}\n")
+	return nil
+}
+
+func (jw *jsonlTableWriter) close() error {
+	return jw.w.Flush()
+}
+
+// ==================== XLSX ====================
+
+// xlsx 的固定部分，工作表内容在写入时流式生成
+var xlsxStaticParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+}
+
+// xlsxTableWriter 生成只有一个工作表的最小 xlsx，字符串使用内联字符串，无需共享字符串表
+type xlsxTableWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+func newXLSXTableWriter(w io.Writer, columns []string) (*xlsxTableWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		entry, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(entry, part.content); err != nil {
+			return nil, err
+		}
+	}
+	// zip 同一时间只能写一个条目，工作表放在最后，之后的行直接写入该条目
+	entry, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	writer := &xlsxTableWriter{zw: zw, sheet: bufio.NewWriter(entry)}
+	writer.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]any, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	if err := writer.writeRow(header); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (xw *xlsxTableWriter) writeRow(values []any) error {
+	if xw.rows >= xlsxMaxRows {
+		return fmt.Errorf("超过 xlsx 单个工作表 %d 行的上限，请缩小范围或改用 csv / jsonl", xlsxMaxRows)
+	}
+	xw.rows++
+	xw.sheet.WriteString("<row>")
+	for _, value := range values {
+		switch v := value.(type) {
+		case int, int64, float64:
+			xw.sheet.WriteString(`<c><v>`)
+			xw.sheet.WriteString(formatCell(v))
+			xw.sheet.WriteString(`</v></c>`)
+		case bool:
+			xw.sheet.WriteString(`<c t="b"><v>`)
+			xw.sheet.WriteString(formatCell(boolToInt(v)))
+			xw.sheet.WriteString(`</v></c>`)
+		default:
+			xw.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			// EscapeText 会将 XML 不允许的控制字符替换为 U+FFFD
+			if err := xml.EscapeText(xw.sheet, []byte(formatCell(v))); err != nil {
+				return err
+			}
+			xw.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := xw.sheet.WriteString("</row>")
+	return err
+}
+
+func (xw *xlsxTableWriter) close() error {
+	xw.sheet.WriteString("</sheetData></worksheet>")
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}